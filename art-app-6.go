@@ -9,6 +9,7 @@ package main
 // Expects blockartlib.go to be in the ../blockartlib/ dir, relative to
 // this art-app.go file
 import (
+	"context"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
@@ -19,10 +20,14 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"./blockartlib"
 )
 
+// How long a request may wait for its shape to be validated
+const ADD_SHAPE_TIMEOUT = 60 * time.Second
+
 ////// TYPES FOR THE WEBSERVER ///////
 type AddRequest struct {
 	Fill   string `json:"fill"`
@@ -105,17 +110,22 @@ func main() {
 				return
 			}
 
-			shapeHash, blockHash, ink, err := canvas.AddShape(4, blockartlib.PATH, addReq.Path, addReq.Fill, addReq.Stroke)
+			// Stop waiting on the miner once the browser goes away or the
+			// shape takes too long
+			ctx, cancel := context.WithTimeout(r.Context(), ADD_SHAPE_TIMEOUT)
+			defer cancel()
+
+			shapeHash, blockHash, ink, err := canvas.AddShapeCtx(ctx, 4, blockartlib.PATH, addReq.Path, addReq.Fill, addReq.Stroke)
 			if err != nil {
 				fmt.Println(err.Error())
-				http.Error(w, err.Error(), 500)
+				http.Error(w, err.Error(), errorStatus(err))
 				return
 			}
 
-			svgString, err := canvas.GetSvgString(shapeHash)
+			svgString, err := canvas.GetSvgStringCtx(ctx, shapeHash)
 			if err != nil {
 				fmt.Println(err.Error())
-				http.Error(w, err.Error(), 500)
+				http.Error(w, err.Error(), errorStatus(err))
 				return
 			}
 
@@ -198,6 +208,16 @@ func checkError(err error) {
 	}
 }
 
+// Returns the HTTP status to report a blockartlib error with
+func errorStatus(err error) int {
+	switch err.(type) {
+	case blockartlib.TimeoutError:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // Recursively get the longest blockchain
 func getLongestBlockchain(currBlockHash string, canvas blockartlib.Canvas) []string {
 	// Add current block hash to longest chain
@@ -8,19 +8,26 @@ library (blockartlib) to be used in project 1 of UBC CS 416 2017W2.
 package blockartlib
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/rpc"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 
+	"../blockchain"
 	"../libminer"
+	"../protocol"
 	"../utils"
 )
 
@@ -28,6 +35,14 @@ const (
 	TRANSPARENT = "transparent"
 )
 
+// TLS to the miner, for canvases opened from then on. With UseTLS set,
+// OpenCanvas talks TLS to the miner, and if MinerKey is set, only to the
+// miner with that key: the hex of the x509 encoding of its public key.
+var (
+	UseTLS   bool
+	MinerKey string
+)
+
 // Represents a type of shape in the BlockArt system.
 type ShapeType int
 
@@ -40,37 +55,10 @@ const (
 )
 
 // Settings for a canvas in BlockArt.
-type CanvasSettings struct {
-	// Canvas dimensions
-	CanvasXMax uint32
-	CanvasYMax uint32
-}
+type CanvasSettings = protocol.CanvasSettings
 
 // Settings for an instance of the BlockArt project/network.
-type MinerNetSettings struct {
-	// Hash of the very first (empty) block in the chain.
-	GenesisBlockHash string
-
-	// The minimum number of ink miners that an ink miner should be
-	// connected to. If the ink miner dips below this number, then
-	// they have to retrieve more nodes from the server using
-	// GetNodes().
-	MinNumMinerConnections uint8
-
-	// Mining ink reward per op and no-op blocks (>= 1)
-	InkPerOpBlock   uint32
-	InkPerNoOpBlock uint32
-
-	// Number of milliseconds between heartbeat messages to the server.
-	HeartBeat uint32
-
-	// Proof of work difficulty: number of zeroes in prefix (>=0)
-	PoWDifficultyOpBlock   uint8
-	PoWDifficultyNoOpBlock uint8
-
-	// Canvas settings
-	CanvasSettings CanvasSettings
-}
+type MinerNetSettings = protocol.MinerNetSettings
 
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <ERROR DEFINITIONS>
@@ -90,66 +78,49 @@ func (e DisconnectedError) Error() string {
 	return fmt.Sprintf("BlockArt: cannot connect to [%s]", string(e))
 }
 
-// Contains amount of ink remaining.
-type InsufficientInkError uint32
-
-func (e InsufficientInkError) Error() string {
-	return fmt.Sprintf("BlockArt: Not enough ink to addShape [%d]", uint32(e))
-}
-
-// Contains the offending svg string.
-type InvalidShapeSvgStringError string
-
-func (e InvalidShapeSvgStringError) Error() string {
-	return fmt.Sprintf("BlockArt: Bad shape svg string [%s]", string(e))
-}
-
-// Contains the offending svg string.
-type ShapeSvgStringTooLongError string
-
-func (e ShapeSvgStringTooLongError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape svg string too long [%s]", string(e))
-}
-
-// Contains the bad shape hash string.
-type InvalidShapeHashError string
-
-func (e InvalidShapeHashError) Error() string {
-	return fmt.Sprintf("BlockArt: Invalid shape hash [%s]", string(e))
-}
-
-// Contains the bad shape hash string.
-type ShapeOwnerError string
-
-func (e ShapeOwnerError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape owned by someone else [%s]", string(e))
-}
-
-// Empty
-type OutOfBoundsError struct{}
-
-func (e OutOfBoundsError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape is outside the bounds of the canvas")
-}
-
-// Contains the hash of the shape that this shape overlaps with.
-type ShapeOverlapError string
-
-func (e ShapeOverlapError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape overlaps with a previously added shape [%s]", string(e))
-}
-
-// Contains the invalid block hash.
-type InvalidBlockHashError string
-
-func (e InvalidBlockHashError) Error() string {
-	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
-}
+// The errors the miner sends are those of the protocol package.
+type (
+	// Contains amount of ink remaining.
+	InsufficientInkError = protocol.InsufficientInkError
+	// Contains the offending svg string.
+	InvalidShapeSvgStringError = protocol.InvalidShapeSvgStringError
+	// Contains the offending svg string.
+	ShapeSvgStringTooLongError = protocol.ShapeSvgStringTooLongError
+	// Contains the bad shape hash string.
+	InvalidShapeHashError = protocol.InvalidShapeHashError
+	// Contains the bad shape hash string.
+	ShapeOwnerError = protocol.ShapeOwnerError
+	// Empty
+	OutOfBoundsError = protocol.OutOfBoundsError
+	// Contains the hash of the shape that this shape overlaps with.
+	ShapeOverlapError = protocol.ShapeOverlapError
+	// Contains the invalid block hash.
+	InvalidBlockHashError = protocol.InvalidBlockHashError
+	// Contains the shape hash of the operation that kept being reorged out.
+	OpEvictedError = protocol.OpEvictedError
+	// Contains the shape hash of the operation that no block took in.
+	OpExpiredError = protocol.OpExpiredError
+	// Contains what was being waited on when the deadline passed.
+	TimeoutError = protocol.TimeoutError
+	// Contains the shape hash of the operation the miner had no room for.
+	MempoolFullError = protocol.MempoolFullError
+	// Contains the recipient of a transfer of no ink, or to a bad or the
+	// sender's own public key.
+	InvalidTransferError = protocol.InvalidTransferError
+	// Contains the protocol version that was rejected and the one required.
+	ProtocolVersionError = protocol.ProtocolVersionError
+)
 
 // </ERROR DEFINITIONS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
 // Represents a canvas in the system.
+//
+// Every call has a Ctx variant that gives up once its context is done: with
+// a TimeoutError if the deadline of the context passed, or the error of the
+// context if it was canceled. AddShapeCtx, DeleteShapeCtx and TransferInkCtx
+// pass the deadline on to the miner, which stops waiting for validateNum blocks
+// at the same time.
 type Canvas interface {
 	// Adds a new shape to the canvas.
 	// Can return the following errors:
@@ -159,46 +130,162 @@ type Canvas interface {
 	// - ShapeSvgStringTooLongError
 	// - ShapeOverlapError
 	// - OutOfBoundsError
+	// - MempoolFullError
+	// - OpEvictedError
+	// - OpExpiredError
 	AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+	// Same as AddShape, but gives up once ctx is done.
+	AddShapeCtx(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
 	// aDD SHAPE blocks until number of blocks (validateNum) follow current block
 
+	// Same as AddShape, but returns once the miner accepted the shape, with
+	// a PendingOp to follow it by. The op's OpSig is the shape hash.
+	// Can return the following errors, the rest come from the PendingOp:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	// - MempoolFullError
+	AddShapeAsync(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (op *PendingOp, err error)
+	// Same as AddShapeAsync, but gives up on the op once ctx is done.
+	AddShapeAsyncCtx(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (op *PendingOp, err error)
+
 	// Returns the encoding of the shape as an svg string.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - InvalidShapeHashError
 	GetSvgString(shapeHash string) (svgString string, err error)
+	// Same as GetSvgString, but gives up once ctx is done.
+	GetSvgStringCtx(ctx context.Context, shapeHash string) (svgString string, err error)
 
 	// Returns the amount of ink currently available.
 	// Can return the following errors:
 	// - DisconnectedError
 	GetInk() (inkRemaining uint32, err error)
+	// Same as GetInk, but gives up once ctx is done.
+	GetInkCtx(ctx context.Context) (inkRemaining uint32, err error)
 
 	// Removes a shape from the canvas.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - ShapeOwnerError
+	// - MempoolFullError
+	// - OpEvictedError
+	// - OpExpiredError
 	DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error)
+	// Same as DeleteShape, but gives up once ctx is done.
+	DeleteShapeCtx(ctx context.Context, validateNum uint8, shapeHash string) (inkRemaining uint32, err error)
+
+	// Same as DeleteShape, but returns once the miner accepted the deletion,
+	// with a PendingOp to follow it by.
+	// Can return the following errors, the rest come from the PendingOp:
+	// - DisconnectedError
+	// - ShapeOwnerError
+	// - MempoolFullError
+	DeleteShapeAsync(validateNum uint8, shapeHash string) (op *PendingOp, err error)
+	// Same as DeleteShapeAsync, but gives up on the op once ctx is done.
+	DeleteShapeAsyncCtx(ctx context.Context, validateNum uint8, shapeHash string) (op *PendingOp, err error)
+
+	// Moves amount of our ink to the art node or miner with toPubKey, the hex
+	// of the x509 encoding of its public key.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidTransferError
+	// - MempoolFullError
+	// - OpEvictedError
+	// - OpExpiredError
+	TransferInk(validateNum uint8, toPubKey string, amount uint32) (blockHash string, inkRemaining uint32, err error)
+	// Same as TransferInk, but gives up once ctx is done.
+	TransferInkCtx(ctx context.Context, validateNum uint8, toPubKey string, amount uint32) (blockHash string, inkRemaining uint32, err error)
 
 	// Retrieves hashes contained by a specific block.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - InvalidBlockHashError
 	GetShapes(blockHash string) (shapeHashes []string, err error)
+	// Same as GetShapes, but gives up once ctx is done.
+	GetShapesCtx(ctx context.Context, blockHash string) (shapeHashes []string, err error)
+
+	// Lists the operations the miner has yet to see in a block, in the order
+	// it will put them into blocks.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetPendingOps() (ops []MempoolOp, err error)
+	// Same as GetPendingOps, but gives up once ctx is done.
+	GetPendingOpsCtx(ctx context.Context) (ops []MempoolOp, err error)
 
 	// Returns the block hash of the genesis block.
 	// Can return the following errors:
 	// - DisconnectedError
 	GetGenesisBlock() (blockHash string, err error)
+	// Same as GetGenesisBlock, but gives up once ctx is done.
+	GetGenesisBlockCtx(ctx context.Context) (blockHash string, err error)
 
 	// Retrieves the children blocks of the block identified by blockHash.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - InvalidBlockHashError
 	GetChildren(blockHash string) (blockHashes []string, err error)
+	// Same as GetChildren, but gives up once ctx is done.
+	GetChildrenCtx(ctx context.Context, blockHash string) (blockHashes []string, err error)
 
 	// Closes the canvas/connection to the BlockArt network.
 	// - DisconnectedError
 	CloseCanvas() (inkRemaining uint32, err error)
+	// Same as CloseCanvas, but gives up once ctx is done.
+	CloseCanvasCtx(ctx context.Context) (inkRemaining uint32, err error)
+}
+
+// An operation waiting in the miner's mempool
+type MempoolOp struct {
+	OpSig     string
+	ShapeHash string // The shape added, or deleted for a delete, "" for a transfer
+	Delete    bool
+	To        string // Public key receiving the ink of a transfer, "" otherwise
+	Owner     string // Public key of the art node that sent the operation
+	SvgString string // HTML svg element of the shape, "" for a transfer
+	InkCost   uint32 // Ink the operation spends or transfers, 0 for a delete
+	Received  time.Time
+}
+
+// An op the miner accepted and is waiting for validateNum blocks on
+type PendingOp struct {
+	OpSig string
+	// The number of blocks on top of the op's block every time it changes,
+	// -1 when the op leaves the longest path. Closed once the op is done.
+	// Depths nobody reads are dropped rather than holding up the op.
+	Depths <-chan int
+
+	depths       chan int
+	done         chan struct{}
+	blockHash    string
+	inkRemaining uint32
+	err          error
+}
+
+// Number of depths a PendingOp keeps for its reader
+const PENDING_OP_DEPTH_BUFFER = 16
+
+// Returns a channel closed once the op is done
+func (op *PendingOp) Done() <-chan struct{} {
+	return op.done
+}
+
+// Waits for the op to be done. Returns the hash of the block holding the op
+// and the ink remaining then.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - ShapeOverlapError
+// - OpEvictedError
+// - OpExpiredError
+// - TimeoutError
+func (op *PendingOp) Result() (blockHash string, inkRemaining uint32, err error) {
+	<-op.done
+	return op.blockHash, op.inkRemaining, op.err
 }
 
 type CanvasT struct {
@@ -216,50 +303,126 @@ type CanvasT struct {
 // - ShapeSvgStringTooLongError
 // - ShapeOverlapError
 // - OutOfBoundsError
+// - MempoolFullError
+// - OpEvictedError
+// - OpExpiredError
 func (canvas CanvasT) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return canvas.AddShapeCtx(context.Background(), validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+// Same as AddShape, but gives up once ctx is done. A deadline on ctx is passed
+// on to the miner.
+func (canvas CanvasT) AddShapeCtx(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
 	if canvas.Miner == nil {
-		return "", "", uint32(0), DisconnectedError(canvas.Id)
+		return "", "", uint32(0), DisconnectedError(strconv.Itoa(canvas.Id))
 	}
 
+	// The ADD op is ours to sign
+	addOp := blockchain.Operation{
+		OpType:    blockchain.ADD,
+		SVGString: shapeSvgString,
+		Fill:      fill,
+		Stroke:    stroke,
+		OpNum:     newOpNum()}
+
 	drawRequest := libminer.DrawRequest{
 		Id:          canvas.Id,
 		ValidateNum: validateNum,
 		SVGString:   shapeSvgString,
 		Fill:        fill,
-		Stroke:      stroke}
+		Stroke:      stroke,
+		Deadline:    contextDeadline(ctx),
+		OpNum:       addOp.OpNum,
+		OpSig:       signOp(addOp, "", &canvas.PrivKey)}
 	msg, _ := json.Marshal(drawRequest)
 	req := getRPCRequest(msg, &canvas.PrivKey)
 
 	var reply libminer.DrawResponse
 
-	err = canvas.Miner.Call("LibMinerInterface.Draw", &req, &reply)
+	err = canvas.call(ctx, "LibMinerInterface.Draw", &req, &reply)
 
 	if err != nil {
 		fmt.Println("Error on calling Miner.Draw")
-		err = checkError(err)
 		return "", "", 0, err
 	}
 
 	return reply.ShapeHash, reply.BlockHash, reply.InkRemaining, err
 }
 
+// Same as AddShape, but returns once the miner accepted the shape, with a
+// PendingOp to follow it by. The op's OpSig is the shape hash.
+// Can return the following errors, the rest come from the PendingOp:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - ShapeOverlapError
+// - OutOfBoundsError
+// - MempoolFullError
+func (canvas CanvasT) AddShapeAsync(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (op *PendingOp, err error) {
+	return canvas.AddShapeAsyncCtx(context.Background(), validateNum, shapeType, shapeSvgString, fill, stroke)
+}
+
+// Same as AddShapeAsync, but gives up on the op once ctx is done. A deadline
+// on ctx is passed on to the miner.
+func (canvas CanvasT) AddShapeAsyncCtx(ctx context.Context, validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (op *PendingOp, err error) {
+	if canvas.Miner == nil {
+		return nil, DisconnectedError(strconv.Itoa(canvas.Id))
+	}
+
+	// The ADD op is ours to sign
+	addOp := blockchain.Operation{
+		OpType:    blockchain.ADD,
+		SVGString: shapeSvgString,
+		Fill:      fill,
+		Stroke:    stroke,
+		OpNum:     newOpNum()}
+
+	drawRequest := libminer.DrawRequest{
+		Id:          canvas.Id,
+		ValidateNum: validateNum,
+		SVGString:   shapeSvgString,
+		Fill:        fill,
+		Stroke:      stroke,
+		Deadline:    contextDeadline(ctx),
+		OpNum:       addOp.OpNum,
+		OpSig:       signOp(addOp, "", &canvas.PrivKey)}
+	msg, _ := json.Marshal(drawRequest)
+	req := getRPCRequest(msg, &canvas.PrivKey)
+
+	var reply libminer.DrawResponse
+
+	err = canvas.call(ctx, "LibMinerInterface.DrawAsync", &req, &reply)
+
+	if err != nil {
+		fmt.Println("Error on calling Miner.DrawAsync")
+		return nil, err
+	}
+
+	return canvas.followOp(ctx, reply.ShapeHash, reply.OpHash), nil
+}
+
 // Returns the encoding of the shape as an svg string.
 // Can return the following errors:
 // - DisconnectedError
 // - InvalidShapeHashError
 func (canvas CanvasT) GetSvgString(shapeHash string) (svgString string, err error) {
+	return canvas.GetSvgStringCtx(context.Background(), shapeHash)
+}
+
+// Same as GetSvgString, but gives up once ctx is done.
+func (canvas CanvasT) GetSvgStringCtx(ctx context.Context, shapeHash string) (svgString string, err error) {
 	if canvas.Miner == nil {
-		return "", DisconnectedError(canvas.Id)
+		return "", DisconnectedError(strconv.Itoa(canvas.Id))
 	}
 
 	msg, _ := json.Marshal(libminer.OpRequest{Id: canvas.Id, ShapeHash: shapeHash})
 	req := getRPCRequest(msg, &canvas.PrivKey)
 	var resp libminer.OpResponse
 
-	err = canvas.Miner.Call("LibMinerInterface.GetOp", &req, &resp)
+	err = canvas.call(ctx, "LibMinerInterface.GetOp", &req, &resp)
 
 	if err != nil {
-		err = checkError(err)
 		return "", err
 	}
 
@@ -271,18 +434,22 @@ func (canvas CanvasT) GetSvgString(shapeHash string) (svgString string, err erro
 // Can return the following errors:
 // - DisconnectedError
 func (canvas CanvasT) GetInk() (inkRemaining uint32, err error) {
+	return canvas.GetInkCtx(context.Background())
+}
+
+// Same as GetInk, but gives up once ctx is done.
+func (canvas CanvasT) GetInkCtx(ctx context.Context) (inkRemaining uint32, err error) {
 	if canvas.Miner == nil {
-		return 0, DisconnectedError(canvas.Id)
+		return 0, DisconnectedError(strconv.Itoa(canvas.Id))
 	}
 
 	msg, _ := json.Marshal(libminer.GenericRequest{Id: canvas.Id})
 	req := getRPCRequest(msg, &canvas.PrivKey)
 	var resp libminer.InkResponse
 
-	err = canvas.Miner.Call("LibMinerInterface.GetInk", &req, &resp)
+	err = canvas.call(ctx, "LibMinerInterface.GetInk", &req, &resp)
 
 	if err != nil {
-		err = checkError(err)
 		return 0, err
 	}
 
@@ -293,71 +460,269 @@ func (canvas CanvasT) GetInk() (inkRemaining uint32, err error) {
 // Can return the following errors:
 // - DisconnectedError
 // - ShapeOwnerError
+// - MempoolFullError
+// - OpEvictedError
+// - OpExpiredError
 func (canvas CanvasT) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
+	return canvas.DeleteShapeCtx(context.Background(), validateNum, shapeHash)
+}
+
+// Same as DeleteShape, but gives up once ctx is done. A deadline on ctx is passed
+// on to the miner.
+func (canvas CanvasT) DeleteShapeCtx(ctx context.Context, validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
 	if canvas.Miner == nil {
-		return 0, DisconnectedError(string(canvas.Id))
+		return 0, DisconnectedError(strconv.Itoa(canvas.Id))
 	}
 
-	deleteArgs := libminer.DeleteRequest{Id: canvas.Id, ShapeHash: shapeHash, ValidateNum: validateNum}
+	deleteOp, err := canvas.deleteOp(ctx, shapeHash)
+	if err != nil {
+		return 0, err
+	}
+
+	deleteArgs := libminer.DeleteRequest{Id: canvas.Id, ShapeHash: shapeHash, ValidateNum: validateNum,
+		Deadline: contextDeadline(ctx), OpNum: deleteOp.OpNum, OpSig: signOp(deleteOp, shapeHash, &canvas.PrivKey)}
 	msg, _ := json.Marshal(deleteArgs)
 	req := getRPCRequest(msg, &canvas.PrivKey)
 
 	var resp libminer.InkResponse
 
-	err = canvas.Miner.Call("LibMinerInterface.Delete", &req, &resp)
+	err = canvas.call(ctx, "LibMinerInterface.Delete", &req, &resp)
 
 	if err != nil {
 		log.Println("Error in Miner.Delete")
-		err = checkError(err)
 		return 0, err
 	}
 
 	return resp.InkRemaining, err
 }
 
+// Same as DeleteShape, but returns once the miner accepted the deletion, with
+// a PendingOp to follow it by.
+// Can return the following errors, the rest come from the PendingOp:
+// - DisconnectedError
+// - ShapeOwnerError
+// - MempoolFullError
+func (canvas CanvasT) DeleteShapeAsync(validateNum uint8, shapeHash string) (op *PendingOp, err error) {
+	return canvas.DeleteShapeAsyncCtx(context.Background(), validateNum, shapeHash)
+}
+
+// Same as DeleteShapeAsync, but gives up on the op once ctx is done. A
+// deadline on ctx is passed on to the miner.
+func (canvas CanvasT) DeleteShapeAsyncCtx(ctx context.Context, validateNum uint8, shapeHash string) (op *PendingOp, err error) {
+	if canvas.Miner == nil {
+		return nil, DisconnectedError(strconv.Itoa(canvas.Id))
+	}
+
+	deleteOp, err := canvas.deleteOp(ctx, shapeHash)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteArgs := libminer.DeleteRequest{Id: canvas.Id, ShapeHash: shapeHash, ValidateNum: validateNum,
+		Deadline: contextDeadline(ctx), OpNum: deleteOp.OpNum, OpSig: signOp(deleteOp, shapeHash, &canvas.PrivKey)}
+	msg, _ := json.Marshal(deleteArgs)
+	req := getRPCRequest(msg, &canvas.PrivKey)
+
+	var reply libminer.DrawResponse
+
+	err = canvas.call(ctx, "LibMinerInterface.DeleteAsync", &req, &reply)
+
+	if err != nil {
+		log.Println("Error in Miner.DeleteAsync")
+		return nil, err
+	}
+
+	return canvas.followOp(ctx, reply.ShapeHash, reply.OpHash), nil
+}
+
+// Moves amount of our ink to the art node or miner with toPubKey.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidTransferError
+// - MempoolFullError
+// - OpEvictedError
+// - OpExpiredError
+func (canvas CanvasT) TransferInk(validateNum uint8, toPubKey string, amount uint32) (blockHash string, inkRemaining uint32, err error) {
+	return canvas.TransferInkCtx(context.Background(), validateNum, toPubKey, amount)
+}
+
+// Same as TransferInk, but gives up once ctx is done. A deadline on ctx is
+// passed on to the miner.
+func (canvas CanvasT) TransferInkCtx(ctx context.Context, validateNum uint8, toPubKey string, amount uint32) (blockHash string, inkRemaining uint32, err error) {
+	if canvas.Miner == nil {
+		return "", 0, DisconnectedError(strconv.Itoa(canvas.Id))
+	}
+
+	// The TRANSFER op is ours to sign
+	transferOp := blockchain.Operation{
+		OpType: blockchain.TRANSFER,
+		OpNum:  newOpNum(),
+		To:     toPubKey,
+		Amount: amount}
+
+	transferRequest := libminer.TransferRequest{
+		Id:          canvas.Id,
+		ValidateNum: validateNum,
+		To:          toPubKey,
+		Amount:      amount,
+		OpNum:       transferOp.OpNum,
+		OpSig:       signOp(transferOp, "", &canvas.PrivKey),
+		Deadline:    contextDeadline(ctx)}
+	msg, _ := json.Marshal(transferRequest)
+	req := getRPCRequest(msg, &canvas.PrivKey)
+
+	var reply libminer.DrawResponse
+
+	err = canvas.call(ctx, "LibMinerInterface.Transfer", &req, &reply)
+
+	if err != nil {
+		fmt.Println("Error on calling Miner.Transfer")
+		return "", 0, err
+	}
+
+	return reply.BlockHash, reply.InkRemaining, nil
+}
+
+// Returns a PendingOp for the op with opSig, kept up to date by long-polling
+// the miner for the op with opHash until the op is done or ctx is
+func (canvas CanvasT) followOp(ctx context.Context, opSig string, opHash string) *PendingOp {
+	depths := make(chan int, PENDING_OP_DEPTH_BUFFER)
+	op := &PendingOp{OpSig: opSig, Depths: depths, depths: depths, done: make(chan struct{})}
+
+	go func() {
+		defer close(op.done)
+		defer close(op.depths)
+
+		knownDepth := -1
+		for {
+			msg, _ := json.Marshal(libminer.OpStatusRequest{Id: canvas.Id, OpHash: opHash, KnownDepth: knownDepth})
+			req := getRPCRequest(msg, &canvas.PrivKey)
+			var status libminer.OpStatusResponse
+
+			if op.err = canvas.call(ctx, "LibMinerInterface.WaitOp", &req, &status); op.err != nil {
+				return
+			}
+
+			if status.Depth != knownDepth {
+				knownDepth = status.Depth
+				select {
+				case op.depths <- knownDepth:
+				default:
+				}
+			}
+
+			if status.Done {
+				op.blockHash = status.BlockHash
+				op.inkRemaining = status.InkRemaining
+				return
+			}
+		}
+	}()
+
+	return op
+}
+
 // Retrieves hashes contained by a specific block.
 // Can return the following errors:
 // - DisconnectedError
 // - InvalidBlockHashError
 func (canvas CanvasT) GetShapes(blockHash string) (shapeHashes []string, err error) {
+	return canvas.GetShapesCtx(context.Background(), blockHash)
+}
+
+// Same as GetShapes, but gives up once ctx is done.
+func (canvas CanvasT) GetShapesCtx(ctx context.Context, blockHash string) (shapeHashes []string, err error) {
 	if canvas.Miner == nil {
-		return shapeHashes, DisconnectedError(string(canvas.Id))
+		return shapeHashes, DisconnectedError(strconv.Itoa(canvas.Id))
 	}
 
 	msg, _ := json.Marshal(libminer.BlockRequest{Id: canvas.Id, BlockHash: blockHash})
 	req := getRPCRequest(msg, &canvas.PrivKey)
 	var resp libminer.BlocksResponse
 
-	err = canvas.Miner.Call("LibMinerInterface.GetBlock", &req, &resp)
+	err = canvas.call(ctx, "LibMinerInterface.GetBlock", &req, &resp)
 
 	if err != nil {
 		log.Println("Error in Miner.GetShapes in GetShapes")
-		err = checkError(err)
 		return shapeHashes, err
 	}
 
 	shapeHashes = make([]string, 0)
 	for _, opInfo := range resp.Blocks[0].OpHistory {
+		// Transfers move ink, they don't draw
+		if opInfo.Op.OpType == blockchain.TRANSFER {
+			continue
+		}
 		shapeHashes = append(shapeHashes, opInfo.OpSig)
 	}
 
 	return shapeHashes, nil
 }
 
+// Lists the operations the miner has yet to see in a block, in the order it
+// will put them into blocks.
+// Can return the following errors:
+// - DisconnectedError
+func (canvas CanvasT) GetPendingOps() (ops []MempoolOp, err error) {
+	return canvas.GetPendingOpsCtx(context.Background())
+}
+
+// Same as GetPendingOps, but gives up once ctx is done.
+func (canvas CanvasT) GetPendingOpsCtx(ctx context.Context) (ops []MempoolOp, err error) {
+	if canvas.Miner == nil {
+		return nil, DisconnectedError(strconv.Itoa(canvas.Id))
+	}
+
+	msg, _ := json.Marshal(libminer.GenericRequest{Id: canvas.Id})
+	req := getRPCRequest(msg, &canvas.PrivKey)
+	var resp libminer.PendingOpsResponse
+
+	err = canvas.call(ctx, "LibMinerInterface.GetPendingOps", &req, &resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pending := range resp.Ops {
+		op := MempoolOp{
+			OpSig:     pending.OpInfo.OpSig,
+			ShapeHash: pending.OpInfo.OpSig,
+			Owner:     pending.OpInfo.PubKey,
+			SvgString: utils.GetHTMLSVGString(pending.OpInfo.Op),
+			InkCost:   pending.InkCost,
+			Received:  time.Unix(0, pending.Received*int64(time.Millisecond))}
+		if pending.OpInfo.Op.OpType == blockchain.DELETE {
+			op.ShapeHash = pending.OpInfo.AddSig
+			op.Delete = true
+		} else if pending.OpInfo.Op.OpType == blockchain.TRANSFER {
+			op.ShapeHash = ""
+			op.To = pending.OpInfo.Op.To
+			op.SvgString = ""
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
 // Returns the block hash of the genesis block.
 // Can return the following errors:
 // - DisconnectedError
 func (canvas CanvasT) GetGenesisBlock() (blockHash string, err error) {
+	return canvas.GetGenesisBlockCtx(context.Background())
+}
+
+// Same as GetGenesisBlock, but gives up once ctx is done.
+func (canvas CanvasT) GetGenesisBlockCtx(ctx context.Context) (blockHash string, err error) {
 	if canvas.Miner == nil {
-		return "", DisconnectedError(string(canvas.Id))
+		return "", DisconnectedError(strconv.Itoa(canvas.Id))
 	}
 
 	msg, _ := json.Marshal(libminer.GenericRequest{Id: canvas.Id})
 	req := getRPCRequest(msg, &canvas.PrivKey)
 
-	err = canvas.Miner.Call("LibMinerInterface.GetGenesisBlock", &req, &blockHash)
+	err = canvas.call(ctx, "LibMinerInterface.GetGenesisBlock", &req, &blockHash)
 	if err != nil {
-		err = checkError(err)
 		return "", err
 	}
 	return blockHash, err
@@ -368,8 +733,13 @@ func (canvas CanvasT) GetGenesisBlock() (blockHash string, err error) {
 // - DisconnectedError
 // - InvalidBlockHashError
 func (canvas CanvasT) GetChildren(blockHash string) (blockHashes []string, err error) {
+	return canvas.GetChildrenCtx(context.Background(), blockHash)
+}
+
+// Same as GetChildren, but gives up once ctx is done.
+func (canvas CanvasT) GetChildrenCtx(ctx context.Context, blockHash string) (blockHashes []string, err error) {
 	if canvas.Miner == nil {
-		return blockHashes, DisconnectedError(string(canvas.Id))
+		return blockHashes, DisconnectedError(strconv.Itoa(canvas.Id))
 	}
 
 	msg, _ := json.Marshal(libminer.BlockRequest{Id: canvas.Id, BlockHash: blockHash})
@@ -377,31 +747,33 @@ func (canvas CanvasT) GetChildren(blockHash string) (blockHashes []string, err e
 
 	var resp libminer.BlocksResponse
 
-	err = canvas.Miner.Call("LibMinerInterface.GetChildren", &req, &resp)
+	err = canvas.call(ctx, "LibMinerInterface.GetChildren", &req, &resp)
 
 	for _, block := range resp.Blocks {
-		bytes, _ := json.Marshal(block)
-		hash := utils.ComputeHash(bytes)
-		blockHashes = append(blockHashes, hex.EncodeToString(hash))
+		hash, _ := blockchain.HashBlock(block)
+		blockHashes = append(blockHashes, hash)
 	}
 
-	err = checkError(err)
 	return blockHashes, err
 }
 
 // Closes the canvas/connection to the BlockArt network.
 // - DisconnectedError
 func (canvas CanvasT) CloseCanvas() (inkRemaining uint32, err error) {
+	return canvas.CloseCanvasCtx(context.Background())
+}
+
+// Same as CloseCanvas, but gives up once ctx is done.
+func (canvas CanvasT) CloseCanvasCtx(ctx context.Context) (inkRemaining uint32, err error) {
 	if canvas.Miner == nil {
-		return 0, DisconnectedError(string(canvas.Id))
+		return 0, DisconnectedError(strconv.Itoa(canvas.Id))
 	}
 
 	msg, _ := json.Marshal(libminer.GenericRequest{Id: canvas.Id})
 	req := getRPCRequest(msg, &canvas.PrivKey)
 	var resp libminer.InkResponse
 
-	err = canvas.Miner.Call("LibMinerInterface.GetInk", &req, &resp)
-	err = checkError(err)
+	err = canvas.call(ctx, "LibMinerInterface.CloseCanvas", &req, &resp)
 	return resp.InkRemaining, err
 }
 
@@ -415,79 +787,201 @@ func (canvas CanvasT) CloseCanvas() (inkRemaining uint32, err error) {
 //
 // Can return the following errors:
 // - DisconnectedError
+// - ProtocolVersionError
 func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
+	return OpenCanvasCtx(context.Background(), minerAddr, privKey)
+}
+
+// Same as OpenCanvas, but gives up once ctx is done.
+func OpenCanvasCtx(ctx context.Context, minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
 	var canvasT CanvasT
-	miner, err := rpc.Dial("tcp", minerAddr)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", minerAddr)
 
+	if ctx.Err() != nil {
+		return canvasT, CanvasSettings{}, contextError(ctx, "OpenCanvas")
+	}
 	if err != nil {
 		return canvasT, CanvasSettings{}, DisconnectedError(minerAddr)
 	}
+	if UseTLS {
+		conn, err = secureConn(ctx, conn, &privKey)
+		if ctx.Err() != nil {
+			return canvasT, CanvasSettings{}, contextError(ctx, "OpenCanvas")
+		}
+		if err != nil {
+			return canvasT, CanvasSettings{}, DisconnectedError(err.Error())
+		}
+	}
+	canvasT.Miner = rpc.NewClient(conn)
 
-	msg := []byte("Hi")
+	msg, _ := json.Marshal(libminer.OpenCanvasRequest{ProtocolVersion: protocol.PROTOCOL_VERSION})
 	req := getRPCRequest(msg, &privKey)
 	var resp libminer.RegisterResponse
 
-	err = miner.Call("LibMinerInterface.OpenCanvas", &req, &resp)
+	err = canvasT.call(ctx, "LibMinerInterface.OpenCanvas", &req, &resp)
+
+	// Miners from before versioning don't reject us, but don't send theirs
+	if err == nil {
+		err = protocol.CheckVersion(resp.ProtocolVersion)
+	}
 
 	if err != nil {
-		err = checkError(err)
+		canvasT.Miner.Close()
 		return canvas, setting, err
 	}
 
-	canvasT = CanvasT{
-		Miner:    miner,
-		Id:       resp.Id,
-		PrivKey:  privKey,
-		Settings: CanvasSettings{CanvasXMax: resp.CanvasXMax, CanvasYMax: resp.CanvasYMax}}
+	canvasT.Id = resp.Id
+	canvasT.PrivKey = privKey
+	canvasT.Settings = CanvasSettings{CanvasXMax: resp.CanvasXMax, CanvasYMax: resp.CanvasYMax}
 
 	return canvasT, canvasT.Settings, nil
 }
 
-func checkError(err error) error {
+// Returns conn over TLS to the miner, pinned to MinerKey if it is set. We
+// present a certificate for privKey.
+func secureConn(ctx context.Context, conn net.Conn, privKey *ecdsa.PrivateKey) (net.Conn, error) {
+	pinned, err := minerKey()
 	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	config, err := protocol.ClientTLSConfig(privKey, pinned)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Returns the key MinerKey pins, or nil if it is empty
+func minerKey() (*ecdsa.PublicKey, error) {
+	if MinerKey == "" {
+		return nil, nil
+	}
+
+	keyBytes, err := hex.DecodeString(MinerKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("MinerKey is not an ECDSA key")
+	}
+	return ecdsaKey, nil
+}
+
+// Returns the error of a call to the miner as one of ours. Errors the miner
+// sent come in an envelope; the errors net/rpc makes up itself mean we lost
+// the miner.
+func checkError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
 		fmt.Fprintln(os.Stderr, "Error ", err.Error())
-		tokens := strings.SplitN(err.Error(), " ", 2)
-		code := tokens[0]
-		msg := ""
-		if len(tokens) == 2 {
-			msg = tokens[1]
-		}
-		err = convertStatusCodeToError(code, msg)
-		return err
-	}
-	return nil
-}
-
-func convertStatusCodeToError(statusCode string, msg string) error {
-	switch statusCode {
-	case "1":
-		return ShapeSvgStringTooLongError(msg)
-	case "2":
-		return InvalidShapeSvgStringError(msg)
-	case "3":
-		m, _ := strconv.Atoi(msg)
-		return InsufficientInkError(uint32(m))
-	case "4":
-		return ShapeOverlapError(msg)
-	case "5":
-		return OutOfBoundsError{}
-	case "6":
-		return InvalidBlockHashError(msg)
-	case "7":
-		return ShapeOwnerError(msg)
-	case "8":
-		return InvalidShapeHashError(msg)
-	case "9":
-		return errors.New(msg) // ERROR WITH BLOCKCHAIN SYSTEM
-	default:
-		return DisconnectedError(msg) // Just making this the catch all
+		return DisconnectedError(err.Error())
+	}
+
+	envelope, ok := protocol.UnwrapError(string(serverErr))
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Error ", string(serverErr))
+		return errors.New(string(serverErr))
+	}
+
+	fmt.Fprintln(os.Stderr, "Error ", envelope.Message)
+	return envelope.Err() // Any error that isn't ours is an ERROR WITH BLOCKCHAIN SYSTEM
+}
+
+// Calls the miner, giving up once ctx is done. Errors from the miner are
+// converted to ours.
+func (canvas CanvasT) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	call := canvas.Miner.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		return checkError(call.Error)
+	case <-ctx.Done():
+		return contextError(ctx, method)
+	}
+}
+
+// Returns the error for a call abandoned because ctx is done
+func contextError(ctx context.Context, method string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return TimeoutError(method)
+	}
+	return ctx.Err()
+}
+
+// Returns the deadline of ctx as Unix time in ms, or 0 if it has none
+func contextDeadline(ctx context.Context) int64 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
 	}
+	return deadline.UnixNano() / int64(time.Millisecond)
 }
 
 func getRPCRequest(msg []byte, privKey *ecdsa.PrivateKey) libminer.Request {
 	hashedMsg := utils.ComputeHash(msg)
 	r, s, _ := ecdsa.Sign(rand.Reader, privKey, hashedMsg)
-	req := libminer.Request{R: *r, S: *s, HashedMsg: hashedMsg, Msg: msg}
+	req := libminer.Request{R: *r, S: *s, HashedMsg: hashedMsg, Msg: msg,
+		PubKey: utils.GetPublicKeyString(privKey.PublicKey)}
 
 	return req
 }
+
+// Returns the DELETE op for the shape with shapeHash, which carries the
+// svg string, fill and stroke of the ADD op of the shape
+func (canvas CanvasT) deleteOp(ctx context.Context, shapeHash string) (op blockchain.Operation, err error) {
+	msg, _ := json.Marshal(libminer.OpRequest{Id: canvas.Id, ShapeHash: shapeHash})
+	req := getRPCRequest(msg, &canvas.PrivKey)
+	var resp libminer.OpResponse
+
+	err = canvas.call(ctx, "LibMinerInterface.GetOp", &req, &resp)
+	if err != nil {
+		if _, ok := err.(InvalidShapeHashError); ok {
+			return op, ShapeOwnerError(shapeHash)
+		}
+		return op, err
+	}
+
+	op = blockchain.Operation{
+		OpType:    blockchain.DELETE,
+		SVGString: resp.Op.SVGString,
+		Fill:      resp.Op.Fill,
+		Stroke:    resp.Op.Stroke,
+		OpNum:     newOpNum()}
+	return op, nil
+}
+
+// Returns a random OpNum, so ops with the same svg string, fill and stroke
+// still differ
+func newOpNum() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// Returns the OpSig of op: the hex of the signature with privKey over the
+// digest of op, the shape it deletes (addSig, "" unless it is a DELETE) and
+// our public key
+func signOp(op blockchain.Operation, addSig string, privKey *ecdsa.PrivateKey) string {
+	opInfo := blockchain.OperationInfo{AddSig: addSig, PubKey: utils.GetPublicKeyString(privKey.PublicKey), Op: op}
+	sig, _ := privKey.Sign(rand.Reader, blockchain.OperationDigest(opInfo), nil)
+	return hex.EncodeToString(sig)
+}
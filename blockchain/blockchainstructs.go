@@ -5,6 +5,7 @@ type OpType int
 const (
 	ADD OpType = iota
 	DELETE
+	TRANSFER // Moves Amount ink from PubKey to To
 )
 
 type ShapeHash struct {
@@ -17,6 +18,8 @@ type Operation struct {
 	Fill      string
 	Stroke    string
 	OpNum     uint64 // Unique id for operations
+	To        string `json:",omitempty"` // Pubkey receiving the ink of a TRANSFER
+	Amount    uint32 `json:",omitempty"` // Ink moved by a TRANSFER
 }
 
 type OperationInfo struct {
@@ -27,10 +30,15 @@ type OperationInfo struct {
 }
 
 type Block struct {
-	PrevHash    string
-	OpHistory   []OperationInfo
-	MinerPubKey string
-	Nonce       uint32
+	PrevHash      string
+	OpHistory     []OperationInfo
+	MinerPubKey   string
+	Nonce         uint32
+	HashAlgorithm HashAlgorithm `json:",omitempty"` // Omitted for legacy MD5 blocks so their hashes don't change
+	ExtraNonce    uint32        `json:",omitempty"` // Rolled by the solver once the 32 bit Nonce is exhausted
+	Timestamp     int64         `json:",omitempty"` // Unix time in ms at which the block was started
+	Difficulty    uint8         `json:",omitempty"` // PoW difficulty this block was mined at after retargeting
+	Signature     string        `json:",omitempty"` // Hex of MinerPubKey's ECDSA signature over EncodeBlockForSigning
 }
 
 type BlockNode struct {
@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"encoding/binary"
+)
+
+// Canonical binary encoding of blocks and operations. This is what block
+// hashes are computed over, so it must never depend on Go struct layout:
+// fields are written in a fixed order, integers as fixed width big endian,
+// and strings/byte slices/lists are prefixed with their uint32 length.
+//
+// Adding a field to Block, OperationInfo or Operation does NOT change the
+// encoding until the field is written here; bump BLOCK_ENCODING_VERSION when
+// it is.
+
+const BLOCK_ENCODING_VERSION = 5
+
+// Returns the canonical encoding of the operation
+func EncodeOperation(op Operation) []byte {
+	buf := make([]byte, 0, 40+len(op.SVGString)+len(op.Fill)+len(op.Stroke)+len(op.To))
+	buf = appendUint64(buf, uint64(op.OpType))
+	buf = appendString(buf, op.SVGString)
+	buf = appendString(buf, op.Fill)
+	buf = appendString(buf, op.Stroke)
+	buf = appendUint64(buf, op.OpNum)
+	buf = appendString(buf, op.To)
+	buf = appendUint32(buf, op.Amount)
+	return buf
+}
+
+// Returns the canonical encoding of the operation info
+func EncodeOperationInfo(opInfo OperationInfo) []byte {
+	buf := make([]byte, 0, 128)
+	buf = appendString(buf, opInfo.AddSig)
+	buf = appendString(buf, opInfo.OpSig)
+	buf = appendString(buf, opInfo.PubKey)
+	buf = appendBytes(buf, EncodeOperation(opInfo.Op))
+	return buf
+}
+
+// Returns what the art node of an op signs: the canonical encoding of the op
+// info without OpSig. The shape a DELETE deletes and the key that spends the
+// ink are signed along with the op.
+func EncodeOperationForSigning(opInfo OperationInfo) []byte {
+	buf := make([]byte, 0, 128)
+	buf = appendString(buf, opInfo.AddSig)
+	buf = appendString(buf, opInfo.PubKey)
+	buf = appendBytes(buf, EncodeOperation(opInfo.Op))
+	return buf
+}
+
+// Returns the canonical encoding of the block
+func EncodeBlock(block Block) []byte {
+	return appendUint32(EncodeBlockPrefix(block), block.Nonce)
+}
+
+// Returns the canonical encoding of the block up to, but not including, the
+// nonce. The nonce is always the last field, so a solver can encode this
+// once and only append a new nonce on every attempt.
+func EncodeBlockPrefix(block Block) []byte {
+	buf := EncodeBlockForSigning(block)
+	buf = appendString(buf, block.Signature)
+	buf = appendUint32(buf, block.ExtraNonce)
+	return buf
+}
+
+// Returns what the miner of the block signs: the canonical encoding of the
+// block up to, but not including, the signature and the nonces. The solver
+// rolls the nonces without having to sign again.
+func EncodeBlockForSigning(block Block) []byte {
+	buf := make([]byte, 0, 256)
+	buf = append(buf, BLOCK_ENCODING_VERSION)
+	buf = appendString(buf, string(block.HashAlgorithm))
+	buf = appendString(buf, block.PrevHash)
+	buf = appendString(buf, block.MinerPubKey)
+	buf = appendUint32(buf, uint32(len(block.OpHistory)))
+	for _, opInfo := range block.OpHistory {
+		buf = appendBytes(buf, EncodeOperationInfo(opInfo))
+	}
+	buf = appendUint64(buf, uint64(block.Timestamp))
+	buf = append(buf, block.Difficulty)
+	return buf
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = appendUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
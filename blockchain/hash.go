@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// The hash function used to compute a block's identity. Every block records
+// the algorithm it was hashed with so that chains mined before a network
+// switched algorithms still validate.
+type HashAlgorithm string
+
+const (
+	// Legacy: blocks that don't name an algorithm were hashed with MD5
+	MD5     HashAlgorithm = ""
+	SHA256  HashAlgorithm = "sha256"
+	BLAKE2B HashAlgorithm = "blake2b"
+)
+
+// Contains the unrecognized algorithm name.
+type UnknownHashAlgorithmError string
+
+func (e UnknownHashAlgorithmError) Error() string {
+	return fmt.Sprintf("BlockArt: Unknown hash algorithm [%s]", string(e))
+}
+
+// Returns a new hash.Hash for the algorithm. MD5 is only ever named by
+// leaving the algorithm empty, so there is one legacy encoding of it.
+func (a HashAlgorithm) New() (hash.Hash, error) {
+	switch a {
+	case MD5:
+		return md5.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case BLAKE2B:
+		return blake2b.New256(nil)
+	default:
+		return nil, UnknownHashAlgorithmError(a)
+	}
+}
+
+// Relative strength of the algorithm. A block may never use a weaker
+// algorithm than its parent, which stops a chain that has moved off MD5 from
+// being extended with MD5 blocks again.
+func (a HashAlgorithm) Strength() int {
+	switch a {
+	case SHA256, BLAKE2B:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Returns the hex encoded hash of the block using the algorithm recorded in
+// the block. Legacy MD5 blocks were hashed over their json encoding and keep
+// being hashed that way; everything else is hashed over EncodeBlock.
+func HashBlock(block Block) (string, error) {
+	h, err := block.HashAlgorithm.New()
+	if err != nil {
+		return "", err
+	}
+
+	if block.HashAlgorithm == MD5 {
+		bytes, err := json.Marshal(block)
+		if err != nil {
+			return "", err
+		}
+		h.Write(bytes)
+	} else {
+		h.Write(EncodeBlock(block))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the SHA-256 digest of EncodeOperationForSigning. Art nodes sign it,
+// and it tells ops apart whichever signature they carry.
+func OperationDigest(opInfo OperationInfo) []byte {
+	digest := sha256.Sum256(EncodeOperationForSigning(opInfo))
+	return digest[:]
+}
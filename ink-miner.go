@@ -2,12 +2,25 @@
 package main
 
 import "./miner"
+import "./pow"
+import "flag"
 import "io/ioutil"
-import "os"
+import "runtime"
 import "strings"
 
 func main(){
-	serverIP := os.Args[1]
+	threads := flag.Int("threads", runtime.NumCPU(), "number of proof-of-work worker threads")
+	useTLS := flag.Bool("tls", false, "use TLS on every link, with a certificate for the miner's key")
+	serverKey := flag.String("server-key", "", "hex of the server's public key to pin with -tls (any server if empty)")
+	admin := flag.String("admin", "", "address to serve the admin RPC at, e.g. 127.0.0.1:9000 (none if empty)")
+	flag.Parse()
+	serverIP := flag.Arg(0)
+	if *threads > 0 {
+		pow.NumWorkers = *threads
+	}
+	miner.UseTLS = *useTLS
+	miner.ServerKey = *serverKey
+	miner.AdminAddr = *admin
 	
 	// Grab pubKey and privKey from key-pairs.txt
 	keyBytes, _ := ioutil.ReadFile("./key-pairs.txt")
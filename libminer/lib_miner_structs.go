@@ -1,7 +1,6 @@
 package libminer
 
 import (
-	"fmt"
 	"math/big"
 
 	"../blockchain"
@@ -16,6 +15,7 @@ type Request struct {
 	HashedMsg []byte
 	R         big.Int
 	S         big.Int
+	PubKey    string // Hex of the x509 encoding of the art node's public key, which R and S verify against
 }
 
 type DrawRequest struct {
@@ -24,18 +24,39 @@ type DrawRequest struct {
 	SVGString   string
 	Fill        string
 	Stroke      string
+	OpNum       uint64 // Unique id the art node picked for the ADD operation
+	OpSig       string // Art node's signature of the ADD operation
+	Deadline    int64 `json:",omitempty"` // Unix time in ms to stop waiting for ValidateNum blocks at, 0 for none
 }
 
 type DeleteRequest struct {
 	Id          int
 	ValidateNum uint8
 	ShapeHash   string
+	OpNum       uint64 // Unique id the art node picked for the DELETE operation
+	OpSig       string // Art node's signature of the DELETE operation
+	Deadline    int64 `json:",omitempty"` // Unix time in ms to stop waiting for ValidateNum blocks at, 0 for none
+}
+
+type TransferRequest struct {
+	Id          int
+	ValidateNum uint8
+	To          string // Hex of the x509 encoding of the recipient's public key
+	Amount      uint32
+	OpNum       uint64 // Unique id the art node picked for the TRANSFER operation
+	OpSig       string // Art node's signature of the TRANSFER operation
+	Deadline    int64 `json:",omitempty"` // Unix time in ms to stop waiting for ValidateNum blocks at, 0 for none
 }
 
 type GenericRequest struct {
 	Id int
 }
 
+// Art nodes from before versioning send "Hi" instead, which reads as version 0
+type OpenCanvasRequest struct {
+	ProtocolVersion uint32
+}
+
 type RegisterRequest struct {
 	R   big.Int
 	S   big.Int
@@ -47,6 +68,13 @@ type OpRequest struct {
 	ShapeHash string
 }
 
+// Long-polls the state of an op started with DrawAsync or DeleteAsync
+type OpStatusRequest struct {
+	Id         int
+	OpHash     string // From the DrawResponse of DrawAsync or DeleteAsync
+	KnownDepth int // Depth the caller last saw; the miner answers once it differs
+}
+
 type BlockRequest struct {
 	Id        int
 	BlockHash string
@@ -54,9 +82,10 @@ type BlockRequest struct {
 
 //////////////////////////Response msgs
 type RegisterResponse struct {
-	Id         int
-	CanvasXMax uint32
-	CanvasYMax uint32
+	Id              int
+	CanvasXMax      uint32
+	CanvasYMax      uint32
+	ProtocolVersion uint32 // Miners from before versioning leave it 0
 }
 
 type InkResponse struct {
@@ -65,72 +94,34 @@ type InkResponse struct {
 
 type DrawResponse struct {
 	ShapeHash    string
+	OpHash       string // Hex of blockchain.OperationDigest of the op, set by DrawAsync and DeleteAsync
 	BlockHash    string
 	InkRemaining uint32
 }
 
-type OpResponse struct {
-	Op blockchain.Operation
+type OpStatusResponse struct {
+	Depth        int    // Blocks on top of the op's block, -1 while no block holds it
+	BlockHash    string // Block holding the op once Done
+	Done         bool   // Set once the op is ValidateNum blocks deep or failed
+	InkRemaining uint32 // Set once Done
 }
 
-type BlocksResponse struct {
-	Blocks []blockchain.Block
+// An op waiting in a miner's mempool
+type MempoolOp struct {
+	OpInfo   blockchain.OperationInfo
+	Size     uint32 // Bytes of the op's encoding
+	InkCost  uint32 // Ink the op spends or transfers, 0 for a delete
+	Received int64  // Unix time in ms the miner got the op at
 }
 
-/*********** ERRORS ************/
-type InsufficientInkError uint32
-
-func (e InsufficientInkError) Error() string {
-	return fmt.Sprintf("BlockArt: Not enough ink to addShape [%d]", uint32(e))
+type PendingOpsResponse struct {
+	Ops []MempoolOp
 }
 
-// Contains the offending svg string.
-type InvalidShapeSvgStringError string
-
-func (e InvalidShapeSvgStringError) Error() string {
-	return fmt.Sprintf("BlockArt: Bad shape svg string [%s]", string(e))
-}
-
-// Contains the offending svg string.
-type ShapeSvgStringTooLongError string
-
-func (e ShapeSvgStringTooLongError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape svg string too long [%s]", string(e))
-}
-
-// Contains the bad shape hash string.
-type InvalidShapeHashError string
-
-func (e InvalidShapeHashError) Error() string {
-	return fmt.Sprintf("BlockArt: Invalid shape hash [%s]", string(e))
-}
-
-// Contains the bad shape hash string.
-type ShapeOwnerError string
-
-func (e ShapeOwnerError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape owned by someone else [%s]", string(e))
-}
-
-// Empty
-type OutOfBoundsError struct{}
-
-func (e OutOfBoundsError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape is outside the bounds of the canvas")
-}
-
-// Contains the hash of the shape that this shape overlaps with.
-type ShapeOverlapError string
-
-func (e ShapeOverlapError) Error() string {
-	return fmt.Sprintf("BlockArt: Shape overlaps with a previously added shape [%s]", string(e))
+type OpResponse struct {
+	Op blockchain.Operation
 }
 
-// Contains the invalid block hash.
-type InvalidBlockHashError string
-
-func (e InvalidBlockHashError) Error() string {
-	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
+type BlocksResponse struct {
+	Blocks []blockchain.Block
 }
-
-/*********** ERRORS ************/
@@ -0,0 +1,78 @@
+/*
+
+This file contains the admin RPC of the miner, for its operator. It is off
+unless AdminAddr is set, and takes no credentials, so AdminAddr should be a
+loopback address.
+
+Admin RPC calls:
+  GetBans(args *empty, reply *[]peerScore)
+  Ban(args *banArgs, reply *empty)
+  Unban(args *string, reply *empty)
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+)
+
+// Address the admin RPC listens at, "" for none
+var AdminAddr string
+
+type AdminRpc struct{}
+
+type BanArgs struct {
+	Target  string // Address or key
+	Seconds int    // 0 for BAN_SECONDS
+	Reason  string
+}
+
+// Returns the addresses and keys that are banned now
+func (a *AdminRpc) GetBans(args Empty, reply *[]PeerScore) error {
+	*reply = Scores.Bans()
+	return nil
+}
+
+// Bans an address or key
+func (a *AdminRpc) Ban(args BanArgs, reply *Empty) error {
+	if args.Target == "" {
+		return fmt.Errorf("BlockArt: nothing to ban")
+	}
+	if args.Seconds <= 0 {
+		args.Seconds = BAN_SECONDS
+	}
+	if args.Reason == "" {
+		args.Reason = "banned by admin"
+	}
+
+	Scores.Ban(args.Target, args.Seconds, args.Reason)
+	return nil
+}
+
+// Lifts the ban on an address or key, and clears its misbehaviour points
+func (a *AdminRpc) Unban(target string, reply *Empty) error {
+	if !Scores.Unban(target) {
+		return fmt.Errorf("BlockArt: [%s] is not banned", target)
+	}
+	return nil
+}
+
+// Serves the admin RPC at AdminAddr, if it is set
+func ListenAdminRpc() {
+	if AdminAddr == "" {
+		return
+	}
+
+	ln, err := net.Listen("tcp", AdminAddr)
+	if CheckError(err, "ListenAdminRpc:Listen") {
+		return
+	}
+	fmt.Println("ListenAdminRpc::listening on: ", ln.Addr().String())
+
+	server := rpc.NewServer()
+	server.RegisterName("Admin", &AdminRpc{})
+	go server.Accept(ln)
+}
@@ -0,0 +1,101 @@
+/*
+
+This file contains the art nodes that opened a canvas with us. Each gets an
+id, and is known by its public key from then on: the key owns its shapes and
+ink, and signs its requests.
+
+An art node that opens a canvas again keeps its id, and gives it back when it
+closes the canvas. At most MAX_ART_NODES art nodes have a canvas open at once.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Most art nodes with a canvas open at once
+const MAX_ART_NODES = 256
+
+// Reasons an art node isn't registered
+const (
+	ART_NODES_FULL = "too many art nodes"
+)
+
+type ArtNodeError struct {
+	PubKey string
+	Reason string
+}
+
+func (e ArtNodeError) Error() string {
+	return fmt.Sprintf("Art node %s not registered: %s", e.PubKey, e.Reason)
+}
+
+type ArtNodeRegistry struct {
+	MaxArtNodes int
+
+	mutex *sync.Mutex
+	ids   map[string]int // Id of every registered art node, by public key
+	free  []int          // Ids given back, handed out again first
+}
+
+func NewArtNodeRegistry() *ArtNodeRegistry {
+	return &ArtNodeRegistry{
+		MaxArtNodes: MAX_ART_NODES,
+		mutex:       &sync.Mutex{},
+		ids:         make(map[string]int)}
+}
+
+// Our singleton art node registry
+var ArtNodes = NewArtNodeRegistry()
+
+// Registers the art node with pubKey and returns its id. An art node that is
+// registered already gets its id back.
+// Possible Errors:
+// - ArtNodeError
+func (r *ArtNodeRegistry) Register(pubKey string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if id, ok := r.ids[pubKey]; ok {
+		return id, nil
+	}
+
+	if len(r.ids) >= r.MaxArtNodes {
+		return 0, ArtNodeError{pubKey, ART_NODES_FULL}
+	}
+
+	id := len(r.ids)
+	if len(r.free) > 0 {
+		id = r.free[len(r.free)-1]
+		r.free = r.free[:len(r.free)-1]
+	}
+	r.ids[pubKey] = id
+	return id, nil
+}
+
+// Drops the art node with pubKey, freeing its id. Returns false if it wasn't
+// registered.
+func (r *ArtNodeRegistry) Release(pubKey string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id, ok := r.ids[pubKey]
+	if !ok {
+		return false
+	}
+	delete(r.ids, pubKey)
+	r.free = append(r.free, id)
+	return true
+}
+
+// Whether the art node with pubKey has a canvas open with us
+func (r *ArtNodeRegistry) Registered(pubKey string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.ids[pubKey]
+	return ok
+}
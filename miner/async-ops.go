@@ -0,0 +1,211 @@
+/*
+
+This file contains the async draw and delete calls. DrawAsync and DeleteAsync
+return as soon as the op is taken into the mempool and handed to the problem
+solver and our peers. The miner then waits for the op's
+validateNum blocks in the background, the same way Draw does, and keeps what
+it saw in AsyncOps. Art nodes long-poll WaitOp to follow the op's depth and
+get its result.
+
+*/
+
+package miner
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"../libminer"
+	"../protocol"
+)
+
+// Longest a WaitOp call is held before it answers with an unchanged state
+const ASYNC_POLL_INTERVAL = 30 * time.Second
+
+// How long the result of a finished async op is kept for WaitOp
+const ASYNC_OP_RETENTION = 10 * time.Minute
+
+// Async ops by opHash, and their lock
+var (
+	AsyncOps      = make(map[string]*asyncOp)
+	AsyncOpsMutex = &sync.Mutex{}
+)
+
+type asyncOp struct {
+	mutex   sync.Mutex
+	changed chan struct{} // Closed and replaced every time the state below changes
+	status  libminer.OpStatusResponse
+	err     error
+}
+
+func newAsyncOp() *asyncOp {
+	return &asyncOp{
+		changed: make(chan struct{}),
+		status:  libminer.OpStatusResponse{Depth: -1}}
+}
+
+// Returns the state of the op and a channel closed on its next change
+func (op *asyncOp) state() (libminer.OpStatusResponse, chan struct{}, error) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	return op.status, op.changed, op.err
+}
+
+func (op *asyncOp) update(fn func()) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	fn()
+	close(op.changed)
+	op.changed = make(chan struct{})
+}
+
+// Records the depth of the op from an OP_CONFIRMED or OP_EVICTED event
+func (op *asyncOp) progress(event ChainEvent) {
+	op.update(func() {
+		if event.Type == OP_CONFIRMED {
+			op.status.Depth = event.Depth
+		} else {
+			op.status.Depth = -1
+		}
+	})
+}
+
+func (op *asyncOp) finish(blockHash string, inkRemaining uint32, err error) {
+	op.update(func() {
+		op.status.Done = true
+		op.status.BlockHash = blockHash
+		op.status.InkRemaining = inkRemaining
+		op.err = err
+	})
+}
+
+// Publishes the op and waits for it in the background, recording its progress
+// in AsyncOps under its opHash
+func (lmi *LibMinerInterface) startAsyncOp(propOpArgs PropagateOpArgs, validateNum int, deadline int64,
+	validate func() error) error {
+	hash := opHash(propOpArgs.OpInfo)
+
+	sub := ChainEvents.WatchOp(hash, validateNum)
+	if err := lmi.publishOp(propOpArgs); err != nil {
+		ChainEvents.Unsubscribe(sub)
+		return err
+	}
+
+	op := newAsyncOp()
+	AsyncOpsMutex.Lock()
+	AsyncOps[hash] = op
+	AsyncOpsMutex.Unlock()
+
+	go func() {
+		blockHash, err := lmi.waitForOp(propOpArgs, sub, validateNum, deadline, validate, op.progress)
+		ChainEvents.Unsubscribe(sub)
+		op.finish(blockHash, uint32(CalculateInk(propOpArgs.OpInfo.PubKey)), err)
+
+		time.AfterFunc(ASYNC_OP_RETENTION, func() {
+			AsyncOpsMutex.Lock()
+			delete(AsyncOps, hash)
+			AsyncOpsMutex.Unlock()
+		})
+	}()
+
+	return nil
+}
+
+// Same as Draw, but returns once the op is valid and published, with
+// BlockHash unset. Use WaitOp with OpHash to follow it.
+func (lmi *LibMinerInterface) DrawAsync(req *libminer.Request, response *libminer.DrawResponse) (err error) {
+	if artNode, ok := ArtNodeKey(req); ok {
+		var drawReq libminer.DrawRequest
+		json.Unmarshal(req.Msg, &drawReq)
+
+		opInfo, err := newDrawOp(drawReq, artNode)
+		if err != nil {
+			return protocol.WrapError(err)
+		}
+		// The mempool validates the op before taking it in
+		err = lmi.startAsyncOp(PropagateOpArgs{OpInfo: opInfo}, int(drawReq.ValidateNum),
+			drawReq.Deadline, validateDrawOp(opInfo))
+		if err != nil {
+			return protocol.WrapError(err)
+		}
+
+		response.ShapeHash = opInfo.OpSig
+		response.OpHash = opHash(opInfo)
+		response.InkRemaining = uint32(CalculateInk(opInfo.PubKey))
+		return nil
+	}
+	err = fmt.Errorf("invalid user")
+	return err
+}
+
+// Same as Delete, but returns once the op is valid and published. The OpSig
+// of the delete op is returned in ShapeHash, and its OpHash for WaitOp.
+func (lmi *LibMinerInterface) DeleteAsync(req *libminer.Request, response *libminer.DrawResponse) (err error) {
+	if artNode, ok := ArtNodeKey(req); ok {
+		var deleteReq libminer.DeleteRequest
+		json.Unmarshal(req.Msg, &deleteReq)
+
+		opInfo, err := newDeleteOp(deleteReq, artNode)
+		if err != nil {
+			return protocol.WrapError(err)
+		}
+
+		err = lmi.startAsyncOp(PropagateOpArgs{OpInfo: opInfo}, int(deleteReq.ValidateNum),
+			deleteReq.Deadline, func() error { return nil })
+		if err != nil {
+			return protocol.WrapError(err)
+		}
+
+		response.ShapeHash = opInfo.OpSig
+		response.OpHash = opHash(opInfo)
+		response.InkRemaining = uint32(CalculateInk(opInfo.PubKey))
+		return nil
+	}
+	err = fmt.Errorf("invalid user")
+	return err
+}
+
+// Answers with the state of an async op once its depth differs from
+// KnownDepth, it is done, or ASYNC_POLL_INTERVAL passed. Once done, the error
+// of the op is returned, if any.
+// Possible Errors:
+// - InvalidShapeHashError
+// - Any error of Draw or Delete
+func (lmi *LibMinerInterface) WaitOp(req *libminer.Request, response *libminer.OpStatusResponse) (err error) {
+	if _, ok := ArtNodeKey(req); ok {
+		var statusReq libminer.OpStatusRequest
+		json.Unmarshal(req.Msg, &statusReq)
+
+		AsyncOpsMutex.Lock()
+		op, ok := AsyncOps[statusReq.OpHash]
+		AsyncOpsMutex.Unlock()
+		if !ok {
+			return protocol.WrapError(protocol.InvalidShapeHashError(statusReq.OpHash))
+		}
+
+		timeout := time.NewTimer(ASYNC_POLL_INTERVAL)
+		defer timeout.Stop()
+
+		for {
+			status, changed, opErr := op.state()
+			if status.Done && opErr != nil {
+				return protocol.WrapError(opErr)
+			}
+			if status.Done || status.Depth != statusReq.KnownDepth {
+				*response = status
+				return nil
+			}
+
+			select {
+			case <-changed:
+			case <-timeout.C:
+				*response = status
+				return nil
+			}
+		}
+	}
+	err = fmt.Errorf("invalid user")
+	return err
+}
@@ -0,0 +1,78 @@
+/*
+
+This file contains the signing of blocks. MinerPubKey is who the block's ink
+reward goes to, so the miner proves it is theirs by signing the block:
+Signature is the hex of the ASN.1 ECDSA signature with the key in MinerPubKey
+over the SHA-256 of EncodeBlockForSigning. The nonces aren't signed, so a
+block is signed once when its job starts. The signature is part of what the
+block hash covers.
+
+Every block but the genesis block must be signed, except legacy MD5 blocks
+(HashAlgorithm ""), which were mined before blocks were signed. A chain that
+moved off MD5 never goes back to it (see VerifyBlock), so unsigned blocks
+can't be mined onto it.
+
+*/
+
+package miner
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"../blockchain"
+)
+
+// Reasons a block signature is rejected for, on top of the op ones
+const (
+	REJECT_UNSIGNED = "missing signature"
+)
+
+type BlockSignatureError struct {
+	MinerPubKey string
+	Reason      string
+}
+
+func (e BlockSignatureError) Error() string {
+	return fmt.Sprintf("Rejected block signature, %s: %s", e.Reason, e.MinerPubKey)
+}
+
+// Signs the block with our key. Everything but the nonces must be set.
+func SignBlock(block *blockchain.Block) {
+	digest := sha256.Sum256(blockchain.EncodeBlockForSigning(*block))
+	sig, err := MinerInstance.PrivKey.Sign(rand.Reader, digest[:], nil)
+	if CheckError(err, "SignBlock") {
+		return
+	}
+	block.Signature = hex.EncodeToString(sig)
+}
+
+// Checks that the block was signed with the key in its MinerPubKey
+func VerifyBlockSignature(block blockchain.Block) error {
+	if block.Signature == "" {
+		if block.HashAlgorithm == blockchain.MD5 {
+			return nil
+		}
+		return BlockSignatureError{block.MinerPubKey, REJECT_UNSIGNED}
+	}
+
+	pubKey, err := parsePubKey(block.MinerPubKey)
+	if err != nil {
+		return BlockSignatureError{block.MinerPubKey, REJECT_BAD_PUBKEY}
+	}
+
+	sig, err := hex.DecodeString(block.Signature)
+	if err != nil {
+		return BlockSignatureError{block.MinerPubKey, REJECT_BAD_SIGNATURE}
+	}
+
+	digest := sha256.Sum256(blockchain.EncodeBlockForSigning(block))
+	if !ecdsa.VerifyASN1(pubKey, digest[:], sig) {
+		return BlockSignatureError{block.MinerPubKey, REJECT_FORGED}
+	}
+
+	return nil
+}
@@ -0,0 +1,369 @@
+/*
+
+This file contains the persistent block store for the miner:
+1. An append-only write-ahead log of every block the miner has inserted
+2. An index of block hash -> offset of the block in the log
+3. Functions to replay the log into the in-memory block chain on boot
+
+Every block is written to the log (and synced) before it is indexed, so a
+crash can at worst leave a record in the log that is missing from the index.
+Such records are recovered when the store is opened. A record that is cut
+short or fails its checksum marks the end of the log; anything after it is
+the remains of an interrupted write and is truncated away.
+
+Log record layout:
+  [4 byte payload length][4 byte crc32 of payload][payload: json block]
+
+Index record layout:
+  [4 byte hash length][hash][8 byte offset of the log record]
+
+*/
+
+package miner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"../blockchain"
+)
+
+const (
+	// Directory under which every miner keeps its block store
+	STORE_ROOT = "./output"
+	// Files that make up a block store
+	STORE_LOG_FILE     = "blocks.log"
+	STORE_INDEX_FILE   = "blocks.idx"
+	STORE_GENESIS_FILE = "genesis"
+	// Size of the header in front of every log record
+	STORE_RECORD_HEADER = 8
+	// Sanity limit on a single record so a corrupt length can't OOM us
+	STORE_MAX_RECORD = 64 << 20
+)
+
+// Our singleton block store. Nil if the store could not be opened, in which
+// case the miner runs purely in memory like it used to.
+var Store *BlockStore
+
+type BlockStore struct {
+	mutex   sync.Mutex
+	dir     string
+	log     *os.File
+	index   *os.File
+	logSize int64
+	// Offsets of the log records in the order they were written
+	order   []string
+	offsets map[string]int64
+}
+
+// Returns the block store directory for the miner with the given public key.
+// Keyed by the key so that several miners can run out of the same directory.
+func StoreDir(pubKey string) string {
+	suffix := pubKey
+	if len(suffix) > 16 {
+		suffix = suffix[len(suffix)-16:]
+	}
+	return filepath.Join(STORE_ROOT, "store-"+suffix)
+}
+
+// Opens (or creates) the block store in dir for the chain rooted at
+// genesisHash. If the store on disk belongs to a different genesis block it is
+// moved aside and a fresh store is started.
+func OpenBlockStore(dir string, genesisHash string) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	genesisPath := filepath.Join(dir, STORE_GENESIS_FILE)
+	storedGenesis, err := ioutil.ReadFile(genesisPath)
+	if err == nil && strings.TrimSpace(string(storedGenesis)) != genesisHash {
+		stale := fmt.Sprintf("%s.stale-%d", dir, time.Now().Unix())
+		fmt.Println("OpenBlockStore:: genesis block changed, moving old store to", stale)
+		if err := os.Rename(dir, stale); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		if err := ioutil.WriteFile(genesisPath, []byte(genesisHash+"\n"), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(dir, STORE_LOG_FILE), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile, err := os.OpenFile(filepath.Join(dir, STORE_INDEX_FILE), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+
+	s := &BlockStore{
+		dir:     dir,
+		log:     logFile,
+		index:   indexFile,
+		offsets: make(map[string]int64)}
+
+	if err := s.recover(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	fmt.Println("OpenBlockStore:: opened", dir, "with", len(s.order), "blocks")
+	return s, nil
+}
+
+// Loads the index, then scans the log past the last indexed record to pick up
+// blocks that were logged but not yet indexed when we went down.
+func (s *BlockStore) recover() error {
+	logInfo, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	s.logSize = logInfo.Size()
+
+	// 1. Read the index, dropping anything torn or pointing past the log
+	indexEnd := int64(0)
+	scanFrom := int64(0)
+	reader := bufio.NewReader(s.index)
+	for {
+		hash, offset, n, err := readIndexRecord(reader)
+		if err != nil {
+			break
+		}
+
+		recordLen, err := s.recordLenAt(offset)
+		if err != nil {
+			break
+		}
+
+		s.order = append(s.order, hash)
+		s.offsets[hash] = offset
+		indexEnd += n
+		scanFrom = offset + recordLen
+	}
+
+	if err := s.index.Truncate(indexEnd); err != nil {
+		return err
+	}
+	if _, err := s.index.Seek(indexEnd, io.SeekStart); err != nil {
+		return err
+	}
+
+	// 2. Recover log records that never made it into the index
+	for scanFrom < s.logSize {
+		block, recordLen, err := s.readRecordAt(scanFrom)
+		if err != nil {
+			fmt.Println("BlockStore:: truncating torn log tail at offset", scanFrom)
+			break
+		}
+
+		hash := GetBlockHash(block)
+		if err := s.appendIndex(hash, scanFrom); err != nil {
+			return err
+		}
+		scanFrom += recordLen
+	}
+
+	if scanFrom < s.logSize {
+		if err := s.log.Truncate(scanFrom); err != nil {
+			return err
+		}
+		s.logSize = scanFrom
+	}
+
+	return s.index.Sync()
+}
+
+// Appends the block to the log and the index. Blocks that are already stored
+// are ignored, so it is safe to call this when replaying the store.
+func (s *BlockStore) Append(block blockchain.Block) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash := GetBlockHash(block)
+	if _, exists := s.offsets[hash]; exists {
+		return nil
+	}
+
+	payload, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, STORE_RECORD_HEADER+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[STORE_RECORD_HEADER:], payload)
+
+	offset := s.logSize
+	if _, err := s.log.WriteAt(record, offset); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.logSize += int64(len(record))
+
+	if err := s.appendIndex(hash, offset); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+// Returns true if a block with this hash has been persisted
+func (s *BlockStore) Has(hash string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, exists := s.offsets[hash]
+	return exists
+}
+
+// Reads a single block from the store by its hash
+func (s *BlockStore) Get(hash string) (block blockchain.Block, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	offset, exists := s.offsets[hash]
+	if !exists {
+		return block, fmt.Errorf("BlockStore: no block with hash [%s]", hash)
+	}
+
+	block, _, err = s.readRecordAt(offset)
+	return block, err
+}
+
+// Returns every stored block in the order they were inserted
+func (s *BlockStore) Blocks() ([]blockchain.Block, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	blocks := make([]blockchain.Block, 0, len(s.order))
+	for _, hash := range s.order {
+		block, _, err := s.readRecordAt(s.offsets[hash])
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (s *BlockStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	indexErr := s.index.Close()
+	if err := s.log.Close(); err != nil {
+		return err
+	}
+	return indexErr
+}
+
+func (s *BlockStore) appendIndex(hash string, offset int64) error {
+	record := make([]byte, 4+len(hash)+8)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(hash)))
+	copy(record[4:], hash)
+	binary.BigEndian.PutUint64(record[4+len(hash):], uint64(offset))
+
+	if _, err := s.index.Write(record); err != nil {
+		return err
+	}
+
+	s.order = append(s.order, hash)
+	s.offsets[hash] = offset
+	return nil
+}
+
+// Returns the full length of the log record at offset if it is intact
+func (s *BlockStore) recordLenAt(offset int64) (int64, error) {
+	_, recordLen, err := s.readRecordAt(offset)
+	return recordLen, err
+}
+
+func (s *BlockStore) readRecordAt(offset int64) (block blockchain.Block, recordLen int64, err error) {
+	header := make([]byte, STORE_RECORD_HEADER)
+	if offset+STORE_RECORD_HEADER > s.logSize {
+		return block, 0, io.ErrUnexpectedEOF
+	}
+	if _, err = s.log.ReadAt(header, offset); err != nil {
+		return block, 0, err
+	}
+
+	payloadLen := int64(binary.BigEndian.Uint32(header[0:4]))
+	if payloadLen > STORE_MAX_RECORD || offset+STORE_RECORD_HEADER+payloadLen > s.logSize {
+		return block, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err = s.log.ReadAt(payload, offset+STORE_RECORD_HEADER); err != nil {
+		return block, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return block, 0, errors.New("BlockStore: checksum mismatch")
+	}
+
+	err = json.Unmarshal(payload, &block)
+	return block, STORE_RECORD_HEADER + payloadLen, err
+}
+
+func readIndexRecord(r *bufio.Reader) (hash string, offset int64, n int64, err error) {
+	lenBytes := make([]byte, 4)
+	if _, err = io.ReadFull(r, lenBytes); err != nil {
+		return "", 0, 0, err
+	}
+
+	hashLen := binary.BigEndian.Uint32(lenBytes)
+	if hashLen > 1024 {
+		return "", 0, 0, errors.New("BlockStore: corrupt index record")
+	}
+
+	rest := make([]byte, int(hashLen)+8)
+	if _, err = io.ReadFull(r, rest); err != nil {
+		return "", 0, 0, err
+	}
+
+	hash = string(rest[:hashLen])
+	offset = int64(binary.BigEndian.Uint64(rest[hashLen:]))
+	return hash, offset, int64(4 + len(rest)), nil
+}
+
+// Replays every stored block into BlockNodeArray, BlockHashMap and PathMap.
+// Blocks stored ahead of their parent wait in the orphan pool until it is
+// replayed. Must be called after the genesis block is set up and before any
+// peers are dialed.
+func LoadBlockStore() {
+	if Store == nil {
+		return
+	}
+
+	blocks, err := Store.Blocks()
+	if CheckError(err, "LoadBlockStore:Blocks") {
+		fmt.Println("LoadBlockStore:: only", len(blocks), "blocks could be read")
+	}
+
+	for _, block := range blocks {
+		InsertBlock(block)
+	}
+
+	_, length := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+	fmt.Println("LoadBlockStore:: restored", len(blocks), "blocks, longest path:", length)
+}
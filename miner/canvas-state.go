@@ -0,0 +1,299 @@
+/*
+
+This file contains the canvas state: the shapes, ink and pixel ownership that
+result from applying the operations of a path of blocks, in order. Ink is
+earned by mining blocks, spent on shapes and moved between pubkeys by
+transfers.
+
+Rather than replaying the whole path on every validation, a single state is
+kept and moved between paths. Applying (connecting) a block records how to
+undo it, so on a reorg the state disconnects blocks back to the fork point and
+connects the blocks of the new path. Usually the new path only extends the old
+one by a block, so keeping up with the longest path costs one block's worth of
+work.
+
+Canvas follows the longest path; it is synced on every InsertBlock. Anyone
+using it must hold CanvasMutex and Seek it to the path they want to look at.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"sync"
+
+	"../blockchain"
+	"../shapelib"
+)
+
+// State of the canvas at the end of the longest path, and its lock
+var (
+	Canvas      *CanvasState
+	CanvasMutex *sync.Mutex
+)
+
+// A shape currently on the canvas
+type LiveShape struct {
+	OpInfo  blockchain.OperationInfo // The ADD operation of the shape
+	Cost    int                      // Ink spent on the shape
+	subarr  shapelib.PixelSubArray
+	painted bool // False if it overlaps a shape of another owner and couldn't take its pixels
+}
+
+type CanvasState struct {
+	hashes   []string              // Hashes of the connected blocks, genesis first
+	undo     [][]canvasUndo        // How to disconnect each connected block
+	shapes   map[string]*LiveShape // Shapes on the canvas by OpSig
+	ink      map[string]int        // Ink remaining by pubkey
+	opBlocks map[string]string     // Hash of the block holding every op on the path, by OpSig
+	opHashes map[string]bool       // Every op on the path or pending, by opHash
+	ownerIds map[string]uint32     // Ids of pubkeys in the owner array
+	owners   shapelib.OwnerArray
+}
+
+// Everything an op or block reward changed
+type canvasUndo struct {
+	opSig    string     // The op indexed in opBlocks, if any
+	opHash   string     // The op indexed in opHashes, if any
+	pubKey   string     // Whose ink changed
+	ink      int        // How much ink was added
+	receiver string     // Who got the ink taken from pubKey by a transfer, if anyone
+	added    *LiveShape // Shape put on the canvas
+	removed  *LiveShape // Shape taken off the canvas
+}
+
+// Returns the state of an empty canvas
+func NewCanvasState() *CanvasState {
+	return &CanvasState{
+		shapes:   make(map[string]*LiveShape),
+		ink:      make(map[string]int),
+		opBlocks: make(map[string]string),
+		opHashes: make(map[string]bool),
+		ownerIds: make(map[string]uint32),
+		owners: shapelib.NewOwnerArray(int(MinerInstance.Settings.CanvasSettings.CanvasXMax),
+			int(MinerInstance.Settings.CanvasSettings.CanvasYMax))}
+}
+
+// Moves the canvas state to path, the longest path
+func SyncCanvas(path []blockchain.Block) {
+	if Canvas == nil {
+		return
+	}
+
+	CanvasMutex.Lock()
+	Canvas.Seek(path)
+	CanvasMutex.Unlock()
+}
+
+// Returns a canvas state at the end of path. Paths from the genesis block use
+// Canvas, so CanvasMutex must be held. Paths of blocks whose ancestors haven't
+// arrived get a state of their own.
+func canvasAt(path []blockchain.Block) *CanvasState {
+	if Canvas == nil || !isRooted(path) {
+		canvas := NewCanvasState()
+		canvas.Seek(path)
+		return canvas
+	}
+
+	Canvas.Seek(path)
+	return Canvas
+}
+
+// Moves the state to the end of path, disconnecting the blocks that aren't on
+// it and connecting the ones that are missing.
+func (c *CanvasState) Seek(path []blockchain.Block) {
+	// Find how many blocks the two paths share
+	common := len(c.hashes)
+	if len(path) < common {
+		common = len(path)
+	}
+	for common > 0 && GetBlockHash(path[common-1]) != c.hashes[common-1] {
+		common--
+	}
+
+	for len(c.hashes) > common {
+		c.disconnect()
+	}
+
+	for _, block := range path[common:] {
+		c.connect(block)
+	}
+}
+
+// Returns the hash of the block at the end of the state's path
+func (c *CanvasState) Tip() string {
+	if len(c.hashes) == 0 {
+		return ""
+	}
+	return c.hashes[len(c.hashes)-1]
+}
+
+// Returns the ink remaining of pubKey
+func (c *CanvasState) Ink(pubKey string) int {
+	return c.ink[pubKey]
+}
+
+// Returns the shape added by the op with opSig if it is still on the canvas
+func (c *CanvasState) Shape(opSig string) (*LiveShape, bool) {
+	shape, ok := c.shapes[opSig]
+	return shape, ok
+}
+
+// Returns the hash of the block holding the op with opSig, or "" if it isn't
+// on the path or is still pending
+func (c *CanvasState) OpBlock(opSig string) string {
+	return c.opBlocks[opSig]
+}
+
+// Returns true if the op, under any signature, is on the path or pending
+func (c *CanvasState) HasOp(opInfo blockchain.OperationInfo) bool {
+	return c.opHashes[opHash(opInfo)]
+}
+
+// Returns true if a shape of pubKey can take the pixels of subarr
+func (c *CanvasState) CanPaint(subarr shapelib.PixelSubArray, pubKey string) bool {
+	return !c.owners.HasConflict(subarr, c.ownerId(pubKey))
+}
+
+// Applies an op that isn't in a block yet. Returns how to undo it.
+func (c *CanvasState) applyPending(opInfo blockchain.OperationInfo) canvasUndo {
+	return c.applyOp(opInfo, "")
+}
+
+func (c *CanvasState) connect(block blockchain.Block) {
+	blockHash := GetBlockHash(block)
+	undo := make([]canvasUndo, 0, len(block.OpHistory)+1)
+
+	// The genesis block rewards no one. VerifyBlock made sure the reward's
+	// MinerPubKey signed the block.
+	if block.PrevHash != "" {
+		reward := MinerInstance.Settings.InkPerNoOpBlock
+		if len(block.OpHistory) > 0 {
+			reward = MinerInstance.Settings.InkPerOpBlock
+		}
+
+		c.ink[block.MinerPubKey] += int(reward)
+		undo = append(undo, canvasUndo{pubKey: block.MinerPubKey, ink: int(reward)})
+	}
+
+	for _, opInfo := range block.OpHistory {
+		undo = append(undo, c.applyOp(opInfo, blockHash))
+	}
+
+	c.hashes = append(c.hashes, blockHash)
+	c.undo = append(c.undo, undo)
+}
+
+func (c *CanvasState) disconnect() {
+	last := len(c.hashes) - 1
+	undo := c.undo[last]
+
+	for i := len(undo) - 1; i >= 0; i-- {
+		c.undoOp(undo[i])
+	}
+
+	c.hashes = c.hashes[:last]
+	c.undo = c.undo[:last]
+}
+
+// Applies an op of the block with blockHash. Ops that made it into a block are
+// applied even if they wouldn't validate, the same way they were counted when
+// the state was rebuilt from the path on every call.
+func (c *CanvasState) applyOp(opInfo blockchain.OperationInfo, blockHash string) canvasUndo {
+	undo := canvasUndo{pubKey: opInfo.PubKey}
+
+	if _, indexed := c.opBlocks[opInfo.OpSig]; !indexed {
+		c.opBlocks[opInfo.OpSig] = blockHash
+		undo.opSig = opInfo.OpSig
+	}
+
+	if hash := opHash(opInfo); !c.opHashes[hash] {
+		c.opHashes[hash] = true
+		undo.opHash = hash
+	}
+
+	if opInfo.Op.OpType == blockchain.TRANSFER {
+		undo.ink = -int(opInfo.Op.Amount)
+		undo.receiver = opInfo.Op.To
+		c.ink[opInfo.PubKey] += undo.ink
+		c.ink[undo.receiver] -= undo.ink
+		return undo
+	}
+
+	shape, err := MinerInstance.getShapeFromOp(opInfo.Op)
+	if err != nil {
+		fmt.Println("CRITICAL ERROR: BAD SHAPE IN BLOCKCHAIN")
+		return undo
+	}
+
+	subarr, cost := shape.SubArrayAndCost()
+
+	if opInfo.Op.OpType == blockchain.ADD {
+		undo.ink = -cost
+		if _, live := c.shapes[opInfo.OpSig]; !live {
+			added := &LiveShape{OpInfo: opInfo, Cost: cost, subarr: subarr}
+			c.addShape(added)
+			undo.added = added
+		}
+	} else {
+		undo.ink = cost
+		if removed, live := c.shapes[opInfo.AddSig]; live && removed.OpInfo.PubKey == opInfo.PubKey {
+			c.removeShape(removed)
+			undo.removed = removed
+		}
+	}
+
+	c.ink[opInfo.PubKey] += undo.ink
+	return undo
+}
+
+func (c *CanvasState) undoOp(undo canvasUndo) {
+	c.ink[undo.pubKey] -= undo.ink
+	if undo.receiver != "" {
+		c.ink[undo.receiver] += undo.ink
+	}
+
+	if undo.added != nil {
+		c.removeShape(undo.added)
+	}
+
+	if undo.removed != nil {
+		c.addShape(undo.removed)
+	}
+
+	if undo.opSig != "" {
+		delete(c.opBlocks, undo.opSig)
+	}
+
+	if undo.opHash != "" {
+		delete(c.opHashes, undo.opHash)
+	}
+}
+
+func (c *CanvasState) addShape(shape *LiveShape) {
+	owner := c.ownerId(shape.OpInfo.PubKey)
+	shape.painted = !c.owners.HasConflict(shape.subarr, owner)
+	if shape.painted {
+		c.owners.Add(shape.subarr, owner)
+	}
+
+	c.shapes[shape.OpInfo.OpSig] = shape
+}
+
+func (c *CanvasState) removeShape(shape *LiveShape) {
+	if shape.painted {
+		c.owners.Remove(shape.subarr)
+	}
+
+	delete(c.shapes, shape.OpInfo.OpSig)
+}
+
+func (c *CanvasState) ownerId(pubKey string) uint32 {
+	id, ok := c.ownerIds[pubKey]
+	if !ok {
+		id = uint32(len(c.ownerIds) + 1)
+		c.ownerIds[pubKey] = id
+	}
+	return id
+}
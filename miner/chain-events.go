@@ -0,0 +1,200 @@
+/*
+
+This file contains the chain event bus. Every time InsertBlock moves the
+longest path, the bus compares it to the path it saw last and tells its
+subscribers what changed:
+1. BLOCK_CONNECTED / BLOCK_DISCONNECTED for every block that joined or left
+   the longest path, disconnects first
+2. OP_EVICTED for ops whose block left the longest path and that aren't on
+   the new one
+3. OP_CONFIRMED for watched ops every time the number of blocks on top of
+   their block grows, until it reaches the depth being watched for
+
+Ops are told apart by their opHash, so an op is confirmed whichever signature
+the copy in the block carries.
+
+Events are delivered on a buffered channel per subscriber. A subscriber that
+falls too far behind loses events rather than holding up InsertBlock, but
+not its op's confirmation: an OP_CONFIRMED that was dropped is sent again on
+the next update.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"sync"
+
+	"../blockchain"
+)
+
+type ChainEventType int
+
+const (
+	BLOCK_CONNECTED ChainEventType = iota
+	BLOCK_DISCONNECTED
+	OP_CONFIRMED
+	OP_EVICTED
+)
+
+// Number of events a subscriber can fall behind by
+const CHAIN_EVENT_BUFFER = 256
+
+type ChainEvent struct {
+	Type      ChainEventType
+	BlockHash string // The block connected or disconnected, or the block holding the op
+	Height    int    // Height of BlockHash, the genesis block being 0
+	OpHash    string // Set for op events
+	Depth     int    // For OP_CONFIRMED, the number of blocks on top of the op's block
+}
+
+type ChainSubscription struct {
+	Events    chan ChainEvent
+	opHash    string // Only op events for the op with this opHash are delivered; "" for all events
+	depth     int    // Depth OP_CONFIRMED is sent up to
+	lastDepth int    // Depth last sent in OP_CONFIRMED, -1 if the op isn't on the path
+}
+
+type ChainEventBus struct {
+	mutex     sync.Mutex
+	hashes    []string   // Hashes of the blocks on the longest path, genesis first
+	opHashes  [][]string // opHashes of the ops in each of those blocks
+	opHeights map[string]int
+	subs      map[*ChainSubscription]bool
+}
+
+var ChainEvents = NewChainEventBus()
+
+func NewChainEventBus() *ChainEventBus {
+	return &ChainEventBus{
+		opHeights: make(map[string]int),
+		subs:      make(map[*ChainSubscription]bool)}
+}
+
+// Returns a subscription to every event
+func (b *ChainEventBus) Subscribe() *ChainSubscription {
+	return b.subscribe(&ChainSubscription{opHash: "", lastDepth: -1})
+}
+
+// Returns a subscription to the block events and the events of the op with
+// hash, its opHash. OP_CONFIRMED is sent until the op is depth blocks deep. If the op
+// is already on the longest path, its current depth is sent right away.
+func (b *ChainEventBus) WatchOp(hash string, depth int) *ChainSubscription {
+	return b.subscribe(&ChainSubscription{opHash: hash, depth: depth, lastDepth: -1})
+}
+
+func (b *ChainEventBus) subscribe(sub *ChainSubscription) *ChainSubscription {
+	sub.Events = make(chan ChainEvent, CHAIN_EVENT_BUFFER)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subs[sub] = true
+	b.confirm(sub)
+	return sub
+}
+
+func (b *ChainEventBus) Unsubscribe(sub *ChainSubscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subs, sub)
+}
+
+// Moves the bus onto path, the new longest path, and publishes the changes
+func (b *ChainEventBus) Update(path []blockchain.Block) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Find how many blocks the two paths share
+	common := len(b.hashes)
+	if len(path) < common {
+		common = len(path)
+	}
+	for common > 0 && GetBlockHash(path[common-1]) != b.hashes[common-1] {
+		common--
+	}
+
+	// Events for the ops that left the path, by opHash
+	evicted := make(map[string]ChainEvent)
+
+	for height := len(b.hashes) - 1; height >= common; height-- {
+		for _, hash := range b.opHashes[height] {
+			if b.opHeights[hash] == height {
+				delete(b.opHeights, hash)
+				evicted[hash] = ChainEvent{Type: OP_EVICTED, BlockHash: b.hashes[height], Height: height, OpHash: hash}
+			}
+		}
+
+		b.publish(ChainEvent{Type: BLOCK_DISCONNECTED, BlockHash: b.hashes[height], Height: height})
+	}
+	b.hashes = b.hashes[:common]
+	b.opHashes = b.opHashes[:common]
+
+	for _, block := range path[common:] {
+		height := len(b.hashes)
+		hash := GetBlockHash(block)
+
+		opHashes := make([]string, len(block.OpHistory))
+		for i, opInfo := range block.OpHistory {
+			opHashes[i] = opHash(opInfo)
+			if _, onPath := b.opHeights[opHashes[i]]; !onPath {
+				b.opHeights[opHashes[i]] = height
+			}
+			delete(evicted, opHashes[i])
+		}
+
+		b.hashes = append(b.hashes, hash)
+		b.opHashes = append(b.opHashes, opHashes)
+		b.publish(ChainEvent{Type: BLOCK_CONNECTED, BlockHash: hash, Height: height})
+	}
+
+	for _, event := range evicted {
+		b.publish(event)
+	}
+
+	for sub := range b.subs {
+		if sub.opHash == "" {
+			continue
+		}
+
+		if _, wasEvicted := evicted[sub.opHash]; wasEvicted {
+			sub.lastDepth = -1
+		}
+		b.confirm(sub)
+	}
+}
+
+// Sends OP_CONFIRMED to an op subscription if its op got deeper
+func (b *ChainEventBus) confirm(sub *ChainSubscription) {
+	height, onPath := b.opHeights[sub.opHash]
+	if sub.opHash == "" || !onPath || sub.lastDepth >= sub.depth {
+		return
+	}
+
+	// The depth only counts as sent once it is in the channel, so a dropped
+	// confirmation is sent again on the next update
+	depth := len(b.hashes) - 1 - height
+	if depth > sub.lastDepth && b.send(sub, ChainEvent{Type: OP_CONFIRMED, BlockHash: b.hashes[height],
+		Height: height, OpHash: sub.opHash, Depth: depth}) {
+		sub.lastDepth = depth
+	}
+}
+
+func (b *ChainEventBus) publish(event ChainEvent) {
+	for sub := range b.subs {
+		if event.OpHash == "" || sub.opHash == "" || sub.opHash == event.OpHash {
+			b.send(sub, event)
+		}
+	}
+}
+
+// Returns false if the subscriber is too far behind to take the event
+func (b *ChainEventBus) send(sub *ChainSubscription, event ChainEvent) bool {
+	select {
+	case sub.Events <- event:
+		return true
+	default:
+		fmt.Println("ChainEventBus:: subscriber is behind, dropping event", event.Type, event.BlockHash)
+		return false
+	}
+}
@@ -0,0 +1,311 @@
+/*
+
+This file contains how miners catch up with their peers. Rather than ship
+whole chains, a peer is synced with in three steps:
+
+  1. Tips: Connect and GetTip tell the hash and height of the tip of the
+     peer's longest path. If it is on a path of ours already, we're done.
+  2. Headers: GetHeaders takes a block locator, hashes of our longest path
+     from the tip back to the genesis block, one by one at first and then
+     exponentially sparser. The peer finds the first of them on its longest
+     path, our common ancestor, and sends the headers of the blocks that
+     follow it, MAX_HEADERS at a time.
+  3. Bodies: of each batch of headers, only the blocks we don't have are
+     fetched with GetBlocks, MAX_BLOCKS_PER_REQUEST at a time, and validated
+     like the blocks peers send us, before the next batch is asked for.
+
+A peer that sends more headers than the height of its tip is asked for its
+tip again, since it may have mined a block in the meantime.
+
+Peers offer their longest path only, so orphans and stale forks stay where
+they are.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"net/rpc"
+
+	"../blockchain"
+)
+
+const (
+	// Headers sent for one GetHeaders
+	MAX_HEADERS = 500
+	// Blocks asked for in one GetBlocks
+	MAX_BLOCKS_PER_REQUEST = 16
+	// Hashes at the start of a block locator before it starts skipping
+	LOCATOR_DENSE = 10
+)
+
+// Reasons a sync with a peer is given up for
+const (
+	SYNC_BAD_HEADERS    = "headers don't follow each other"
+	SYNC_TOO_MANY       = "more than the tip's height of headers"
+	SYNC_WRONG_BLOCK    = "block doesn't match its header"
+	SYNC_MISSING_BLOCKS = "peer doesn't have the blocks of its headers"
+	SYNC_INVALID_BLOCK  = "invalid block"
+	SYNC_BATCH_TOO_BIG  = "too many blocks asked for"
+)
+
+type ChainSyncError struct {
+	Addr   string
+	Reason string
+}
+
+func (e ChainSyncError) Error() string {
+	return fmt.Sprintf("Sync with %s failed: %s", e.Addr, e.Reason)
+}
+
+// The tip of a longest path. Height is the number of blocks after the
+// genesis block.
+type ChainTip struct {
+	Hash   string
+	Height int
+}
+
+// A block without its ops
+type BlockHeader struct {
+	Hash        string
+	PrevHash    string
+	MinerPubKey string
+	Timestamp   int64
+	Difficulty  uint8
+	NumOps      int
+}
+
+type GetHeadersArgs struct {
+	Locator []string
+}
+
+type GetBlocksArgs struct {
+	Hashes []string
+}
+
+func NewBlockHeader(block blockchain.Block, hash string) BlockHeader {
+	return BlockHeader{hash, block.PrevHash, block.MinerPubKey, block.Timestamp, block.Difficulty,
+		len(block.OpHistory)}
+}
+
+// Returns the hashes of the blocks on path, which starts at the genesis block
+func pathHashes(path []blockchain.Block) []string {
+	hashes := make([]string, len(path))
+	for i, block := range path {
+		if i == 0 {
+			hashes[i] = MinerInstance.Settings.GenesisBlockHash
+		} else {
+			hashes[i] = GetBlockHash(block)
+		}
+	}
+	return hashes
+}
+
+// Returns the tip of our longest path
+func LocalTip() ChainTip {
+	longest, length := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+	hashes := pathHashes(longest)
+	return ChainTip{hashes[length-1], length - 1}
+}
+
+// Returns the block locator of our longest path: the hashes of its last
+// LOCATOR_DENSE blocks, then of every 2nd, 4th, 8th... block before them,
+// and last the genesis block
+func BlockLocator() []string {
+	longest, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+	hashes := pathHashes(longest)
+
+	locator := make([]string, 0, LOCATOR_DENSE+32)
+	step := 1
+	for i := len(hashes) - 1; i > 0; i -= step {
+		locator = append(locator, hashes[i])
+		if len(locator) >= LOCATOR_DENSE {
+			step *= 2
+		}
+	}
+	return append(locator, hashes[0])
+}
+
+// Whether the block with hash is on a path of ours from the genesis block
+func haveTip(hash string) bool {
+	pathInfo, ok := ReadPathMap(hash)
+	return ok && isRooted(pathInfo.Path)
+}
+
+// Returns the tip of our longest path
+func (p *PeerRpc) GetTip(args Empty, reply *ChainTip) error {
+	if _, err := p.peer(); err != nil {
+		return err
+	}
+
+	*reply = LocalTip()
+	return nil
+}
+
+// Returns the headers of up to MAX_HEADERS blocks of our longest path, from
+// after the first hash of the locator that is on it. Hashes that aren't on it
+// are skipped; if none are, the headers start after the genesis block.
+func (p *PeerRpc) GetHeaders(args GetHeadersArgs, reply *[]BlockHeader) error {
+	if _, err := p.peer(); err != nil {
+		return err
+	}
+
+	longest, length := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+	hashes := pathHashes(longest)
+	positions := make(map[string]int, length)
+	for i, hash := range hashes {
+		positions[hash] = i
+	}
+
+	start := 0
+	for _, hash := range args.Locator {
+		if i, ok := positions[hash]; ok {
+			start = i
+			break
+		}
+	}
+
+	end := start + 1 + MAX_HEADERS
+	if end > length {
+		end = length
+	}
+	headers := make([]BlockHeader, 0, end-start-1)
+	for i := start + 1; i < end; i++ {
+		headers = append(headers, NewBlockHeader(longest[i], hashes[i]))
+	}
+	*reply = headers
+	return nil
+}
+
+// Returns the blocks with the hashes asked for, in order, up to the first
+// one we don't have
+func (p *PeerRpc) GetBlocks(args GetBlocksArgs, reply *[]blockchain.Block) error {
+	if _, err := p.peer(); err != nil {
+		return err
+	}
+	if len(args.Hashes) > MAX_BLOCKS_PER_REQUEST {
+		p.misbehaved(SCORE_BAD_SYNC, SYNC_BATCH_TOO_BIG)
+		return ChainSyncError{p.auth.remote, SYNC_BATCH_TOO_BIG}
+	}
+
+	blocks := make([]blockchain.Block, 0, len(args.Hashes))
+	for _, hash := range args.Hashes {
+		index, ok := ReadBlockChainMap(hash)
+		if !ok || index == 0 {
+			break
+		}
+		blocks = append(blocks, BlockNodeArray[index].Block)
+	}
+	*reply = blocks
+	return nil
+}
+
+// Catches up with the peer at addr over client, whose tip is tip. Returns
+// the number of blocks fetched.
+func SyncWithPeer(client *rpc.Client, addr string, tip ChainTip) (int, error) {
+	if haveTip(tip.Hash) {
+		return 0, nil
+	}
+
+	locator := BlockLocator()
+	prevHash := ""
+	numHeaders := 0
+	fetched := 0
+	for {
+		// Headers of the next blocks after our common ancestor with the peer
+		var headers []BlockHeader
+		if err := client.Call("Peer.GetHeaders", GetHeadersArgs{locator}, &headers); err != nil {
+			return fetched, err
+		}
+		if len(headers) == 0 {
+			break
+		}
+
+		// The peer may have moved on since it told us its tip
+		numHeaders += len(headers)
+		if numHeaders > tip.Height {
+			if err := client.Call("Peer.GetTip", new(Empty), &tip); err != nil {
+				return fetched, err
+			}
+			if numHeaders > tip.Height {
+				return fetched, ChainSyncError{addr, SYNC_TOO_MANY}
+			}
+		}
+
+		var missing []string
+		for _, header := range headers {
+			// The first header follows a block of ours, the rest follow
+			// each other
+			if prevHash == "" {
+				if _, ok := ReadBlockChainMap(header.PrevHash); !ok {
+					return fetched, ChainSyncError{addr, SYNC_BAD_HEADERS}
+				}
+			} else if header.PrevHash != prevHash {
+				return fetched, ChainSyncError{addr, SYNC_BAD_HEADERS}
+			}
+			prevHash = header.Hash
+
+			if _, ok := ReadBlockChainMap(header.Hash); !ok {
+				missing = append(missing, header.Hash)
+			}
+		}
+
+		// Headers prove nothing, so their blocks are fetched and validated
+		// before we ask for more of them
+		n, err := fetchBlocks(client, addr, missing)
+		fetched += n
+		if err != nil {
+			return fetched, err
+		}
+
+		if prevHash == tip.Hash || len(headers) < MAX_HEADERS {
+			break
+		}
+		locator = []string{prevHash}
+	}
+
+	return fetched, nil
+}
+
+// Fetches the blocks with hashes from the peer at addr over client, and
+// validates and inserts them in order. Returns the number of blocks fetched.
+func fetchBlocks(client *rpc.Client, addr string, hashes []string) (int, error) {
+	fetched := 0
+	for start := 0; start < len(hashes); start += MAX_BLOCKS_PER_REQUEST {
+		end := start + MAX_BLOCKS_PER_REQUEST
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		var blocks []blockchain.Block
+		if err := client.Call("Peer.GetBlocks", GetBlocksArgs{hashes[start:end]}, &blocks); err != nil {
+			return fetched, err
+		}
+
+		for i, block := range blocks {
+			if i >= end-start || GetBlockHash(block) != hashes[start+i] {
+				return fetched, ChainSyncError{addr, SYNC_WRONG_BLOCK}
+			}
+			fetched++
+			if _, ok := ReadBlockChainMap(hashes[start+i]); ok {
+				// Heard of it by gossip in the meantime
+				continue
+			}
+			validateLock.Lock()
+			ok := MinerInstance.ValidateBlock(block, GetPath(block.PrevHash))
+			validateLock.Unlock()
+			if !ok {
+				return fetched, ChainSyncError{addr, SYNC_INVALID_BLOCK}
+			}
+			if err := InsertBlock(block); err != nil {
+				return fetched, ChainSyncError{addr, SYNC_INVALID_BLOCK}
+			}
+		}
+		if len(blocks) < end-start {
+			return fetched, ChainSyncError{addr, SYNC_MISSING_BLOCKS}
+		}
+	}
+
+	return fetched, nil
+}
@@ -0,0 +1,161 @@
+/*
+
+This file contains the consensus rules for block difficulty and timestamps:
+1. The difficulty a new block must be mined at, retargeted from the block
+   times on its path (see pow.NextAdjustment)
+2. The checks VerifyBlock applies to a block's recorded difficulty and
+   timestamp
+3. The work a block represents, which fork choice adds up along a path
+
+Legacy MD5 blocks predate both fields. They are mined at the configured
+difficulty and must leave the fields empty.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"../blockchain"
+	"../pow"
+)
+
+// How far in the future (ms) a block's timestamp may be compared to our clock
+const MAX_CLOCK_DRIFT = 2 * 60 * 1000
+
+// Returns the difficulty configured by the server for this kind of block
+func BaseDifficulty(isOpBlock bool) uint8 {
+	if isOpBlock {
+		return MinerInstance.Settings.PoWDifficultyOpBlock
+	}
+	return MinerInstance.Settings.PoWDifficultyNoOpBlock
+}
+
+// Returns the adjustment a block was mined at relative to the configured
+// difficulty. Legacy blocks and the genesis block have none.
+func blockAdjustment(block blockchain.Block) int {
+	if block.HashAlgorithm == blockchain.MD5 || block.PrevHash == "" {
+		return 0
+	}
+	return int(block.Difficulty) - int(BaseDifficulty(len(block.OpHistory) > 0))
+}
+
+// Returns true if the path starts at the genesis block, i.e. it is not the
+// path of a block whose ancestors have yet to arrive
+func isRooted(path []blockchain.Block) bool {
+	return len(path) > 0 && path[0].PrevHash == ""
+}
+
+// Returns the difficulty the block following parentPath must be mined at
+func ExpectedDifficulty(parentPath []blockchain.Block, isOpBlock bool) uint8 {
+	parentAdjustment := 0
+	if len(parentPath) > 0 {
+		parentAdjustment = blockAdjustment(parentPath[len(parentPath)-1])
+	}
+
+	adjustment := pow.NextAdjustment(len(parentPath), parentAdjustment, blockTimestamps(parentPath),
+		int64(MinerInstance.Settings.BlockInterval))
+
+	difficulty := int(BaseDifficulty(isOpBlock)) + adjustment
+	if difficulty < 0 {
+		return 0
+	}
+	return uint8(difficulty)
+}
+
+// Fills in the timestamp and difficulty of a block we are about to mine
+func SetBlockDifficulty(block *blockchain.Block) {
+	if block.HashAlgorithm == blockchain.MD5 {
+		return
+	}
+
+	parentPath := GetPath(block.PrevHash)
+	block.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	if median := pow.MedianTime(blockTimestamps(parentPath)); block.Timestamp <= median {
+		block.Timestamp = median + 1
+	}
+	block.Difficulty = ExpectedDifficulty(parentPath, len(block.OpHistory) > 0)
+}
+
+// Returns the difficulty the block's proof of work must satisfy, and false if
+// its recorded difficulty or timestamp break the rules.
+func CheckDifficulty(block blockchain.Block) (uint8, bool) {
+	isOpBlock := len(block.OpHistory) > 0
+
+	if block.HashAlgorithm == blockchain.MD5 {
+		if block.Timestamp != 0 || block.Difficulty != 0 {
+			fmt.Println("CheckDifficulty:: legacy block carries a timestamp or difficulty")
+			return 0, false
+		}
+		return BaseDifficulty(isOpBlock), true
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if block.Timestamp > now+MAX_CLOCK_DRIFT {
+		fmt.Println("CheckDifficulty:: block timestamp too far in the future:", block.Timestamp)
+		return 0, false
+	}
+
+	parentPath := GetPath(block.PrevHash)
+	if !isRooted(parentPath) {
+		// Parent hasn't arrived yet; all we can do is bound the difficulty
+		base := int(BaseDifficulty(isOpBlock))
+		if int(block.Difficulty) > base+pow.MAX_DIFFICULTY_ADJUSTMENT ||
+			int(block.Difficulty) < base-pow.MAX_DIFFICULTY_ADJUSTMENT {
+			fmt.Println("CheckDifficulty:: difficulty out of bounds:", block.Difficulty)
+			return 0, false
+		}
+		return block.Difficulty, true
+	}
+
+	if median := pow.MedianTime(blockTimestamps(parentPath)); block.Timestamp <= median {
+		fmt.Println("CheckDifficulty:: block timestamp", block.Timestamp, "not after median", median)
+		return 0, false
+	}
+
+	expected := ExpectedDifficulty(parentPath, isOpBlock)
+	if block.Difficulty != expected {
+		fmt.Println("CheckDifficulty:: block difficulty", block.Difficulty, "expected", expected)
+		return 0, false
+	}
+	return expected, true
+}
+
+// Returns the difficulty a block was mined at. Legacy blocks don't record it
+// and were mined at the configured difficulty.
+func BlockDifficulty(block blockchain.Block) uint8 {
+	if block.HashAlgorithm == blockchain.MD5 {
+		return BaseDifficulty(len(block.OpHistory) > 0)
+	}
+	return block.Difficulty
+}
+
+// Returns the work a block represents: the expected number of hashes needed
+// to find it, 16^difficulty since every step of difficulty is one more hex
+// zero. The genesis block carries no work.
+func BlockWork(block blockchain.Block) *big.Int {
+	if block.PrevHash == "" {
+		return new(big.Int)
+	}
+	return new(big.Int).Lsh(big.NewInt(1), 4*uint(BlockDifficulty(block)))
+}
+
+// Returns the total work of the blocks on a path
+func PathWork(path []blockchain.Block) *big.Int {
+	work := new(big.Int)
+	for _, block := range path {
+		work.Add(work, BlockWork(block))
+	}
+	return work
+}
+
+func blockTimestamps(path []blockchain.Block) []int64 {
+	timestamps := make([]int64, len(path))
+	for i, block := range path {
+		timestamps[i] = block.Timestamp
+	}
+	return timestamps
+}
@@ -0,0 +1,272 @@
+/*
+
+This file contains how blocks and ops spread between miners. Rather than push
+whole blocks and ops to every peer, a miner announces their hashes:
+
+  1. Announce: a miner that has a new block or op, mined, drawn by an art
+     node or heard of from a peer, sends its hash to every peer.
+  2. Request: the peer replies with the hashes it lacks and isn't waiting
+     on from anyone else.
+  3. Send: the miner sends just those with PropagateBlock and PropagateOp.
+     Once the peer has taken a block or op in, it announces it in turn.
+
+Every miner announces everything new to it, so blocks and ops reach every
+miner its peers connect it to, however many hops away. What a miner asked for
+is waited on for GOSSIP_REQUEST_TIMEOUT before it is asked for again, from
+whoever announces it next, since the peer may not send it after all. Once it
+arrives and is valid, it goes into a seen cache of SEEN_CACHE_SIZE items, so
+it isn't asked for twice.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	// Kinds of items announced
+	INV_BLOCK = "block"
+	INV_OP    = "op"
+	// Items a seen cache remembers
+	SEEN_CACHE_SIZE = 8192
+	// Items taken in one Announce
+	MAX_INV = 1000
+	// How long an item asked for is waited on
+	GOSSIP_REQUEST_TIMEOUT = 10 * time.Second
+)
+
+// Reasons an announcement is refused for
+const (
+	GOSSIP_TOO_MANY = "too many items announced"
+)
+
+type GossipError struct {
+	Addr   string
+	Reason string
+}
+
+func (e GossipError) Error() string {
+	return fmt.Sprintf("Announcement from %s refused: %s", e.Addr, e.Reason)
+}
+
+// A block or op, by the hash of the block or the opHash of the op
+type Inv struct {
+	Type string
+	Hash string
+}
+
+type AnnounceArgs struct {
+	Items []Inv
+}
+
+// The last items added, up to a fixed number of them. The oldest are
+// forgotten first.
+type SeenCache struct {
+	mutex *sync.Mutex
+	items map[Inv]bool
+	ring  []Inv
+	next  int
+}
+
+func NewSeenCache(size int) *SeenCache {
+	return &SeenCache{
+		mutex: &sync.Mutex{},
+		items: make(map[Inv]bool, size),
+		ring:  make([]Inv, 0, size)}
+}
+
+// Adds item, forgetting the oldest item if the cache is full. Returns false
+// if item was already there.
+func (c *SeenCache) Add(item Inv) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.items[item] {
+		return false
+	}
+
+	if len(c.ring) < cap(c.ring) {
+		c.ring = append(c.ring, item)
+	} else {
+		delete(c.items, c.ring[c.next])
+		c.ring[c.next] = item
+		c.next = (c.next + 1) % len(c.ring)
+	}
+	c.items[item] = true
+	return true
+}
+
+// Returns true if item is remembered
+func (c *SeenCache) Has(item Inv) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.items[item]
+}
+
+// Returns the number of items remembered
+func (c *SeenCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.items)
+}
+
+// One miner's side of the gossip. have tells whether the miner has an item
+// already. At most as many items as the seen cache holds are waited on at
+// once.
+type Gossip struct {
+	Seen           *SeenCache
+	RequestTimeout time.Duration
+
+	have      func(Inv) bool
+	mutex     *sync.Mutex
+	requested map[Inv]time.Time // Items waited on, by when they were asked for
+	size      int
+}
+
+func NewGossip(size int, have func(Inv) bool) *Gossip {
+	return &Gossip{
+		Seen:           NewSeenCache(size),
+		RequestTimeout: GOSSIP_REQUEST_TIMEOUT,
+		have:           have,
+		mutex:          &sync.Mutex{},
+		requested:      make(map[Inv]time.Time),
+		size:           size}
+}
+
+// Returns the items of an announcement we lack, haven't seen and aren't
+// waiting on, and remembers that we asked for them
+func (g *Gossip) Want(items []Inv) []Inv {
+	lacking := make([]Inv, 0, len(items))
+	for _, item := range items {
+		if !g.have(item) && !g.Seen.Has(item) {
+			lacking = append(lacking, item)
+		}
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	if len(g.requested)+len(lacking) > g.size {
+		g.expire(now)
+	}
+
+	wanted := make([]Inv, 0)
+	for _, item := range lacking {
+		if asked, ok := g.requested[item]; ok && now.Sub(asked) < g.RequestTimeout {
+			continue
+		}
+		if len(g.requested) >= g.size {
+			break
+		}
+		g.requested[item] = now
+		wanted = append(wanted, item)
+	}
+	return wanted
+}
+
+// Marks item as arrived and valid, so it isn't asked for again
+func (g *Gossip) Received(item Inv) {
+	g.mutex.Lock()
+	delete(g.requested, item)
+	g.mutex.Unlock()
+
+	g.Seen.Add(item)
+}
+
+// Returns the number of items waited on
+func (g *Gossip) Requested() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return len(g.requested)
+}
+
+// Forgets the items that were waited on for too long
+func (g *Gossip) expire(now time.Time) {
+	for item, asked := range g.requested {
+		if now.Sub(asked) >= g.RequestTimeout {
+			delete(g.requested, item)
+		}
+	}
+}
+
+// Announces items to the peer over client. Returns the items it asked for.
+func Announce(client *rpc.Client, items []Inv) ([]Inv, error) {
+	var wanted []Inv
+	err := client.Call("Peer.Announce", AnnounceArgs{items}, &wanted)
+	return wanted, err
+}
+
+// Our singleton gossip
+var PeerGossip = NewGossip(SEEN_CACHE_SIZE, haveInv)
+
+// Whether the block is in our block chain or the op in our mempool
+func haveInv(item Inv) bool {
+	switch item.Type {
+	case INV_BLOCK:
+		_, ok := ReadBlockChainMap(item.Hash)
+		return ok
+	case INV_OP:
+		_, ok := Pool.Get(item.Hash)
+		return ok
+	}
+	// Nothing to ask for
+	return true
+}
+
+// Takes an announcement from a peer. Returns the items we want, for the peer
+// to send with PropagateBlock and PropagateOp.
+func (p *PeerRpc) Announce(args AnnounceArgs, reply *[]Inv) error {
+	if _, err := p.peer(); err != nil {
+		return err
+	}
+	if len(args.Items) > MAX_INV {
+		p.misbehaved(SCORE_BAD_GOSSIP, GOSSIP_TOO_MANY)
+		return GossipError{p.auth.remote, GOSSIP_TOO_MANY}
+	}
+
+	*reply = PeerGossip.Want(args.Items)
+	return nil
+}
+
+// Announces items to each peer and sends them the ones they ask for
+func PeerAnnounce(items []Inv) {
+	for _, peer := range Peers.List() {
+		wanted, err := Announce(peer.Client, items)
+		if CheckError(err, "PeerAnnounce:"+peer.Addr) {
+			continue
+		}
+		for _, item := range wanted {
+			CheckError(sendInv(peer.Client, item), "PeerAnnounce:"+peer.Addr)
+		}
+	}
+}
+
+// Sends item to the peer over client. Ops that left the mempool in the
+// meantime aren't sent; the peer gets them with their block.
+func sendInv(client *rpc.Client, item Inv) error {
+	empty := new(Empty)
+	switch item.Type {
+	case INV_BLOCK:
+		index, ok := ReadBlockChainMap(item.Hash)
+		if !ok {
+			return nil
+		}
+		return client.Call("Peer.PropagateBlock", PropagateBlockArgs{BlockNodeArray[index].Block}, &empty)
+	case INV_OP:
+		opInfo, ok := Pool.Get(item.Hash)
+		if !ok {
+			return nil
+		}
+		return client.Call("Peer.PropagateOp", PropagateOpArgs{opInfo}, &empty)
+	}
+	return nil
+}
@@ -3,18 +3,16 @@ package miner
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/md5"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
 	"math/big"
+	mathrand "math/rand"
 	"net"
 	"net/rpc"
 	"os"
@@ -23,7 +21,7 @@ import (
 	"time"
 	"../blockchain"
 	"../libminer"
-	"../minerserver"
+	"../protocol"
 	"../pow"
 	"../utils"
 )
@@ -35,29 +33,17 @@ const (
 // Our singleton miner instance
 var MinerInstance *Miner
 
-// Primitive representation of active art miners
-var ArtNodeList map[int]bool = make(map[int]bool)
-
-// List of peers WE connect TO, not peers that connect to US
-var PeerList map[string]*Peer = make(map[string]*Peer)
-
-var BlockCond *sync.Cond
-
 const (
-	// Global TTL of propagate requests
-	TTL = 2
-	// Maximum threads we will use for problem solving
-	MAX_THREADS = 1
+	// Seconds between hash rate reports
+	HASH_RATE_INTERVAL = 30
 	// Num new blocks with no operation before repropagating op
 	BLOCKS_BEFORE_REPROPAGATE = 10
+	// Num new blocks with no operation before giving up on it
+	OP_EXPIRY_BLOCKS = 5 * BLOCKS_BEFORE_REPROPAGATE
+	// Num times an op is republished after being reorged out
+	OP_MAX_RETRIES = 3
 )
 
-// Global blockchain Parent->Children Map
-// Key-value pairs are added when a child arrives but its parent has yet to arrive
-// Key: Parent not yet in the blockchain
-// Val: List of orphaned children, representing their indices in BlockNodeArray
-var ParentHashMap map[string][]int = make(map[string][]int)
-
 // Global block chain array
 var BlockNodeArray []blockchain.BlockNode
 
@@ -74,23 +60,15 @@ var PathMap map[string]LongestPathInfo = make(map[string]LongestPathInfo)
 // Locks for local blockchain and blockchainmap
 // BlockChainMutex only allows concurrent R or single W
 // BlockArrayMutex only protects W
-// ParentMapMutex only allows concurrent R or single W
 var (
 	BlockChainMutex *sync.RWMutex
 	BlockArrayMutex *sync.Mutex
-	ParentMapMutex  *sync.RWMutex
 	PathMapMutex    *sync.RWMutex
 )
 
 // Current Job ID
 var CurrJobId int = 0
 
-// This lock is to guarantee operations are unique, even if they have the same svgString, fill and stroke
-var (
-	OpNum   uint64 = 0
-	OpMutex *sync.Mutex
-)
-
 /*******************************
 | Structs for the miners to use internally
 | note: shared structs should be put in a different lib
@@ -98,7 +76,7 @@ var (
 type Miner struct {
 	PrivKey    *ecdsa.PrivateKey
 	Addr       net.Addr
-	Settings   minerserver.MinerNetSettings
+	Settings   protocol.MinerNetSettings
 	InkAmt     int
 	LMI        *LibMinerInterface
 	MSI        *MinerServerInterface
@@ -109,11 +87,6 @@ type Miner struct {
 	SBlockChan chan blockchain.Block
 }
 
-type MinerInfo struct {
-	Address net.Addr
-	Key     ecdsa.PublicKey
-}
-
 type LibMinerInterface struct {
 	SOpChan chan blockchain.OperationInfo
 	POpChan chan PropagateOpArgs
@@ -123,15 +96,11 @@ type MinerServerInterface struct {
 	Client *rpc.Client
 }
 
-type Peer struct {
-	Client        *rpc.Client
-	LastHeartBeat time.Time
-}
-
 // For calculating the longest path
 type LongestPathInfo struct {
 	Len  int                // Length of the block
 	Path []blockchain.Block // The longest path of blocks excluding the current block
+	Work *big.Int           // Cumulative work of the blocks on Path
 }
 
 /*******************************
@@ -151,7 +120,16 @@ func (m *Miner) ConnectToServer(ip string) {
 
 	fmt.Println("ConnectToServer::connecting to server on:", conn.LocalAddr().String())
 
-	client := rpc.NewClient(conn)
+	pinned, err := serverKey()
+	if CheckError(err, "ConnectToServer:ServerKey") {
+		os.Exit(1)
+	}
+	secureConn, err := secureDial(conn, pinned)
+	if CheckError(err, "ConnectToServer:TLS") {
+		os.Exit(1)
+	}
+
+	client := rpc.NewClient(secureConn)
 	miner_server_int.Client = client
 	m.MSI = miner_server_int
 }
@@ -180,21 +158,33 @@ func OpenLibMinerConn(ip string, pop chan PropagateOpArgs, sop chan blockchain.O
 	MinerInstance.LMI = lib_miner_int
 
 	fmt.Println("OpenLibMinerConn:: Listening on: ", tcp.Addr().String())
-	server.Accept(tcp)
+	server.Accept(SecureListener(tcp, false))
 }
 
+// Registers the art node that signed the request. From then on it can sign
+// requests and ops with its own key. Art nodes must speak our protocol
+// version.
 func (lmi *LibMinerInterface) OpenCanvas(req *libminer.Request, response *libminer.RegisterResponse) (err error) {
-	if Verify(req.Msg, req.HashedMsg, req.R, req.S, MinerInstance.PrivKey) {
-		//Generate an id in a basic fashion
-		for i := 0; ; i++ {
-			if !ArtNodeList[i] {
-				ArtNodeList[i] = true
-				response.Id = i
-				response.CanvasXMax = MinerInstance.Settings.CanvasSettings.CanvasXMax
-				response.CanvasYMax = MinerInstance.Settings.CanvasSettings.CanvasYMax
-				break
-			}
+	pubKey, err := parsePubKey(req.PubKey)
+	if err == nil && Verify(req.Msg, req.HashedMsg, req.R, req.S, pubKey) {
+		var openReq libminer.OpenCanvasRequest
+		json.Unmarshal(req.Msg, &openReq)
+		if err := protocol.CheckVersion(openReq.ProtocolVersion); err != nil {
+			fmt.Println("OpenCanvas::", err)
+			return protocol.WrapError(err)
+		}
+
+		id, err := ArtNodes.Register(req.PubKey)
+		if err != nil {
+			fmt.Println("OpenCanvas::", err)
+			return err
 		}
+
+		response.Id = id
+		response.CanvasXMax = MinerInstance.Settings.CanvasSettings.CanvasXMax
+		response.CanvasYMax = MinerInstance.Settings.CanvasSettings.CanvasYMax
+		response.ProtocolVersion = protocol.PROTOCOL_VERSION
+		fmt.Println("OpenCanvas:: registered art node", response.Id)
 		return nil
 	}
 
@@ -203,9 +193,22 @@ func (lmi *LibMinerInterface) OpenCanvas(req *libminer.Request, response *libmin
 }
 
 func (lmi *LibMinerInterface) GetInk(req *libminer.Request, response *libminer.InkResponse) (err error) {
-	if Verify(req.Msg, req.HashedMsg, req.R, req.S, MinerInstance.PrivKey) {
-		MinerInstance.InkAmt = CalculateInk(utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey))
-		response.InkRemaining = uint32(MinerInstance.InkAmt)
+	if artNode, ok := ArtNodeKey(req); ok {
+		response.InkRemaining = uint32(CalculateInk(artNode))
+		return nil
+	}
+
+	err = fmt.Errorf("invalid user")
+	return err
+}
+
+// Unregisters the art node that signed the request and answers with its ink.
+// It must open a canvas again to send more requests.
+func (lmi *LibMinerInterface) CloseCanvas(req *libminer.Request, response *libminer.InkResponse) (err error) {
+	if artNode, ok := ArtNodeKey(req); ok {
+		response.InkRemaining = uint32(CalculateInk(artNode))
+		ArtNodes.Release(artNode)
+		fmt.Println("CloseCanvas:: released art node", artNode)
 		return nil
 	}
 
@@ -215,105 +218,30 @@ func (lmi *LibMinerInterface) GetInk(req *libminer.Request, response *libminer.I
 
 
 func (lmi *LibMinerInterface) Draw(req *libminer.Request, response *libminer.DrawResponse) (err error) {
-	if Verify(req.Msg, req.HashedMsg, req.R, req.S, MinerInstance.PrivKey) {
-		MinerInstance.InkAmt = CalculateInk(utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey))
+	if artNode, ok := ArtNodeKey(req); ok {
 		var drawReq libminer.DrawRequest
 		json.Unmarshal(req.Msg, &drawReq)
-		pubKeyString := utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey)
-
-		// Create Operation
-		OpMutex.Lock()
-		op := blockchain.Operation{
-			OpType:    blockchain.ADD,
-			SVGString: drawReq.SVGString,
-			Fill:      drawReq.Fill,
-			Stroke:    drawReq.Stroke,
-			OpNum:     OpNum}
-
-		OpNum++
-		OpMutex.Unlock()
-
-		// Disseminate Operation
-		opBytes, _ := json.Marshal(op)
-		opSig, _ := MinerInstance.PrivKey.Sign(rand.Reader, opBytes, nil)
-		opSigStr := hex.EncodeToString(opSig)
-		opInfo := blockchain.OperationInfo{
-			AddSig: "",
-			OpSig:  opSigStr,
-			PubKey: pubKeyString,
-			Op:     op}
-
-		propOpArgs := PropagateOpArgs{
-			OpInfo: opInfo,
-			TTL:    TTL}
-
-		log.Printf("write to ch")
-		lmi.POpChan <- propOpArgs
-		log.Printf("write to ch")
-		lmi.SOpChan <- opInfo
-
-		blockHash := ""
-		count := 0
-
-		// keep trying to validate the operation
-		for {
-			BlockCond.L.Lock()
-			BlockCond.Wait()
-			BlockCond.L.Unlock()
-
-			// Check if it conflicts with the existing canvas
-			err := ValidateOperation(op, pubKeyString, opSigStr)
-			_, ok := err.(DuplicateError)
-			if !ok {
-				if err != nil {
-					return err
-				} else {
-					// Keep count of how many times no duplicate.
-					// If too many, reattempt operation
-					count++
-					if count > BLOCKS_BEFORE_REPROPAGATE {
-						log.Printf("write to ch")
-						lmi.POpChan <- propOpArgs
-						log.Printf("write to ch")
-						lmi.SOpChan <- opInfo
-						fmt.Println("No dupe count too high - republishing")
-						count = 0
-					}
-
-					fmt.Println("no duplicate yet - wait for new block")
-					continue
-				}
-			}
 
-			// Keep looping until there are NumValidate blocks
-			blockHash := GetBlockHashOfShapeHash(opInfo.OpSig)
-			if blockHash == "" {
-				fmt.Println("Weird, no block hash - sleep then continue...")
-				time.Sleep(1 * time.Second)
-				continue
-			}
+		opInfo, err := newDrawOp(drawReq, artNode)
+		if err != nil {
+			return protocol.WrapError(err)
+		}
+		propOpArgs := PropagateOpArgs{OpInfo: opInfo}
 
-			chain, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-			numBlocksFollowing := 0
-			for i := len(chain) - 1; i >= 0; i-- {
-				blockByteData, _ := json.Marshal(chain[i])
-				hashedBlock := utils.ComputeHash(blockByteData)
-				hash := hex.EncodeToString(hashedBlock)
-				if hash == blockHash {
-					break
-				} else {
-					numBlocksFollowing++
-				}
-			}
+		// Watch for the op before publishing it so no event is missed
+		sub := ChainEvents.WatchOp(opHash(opInfo), int(drawReq.ValidateNum))
+		defer ChainEvents.Unsubscribe(sub)
+		if err := lmi.publishOp(propOpArgs); err != nil {
+			return protocol.WrapError(err)
+		}
 
-			if numBlocksFollowing >= int(drawReq.ValidateNum) {
-				break
-			} else {
-				fmt.Println("Not enough blocks to validate yet:", numBlocksFollowing)
-			}
+		blockHash, err := lmi.waitForOp(propOpArgs, sub, int(drawReq.ValidateNum), drawReq.Deadline,
+			validateDrawOp(opInfo), nil)
+		if err != nil {
+			return protocol.WrapError(err)
 		}
 
-		response.InkRemaining = uint32(CalculateInk(pubKeyString))
+		response.InkRemaining = uint32(CalculateInk(opInfo.PubKey))
 		response.ShapeHash = opInfo.OpSig
 		response.BlockHash = blockHash
 		return nil
@@ -323,120 +251,146 @@ func (lmi *LibMinerInterface) Draw(req *libminer.Request, response *libminer.Dra
 
 }
 
+// Returns the ADD operation of a draw request, which the art node with
+// pubKey must have signed
+func newDrawOp(drawReq libminer.DrawRequest, pubKey string) (opInfo blockchain.OperationInfo, err error) {
+	op := blockchain.Operation{
+		OpType:    blockchain.ADD,
+		SVGString: drawReq.SVGString,
+		Fill:      drawReq.Fill,
+		Stroke:    drawReq.Stroke,
+		OpNum:     drawReq.OpNum}
+
+	opInfo = blockchain.OperationInfo{
+		AddSig: "",
+		OpSig:  drawReq.OpSig,
+		PubKey: pubKey,
+		Op:     op}
+	return opInfo, VerifyOpSignature(opInfo)
+}
+
+// Returns the check run on an ADD operation for every block that doesn't
+// take it in: it must still fit on the canvas
+func validateDrawOp(opInfo blockchain.OperationInfo) func() error {
+	return func() error {
+		err := ValidateOperation(opInfo)
+		if _, ok := err.(DuplicateError); ok {
+			return nil
+		}
+		return err
+	}
+}
+
 func (lmi *LibMinerInterface) Delete(req *libminer.Request, response *libminer.InkResponse) (err error) {
-	if Verify(req.Msg, req.HashedMsg, req.R, req.S, MinerInstance.PrivKey) {
+	if artNode, ok := ArtNodeKey(req); ok {
 		var deleteReq libminer.DeleteRequest
 		json.Unmarshal(req.Msg, &deleteReq)
-		pubKeyString := utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey)
 		fmt.Println("Delete called!")
 
-		// Check if deletion is allowed
-		path, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-		err := MinerInstance.checkDeletion(deleteReq.ShapeHash, pubKeyString, path)
+		opInfo, err := newDeleteOp(deleteReq, artNode)
 		if err != nil {
-			return err
+			return protocol.WrapError(err)
 		}
 
-		// Find the ADD Operation for metadata
-		addBlockHash := GetBlockHashOfShapeHash(deleteReq.ShapeHash)
-		if addBlockHash == "" {
-			code := CheckStatusCode(libminer.ShapeOwnerError(deleteReq.ShapeHash))
-			return errors.New(code)
-		}
+		propOpArgs := PropagateOpArgs{OpInfo: opInfo}
 
-		addBlock := GetBlock(addBlockHash)
-		var addOpInfo blockchain.OperationInfo
-		for _, addInfo := range addBlock.OpHistory {
-			if addInfo.OpSig == deleteReq.ShapeHash {
-				addOpInfo = addInfo
-				break
-			}
+		sub := ChainEvents.WatchOp(opHash(opInfo), int(deleteReq.ValidateNum))
+		defer ChainEvents.Unsubscribe(sub)
+		if err := lmi.publishOp(propOpArgs); err != nil {
+			return protocol.WrapError(err)
 		}
 
-		if addOpInfo.Op.OpType != blockchain.ADD {
-			code := CheckStatusCode(libminer.ShapeOwnerError(deleteReq.ShapeHash))
-			return errors.New(code)
+		fmt.Println("Delete ok - waiting now")
+
+		_, err = lmi.waitForOp(propOpArgs, sub, int(deleteReq.ValidateNum), deleteReq.Deadline,
+			func() error { return nil }, nil)
+		if err != nil {
+			return protocol.WrapError(err)
 		}
 
-		OpMutex.Lock()
-		op := blockchain.Operation{
-			OpType:    blockchain.DELETE,
-			SVGString: addOpInfo.Op.SVGString,
-			Fill:      addOpInfo.Op.Fill,
-			Stroke:    addOpInfo.Op.Stroke,
-			OpNum:     OpNum}
-
-		OpNum++
-		OpMutex.Unlock()
-
-		// Disseminate Operation
-		opBytes, _ := json.Marshal(op)
-		opSig, _ := MinerInstance.PrivKey.Sign(rand.Reader, opBytes, nil)
-		opInfo := blockchain.OperationInfo{
-			AddSig: deleteReq.ShapeHash,
-			OpSig:  hex.EncodeToString(opSig),
-			PubKey: pubKeyString,
-			Op:     op}
-
-		propOpArgs := PropagateOpArgs{
-			OpInfo: opInfo,
-			TTL:    TTL}
-
-		log.Printf("write to ch")
-		lmi.POpChan <- propOpArgs
-		log.Printf("write to ch")
-		lmi.SOpChan <- opInfo
-
-		count := 0
+		response.InkRemaining = uint32(CalculateInk(opInfo.PubKey))
+		return nil
+	}
 
-		fmt.Println("Delete ok - waiting now")
+	err = fmt.Errorf("invalid user")
+	return err
+}
+
+// Checks that a delete request is allowed and returns its DELETE operation,
+// which the art node with pubKey must have signed. Only the art node that
+// added a shape may delete it.
+func newDeleteOp(deleteReq libminer.DeleteRequest, pubKey string) (opInfo blockchain.OperationInfo, err error) {
+	// Check if deletion is allowed
+	path, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+	CanvasMutex.Lock()
+	err = MinerInstance.checkDeletion(deleteReq.ShapeHash, pubKey, canvasAt(path))
+	CanvasMutex.Unlock()
+	if err != nil {
+		return opInfo, err
+	}
 
-		// keep trying to validate the operation
-		for {
-			BlockCond.L.Lock()
-			BlockCond.Wait()
-			BlockCond.L.Unlock()
+	// Find the ADD Operation for metadata
+	addBlockHash := GetBlockHashOfShapeHash(deleteReq.ShapeHash)
+	if addBlockHash == "" {
+		return opInfo, protocol.ShapeOwnerError(deleteReq.ShapeHash)
+	}
 
-			// Keep looping until there are NumValidate blocks
-			blockHash := GetBlockHashOfShapeHash(opInfo.OpSig)
-			if blockHash == "" {
-				fmt.Println("No del yet - sleep then continue...")
-				count++
+	addBlock := GetBlock(addBlockHash)
+	var addOpInfo blockchain.OperationInfo
+	for _, addInfo := range addBlock.OpHistory {
+		if addInfo.OpSig == deleteReq.ShapeHash {
+			addOpInfo = addInfo
+			break
+		}
+	}
 
-				if count > BLOCKS_BEFORE_REPROPAGATE {
-					log.Printf("write to ch")
-					lmi.POpChan <- propOpArgs
-					log.Printf("write to ch")
-					lmi.SOpChan <- opInfo
-					count = 0
-				}
+	if addOpInfo.Op.OpType != blockchain.ADD {
+		return opInfo, protocol.ShapeOwnerError(deleteReq.ShapeHash)
+	}
 
-				fmt.Println("no duplicate yet - wait for new block")
-				continue
-			}
+	op := blockchain.Operation{
+		OpType:    blockchain.DELETE,
+		SVGString: addOpInfo.Op.SVGString,
+		Fill:      addOpInfo.Op.Fill,
+		Stroke:    addOpInfo.Op.Stroke,
+		OpNum:     deleteReq.OpNum}
+
+	opInfo = blockchain.OperationInfo{
+		AddSig: deleteReq.ShapeHash,
+		OpSig:  deleteReq.OpSig,
+		PubKey: pubKey,
+		Op:     op}
+	return opInfo, VerifyOpSignature(opInfo)
+}
 
+// Moves ink of the art node to another pubkey
+func (lmi *LibMinerInterface) Transfer(req *libminer.Request, response *libminer.DrawResponse) (err error) {
+	if artNode, ok := ArtNodeKey(req); ok {
+		var transferReq libminer.TransferRequest
+		json.Unmarshal(req.Msg, &transferReq)
 
-			chain, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-			numBlocksFollowing := 0
-			for i := len(chain) - 1; i >= 0; i-- {
-				blockByteData, _ := json.Marshal(chain[i])
-				hashedBlock := utils.ComputeHash(blockByteData)
-				hash := hex.EncodeToString(hashedBlock)
-				if hash == blockHash {
-					break
-				} else {
-					numBlocksFollowing++
-				}
-			}
+		opInfo, err := newTransferOp(transferReq, artNode)
+		if err != nil {
+			return protocol.WrapError(err)
+		}
 
-			if numBlocksFollowing >= int(deleteReq.ValidateNum) {
-				break
-			} else {
-				fmt.Println("Not enough blocks to validate yet:", numBlocksFollowing)
-			}
+		propOpArgs := PropagateOpArgs{OpInfo: opInfo}
+
+		sub := ChainEvents.WatchOp(opHash(opInfo), int(transferReq.ValidateNum))
+		defer ChainEvents.Unsubscribe(sub)
+		if err := lmi.publishOp(propOpArgs); err != nil {
+			return protocol.WrapError(err)
+		}
+
+		blockHash, err := lmi.waitForOp(propOpArgs, sub, int(transferReq.ValidateNum), transferReq.Deadline,
+			validateTransferOp(opInfo), nil)
+		if err != nil {
+			return protocol.WrapError(err)
 		}
 
-		response.InkRemaining = uint32(CalculateInk(pubKeyString))
+		response.InkRemaining = uint32(CalculateInk(opInfo.PubKey))
+		response.ShapeHash = opInfo.OpSig
+		response.BlockHash = blockHash
 		return nil
 	}
 
@@ -444,8 +398,132 @@ func (lmi *LibMinerInterface) Delete(req *libminer.Request, response *libminer.I
 	return err
 }
 
+// Returns the TRANSFER operation of a transfer request, which the art node
+// with pubKey must have signed
+func newTransferOp(transferReq libminer.TransferRequest, pubKey string) (opInfo blockchain.OperationInfo, err error) {
+	op := blockchain.Operation{
+		OpType: blockchain.TRANSFER,
+		OpNum:  transferReq.OpNum,
+		To:     transferReq.To,
+		Amount: transferReq.Amount}
+
+	opInfo = blockchain.OperationInfo{
+		AddSig: "",
+		OpSig:  transferReq.OpSig,
+		PubKey: pubKey,
+		Op:     op}
+	return opInfo, VerifyOpSignature(opInfo)
+}
+
+// Returns the check run on a TRANSFER operation for every block that doesn't
+// take it in: the sender must still have the ink
+func validateTransferOp(opInfo blockchain.OperationInfo) func() error {
+	return func() error {
+		err := ValidateTransfer(opInfo)
+		if _, ok := err.(DuplicateError); ok {
+			return nil
+		}
+		return err
+	}
+}
+
+// Adds an op to the mempool and sends it to our peers and to the problem
+// solver. An op that is already pooled is sent again.
+func (lmi *LibMinerInterface) publishOp(propOpArgs PropagateOpArgs) error {
+	if err := Pool.Add(propOpArgs.OpInfo); err != nil {
+		if _, ok := err.(DuplicateError); !ok {
+			return err
+		}
+	}
+
+	log.Printf("write to ch")
+	lmi.POpChan <- propOpArgs
+	log.Printf("write to ch")
+	lmi.SOpChan <- propOpArgs.OpInfo
+	return nil
+}
+
+// Waits for the op watched by sub to be validateNum blocks deep in the
+// longest path and returns the hash of its block. While no block holds the op,
+// validate is called on every new block and its error returned. The op is
+// published again if no block takes it in for a while, and if it is reorged
+// out, up to OP_MAX_RETRIES times. Waiting stops at deadline (Unix time in ms)
+// unless it is 0; the op may still make it into a block after that. If
+// progress isn't nil, it is called with every OP_CONFIRMED and OP_EVICTED.
+// Possible Errors:
+// - OpEvictedError
+// - OpExpiredError
+// - TimeoutError
+// - Any error from validate
+func (lmi *LibMinerInterface) waitForOp(propOpArgs PropagateOpArgs, sub *ChainSubscription,
+	validateNum int, deadline int64, validate func() error, progress func(ChainEvent)) (blockHash string, err error) {
+	opSig := propOpArgs.OpInfo.OpSig
+	included := false
+	blocksWaited := 0
+	retries := 0
+
+	// A nil channel never fires, so without a deadline we wait for good
+	var timeout <-chan time.Time
+	if deadline != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, deadline*int64(time.Millisecond))))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		var event ChainEvent
+		select {
+		case event = <-sub.Events:
+		case <-timeout:
+			fmt.Println("Deadline passed while waiting for op")
+			return "", protocol.TimeoutError(opSig)
+		}
+
+		if progress != nil && (event.Type == OP_CONFIRMED || event.Type == OP_EVICTED) {
+			progress(event)
+		}
+
+		switch event.Type {
+		case OP_CONFIRMED:
+			included = true
+			if event.Depth >= validateNum {
+				return event.BlockHash, nil
+			}
+			fmt.Println("Not enough blocks to validate yet:", event.Depth)
+
+		case OP_EVICTED:
+			included = false
+			blocksWaited = 0
+			retries++
+			if retries > OP_MAX_RETRIES {
+				return "", protocol.OpEvictedError(opSig)
+			}
+			fmt.Println("Op was reorged out - republishing")
+			CheckError(lmi.publishOp(propOpArgs), "waitForOp:publishOp")
+
+		case BLOCK_CONNECTED:
+			if included {
+				continue
+			}
+
+			if err := validate(); err != nil {
+				return "", err
+			}
+
+			blocksWaited++
+			if blocksWaited > OP_EXPIRY_BLOCKS {
+				return "", protocol.OpExpiredError(opSig)
+			}
+			if blocksWaited%BLOCKS_BEFORE_REPROPAGATE == 0 {
+				fmt.Println("Op not in a block yet - republishing")
+				CheckError(lmi.publishOp(propOpArgs), "waitForOp:publishOp")
+			}
+		}
+	}
+}
+
 func (lmi *LibMinerInterface) GetGenesisBlock(req *libminer.Request, response *string) (err error) {
-	if Verify(req.Msg, req.HashedMsg, req.R, req.S, MinerInstance.PrivKey) {
+	if _, ok := ArtNodeKey(req); ok {
 		*response = MinerInstance.Settings.GenesisBlockHash
 		return nil
 	}
@@ -454,12 +532,11 @@ func (lmi *LibMinerInterface) GetGenesisBlock(req *libminer.Request, response *s
 }
 
 func (lmi *LibMinerInterface) GetChildren(req *libminer.Request, response *libminer.BlocksResponse) (err error) {
-	if Verify(req.Msg, req.HashedMsg, req.R, req.S, MinerInstance.PrivKey) {
+	if _, ok := ArtNodeKey(req); ok {
 		var blockRequest libminer.BlockRequest
 		json.Unmarshal(req.Msg, &blockRequest)
 		if _, ok := ReadBlockChainMap(blockRequest.BlockHash); !ok {
-			code := CheckStatusCode(libminer.InvalidBlockHashError(blockRequest.BlockHash))
-			return errors.New(code)
+			return protocol.WrapError(protocol.InvalidBlockHashError(blockRequest.BlockHash))
 		}
 		children := GetBlockChildren(blockRequest.BlockHash)
 		response.Blocks = children
@@ -470,7 +547,7 @@ func (lmi *LibMinerInterface) GetChildren(req *libminer.Request, response *libmi
 }
 
 func (lmi *LibMinerInterface) GetBlock(req *libminer.Request, response *libminer.BlocksResponse) (err error) {
-	if Verify(req.Msg, req.HashedMsg, req.R, req.S, MinerInstance.PrivKey) {
+	if _, ok := ArtNodeKey(req); ok {
 		var blockRequest libminer.BlockRequest
 		json.Unmarshal(req.Msg, &blockRequest)
 
@@ -492,8 +569,7 @@ func (lmi *LibMinerInterface) GetBlock(req *libminer.Request, response *libminer
 			}
 		}
 
-		code := CheckStatusCode(libminer.InvalidBlockHashError(blockRequest.BlockHash))
-		return errors.New(code)
+		return protocol.WrapError(protocol.InvalidBlockHashError(blockRequest.BlockHash))
 	}
 
 	err = fmt.Errorf("invalid user")
@@ -501,14 +577,13 @@ func (lmi *LibMinerInterface) GetBlock(req *libminer.Request, response *libminer
 }
 
 func (lmi *LibMinerInterface) GetOp(req *libminer.Request, response *libminer.OpResponse) (err error) {
-	if Verify(req.Msg, req.HashedMsg, req.R, req.S, MinerInstance.PrivKey) {
+	if _, ok := ArtNodeKey(req); ok {
 		var opRequest libminer.OpRequest
 		json.Unmarshal(req.Msg, &opRequest)
 
 		blockHash := GetBlockHashOfShapeHash(opRequest.ShapeHash)
 		if blockHash == "" {
-			code := CheckStatusCode(libminer.InvalidShapeHashError(opRequest.ShapeHash))
-			return errors.New(code)
+			return protocol.WrapError(protocol.InvalidShapeHashError(opRequest.ShapeHash))
 		}
 
 		blockIndex, _ := ReadBlockChainMap(blockHash)
@@ -519,8 +594,7 @@ func (lmi *LibMinerInterface) GetOp(req *libminer.Request, response *libminer.Op
 			}
 		}
 
-		code := CheckStatusCode(libminer.InvalidShapeHashError(opRequest.ShapeHash))
-		return errors.New(code)
+		return protocol.WrapError(protocol.InvalidShapeHashError(opRequest.ShapeHash))
 	}
 
 	err = fmt.Errorf("invalid user")
@@ -530,70 +604,58 @@ func (lmi *LibMinerInterface) GetOp(req *libminer.Request, response *libminer.Op
 /*******************************
 | Blockchain functions
 ********************************/
-// Appends the new block to BlockArray and updates BlockHashMap
+// Appends the new block to BlockArray and updates BlockHashMap. A block whose
+// parent we haven't got waits in the orphan pool instead, and goes in once its
+// parent does (see orphan-pool.go).
 func InsertBlock(newBlock blockchain.Block) (err error) {
 	newBlockHash := GetBlockHash(newBlock)
 	if _, ok := ReadBlockChainMap(newBlockHash); !ok && VerifyBlock(newBlock) {
+		parentIndex, hasParent := ReadBlockChainMap(newBlock.PrevHash)
+		if !hasParent {
+			Orphans.Add(newBlock, "")
+			return nil
+		}
+
+		// Write the block through to disk before it becomes visible in memory
+		if Store != nil {
+			CheckError(Store.Append(newBlock), "InsertBlock:Store.Append")
+		}
+
 		// Create a new BlockNode for newBlock and append it to BlockNodeArray
 		fmt.Println("inserting:< Q", newBlock.PrevHash, ":", newBlock.Nonce)
-		newPathInfo := LongestPathInfo{Len: 1, Path: []blockchain.Block{newBlock}}
-
-		existingChildren, _ := ReadParentMap(newBlockHash)
-		newBlockNode := blockchain.BlockNode{Block: newBlock, Children: existingChildren}
+		newBlockNode := blockchain.BlockNode{Block: newBlock}
 
 		newBlockIndex := WriteBlockNodeArray(newBlockNode)
 
 		// Create an entry for newBlock in BlockHashMap
 		WriteBlockChainMap(newBlockHash, newBlockIndex)
 
-		// Get the path up until this current block and add the current block to the PathMap
+		// Add the current block to the PathMap, at the end of its parent's path.
+		// The path is copied, as siblings share the parent's.
 		PathMapMutex.Lock() // Using a WriteLock since we're doing both R/W.
-		if existingPath, hasPrevPath := PathMap[newBlockNode.Block.PrevHash]; hasPrevPath {
-			// Has existing parent, need to add its path to the current block
-			newPathInfo := LongestPathInfo{
-				Len:  existingPath.Len + 1,
-				Path: append(existingPath.Path, newBlock)}
-
-			PathMap[newBlockHash] = newPathInfo
-		} else {
-			// Parent hasn't arrived yet. Path is itself.
-			PathMap[newBlockHash] = newPathInfo
-		}
+		parentPath := PathMap[newBlock.PrevHash]
+		path := make([]blockchain.Block, 0, parentPath.Len+1)
+		PathMap[newBlockHash] = LongestPathInfo{
+			Len:  parentPath.Len + 1,
+			Path: append(append(path, parentPath.Path...), newBlock),
+			Work: new(big.Int).Add(parentPath.Work, BlockWork(newBlock))}
 		PathMapMutex.Unlock()
 
-		// Check for any orphaned children that this newBlock is a parent to
-		// and update the child's path in PathMap to include the newBlock's path + the childBlock
-		if existingChildren, hasExistingChildren := ReadParentMap(GetBlockHash(newBlock)); hasExistingChildren {
-			for _, existingChildIndex := range existingChildren {
-				existingChildBlock := BlockNodeArray[existingChildIndex].Block
-				existingChildHash := GetBlockHash(existingChildBlock)
-				childPathInfo := LongestPathInfo{Len: newPathInfo.Len + 1, Path: append(newPathInfo.Path, existingChildBlock)}
-				WritePathMap(existingChildHash, childPathInfo)
-			}
-		}
+		// Append this new block as a child of its parent in BlockNodeArray
+		BlockArrayMutex.Lock()
+		parentBlockNode := &BlockNodeArray[parentIndex]
+		parentBlockNode.Children = append(parentBlockNode.Children, newBlockIndex)
+		BlockArrayMutex.Unlock()
 
-		// Update the entry for newBlock's parent in BlockNodeArray
-		// If the parent exists in the blockchain, simply append this new block as a child of the parent
-		// If the parent does not exist either because:
-		// 		1) It is an invalid block
-		//			- Adding this to the BlockNodeArray will make this an unreachable Node
-		//      2) The parent has yet to arrive
-		//			- When the parent arrives, it will append all the pending children in ParentHashMap
-		if parentIndex, ok := ReadBlockChainMap(newBlock.PrevHash); ok {
-			BlockArrayMutex.Lock()
-			parentBlockNode := &BlockNodeArray[parentIndex]
-			parentBlockNode.Children = append(parentBlockNode.Children, newBlockIndex)
-			BlockArrayMutex.Unlock()
-		} else {
-			ParentMapMutex.Lock()
-			existingChildren, _ := ParentHashMap[newBlock.PrevHash]
-			ParentHashMap[newBlock.PrevHash] = append(existingChildren, newBlockIndex)
-			ParentMapMutex.Unlock()
-		}
+		// Move the canvas state onto the (possibly new) longest path and
+		// tell anyone waiting on it what changed
+		longest, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+		SyncCanvas(longest)
+		ChainEvents.Update(longest)
+		SyncMempool(longest)
 
-		BlockCond.L.Lock()
-		BlockCond.Broadcast()
-		BlockCond.L.Unlock()
+		// Orphans waiting for this block can follow it in now
+		adoptOrphans(newBlockHash)
 
 		//fmt.Println("parent's node with new child:", parentBlockNode)
 		return nil
@@ -619,14 +681,40 @@ func GetBlockChildren(blockHash string) []blockchain.Block {
 }
 
 func VerifyBlock(block blockchain.Block) bool {
-	hash := GetBlockHash(block)
-	if len(block.OpHistory) == 0 {
-		return pow.Verify(hash, int(MinerInstance.Settings.PoWDifficultyNoOpBlock))
+	hash, err := blockchain.HashBlock(block)
+	if CheckError(err, "VerifyBlock") {
+		return false
+	}
+
+	// The chain may move to a stronger hash algorithm but never back
+	if parentIndex, ok := ReadBlockChainMap(block.PrevHash); ok {
+		parent := BlockNodeArray[parentIndex].Block
+		if block.HashAlgorithm.Strength() < parent.HashAlgorithm.Strength() {
+			fmt.Println("VerifyBlock:: block downgrades hash algorithm from", parent.HashAlgorithm)
+			return false
+		}
+	}
+
+	// Only the miner named in the block may claim its reward
+	if err := VerifyBlockSignature(block); err != nil {
+		fmt.Println("VerifyBlock::", err)
+		return false
+	}
+
+	if block.ExtraNonce != 0 && !pow.CanRollExtraNonce(block) {
+		fmt.Println("VerifyBlock:: legacy block carries an extra nonce")
+		return false
 	}
-	return pow.Verify(hash, int(MinerInstance.Settings.PoWDifficultyOpBlock))
+
+	difficulty, ok := CheckDifficulty(block)
+	if !ok {
+		return false
+	}
+	return pow.Verify(hash, int(difficulty))
 }
 
-// Returns an array of Blocks of the longest path that follow initBlockHash and length of the longest path
+// Returns an array of Blocks of the longest path that follow initBlockHash and length of the longest path.
+// The longest path is the one with the most cumulative work, not the most blocks.
 func GetLongestPath(initBlockHash string) ([]blockchain.Block, int) {
 	//fmt.Println("running get longest path with block hash: ", initBlockHash)
 	defer Recover()
@@ -645,12 +733,17 @@ func GetLongestPath(initBlockHash string) ([]blockchain.Block, int) {
 		PathMapMutex.RLock()
 		defer PathMapMutex.RUnlock()
 		var maxHash string
-		var maxPathInfo LongestPathInfo
+		maxPathInfo := LongestPathInfo{Work: big.NewInt(-1)}
 		for bHash, pathInfo := range PathMap {
-			if pathInfo.Len > maxPathInfo.Len {
+			// Paths of blocks whose ancestors haven't arrived don't reach the genesis block
+			if !isRooted(pathInfo.Path) {
+				continue
+			}
+
+			if cmp := pathInfo.Work.Cmp(maxPathInfo.Work); cmp > 0 {
 				maxHash = bHash
 				maxPathInfo = pathInfo
-			} else if pathInfo.Len == maxPathInfo.Len {
+			} else if cmp == 0 {
 				// Break the tie by comparing the hash
 				if strings.Compare(bHash, maxHash) > 0 {
 					maxHash = bHash
@@ -671,6 +764,8 @@ func GetLongestPath(initBlockHash string) ([]blockchain.Block, int) {
 
 	var longestPath []blockchain.Block
 	maxLen := -1
+	maxWork := big.NewInt(-1)
+	longestPathBlockHash := ""
 
 	for _, childIndex := range BlockNodeArray[initBIndex].Children {
 		// TODO remove
@@ -683,14 +778,22 @@ func GetLongestPath(initBlockHash string) ([]blockchain.Block, int) {
 
 		childHash := GetBlockHash(child.Block)
 		childPath, childLen := GetLongestPath(childHash)
-		longestPathBlockHash := ""
 
-		// If the childLen is equal to the max length, we use their hashes to determine which path to build off of
-		// If childLen > maxLen, we simply update the longestPath
-		if (maxLen == childLen && strings.Compare(childHash, longestPathBlockHash) > 0) || maxLen < childLen {
+		// The paths of the children all run through initBlockHash, so the work
+		// cached in PathMap for the tips of their paths compares them
+		tipHash := GetBlockHash(childPath[childLen-1])
+		PathMapMutex.RLock()
+		childWork := PathMap[tipHash].Work
+		PathMapMutex.RUnlock()
+
+		// If the childWork is equal to the max work, we use the hashes of the tips to determine which path to build off of
+		// If childWork > maxWork, we simply update the longestPath
+		cmp := childWork.Cmp(maxWork)
+		if (cmp == 0 && strings.Compare(tipHash, longestPathBlockHash) > 0) || cmp > 0 {
 			longestPath = childPath
 			maxLen = childLen
-			longestPathBlockHash = childHash
+			maxWork = childWork
+			longestPathBlockHash = tipHash
 		}
 	}
 
@@ -736,22 +839,6 @@ func WriteBlockNodeArray(b blockchain.BlockNode) int {
 	return i
 }
 
-func WriteParentMap(k string, v []int) {
-	ParentMapMutex.Lock()
-	defer ParentMapMutex.Unlock()
-	ParentHashMap[k] = v
-}
-
-func ReadParentMap(k string) (childIndices []int, hasChildren bool) {
-	ParentMapMutex.RLock()
-	defer ParentMapMutex.RUnlock()
-	if v, ok := ParentHashMap[k]; ok {
-		return v, true
-	}
-
-	return []int{}, false
-}
-
 func WritePathMap(k string, v LongestPathInfo) {
 	PathMapMutex.Lock()
 	defer PathMapMutex.Unlock()
@@ -794,49 +881,40 @@ func GetPath(targetBlockHash string) []blockchain.Block {
 // Calculates how much ink a particular miner public key has
 func CalculateInk(minerKey string) int {
 	blockChain, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-	var inkAmt uint32
-	for _, block := range blockChain {
-		if block.MinerPubKey == minerKey {
-			if len(block.OpHistory) == 0 {
-				inkAmt += MinerInstance.Settings.InkPerNoOpBlock
-			} else {
-				inkAmt += MinerInstance.Settings.InkPerOpBlock
-			}
-		}
 
-		for _, opInfo := range block.OpHistory {
-			op := opInfo.Op
-			if opInfo.PubKey == minerKey {
-				shape, err := MinerInstance.getShapeFromOp(op)
-				if err != nil {
-					fmt.Println("CRITICAL ERROR: BAD SHAPE IN BLOCKCHAIN")
-					continue
-				}
+	CanvasMutex.Lock()
+	inkAmt := canvasAt(blockChain).Ink(minerKey)
+	CanvasMutex.Unlock()
 
-				_, cost := shape.SubArrayAndCost()
-				if op.OpType == blockchain.ADD {
-					inkAmt -= uint32(cost)
-				} else {
-					inkAmt += uint32(cost)
-				}
-			}
-		}
-	}
-	fmt.Println("this miner has this much ink:", int(inkAmt))
-	return int(inkAmt)
+	fmt.Println("this miner has this much ink:", inkAmt)
+	return inkAmt
 }
 
 /*******************************
 | Server Management functions
 ********************************/
 
+// Registers with the server and takes on its settings. Exits if the server
+// doesn't speak our protocol version.
 func (msi *MinerServerInterface) Register(minerAddr net.Addr) {
-	reqArgs := minerserver.MinerInfo{Address: minerAddr, Key: MinerInstance.PrivKey.PublicKey}
-	var resp minerserver.MinerNetSettings
+	reqArgs := protocol.MinerInfo{Address: minerAddr, Key: MinerInstance.PrivKey.PublicKey,
+		ProtocolVersion: protocol.PROTOCOL_VERSION}
+	var resp protocol.MinerNetSettings
 	err := msi.Client.Call("RServer.Register", reqArgs, &resp)
-	resp.PoWDifficultyOpBlock ++
-	resp.PoWDifficultyNoOpBlock ++
+	if envelope, ok := protocol.UnwrapError(fmt.Sprint(err)); ok {
+		err = envelope.Err()
+	}
+	if err == nil {
+		err = protocol.CheckVersion(resp.ProtocolVersion)
+	}
+	if _, ok := err.(protocol.ProtocolVersionError); ok {
+		CheckError(err, "Register:ProtocolVersion")
+		os.Exit(1)
+	}
 	CheckError(err, "Register:Client.Call")
+	if _, err := blockchain.HashAlgorithm(resp.HashAlgorithm).New(); CheckError(err, "Register:HashAlgorithm") {
+		os.Exit(1)
+	}
 	MinerInstance.Settings = resp
 }
 
@@ -850,10 +928,27 @@ func (msi *MinerServerInterface) ServerHeartBeat() {
 	}
 }
 
+// Returns the key the server has registered at addr
+func (msi *MinerServerInterface) GetMinerKey(addr net.Addr) (ecdsa.PublicKey, error) {
+	var key ecdsa.PublicKey
+	err := msi.Client.Call("RServer.GetMinerKey", addr.String(), &key)
+	return key, err
+}
+
+// Connects to the miners at addrSet we aren't connected to yet, while an
+// outbound slot is free. Miners that can't prove they own the key registered
+// at their address are dropped.
 func (msi *MinerServerInterface) GetPeers(addrSet []net.Addr) {
-	var blockchainResp []blockchain.Block
 	for _, addr := range addrSet {
-		if _, ok := PeerList[addr.String()]; !ok {
+		if !Peers.CanDial() {
+			fmt.Println("GetPeers::No outbound slot left")
+			return
+		}
+		if _, ok := Peers.Get(addr.String()); !ok {
+			if Scores.Banned(addr.String(), "") {
+				fmt.Println("GetPeers::Not connecting to banned address: ", addr.String())
+				continue
+			}
 			fmt.Println("GetPeers::Connecting to address: ", addr.String())
 			LocalAddr, err := net.ResolveTCPAddr("tcp", ":0")
 			if CheckError(err, "GetPeers:ResolvePeerAddr") {
@@ -865,22 +960,52 @@ func (msi *MinerServerInterface) GetPeers(addrSet []net.Addr) {
 				continue
 			}
 
+			// Over TLS, the peer must have the key registered at its address
+			var pinned *ecdsa.PublicKey
+			if UseTLS {
+				registered, err := msi.GetMinerKey(addr)
+				if CheckError(err, "GetPeers:GetMinerKey") {
+					continue
+				}
+				pinned = &registered
+			}
+
 			conn, err := net.DialTCP("tcp", LocalAddr, PeerAddr)
 			if CheckError(err, "GetPeers:DialTCP") {
 				continue
 			}
 
-			client := rpc.NewClient(conn)
+			secureConn, err := secureDial(conn, pinned)
+			if CheckError(err, "GetPeers:TLS") {
+				continue
+			}
 
-			args := ConnectArgs{MinerInstance.Addr}
-			err = client.Call("Peer.Connect", args, &blockchainResp)
-			if CheckError(err, "GetPeers:Connect") {
+			// The miner calls us over the same connection
+			peerConn := NewPeerConn(secureConn)
+			client := rpc.NewClientWithCodec(peerConn.ClientCodec())
+			auth := &peerAuth{remote: addr.String()}
+			Peers.serve(peerConn, auth)
+
+			key, tip, err := handshake(client, addr, auth)
+			if CheckError(err, "GetPeers:Handshake") {
+				client.Close()
+				continue
+			}
+			if Scores.Banned("", key) {
+				fmt.Println("GetPeers::Dropping banned key at: ", addr.String())
+				client.Close()
 				continue
 			}
-			for _, block := range blockchainResp {
-				InsertBlock(block)
+			if CheckError(Peers.Add(&Peer{client, time.Now(), key, addr.String(), false}), "GetPeers:Add") {
+				client.Close()
+				continue
+			}
+
+			fetched, err := SyncWithPeer(client, addr.String(), tip)
+			misbehavedInSync(addr.String(), key, err)
+			if !CheckError(err, "GetPeers:SyncWithPeer") && fetched > 0 {
+				fmt.Println("GetPeers::Fetched", fetched, "blocks from", addr.String())
 			}
-			PeerList[addr.String()] = &Peer{client, time.Now()}
 		}
 	}
 }
@@ -888,15 +1013,17 @@ func (msi *MinerServerInterface) GetPeers(addrSet []net.Addr) {
 /*******************************
 | Connection Management
 ********************************/
-// This function has 5 purposes:
+// This function has 6 purposes:
 // 1. Send the server heartbeat to maintain connectivity
 // 2. Send miner heartbeats to maintain connectivity with peers
-// 3. Check for stale peers and remove them from the list
-// 4. Request new nodes from server and connect to them when peers drop too low
+// 3. Check for stale and banned peers and remove them from the list
+// 4. Request new nodes from server and connect to them when peers drop too low,
+//    least misbehaved first, while outbound slots are free
 // 5. When a operation or block is sent through the channel, heartbeat will be replaced by Propagate<Type>
+// 6. Fetch the missing ancestors of orphans from the peers that sent them
 // This is the central point of control for the peer connectivity
 
-func ManageConnections(pop chan PropagateOpArgs, pblock chan PropagateBlockArgs, peerconn chan net.Addr) {
+func ManageConnections(pop chan PropagateOpArgs, pblock chan PropagateBlockArgs) {
 	// Send heartbeats at three times the timeout interval to be safe
 	interval := time.Duration(MinerInstance.Settings.HeartBeat / 5)
 	heartbeat := time.Tick(interval * time.Millisecond)
@@ -905,6 +1032,8 @@ func ManageConnections(pop chan PropagateOpArgs, pblock chan PropagateBlockArgs,
 		select {
 		case <-heartbeat:
 			MinerInstance.MSI.ServerHeartBeat()
+			Orphans.Expire()
+			DropBannedPeers()
 			if count >= 50 {
 				PeerSync()
 				count = 0
@@ -912,10 +1041,9 @@ func ManageConnections(pop chan PropagateOpArgs, pblock chan PropagateBlockArgs,
 				count++
 				PeerHeartBeats()
 			}
-		case addr := <-peerconn:
-			// Connection request from peerRpc
-			addrSet := []net.Addr{addr}
-			MinerInstance.MSI.GetPeers(addrSet)
+		case fetch := <-Orphans.Fetches:
+			// An orphan came in from a peer
+			FetchOrphanAncestors(fetch)
 		case op := <-pop:
 			MinerInstance.MSI.ServerHeartBeat()
 			PeerPropagateOp(op)
@@ -924,70 +1052,66 @@ func ManageConnections(pop chan PropagateOpArgs, pblock chan PropagateBlockArgs,
 			PeerPropagateBlock(block)
 		default:
 			CheckLiveliness()
-			if len(PeerList) < int(MinerInstance.Settings.MinNumMinerConnections) {
+			if Peers.Len() < int(MinerInstance.Settings.MinNumMinerConnections) && Peers.CanDial() {
 				var addrSet []net.Addr
 				MinerInstance.MSI.Client.Call("RServer.GetNodes", MinerInstance.PrivKey.PublicKey, &addrSet)
-				MinerInstance.MSI.GetPeers(addrSet)
+				MinerInstance.MSI.GetPeers(PreferPeers(addrSet))
 			}
 		}
 	}
 }
 
-// Try to sync up with peers once in a while
+// Try to sync up with peers once in a while. Only the blocks we are missing
+// are fetched (see chain-sync.go).
 func PeerSync() {
 	fmt.Println("Performing a sync")
-	for addr, peer := range PeerList {
-		var blockchainResp []blockchain.Block
+	for _, peer := range Peers.List() {
+		var tip ChainTip
 		empty := new(Empty)
-		err := peer.Client.Call("Peer.GetBlockChain", empty, &blockchainResp)
-		if !CheckError(err, "PeerSync:"+addr) {
-			peer.LastHeartBeat = time.Now()
-			for _, block := range blockchainResp {
-				InsertBlock(block)
-			}
+		err := peer.Client.Call("Peer.GetTip", empty, &tip)
+		if CheckError(err, "PeerSync:"+peer.Addr) {
+			continue
+		}
+		peer.LastHeartBeat = time.Now()
+
+		fetched, err := SyncWithPeer(peer.Client, peer.Addr, tip)
+		misbehavedInSync(peer.Addr, peer.Key, err)
+		if !CheckError(err, "PeerSync:"+peer.Addr) && fetched > 0 {
+			fmt.Println("PeerSync::Fetched", fetched, "blocks from", peer.Addr)
 		}
 	}
 }
 
 // Send a heartbeat call to each peer
 func PeerHeartBeats() {
-	for addr, peer := range PeerList {
+	for _, peer := range Peers.List() {
 		empty := new(Empty)
 		err := peer.Client.Call("Peer.Hb", &empty, &empty)
-		if !CheckError(err, "PeerHeartBeats:"+addr) {
+		if !CheckError(err, "PeerHeartBeats:"+peer.Addr) {
 			peer.LastHeartBeat = time.Now()
 		}
 	}
 }
 
-// Send a PropagateOp call to each peer
+// Announce an op to each peer, sending it to the peers that lack it
 // Assumption: Nothing needs to be done on the miner itself, only send the op onwards
 func PeerPropagateOp(op PropagateOpArgs) {
-	for _, peer := range PeerList {
-		empty := new(Empty)
-		args := PropagateOpArgs{op.OpInfo, op.TTL}
-		peer.Client.Call("Peer.PropagateOp", args, &empty)
-	}
+	PeerAnnounce([]Inv{{INV_OP, opHash(op.OpInfo)}})
 }
 
-// Send a PropagateBlock call to each peer
+// Announce a block to each peer, sending it to the peers that lack it
 // Assumption: Nothing needs to be done on the miner itself, only send the block onwards
 func PeerPropagateBlock(block PropagateBlockArgs) {
-	for _, peer := range PeerList {
-		empty := new(Empty)
-		args := PropagateBlockArgs{block.Block, block.TTL}
-		peer.Client.Call("Peer.PropagateBlock", args, &empty)
-	}
+	PeerAnnounce([]Inv{{INV_BLOCK, GetBlockHash(block.Block)}})
 }
 
 // Look through current active connections and delete them if they are not live
 func CheckLiveliness() {
 	interval := time.Duration(MinerInstance.Settings.HeartBeat) * time.Millisecond
-	for addr, peer := range PeerList {
+	for _, peer := range Peers.List() {
 		if time.Since(peer.LastHeartBeat) > interval {
-			fmt.Println("Stale connection: ", addr, " deleting")
-			peer.Client.Close()
-			delete(PeerList, addr)
+			fmt.Println("Stale connection: ", peer.Addr, " deleting")
+			Peers.Remove(peer)
 		}
 	}
 }
@@ -1004,18 +1128,15 @@ func CheckLiveliness() {
 func ProblemSolver(sop chan blockchain.OperationInfo, sblock chan blockchain.Block, pblock chan PropagateBlockArgs) {
 	// Channel for receiving the final block w/ nonce from workers
 	solved := make(chan blockchain.Block)
-	workingSet := make([]blockchain.OperationInfo, 0)
 
 	// Channel returned by a job call that can kill the workers for that particular job
 	var done chan bool
 
 	for {
 		select {
-		case op := <-sop:
-			// Received an op from somewhere
-			// Assuming it is properly validated
-			// Add it to the block we were working on
-			// reissue job
+		case <-sop:
+			// An op was added to the mempool
+			// Reissue the job with everything in the mempool
 			fmt.Println("got new op to hash")
 			// Kill current job
 			close(done)
@@ -1024,10 +1145,9 @@ func ProblemSolver(sop chan blockchain.OperationInfo, sblock chan blockchain.Blo
 			// Make a new channel
 			solved = make(chan blockchain.Block)
 
-			workingSet = append(workingSet, op)
-
+			// The mempool only holds ops that validate against the longest path
 			chain, chainLen := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-			workingSet = ValidateOps(workingSet, chain)
+			workingSet := Pool.Ops()
 
 			if len(workingSet) == 0 {
 				done = NoopJob(GetBlockHash(chain[chainLen-1]), solved)
@@ -1050,9 +1170,8 @@ func ProblemSolver(sop chan blockchain.OperationInfo, sblock chan blockchain.Blo
 			solved = make(chan blockchain.Block)
 
 			// Assume this was block was validated
-			// Assume this block has already been inserted
-			chain, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-			workingSet = ValidateOps(workingSet, chain)
+			// Assume this block has already been inserted, which moved the mempool onto it
+			workingSet := Pool.Ops()
 			if len(workingSet) == 0 {
 				done = NoopJob(GetBlockHash(block), solved)
 			} else {
@@ -1071,7 +1190,7 @@ func ProblemSolver(sop chan blockchain.OperationInfo, sblock chan blockchain.Blo
 
 			// Insert block into our data structure
 			InsertBlock(sol)
-			pblock <- PropagateBlockArgs{sol, TTL}
+			pblock <- PropagateBlockArgs{sol}
 
 			//fmt.Println("inserted solution: ", BlockNodeArray)
 			// Start a job on the longest block in the chain
@@ -1083,8 +1202,14 @@ func ProblemSolver(sop chan blockchain.OperationInfo, sblock chan blockchain.Blo
 			PrintBlockChain(chain)
 		default:
 			if CurrJobId == 0 {
+				// Build off whatever was restored from the block store
 				fmt.Println("Initiating the first job")
-				done = NoopJob(MinerInstance.Settings.GenesisBlockHash, solved)
+				chain, chainLen := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+				tipHash := MinerInstance.Settings.GenesisBlockHash
+				if chainLen > 1 {
+					tipHash = GetBlockHash(chain[chainLen-1])
+				}
+				done = NoopJob(tipHash, solved)
 			}
 		}
 	}
@@ -1095,15 +1220,12 @@ func NoopJob(hash string, solved chan blockchain.Block) chan bool {
 	CurrJobId++
 	fmt.Println("Starting job:", CurrJobId)
 	block := blockchain.Block{PrevHash: hash,
-		MinerPubKey: utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey)}
-	done := make(chan bool)
-	for i := 0; i <= MAX_THREADS; i++ {
-		CurrJobId++
-		// Split up the start by the maximum number of threads we allow
-		start := math.MaxUint32 / MAX_THREADS * i
-		go pow.Solve(block, MinerInstance.Settings.PoWDifficultyNoOpBlock, uint32(start), solved, done)
-	}
-	return done
+		MinerPubKey:   utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey),
+		HashAlgorithm: blockchain.HashAlgorithm(MinerInstance.Settings.HashAlgorithm)}
+	SetBlockDifficulty(&block)
+	SignBlock(&block)
+	difficulty, _ := CheckDifficulty(block)
+	return StartWorkers(block, difficulty, solved)
 }
 
 // Initiate a job with a predefined op array
@@ -1111,32 +1233,66 @@ func OpJob(hash string, Ops []blockchain.OperationInfo, solved chan blockchain.B
 	CurrJobId++
 	fmt.Println("Starting job:", CurrJobId)
 	block := blockchain.Block{PrevHash: hash,
-		OpHistory:   Ops,
-		MinerPubKey: utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey)}
+		OpHistory:     Ops,
+		MinerPubKey:   utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey),
+		HashAlgorithm: blockchain.HashAlgorithm(MinerInstance.Settings.HashAlgorithm)}
+	SetBlockDifficulty(&block)
+	SignBlock(&block)
+	difficulty, _ := CheckDifficulty(block)
+	return StartWorkers(block, difficulty, solved)
+}
+
+// Splits the nonce space of the block across pow.NumWorkers workers and
+// returns the channel that stops them
+func StartWorkers(block blockchain.Block, powDiff uint8, solved chan blockchain.Block) chan bool {
+	// Seed the search so that jobs don't all start from the same extra nonce
+	if pow.CanRollExtraNonce(block) {
+		block.ExtraNonce = mathrand.Uint32()
+	}
+
 	done := make(chan bool)
-	for i := 0; i <= MAX_THREADS; i++ {
-		CurrJobId++
-		// Split up the start by the maximum number of threads we allow
-		start := math.MaxUint32 / MAX_THREADS * i
-		go pow.Solve(block, MinerInstance.Settings.PoWDifficultyOpBlock, uint32(start), solved, done)
+	for i := 0; i < pow.NumWorkers; i++ {
+		start, end := pow.NonceRange(i, pow.NumWorkers)
+		go pow.Solve(block, powDiff, start, end, solved, done)
 	}
 	return done
 }
 
+// Periodically print how fast this miner is hashing
+func ReportHashRate() {
+	for range time.Tick(HASH_RATE_INTERVAL * time.Second) {
+		fmt.Printf("HashRate:: %.0f H/s across %d workers\n", pow.HashRate(), pow.NumWorkers)
+	}
+}
+
 /*******************************
 | Helpers
 ********************************/
-func Verify(msg []byte, sign []byte, R, S big.Int, privKey *ecdsa.PrivateKey) bool {
-	h := md5.New()
-	h.Write(msg)
-	hash := hex.EncodeToString(h.Sum(nil))
-	if hash == hex.EncodeToString(sign) && ecdsa.Verify(&privKey.PublicKey, sign, &R, &S) {
+func Verify(msg []byte, sign []byte, R, S big.Int, pubKey *ecdsa.PublicKey) bool {
+	hash := hex.EncodeToString(utils.ComputeHash(msg))
+	if hash == hex.EncodeToString(sign) && ecdsa.Verify(pubKey, sign, &R, &S) {
 		return true
 	} else {
 		fmt.Println("invalid access\n")
 		return false
 	}
 }
+
+// Returns the public key of the art node that signed the request, if it has
+// opened a canvas with us
+func ArtNodeKey(req *libminer.Request) (artNode string, ok bool) {
+	if !ArtNodes.Registered(req.PubKey) {
+		fmt.Println("invalid access: art node never opened a canvas")
+		return "", false
+	}
+
+	pubKey, err := parsePubKey(req.PubKey)
+	if err != nil || !Verify(req.Msg, req.HashedMsg, req.R, req.S, pubKey) {
+		return "", false
+	}
+	return req.PubKey, true
+}
+
 func CheckError(err error, parent string) bool {
 	if err != nil {
 		fmt.Println(parent, ":: found error! ", err)
@@ -1145,29 +1301,6 @@ func CheckError(err error, parent string) bool {
 	return false
 }
 
-func CheckStatusCode(err error) string {
-	switch err.(type) {
-	case libminer.ShapeSvgStringTooLongError:
-		return "1" + " " + err.Error()
-	case libminer.InvalidShapeSvgStringError:
-		return "2" + " " + err.Error()
-	case libminer.InsufficientInkError:
-		return "3" + " " + err.Error()
-	case libminer.ShapeOverlapError:
-		return "4" + " " + err.Error()
-	case libminer.OutOfBoundsError:
-		return "5" + " " + err.Error()
-	case libminer.InvalidBlockHashError:
-		return "6" + " " + err.Error()
-	case libminer.ShapeOwnerError:
-		return "7" + " " + err.Error()
-	case libminer.InvalidShapeHashError:
-		return "8" + " " + err.Error()
-	default:
-		return "9"
-	}
-}
-
 func ExtractKeyPairs(pubKey, privKey string) {
 	var PublicKey *ecdsa.PublicKey
 	var PrivateKey *ecdsa.PrivateKey
@@ -1195,11 +1328,13 @@ func pubKeyToString(key ecdsa.PublicKey) string {
 	return string(elliptic.Marshal(key.Curve, key.X, key.Y))
 }
 
+// Returns the hash of the block, or "" if the block names a hash algorithm
+// we don't know
 func GetBlockHash(block blockchain.Block) string {
-	h := md5.New()
-	bytes, _ := json.Marshal(block)
-	h.Write(bytes)
-	hash := hex.EncodeToString(h.Sum(nil))
+	hash, err := blockchain.HashBlock(block)
+	if err != nil {
+		return ""
+	}
 	return hash
 }
 
@@ -1208,17 +1343,9 @@ func GetBlockHash(block blockchain.Block) string {
 func GetBlockHashOfShapeHash(opSig string) string {
 	blockchain, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
 
-	for _, block := range blockchain {
-		for _, op := range block.OpHistory {
-			if op.OpSig == opSig {
-				blockByteData, _ := json.Marshal(block)
-				hashedBlock := utils.ComputeHash(blockByteData)
-				return hex.EncodeToString(hashedBlock)
-			}
-		}
-	}
-
-	return ""
+	CanvasMutex.Lock()
+	defer CanvasMutex.Unlock()
+	return canvasAt(blockchain).OpBlock(opSig)
 }
 
 func PrintBlockChain(blocks []blockchain.Block) {
@@ -1232,6 +1359,8 @@ func PrintBlockChain(blocks []blockchain.Block) {
 			for _, opinfo := range block.OpHistory {
 				if opinfo.Op.OpType == blockchain.ADD {
 					fmt.Print("-ADD:", opinfo.Op.SVGString, ":", opinfo.OpSig,"-")
+				} else if opinfo.Op.OpType == blockchain.TRANSFER {
+					fmt.Print("-TRANSFER:", opinfo.Op.Amount, ":", opinfo.OpSig,"-")
 				} else {
 					fmt.Print("-DELETE:", opinfo.Op.SVGString, ":", opinfo.OpSig,"-")
 				}
@@ -1295,13 +1424,33 @@ func GeneratePublicIP() string {
 /*******************************
 | Main
 ********************************/
+
+// Sets up the block chain globals with just the genesis block of our
+// settings, and moves the canvas, the chain events and the mempool onto it
+func InitBlockChain() {
+	// Initialize mutexes for concurrent R/W of BlockChain global variables
+	BlockChainMutex = &sync.RWMutex{}
+	BlockArrayMutex = &sync.Mutex{}
+	PathMapMutex = &sync.RWMutex{}
+	CanvasMutex = &sync.Mutex{}
+
+	// Initialize the hash map, block node array, and path map with the genesis block
+	BlockHashMap[MinerInstance.Settings.GenesisBlockHash] = 0
+	WriteBlockNodeArray(blockchain.BlockNode{})
+	dummyGenesisBlock := blockchain.Block{}
+	WritePathMap(MinerInstance.Settings.GenesisBlockHash, LongestPathInfo{Len: 1, Path: []blockchain.Block{dummyGenesisBlock}, Work: new(big.Int)})
+	Canvas = NewCanvasState()
+	genesisPath, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+	SyncCanvas(genesisPath)
+	ChainEvents.Update(genesisPath)
+	// Ops sent before the first block validate against the genesis block
+	SyncMempool(genesisPath)
+}
+
 func Mine(serverIP, pubKey, privKey string) {
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{})
-	// serverIP, pubKey, privKey := os.Args[1], os.Args[2], os.Args[3]
-	serverIP = os.Args[1]
 
-	BlockCond = &sync.Cond{L: &sync.Mutex{}}
 
 	// 1. Setup the singleton miner instance
 	MinerInstance = new(Miner)
@@ -1311,7 +1460,8 @@ func Mine(serverIP, pubKey, privKey string) {
 	publicIP := GeneratePublicIP()
 	fmt.Println(publicIP)
 
-	ln, _ := net.Listen("tcp", publicIP)
+	ln, err := net.Listen("tcp", publicIP)
+	CheckError(err, "Mine:Listen")
 	addr := ln.Addr()
 	MinerInstance.Addr = addr
 
@@ -1320,33 +1470,40 @@ func Mine(serverIP, pubKey, privKey string) {
 	pblock := make(chan PropagateBlockArgs, 1024)
 	sop := make(chan blockchain.OperationInfo, 1024)
 	sblock := make(chan blockchain.Block, 1024)
-	peerconn := make(chan net.Addr, 64)
 
 	// 3. Setup Miner-Miner Listener
-	go listenPeerRpc(ln, MinerInstance, pop, pblock, sop, sblock, peerconn)
+	go ListenPeerRpc(SecureListener(ln, true), MinerInstance, pop, pblock, sop, sblock)
+	ListenAdminRpc()
 
 	// Connect to Server
 	MinerInstance.ConnectToServer(serverIP)
 	MinerInstance.MSI.Register(addr)
 
-	// Initialize mutexes for concurrent R/W of BlockChain global variables
-	OpMutex = &sync.Mutex{}
-	BlockChainMutex = &sync.RWMutex{}
-	BlockArrayMutex = &sync.Mutex{}
-	ParentMapMutex = &sync.RWMutex{}
-	PathMapMutex = &sync.RWMutex{}
+	// Leave room to dial as many peers as the network asks for
+	if min := int(MinerInstance.Settings.MinNumMinerConnections); Peers.MaxOutbound < min {
+		Peers.MaxOutbound = min
+	}
 
-	// Initialize the hash map, block node array, and path map with the genesis block
-	BlockHashMap[MinerInstance.Settings.GenesisBlockHash] = 0
-	WriteBlockNodeArray(blockchain.BlockNode{})
-	dummyGenesisBlock := blockchain.Block{}
-	WritePathMap(MinerInstance.Settings.GenesisBlockHash, LongestPathInfo{Len: 1, Path: []blockchain.Block{dummyGenesisBlock}})
+	InitBlockChain()
+
+	// Rebuild the block chain from disk before dialing any peers
+	Store, err = OpenBlockStore(StoreDir(pubKey), MinerInstance.Settings.GenesisBlockHash)
+	if !CheckError(err, "Mine:OpenBlockStore") {
+		LoadBlockStore()
+
+		// Pick up the ops that were pending when we went down
+		if !CheckError(Pool.Open(Store.dir), "Mine:OpenMempool") {
+			longest, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+			SyncMempool(longest)
+		}
+	}
 
 	// 4. Setup Miner Heartbeat Manager
-	go ManageConnections(pop, pblock, peerconn)
+	go ManageConnections(pop, pblock)
 
 	// 5. Setup Problem Solving
 	go ProblemSolver(sop, sblock, pblock)
+	go ReportHashRate()
 
 	// 6. Setup Client-Miner Listener (this thread)
 	OpenLibMinerConn(":0", pop, sop)
@@ -0,0 +1,350 @@
+/*
+
+This file contains the mempool: the ops this miner has heard of that no block
+on the longest path holds yet. The problem solver builds its blocks from it.
+
+1. Ops are kept once, however many peers they are heard from and whatever
+   signature they carry: ops are told apart by opHash
+2. Ops are validated against the longest path, with the ops ahead of them in
+   the pool applied, when they are added and again every time the longest
+   path moves. Ops that no longer validate are dropped, and the ops of blocks
+   that left the longest path are taken back in.
+3. The pool is capped by the bytes of its ops and the ink they spend
+4. Ops that no block took in for OP_EXPIRY_BLOCKS blocks are dropped
+5. The pool is saved next to the block store on every change and loaded back
+   on boot
+
+*/
+
+package miner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"../blockchain"
+	"../libminer"
+	"../protocol"
+)
+
+const (
+	// Most bytes the encodings of the pooled ops may take together
+	MEMPOOL_MAX_BYTES = 1 << 20
+	// Most ink the pooled ADD and TRANSFER ops may spend together
+	MEMPOOL_MAX_INK = 1 << 20
+	// File in the block store directory the pool is saved to
+	MEMPOOL_FILE = "mempool.json"
+)
+
+// Our singleton mempool. It is only saved to disk once opened.
+var Pool = NewMempool()
+
+type MempoolEntry struct {
+	OpInfo   blockchain.OperationInfo
+	Height   int       // Height of the longest path when the op was added
+	Received time.Time // When the op was added
+	Size     int       // Bytes of the op's encoding
+	Cost     int       // Ink the op spends or transfers, 0 for a DELETE
+}
+
+type Mempool struct {
+	MaxBytes int
+	MaxInk   int
+
+	mutex   sync.Mutex
+	file    string // Where the pool is saved, "" if it isn't
+	entries map[string]*MempoolEntry // By OpSig
+	hashes  map[string]string        // OpSigs of the entries, by opHash
+	order   []string // OpSigs of the entries in the order they go into blocks
+	bytes   int
+	ink     int
+	path    []blockchain.Block // Longest path the pool was last validated against
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		MaxBytes: MEMPOOL_MAX_BYTES,
+		MaxInk:   MEMPOOL_MAX_INK,
+		entries:  make(map[string]*MempoolEntry),
+		hashes:   make(map[string]string)}
+}
+
+// Moves the mempool onto path, the longest path
+func SyncMempool(path []blockchain.Block) {
+	Pool.Update(path)
+}
+
+// Loads the pool saved in dir and saves it there from now on. The loaded ops
+// are validated on the next Update.
+func (p *Mempool) Open(dir string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.file = filepath.Join(dir, MEMPOOL_FILE)
+	data, err := ioutil.ReadFile(p.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*MempoolEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !p.has(entry.OpInfo) {
+			p.insert(entry)
+		}
+	}
+
+	fmt.Println("Mempool:: loaded", len(entries), "ops from", p.file)
+	return nil
+}
+
+// Adds an op to the pool if it validates after the ops already in it.
+// Possible Errors:
+// - DuplicateError
+// - MempoolFullError
+// - Any error from validating the op
+func (p *Mempool) Add(opInfo blockchain.OperationInfo) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.has(opInfo) {
+		return DuplicateError(opInfo.OpSig)
+	}
+
+	entry, err := p.newEntry(opInfo)
+	if err != nil {
+		return err
+	}
+
+	if p.bytes+entry.Size > p.MaxBytes || p.ink+entry.Cost > p.MaxInk {
+		return protocol.MempoolFullError(opInfo.OpSig)
+	}
+
+	CanvasMutex.Lock()
+	canvas := canvasAt(p.path)
+	pending := p.applyAll(canvas)
+	err = MinerInstance.checkOp(opInfo, canvas)
+	undoAll(canvas, pending)
+	CanvasMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	p.insert(entry)
+	p.save()
+	return nil
+}
+
+// Moves the pool onto path. Ops of blocks that left the longest path are
+// taken back in ahead of the others, without counting against the caps. Ops
+// now in a block, stale ops and ops that no longer validate are dropped.
+func (p *Mempool) Update(path []blockchain.Block) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Find how many blocks the two paths share
+	common := len(p.path)
+	if len(path) < common {
+		common = len(path)
+	}
+	for common > 0 && GetBlockHash(path[common-1]) != GetBlockHash(p.path[common-1]) {
+		common--
+	}
+
+	oldPath := p.path
+	p.path = path
+
+	var oldOrder []string
+	for _, block := range oldPath[common:] {
+		for _, opInfo := range block.OpHistory {
+			if p.has(opInfo) {
+				continue
+			}
+
+			entry, err := p.newEntry(opInfo)
+			if err != nil {
+				continue
+			}
+			p.insert(entry)
+			oldOrder = append(oldOrder, opInfo.OpSig)
+		}
+	}
+	if len(oldOrder) > 0 {
+		p.order = append(oldOrder, p.order[:len(p.order)-len(oldOrder)]...)
+	}
+
+	height := len(path) - 1
+	order := p.order
+	p.order = make([]string, 0, len(order))
+
+	CanvasMutex.Lock()
+	canvas := canvasAt(path)
+	pending := make([]canvasUndo, 0, len(order))
+	for _, opSig := range order {
+		entry := p.entries[opSig]
+		if canvas.HasOp(entry.OpInfo) {
+			p.remove(entry, "in a block")
+		} else if height-entry.Height > OP_EXPIRY_BLOCKS {
+			p.remove(entry, "expired")
+		} else if err := MinerInstance.checkOp(entry.OpInfo, canvas); err != nil {
+			p.remove(entry, err.Error())
+		} else {
+			pending = append(pending, canvas.applyPending(entry.OpInfo))
+			p.order = append(p.order, opSig)
+		}
+	}
+	undoAll(canvas, pending)
+	CanvasMutex.Unlock()
+
+	p.save()
+}
+
+// Returns the pooled ops in the order they go into blocks
+func (p *Mempool) Ops() []blockchain.OperationInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ops := make([]blockchain.OperationInfo, len(p.order))
+	for i, opSig := range p.order {
+		ops[i] = p.entries[opSig].OpInfo
+	}
+	return ops
+}
+
+// Returns the pooled entries in the order they go into blocks
+func (p *Mempool) Entries() []MempoolEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entries := make([]MempoolEntry, len(p.order))
+	for i, opSig := range p.order {
+		entries[i] = *p.entries[opSig]
+	}
+	return entries
+}
+
+// Returns the pooled op with hash, its opHash, under whatever signature it
+// was pooled with. False if there is none.
+func (p *Mempool) Get(hash string) (blockchain.OperationInfo, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry, ok := p.entries[p.hashes[hash]]
+	if !ok {
+		return blockchain.OperationInfo{}, false
+	}
+	return entry.OpInfo, true
+}
+
+// Returns an entry for an op arriving now
+func (p *Mempool) newEntry(opInfo blockchain.OperationInfo) (*MempoolEntry, error) {
+	entry := &MempoolEntry{
+		OpInfo:   opInfo,
+		Height:   len(p.path) - 1,
+		Received: time.Now(),
+		Size:     len(blockchain.EncodeOperationInfo(opInfo))}
+
+	if opInfo.Op.OpType == blockchain.TRANSFER {
+		entry.Cost = int(opInfo.Op.Amount)
+		return entry, nil
+	}
+
+	shape, err := MinerInstance.getShapeFromOp(opInfo.Op)
+	if err != nil {
+		return nil, err
+	}
+
+	if opInfo.Op.OpType == blockchain.ADD {
+		_, entry.Cost = shape.SubArrayAndCost()
+	}
+	return entry, nil
+}
+
+// Whether the op is pooled, under any signature
+func (p *Mempool) has(opInfo blockchain.OperationInfo) bool {
+	_, ok := p.hashes[opHash(opInfo)]
+	return ok
+}
+
+func (p *Mempool) insert(entry *MempoolEntry) {
+	p.entries[entry.OpInfo.OpSig] = entry
+	p.hashes[opHash(entry.OpInfo)] = entry.OpInfo.OpSig
+	p.order = append(p.order, entry.OpInfo.OpSig)
+	p.bytes += entry.Size
+	p.ink += entry.Cost
+}
+
+// Takes an entry out of the entries; the caller fixes up order
+func (p *Mempool) remove(entry *MempoolEntry, reason string) {
+	fmt.Println("Mempool:: dropping op,", reason+":", entry.OpInfo.OpSig)
+	delete(p.entries, entry.OpInfo.OpSig)
+	delete(p.hashes, opHash(entry.OpInfo))
+	p.bytes -= entry.Size
+	p.ink -= entry.Cost
+}
+
+// Applies the pooled ops to canvas and returns how to undo them
+func (p *Mempool) applyAll(canvas *CanvasState) []canvasUndo {
+	pending := make([]canvasUndo, len(p.order))
+	for i, opSig := range p.order {
+		pending[i] = canvas.applyPending(p.entries[opSig].OpInfo)
+	}
+	return pending
+}
+
+func undoAll(canvas *CanvasState, pending []canvasUndo) {
+	for i := len(pending) - 1; i >= 0; i-- {
+		canvas.undoOp(pending[i])
+	}
+}
+
+// Writes the pool to its file, replacing the old one in a single rename
+func (p *Mempool) save() {
+	if p.file == "" {
+		return
+	}
+
+	entries := make([]*MempoolEntry, len(p.order))
+	for i, opSig := range p.order {
+		entries[i] = p.entries[opSig]
+	}
+
+	data, err := json.Marshal(entries)
+	if CheckError(err, "Mempool:Marshal") {
+		return
+	}
+
+	tmp := p.file + ".tmp"
+	if CheckError(ioutil.WriteFile(tmp, data, 0644), "Mempool:WriteFile") {
+		return
+	}
+	CheckError(os.Rename(tmp, p.file), "Mempool:Rename")
+}
+
+// Lists the ops in the mempool, in the order they go into blocks
+func (lmi *LibMinerInterface) GetPendingOps(req *libminer.Request, response *libminer.PendingOpsResponse) (err error) {
+	if _, ok := ArtNodeKey(req); ok {
+		for _, entry := range Pool.Entries() {
+			response.Ops = append(response.Ops, libminer.MempoolOp{
+				OpInfo:   entry.OpInfo,
+				Size:     uint32(entry.Size),
+				InkCost:  uint32(entry.Cost),
+				Received: entry.Received.UnixNano() / int64(time.Millisecond)})
+		}
+		return nil
+	}
+	err = fmt.Errorf("invalid user")
+	return err
+}
@@ -0,0 +1,124 @@
+/*
+
+This file contains the verification of operation signatures. Art nodes sign
+their own ops with the key they opened the canvas with: OpSig is the hex of
+the ASN.1 ECDSA signature over blockchain.OperationDigest, which covers the
+whole op info but OpSig, and PubKey the hex of the x509 encoding of the public
+key. Ops from art nodes, ops heard from peers and ops in the blocks of peers
+are checked against PubKey, so no one can spend the ink of another key.
+
+An ECDSA signature can be changed into another valid one for the same op, so
+ops are told apart by the hash of their content (see opHash), never by OpSig.
+
+Rejected ops are logged and counted by reason.
+
+*/
+
+package miner
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"../blockchain"
+)
+
+// Reasons an op signature is rejected for
+const (
+	REJECT_BAD_PUBKEY    = "bad public key"
+	REJECT_BAD_SIGNATURE = "bad signature encoding"
+	REJECT_FORGED        = "signature does not match public key"
+)
+
+// Number of ops rejected for every reason, and its lock
+var (
+	OpRejections      = make(map[string]int)
+	OpRejectionsMutex = &sync.Mutex{}
+)
+
+type OpSignatureError struct {
+	OpSig  string
+	Reason string
+}
+
+func (e OpSignatureError) Error() string {
+	return fmt.Sprintf("Rejected op signature, %s: %s", e.Reason, e.OpSig)
+}
+
+// Checks that the op was signed with the key in its PubKey
+func VerifyOpSignature(opInfo blockchain.OperationInfo) error {
+	pubKey, err := parsePubKey(opInfo.PubKey)
+	if err != nil {
+		return OpSignatureError{opInfo.OpSig, REJECT_BAD_PUBKEY}
+	}
+
+	sig, err := hex.DecodeString(opInfo.OpSig)
+	if err != nil || len(sig) == 0 {
+		return OpSignatureError{opInfo.OpSig, REJECT_BAD_SIGNATURE}
+	}
+
+	if !ecdsa.VerifyASN1(pubKey, blockchain.OperationDigest(opInfo), sig) {
+		return OpSignatureError{opInfo.OpSig, REJECT_FORGED}
+	}
+
+	return nil
+}
+
+// Returns the hash of the op's content, which is the same whatever signature
+// the op carries
+func opHash(opInfo blockchain.OperationInfo) string {
+	return hex.EncodeToString(blockchain.OperationDigest(opInfo))
+}
+
+// Parses a public key in the hex of its x509 encoding
+func parsePubKey(hexKey string) (*ecdsa.PublicKey, error) {
+	pubKeyBytes, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA key")
+	}
+	return pubKey, nil
+}
+
+// Verifies the signature of an op received from source, logging and counting
+// it if it is rejected
+func CheckOpSignature(opInfo blockchain.OperationInfo, source string) error {
+	err := VerifyOpSignature(opInfo)
+	if err == nil {
+		return nil
+	}
+
+	reason := err.(OpSignatureError).Reason
+	OpRejectionsMutex.Lock()
+	OpRejections[reason]++
+	count := OpRejections[reason]
+	OpRejectionsMutex.Unlock()
+
+	fmt.Println("CheckOpSignature:: rejected op from", source+":", reason, "-", count, "so far. PubKey:",
+		opInfo.PubKey, "OpSig:", opInfo.OpSig)
+	return err
+}
+
+// Returns a copy of the rejection counts
+func OpRejectionCounts() map[string]int {
+	OpRejectionsMutex.Lock()
+	defer OpRejectionsMutex.Unlock()
+
+	counts := make(map[string]int, len(OpRejections))
+	for reason, count := range OpRejections {
+		counts[reason] = count
+	}
+	return counts
+}
@@ -0,0 +1,298 @@
+/*
+
+This file contains the orphan pool: blocks whose parent we haven't got. They
+are kept out of the block chain, and go in right after their parent does.
+
+1. Orphans are verified like any other block (hash, signature and proof of
+   work at a bounded difficulty) before they are pooled, and their ops once
+   they go in
+2. The pool is capped by the number of orphans, by the number from any one
+   peer and by their bytes. A full pool drops a random orphan, so junk can't
+   push out a chosen one.
+3. Orphans that are still waiting after ORPHAN_EXPIRY seconds are dropped
+4. The peer that sent an orphan is asked for its missing ancestors (see
+   FetchOrphanAncestors)
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"../blockchain"
+)
+
+const (
+	// Most orphans the pool holds
+	MAX_ORPHANS = 100
+	// Most orphans the pool holds from any one peer
+	MAX_ORPHANS_PER_PEER = 20
+	// Most bytes the encodings of the orphans may take together
+	MAX_ORPHAN_BYTES = 4 << 20
+	// Seconds an orphan waits for its parent
+	ORPHAN_EXPIRY = 10 * 60
+	// Ancestors fetched one by one for an orphan off the peer's longest path
+	MAX_ORPHAN_FETCHES = 16
+	// Fetches that may wait for the connection manager
+	ORPHAN_FETCH_QUEUE = 64
+)
+
+type Orphan struct {
+	Block    blockchain.Block
+	From     string    // Address of the peer that sent it, "" if none did
+	Received time.Time // When it was pooled
+	Size     int       // Bytes of its encoding
+}
+
+// A request to the peer at Addr for the missing ancestors of the orphan with
+// Hash
+type OrphanFetch struct {
+	Addr string
+	Hash string
+}
+
+type OrphanPool struct {
+	MaxOrphans int
+	MaxPerPeer int
+	MaxBytes   int
+	Expiry     time.Duration
+
+	// Fetches for the connection manager to make
+	Fetches chan OrphanFetch
+
+	mutex    *sync.Mutex
+	orphans  map[string]*Orphan
+	children map[string][]string // Hashes of the orphans by the hash of their parent
+	perPeer  map[string]int
+	bytes    int
+}
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		MaxOrphans: MAX_ORPHANS,
+		MaxPerPeer: MAX_ORPHANS_PER_PEER,
+		MaxBytes:   MAX_ORPHAN_BYTES,
+		Expiry:     ORPHAN_EXPIRY * time.Second,
+		Fetches:    make(chan OrphanFetch, ORPHAN_FETCH_QUEUE),
+		mutex:      &sync.Mutex{},
+		orphans:    make(map[string]*Orphan),
+		children:   make(map[string][]string),
+		perPeer:    make(map[string]int)}
+}
+
+// Our singleton orphan pool
+var Orphans = NewOrphanPool()
+
+// Pools block, sent by the peer at from. Returns false if it is pooled
+// already or from has used up its share of the pool.
+func (p *OrphanPool) Add(block blockchain.Block, from string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.expire()
+
+	hash := GetBlockHash(block)
+	if _, ok := p.orphans[hash]; ok {
+		return false
+	}
+	if from != "" && p.perPeer[from] >= p.MaxPerPeer {
+		fmt.Println("OrphanPool:: too many orphans from", from)
+		return false
+	}
+
+	orphan := &Orphan{block, from, time.Now(), len(blockchain.EncodeBlock(block))}
+	if orphan.Size > p.MaxBytes {
+		return false
+	}
+	for len(p.orphans) > 0 && (len(p.orphans) >= p.MaxOrphans || p.bytes+orphan.Size > p.MaxBytes) {
+		p.evictRandom()
+	}
+
+	p.orphans[hash] = orphan
+	p.children[block.PrevHash] = append(p.children[block.PrevHash], hash)
+	if from != "" {
+		p.perPeer[from]++
+	}
+	p.bytes += orphan.Size
+	return true
+}
+
+// Asks for the missing ancestors of the orphan with hash to be fetched from
+// the peer at from. Dropped if too many fetches are waiting already.
+func (p *OrphanPool) RequestAncestors(from, hash string) {
+	select {
+	case p.Fetches <- OrphanFetch{from, hash}:
+	default:
+		fmt.Println("OrphanPool:: dropping fetch of the ancestors of", hash)
+	}
+}
+
+// Takes the orphans whose parent has the hash out of the pool and returns
+// them
+func (p *OrphanPool) Adopt(hash string) []blockchain.Block {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	blocks := make([]blockchain.Block, 0)
+	for _, childHash := range p.children[hash] {
+		if orphan, ok := p.orphans[childHash]; ok {
+			blocks = append(blocks, orphan.Block)
+			p.remove(childHash)
+		}
+	}
+	return blocks
+}
+
+// Returns the hash of the block the orphan with hash is missing: its parent,
+// or the parent of its oldest ancestor in the pool. Returns false if the
+// orphan isn't in the pool.
+func (p *OrphanPool) MissingParent(hash string) (string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	orphan, ok := p.orphans[hash]
+	if !ok {
+		return "", false
+	}
+	for {
+		parent, ok := p.orphans[orphan.Block.PrevHash]
+		if !ok {
+			return orphan.Block.PrevHash, true
+		}
+		orphan = parent
+	}
+}
+
+// Drops the orphans that have waited too long
+func (p *OrphanPool) Expire() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.expire()
+}
+
+func (p *OrphanPool) Has(hash string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, ok := p.orphans[hash]
+	return ok
+}
+
+// Returns the number of orphans in the pool
+func (p *OrphanPool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.orphans)
+}
+
+func (p *OrphanPool) expire() {
+	for hash, orphan := range p.orphans {
+		if time.Since(orphan.Received) > p.Expiry {
+			fmt.Println("OrphanPool:: orphan expired:", hash)
+			p.remove(hash)
+		}
+	}
+}
+
+func (p *OrphanPool) evictRandom() {
+	i := rand.Intn(len(p.orphans))
+	for hash := range p.orphans {
+		if i == 0 {
+			p.remove(hash)
+			return
+		}
+		i--
+	}
+}
+
+func (p *OrphanPool) remove(hash string) {
+	orphan := p.orphans[hash]
+	delete(p.orphans, hash)
+
+	prevHash := orphan.Block.PrevHash
+	siblings := p.children[prevHash]
+	for i, sibling := range siblings {
+		if sibling == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.children, prevHash)
+	} else {
+		p.children[prevHash] = siblings
+	}
+
+	if orphan.From != "" {
+		p.perPeer[orphan.From]--
+		if p.perPeer[orphan.From] == 0 {
+			delete(p.perPeer, orphan.From)
+		}
+	}
+	p.bytes -= orphan.Size
+}
+
+// Puts the orphans following the block with hash into the block chain, once
+// their ops check out on top of it
+func adoptOrphans(hash string) {
+	for _, block := range Orphans.Adopt(hash) {
+		if !MinerInstance.ValidateBlock(block, GetPath(block.PrevHash)) {
+			fmt.Println("adoptOrphans:: dropping invalid orphan", GetBlockHash(block))
+			continue
+		}
+		CheckError(InsertBlock(block), "adoptOrphans:InsertBlock")
+	}
+}
+
+// Asks the peer that sent an orphan for its missing ancestors. The orphan most
+// likely follows the peer's longest path, so the peer is synced with first
+// (see chain-sync.go). Ancestors off that path are then fetched one by one, up
+// to MAX_ORPHAN_FETCHES of them.
+func FetchOrphanAncestors(fetch OrphanFetch) {
+	peer, ok := Peers.Get(fetch.Addr)
+	if !ok {
+		return
+	}
+
+	var tip ChainTip
+	empty := new(Empty)
+	if !CheckError(peer.Client.Call("Peer.GetTip", empty, &tip), "FetchOrphanAncestors:GetTip") {
+		_, err := SyncWithPeer(peer.Client, fetch.Addr, tip)
+		misbehavedInSync(fetch.Addr, peer.Key, err)
+		CheckError(err, "FetchOrphanAncestors:SyncWithPeer")
+	}
+
+	for i := 0; i < MAX_ORPHAN_FETCHES; i++ {
+		missing, ok := Orphans.MissingParent(fetch.Hash)
+		if !ok {
+			// Adopted, or dropped
+			return
+		}
+
+		var blocks []blockchain.Block
+		err := peer.Client.Call("Peer.GetBlocks", GetBlocksArgs{[]string{missing}}, &blocks)
+		if CheckError(err, "FetchOrphanAncestors:GetBlocks") || len(blocks) != 1 || GetBlockHash(blocks[0]) != missing {
+			return
+		}
+
+		block := blocks[0]
+		if _, hasParent := ReadBlockChainMap(block.PrevHash); hasParent {
+			if !MinerInstance.ValidateBlock(block, GetPath(block.PrevHash)) {
+				Scores.Misbehaved(fetch.Addr, peer.Key, SCORE_INVALID_BLOCK, "invalid block")
+				return
+			}
+			CheckError(InsertBlock(block), "FetchOrphanAncestors:InsertBlock")
+		} else if !VerifyBlock(block) {
+			Scores.Misbehaved(fetch.Addr, peer.Key, SCORE_INVALID_BLOCK, "invalid block")
+			return
+		} else if !Orphans.Add(block, fetch.Addr) {
+			return
+		}
+	}
+}
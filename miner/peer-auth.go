@@ -0,0 +1,247 @@
+/*
+
+This file contains the handshake miners authenticate each other with. Every
+miner proves it owns the key it registered with the server, on both ends of a
+connection:
+
+  1. The dialer calls Hello with its key and a fresh challenge. The listener
+     answers with its own key, a challenge of its own, and its signature over
+     both challenges.
+  2. The dialer checks the signature, and that the server has the listener's
+     key registered at the address it dialed. It then calls Connect with its
+     listening address and its signature over both challenges.
+  3. The listener checks the signature, and that the server has the dialer's
+     key registered at that address.
+
+Signatures are ASN.1 ECDSA over the SHA-256 of the role of the signer and the
+two challenges, the challenge of the other side first, so a signature can't be
+replayed on another connection or reflected back. Keys are the hex of their
+x509 encoding, as in op signatures.
+
+From Connect on, the connection belongs to the dialer's key at our end if we
+listened, and to the listener's key if we dialed, as both ends take calls
+over it (see peer-conn.go). Every other peer RPC is refused on connections
+that haven't authenticated, or whose address or key got banned (see
+peer-score.go). Over TLS, the dialer must say hello with the key of its
+certificate.
+
+*/
+
+package miner
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"../utils"
+)
+
+// Bytes in a handshake challenge
+const CHALLENGE_SIZE = 32
+
+// Roles a handshake signature is made in
+const (
+	HANDSHAKE_ACCEPT = "blockart-peer-accept"
+	HANDSHAKE_DIAL   = "blockart-peer-dial"
+)
+
+// Reasons a peer is rejected for, on top of the op ones
+const (
+	REJECT_BAD_CHALLENGE     = "bad challenge"
+	REJECT_NO_HELLO          = "connect before hello"
+	REJECT_UNREGISTERED      = "key not registered at address"
+	REJECT_UNAUTHENTICATED   = "connection not authenticated"
+	REJECT_ALREADY_CONNECTED = "connection already authenticated"
+	REJECT_TLS_MISMATCH      = "key differs from TLS certificate"
+	REJECT_BANNED            = "peer is banned"
+)
+
+type PeerAuthError struct {
+	Addr   string
+	Reason string
+}
+
+func (e PeerAuthError) Error() string {
+	return fmt.Sprintf("Rejected peer %s: %s", e.Addr, e.Reason)
+}
+
+type HelloArgs struct {
+	Key       string
+	Challenge []byte
+}
+
+type HelloReply struct {
+	Key       string
+	Challenge []byte
+	Sig       []byte
+}
+
+// Handshake state of one connection
+type peerAuth struct {
+	sync.Mutex
+	remote string // Address of the other end
+	key    string // Key the other end said hello with
+	theirs []byte // Challenge of the dialer
+	ours   []byte // Challenge we sent the dialer
+	peer   string // Key the connection belongs to once authenticated
+	addr   string // Address the peer listens at once authenticated
+	cert   string // Key of the dialer's TLS certificate, if over TLS
+}
+
+// Returns a fresh challenge
+func newChallenge() []byte {
+	challenge := make([]byte, CHALLENGE_SIZE)
+	rand.Read(challenge)
+	return challenge
+}
+
+// Returns what a handshake signature in role is made over
+func handshakeDigest(role string, theirs, ours []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(role))
+	h.Write(theirs)
+	h.Write(ours)
+	return h.Sum(nil)
+}
+
+// Signs the two challenges with our key in role
+func signHandshake(role string, theirs, ours []byte) []byte {
+	sig, err := MinerInstance.PrivKey.Sign(rand.Reader, handshakeDigest(role, theirs, ours), nil)
+	CheckError(err, "signHandshake")
+	return sig
+}
+
+// Checks that key signed the two challenges in role, and that it is the key
+// the server has registered at addr
+func verifyPeer(addr net.Addr, key string, sig []byte, role string, theirs, ours []byte) error {
+	pubKey, err := parsePubKey(key)
+	if err != nil {
+		return PeerAuthError{addr.String(), REJECT_BAD_PUBKEY}
+	}
+
+	if !ecdsa.VerifyASN1(pubKey, handshakeDigest(role, theirs, ours), sig) {
+		return PeerAuthError{addr.String(), REJECT_FORGED}
+	}
+
+	registered, err := MinerInstance.MSI.GetMinerKey(addr)
+	if err != nil || pubKeyToString(registered) != pubKeyToString(*pubKey) {
+		return PeerAuthError{addr.String(), REJECT_UNREGISTERED}
+	}
+
+	return nil
+}
+
+// Starts the handshake of an incoming connection: takes the dialer's key and
+// challenge, and proves we own our key
+func (p *PeerRpc) Hello(args HelloArgs, reply *HelloReply) error {
+	p.auth.Lock()
+	defer p.auth.Unlock()
+
+	if p.auth.peer != "" {
+		return PeerAuthError{p.auth.remote, REJECT_ALREADY_CONNECTED}
+	}
+	if len(args.Challenge) != CHALLENGE_SIZE {
+		return PeerAuthError{p.auth.remote, REJECT_BAD_CHALLENGE}
+	}
+
+	p.auth.key = args.Key
+	p.auth.theirs = args.Challenge
+	p.auth.ours = newChallenge()
+
+	reply.Key = utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey)
+	reply.Challenge = p.auth.ours
+	reply.Sig = signHandshake(HANDSHAKE_ACCEPT, p.auth.theirs, p.auth.ours)
+	return nil
+}
+
+// Finishes the handshake of an incoming connection. On success the
+// connection belongs to the key the dialer said hello with. A challenge is
+// good for one try only.
+func (p *PeerRpc) authenticate(args ConnectArgs) error {
+	p.auth.Lock()
+	defer p.auth.Unlock()
+
+	if p.auth.peer != "" {
+		return PeerAuthError{p.auth.remote, REJECT_ALREADY_CONNECTED}
+	}
+	if p.auth.ours == nil || args.Addr == nil {
+		return PeerAuthError{p.auth.remote, REJECT_NO_HELLO}
+	}
+
+	theirs, ours := p.auth.theirs, p.auth.ours
+	p.auth.theirs, p.auth.ours = nil, nil
+	if p.auth.cert != "" && p.auth.cert != p.auth.key {
+		return PeerAuthError{p.auth.remote, REJECT_TLS_MISMATCH}
+	}
+	if Scores.Banned(args.Addr.String(), p.auth.key) {
+		return PeerAuthError{args.Addr.String(), REJECT_BANNED}
+	}
+	if err := verifyPeer(args.Addr, p.auth.key, args.Sig, HANDSHAKE_DIAL, ours, theirs); err != nil {
+		fmt.Println("authenticate::", err)
+		return err
+	}
+
+	// The connection is a peer of ours from now on, if a slot is free
+	peer := &Peer{rpc.NewClientWithCodec(p.conn.ClientCodec()), time.Now(), p.auth.key, args.Addr.String(), true}
+	if err := Peers.Add(peer); err != nil {
+		fmt.Println("authenticate::", err)
+		return err
+	}
+
+	p.auth.peer = p.auth.key
+	p.auth.addr = args.Addr.String()
+	return nil
+}
+
+// Returns the key the connection belongs to, or an error if it hasn't
+// authenticated or got banned
+func (p *PeerRpc) peer() (string, error) {
+	p.auth.Lock()
+	defer p.auth.Unlock()
+
+	if p.auth.peer == "" {
+		return "", PeerAuthError{p.auth.remote, REJECT_UNAUTHENTICATED}
+	}
+	if Scores.Banned(p.auth.addr, p.auth.peer) {
+		return "", PeerAuthError{p.auth.addr, REJECT_BANNED}
+	}
+	return p.auth.peer, nil
+}
+
+// Runs the dialer's half of the handshake over client, to the miner we dialed
+// at addr. Calls from the miner over the connection are taken once it has
+// proven its key, so auth is the handshake state of our end. Returns the key
+// of the miner and the tip it sent on Connect.
+func handshake(client *rpc.Client, addr net.Addr, auth *peerAuth) (string, ChainTip, error) {
+	ours := newChallenge()
+	args := HelloArgs{utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey), ours}
+	var hello HelloReply
+	if err := client.Call("Peer.Hello", args, &hello); err != nil {
+		return "", ChainTip{}, err
+	}
+
+	if len(hello.Challenge) != CHALLENGE_SIZE {
+		return "", ChainTip{}, PeerAuthError{addr.String(), REJECT_BAD_CHALLENGE}
+	}
+	if err := verifyPeer(addr, hello.Key, hello.Sig, HANDSHAKE_ACCEPT, ours, hello.Challenge); err != nil {
+		return "", ChainTip{}, err
+	}
+
+	// The miner may call us as soon as it has taken Connect
+	auth.Lock()
+	auth.key, auth.peer, auth.addr = hello.Key, hello.Key, addr.String()
+	auth.Unlock()
+
+	var tip ChainTip
+	connectArgs := ConnectArgs{MinerInstance.Addr, signHandshake(HANDSHAKE_DIAL, hello.Challenge, ours)}
+	if err := client.Call("Peer.Connect", connectArgs, &tip); err != nil {
+		return "", ChainTip{}, err
+	}
+	return hello.Key, tip, nil
+}
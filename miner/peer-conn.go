@@ -0,0 +1,175 @@
+/*
+
+This file contains how both ends of one connection call each other's peer
+RPCs. net/rpc only calls one way over a connection, so calls and replies in
+both directions are sent as frames over it:
+
+  - a frame carries the header of a call or of a reply, and its body encoded
+    on its own
+  - one goroutine reads the frames, and hands calls to the server of the
+    connection and replies to its client
+
+So a peer is one connection, whichever end dialed it.
+
+*/
+
+package miner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// Frames that may wait for the server or the client of a connection
+const PEER_CONN_QUEUE = 64
+
+// A call or reply on a peer connection
+type peerFrame struct {
+	Reply         bool // A reply to a call of ours, or a call from the peer
+	ServiceMethod string
+	Seq           uint64
+	Error         string // Of a reply
+	Body          []byte
+}
+
+type PeerConn struct {
+	conn       net.Conn
+	writeMutex *sync.Mutex
+	buf        *bufio.Writer
+	enc        *gob.Encoder
+	calls      chan peerFrame
+	replies    chan peerFrame
+}
+
+// Starts reading the frames of conn
+func NewPeerConn(conn net.Conn) *PeerConn {
+	buf := bufio.NewWriter(conn)
+	c := &PeerConn{
+		conn:       conn,
+		writeMutex: &sync.Mutex{},
+		buf:        buf,
+		enc:        gob.NewEncoder(buf),
+		calls:      make(chan peerFrame, PEER_CONN_QUEUE),
+		replies:    make(chan peerFrame, PEER_CONN_QUEUE)}
+	go c.read()
+	return c
+}
+
+// Returns the codec to serve the peer's calls with
+func (c *PeerConn) ServerCodec() rpc.ServerCodec {
+	return &peerServerCodec{conn: c}
+}
+
+// Returns the codec to call the peer with
+func (c *PeerConn) ClientCodec() rpc.ClientCodec {
+	return &peerClientCodec{conn: c}
+}
+
+// Closes the connection, for the server and the client both
+func (c *PeerConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *PeerConn) read() {
+	dec := gob.NewDecoder(bufio.NewReader(c.conn))
+	for {
+		var frame peerFrame
+		if err := dec.Decode(&frame); err != nil {
+			break
+		}
+		if frame.Reply {
+			c.replies <- frame
+		} else {
+			c.calls <- frame
+		}
+	}
+	c.conn.Close()
+	close(c.calls)
+	close(c.replies)
+}
+
+func (c *PeerConn) write(frame peerFrame, body interface{}) error {
+	if body != nil {
+		var encoded bytes.Buffer
+		if err := gob.NewEncoder(&encoded).Encode(body); err != nil {
+			return err
+		}
+		frame.Body = encoded.Bytes()
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := c.enc.Encode(frame); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return c.buf.Flush()
+}
+
+// Decodes body into x, unless x is nil
+func decodeBody(body []byte, x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(body)).Decode(x)
+}
+
+type peerServerCodec struct {
+	conn *PeerConn
+	body []byte
+}
+
+func (s *peerServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	frame, ok := <-s.conn.calls
+	if !ok {
+		return io.EOF
+	}
+	r.ServiceMethod, r.Seq = frame.ServiceMethod, frame.Seq
+	s.body = frame.Body
+	return nil
+}
+
+func (s *peerServerCodec) ReadRequestBody(x interface{}) error {
+	return decodeBody(s.body, x)
+}
+
+func (s *peerServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	return s.conn.write(peerFrame{Reply: true, ServiceMethod: r.ServiceMethod, Seq: r.Seq, Error: r.Error}, x)
+}
+
+func (s *peerServerCodec) Close() error {
+	return s.conn.Close()
+}
+
+type peerClientCodec struct {
+	conn *PeerConn
+	body []byte
+}
+
+func (c *peerClientCodec) WriteRequest(r *rpc.Request, x interface{}) error {
+	return c.conn.write(peerFrame{ServiceMethod: r.ServiceMethod, Seq: r.Seq}, x)
+}
+
+func (c *peerClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	frame, ok := <-c.conn.replies
+	if !ok {
+		return io.EOF
+	}
+	r.ServiceMethod, r.Seq, r.Error = frame.ServiceMethod, frame.Seq, frame.Error
+	c.body = frame.Body
+	return nil
+}
+
+func (c *peerClientCodec) ReadResponseBody(x interface{}) error {
+	return decodeBody(c.body, x)
+}
+
+func (c *peerClientCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,220 @@
+/*
+
+This file contains the peer manager: the miners we are connected to, whichever
+end dialed (see peer-conn.go).
+
+1. Peers are known by the key they authenticated with. There is one
+   connection per key: when two miners dial each other at once, both keep the
+   connection dialed by the lower key and close the other.
+2. Peers we dial take an outbound slot, and peers that dial us an inbound
+   one. A connection is refused when its slots are taken.
+3. A connection to ourselves is tracked once, at the end that dialed it.
+
+The peers are behind a mutex, as the listener adds inbound peers while the
+connection manager (see ManageConnections) dials, heartbeats and drops them.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"../utils"
+)
+
+const (
+	// Most peers we dial
+	MAX_OUTBOUND_PEERS = 8
+	// Most peers that dial us
+	MAX_INBOUND_PEERS = 32
+)
+
+// Reasons a peer isn't added
+const (
+	PEER_DUPLICATE  = "already connected to key"
+	PEER_SLOTS_FULL = "no free slot"
+)
+
+type PeerManagerError struct {
+	Addr   string
+	Reason string
+}
+
+func (e PeerManagerError) Error() string {
+	return fmt.Sprintf("Peer %s not added: %s", e.Addr, e.Reason)
+}
+
+type Peer struct {
+	Client        *rpc.Client
+	LastHeartBeat time.Time
+	Key           string // Key the peer proved it owns when we connected
+	Addr          string // Address the peer listens at
+	Inbound       bool   // Whether the peer dialed us
+}
+
+// Returns the key of the miner that dialed the connection to peer
+func (peer *Peer) dialer() string {
+	if peer.Inbound {
+		return peer.Key
+	}
+	return utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey)
+}
+
+type PeerManager struct {
+	MaxOutbound int
+	MaxInbound  int
+
+	mutex   *sync.Mutex
+	peers   map[string]*Peer // By key
+	handler *PeerRpc         // RPCs served to peers, once ListenPeerRpc sets them
+}
+
+func NewPeerManager() *PeerManager {
+	return &PeerManager{
+		MaxOutbound: MAX_OUTBOUND_PEERS,
+		MaxInbound:  MAX_INBOUND_PEERS,
+		mutex:       &sync.Mutex{},
+		peers:       make(map[string]*Peer)}
+}
+
+// Our singleton peer manager
+var Peers = NewPeerManager()
+
+// Adds peer in a slot of its direction.
+// Possible Errors:
+// - PeerManagerError
+func (m *PeerManager) Add(peer *Peer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ours := utils.GetPublicKeyString(MinerInstance.PrivKey.PublicKey)
+	if peer.Inbound && peer.Key == ours {
+		// The outbound end is tracked
+		return nil
+	}
+
+	existing, ok := m.peers[peer.Key]
+	if ok && (existing.Inbound == peer.Inbound || existing.dialer() < peer.dialer()) {
+		return PeerManagerError{peer.Addr, PEER_DUPLICATE}
+	}
+
+	inbound, outbound := m.count()
+	if ok && existing.Inbound {
+		inbound--
+	} else if ok {
+		outbound--
+	}
+	if peer.Inbound && inbound >= m.MaxInbound || !peer.Inbound && outbound >= m.MaxOutbound {
+		return PeerManagerError{peer.Addr, PEER_SLOTS_FULL}
+	}
+
+	if ok {
+		fmt.Println("PeerManager:: replacing connection to", existing.Addr, "dialed by the other end")
+		existing.Client.Close()
+	}
+	m.peers[peer.Key] = peer
+	return nil
+}
+
+// Drops peer and closes its connection, unless another connection replaced
+// it already
+func (m *PeerManager) Remove(peer *Peer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.peers[peer.Key] == peer {
+		delete(m.peers, peer.Key)
+	}
+	peer.Client.Close()
+}
+
+// Returns the peer listening at addr
+func (m *PeerManager) Get(addr string) (*Peer, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, peer := range m.peers {
+		if peer.Addr == addr {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the peers we have now
+func (m *PeerManager) List() []*Peer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, peer := range m.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Returns the number of peers
+func (m *PeerManager) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.peers)
+}
+
+// Whether an outbound slot is free
+func (m *PeerManager) CanDial() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, outbound := m.count()
+	return outbound < m.MaxOutbound
+}
+
+// Whether an inbound slot is free
+func (m *PeerManager) CanAccept() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	inbound, _ := m.count()
+	return inbound < m.MaxInbound
+}
+
+// Sets the RPCs to serve peers with
+func (m *PeerManager) setHandler(handler PeerRpc) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.handler = &handler
+}
+
+// Serves the peer RPCs over conn, whose handshake state is auth. Calls are
+// refused until ListenPeerRpc sets the RPCs.
+func (m *PeerManager) serve(conn *PeerConn, auth *peerAuth) {
+	m.mutex.Lock()
+	handler := m.handler
+	m.mutex.Unlock()
+
+	server := rpc.NewServer()
+	if handler != nil {
+		connRpc := *handler
+		connRpc.conn = conn
+		connRpc.auth = auth
+		server.RegisterName("Peer", &connRpc)
+	}
+	go server.ServeCodec(conn.ServerCodec())
+}
+
+func (m *PeerManager) count() (inbound, outbound int) {
+	for _, peer := range m.peers {
+		if peer.Inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	return inbound, outbound
+}
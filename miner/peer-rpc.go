@@ -6,11 +6,21 @@ This file contains the following:
 3. Function to initialize the miner peer listener
 
 Peer RPC calls:
-  Connect(args *connectArgs, reply *empty)
+  Hello(args *helloArgs, reply *helloReply)
+  Connect(args *connectArgs, reply *chainTip)
   Hb(args *empty, reply *empty)
+  Announce(args *announceArgs, reply *[]inv)
   PropagateOp(args *propagateOpArgs, reply *empty)
   PropagateBlock(args *propagateBlockArgs, reply *empty)
-  GetBlockChain(args *empty, reply *getBlockChainArgs)
+  GetTip(args *empty, reply *chainTip)
+  GetHeaders(args *getHeadersArgs, reply *[]blockHeader)
+  GetBlocks(args *getBlocksArgs, reply *[]block)
+
+Every connection is served on its own, at both ends (see peer-conn.go), and
+must authenticate with Hello and Connect before the other calls are taken
+(see peer-auth.go). Announce and the Propagate calls spread new blocks and ops
+(see gossip.go), and the last three are for syncing with the peer (see
+chain-sync.go).
 
 */
 
@@ -19,7 +29,6 @@ package miner
 import (
 	"fmt"
 	"net"
-	"net/rpc"
 	"sync"
 	"log"
 
@@ -32,15 +41,16 @@ import (
 * TYPE_DEFINITIONS *
 *******************/
 
-// Struct for maintaining state of the PeerRpc
+// Struct for maintaining state of the PeerRpc. There is one per connection;
+// all but conn and auth are shared between them.
 type PeerRpc struct {
 	miner  *Miner
 	opCh   chan PropagateOpArgs
 	blkCh  chan PropagateBlockArgs
 	opSCh  chan blockchain.OperationInfo
 	blkSCh chan blockchain.Block
-	reqCh  chan net.Addr
-	blks   map[string]Empty
+	conn   *PeerConn
+	auth   *peerAuth
 }
 
 // Empty struct. Use for filling required but unused function parameters.
@@ -48,42 +58,32 @@ type Empty struct{}
 
 type ConnectArgs struct {
 	Addr net.Addr
+	Sig  []byte
 }
 
 type PropagateOpArgs struct {
 	OpInfo blockchain.OperationInfo
-	TTL    int
 }
 
 type PropagateBlockArgs struct {
 	Block blockchain.Block
-	TTL   int
-}
-
-type GetBlockChainArgs struct {
-	blockChain []blockchain.Block
 }
 
 /***********************
 * FUNCTION_DEFINITIONS *
 ***********************/
 
-// Adds the connecting peer to the list of maintained peers. The peer
-// requesting connect will be added to the maintained peer count. There will
-// be a heartbeat procedure for it, and any data propagations will be sent to
-// the peer as well.
-func (p *PeerRpc) Connect(args ConnectArgs, reply *[]blockchain.Block) error {
-
-	// - Send through request channel to Connection Manager to connect next time
-	log.Printf("write to ch")
-	p.reqCh <- args.Addr
-	blockchain := make([]blockchain.Block, 0)
-	for i, node := range BlockNodeArray {
-		if i != 0 {
-			blockchain = append(blockchain, node.Block)
-		}
+// Adds the connecting peer to the list of maintained peers, in an inbound
+// slot. There will be a heartbeat procedure for it, and any data
+// propagations will be sent to the peer as well, over this connection. The
+// peer must have proven its key with Hello first. Returns our tip, for the
+// peer to sync with us from.
+func (p *PeerRpc) Connect(args ConnectArgs, reply *ChainTip) error {
+	if err := p.authenticate(args); err != nil {
+		return err
 	}
-	*reply = blockchain
+
+	*reply = LocalTip()
 	fmt.Println("Connect called by: ", args.Addr.String())
 
 	return nil
@@ -92,7 +92,8 @@ func (p *PeerRpc) Connect(args ConnectArgs, reply *[]blockchain.Block) error {
 // This RPC is a no-op. It's used by the peer to ensure that this miner is still alive.
 func (p *PeerRpc) Hb(args *Empty, reply *Empty) error {
 	//fmt.Println("Hb called")
-	return nil
+	_, err := p.peer()
+	return err
 }
 
 // Get a shape interface from an operation.
@@ -140,68 +141,73 @@ func (m Miner) getPathFromOp(op blockchain.Operation) (shapelib.Path, error) {
 // of multiple, conflicting operations.
 var validateLock sync.Mutex
 
-// This RPC is used to send an operation (addshape, deleteshape) to miners.
-// Will not return any useful information.
+// This RPC is used to send an operation (addshape, deleteshape) to miners,
+// usually one they asked for with Announce. Will not return any useful
+// information.
 func (p *PeerRpc) PropagateOp(args PropagateOpArgs, reply *Empty) error {
 	fmt.Println("PropagateOp called")
-
-	// TODO: Validate the shapehash using the public key
-
-	// Get the shapelib.Shape representation for this svg
-	shape, err := p.miner.getShapeFromOp(args.OpInfo.Op)
-	if err != nil {
+	if _, err := p.peer(); err != nil {
 		return err
 	}
 
-	subarr, inkRequired := shape.SubArrayAndCost()
+	// Drop ops that weren't signed with the key they spend the ink of
+	if err := CheckOpSignature(args.OpInfo, "gossip"); err != nil {
+		p.misbehaved(SCORE_INVALID_OP, "forged op")
+		return err
+	}
 
+	// The mempool validates the op against the longest path and the ops
+	// already pending. Ops we already have aren't passed on again.
 	validateLock.Lock()
-
-	blocks, _ := GetLongestPath(p.miner.Settings.GenesisBlockHash)
-	if args.OpInfo.Op.OpType == blockchain.ADD {
-		err = p.miner.checkInkAndConflicts(subarr, inkRequired, args.OpInfo.PubKey, blocks, args.OpInfo.Op.SVGString, args.OpInfo.OpSig)
-	} else {
-		fmt.Println("Checking deletion")
-		err = p.miner.checkDeletion(args.OpInfo.AddSig, args.OpInfo.PubKey, blocks)
-		if err != nil {
-			fmt.Println("DELETE WAS BAD!!!")
-		}
-	}
+	err := Pool.Add(args.OpInfo)
 	validateLock.Unlock()
 
 	if err != nil {
+		if opIsMalformed(err) {
+			p.misbehaved(SCORE_INVALID_OP, "malformed op")
+		}
 		return err
 	}
+	PeerGossip.Received(Inv{INV_OP, opHash(args.OpInfo)})
 
 	// Update the solver. There will likely need to be additional logic somewhere here.
 	log.Printf("write to ch")
 	p.opSCh <- args.OpInfo
 
-	// Propagate op to list of connected peers.
-	args.TTL--
-	if args.TTL > 0 {
-		log.Printf("write to ch")
-		p.opCh <- args
-	}
+	// Announce op to list of connected peers.
+	log.Printf("write to ch")
+	p.opCh <- args
 
 	return nil
 }
 
-var msgLock sync.Mutex
-
-// This RPC is used to send a new block (addshape, deleteshape) to miners.
-// Will not return any useful information.
+// This RPC is used to send a new block (addshape, deleteshape) to miners,
+// usually one they asked for with Announce. Will not return any useful
+// information.
 func (p *PeerRpc) PropagateBlock(args PropagateBlockArgs, reply *Empty) error {
 	//fmt.Println("PropagateBlock called")
-	msgLock.Lock()
+	if _, err := p.peer(); err != nil {
+		return err
+	}
+
 	blkHash := GetBlockHash(args.Block)
-	if _, exists := p.blks[blkHash]; exists {
+	if _, exists := ReadBlockChainMap(blkHash); exists {
 		//fmt.Println("Ignoring already received blockhash")
-		msgLock.Unlock()
 		return nil
-	} else {
-		p.blks[blkHash] = Empty{}
-		msgLock.Unlock()
+	}
+
+	// A block whose parent we haven't got waits in the orphan pool, while the
+	// peer is asked for its ancestors
+	if _, hasParent := ReadBlockChainMap(args.Block.PrevHash); !hasParent {
+		if !VerifyBlock(args.Block) {
+			p.misbehaved(SCORE_INVALID_BLOCK, "invalid block")
+		} else {
+			PeerGossip.Received(Inv{INV_BLOCK, blkHash})
+			if Orphans.Add(args.Block, p.auth.addr) {
+				Orphans.RequestAncestors(p.auth.addr, blkHash)
+			}
+		}
+		return nil
 	}
 
 	// Find the path that the block should be on, no guarantee it is the longest
@@ -212,63 +218,74 @@ func (p *PeerRpc) PropagateBlock(args PropagateBlockArgs, reply *Empty) error {
 	ok := p.miner.ValidateBlock(args.Block, path)
 	validateLock.Unlock()
 
-	if ok {
-		// Propagate block to list of connected peers. Too lazy to get rid of TTL;
-		// it's not used any more for PropgateBlock though.
-		if args.TTL > 0 {
-			log.Printf("write to ch")
-			p.blkCh <- args
-		}
-
-		// Snapshot the current longest path
-		longest, length := GetLongestPath(p.miner.Settings.GenesisBlockHash)
-		lastblock := longest[length-1]
-
-		// - Add block to block chain.
-		InsertBlock(args.Block)
+	if !ok {
+		p.misbehaved(SCORE_INVALID_BLOCK, "invalid block")
+		return nil
+	}
 
-		// Check if the longest path changed
-		newlongest, newlength := GetLongestPath(p.miner.Settings.GenesisBlockHash)
-		newlastblock := newlongest[newlength-1]
+	// Snapshot the current longest path
+	longest, length := GetLongestPath(p.miner.Settings.GenesisBlockHash)
+	lastblock := longest[length-1]
 
-		// If the longest path changed we should build off of it so send it to problem solver
-		if newlength >= length && newlastblock.Nonce != lastblock.Nonce && newlastblock.MinerPubKey != lastblock.MinerPubKey {
-			fmt.Println("Propgation:", args.TTL)
-			p.blkSCh <- args.Block
-		}
+	// - Add block to block chain.
+	if CheckError(InsertBlock(args.Block), "PropagateBlock:InsertBlock") {
+		return nil
 	}
+	PeerGossip.Received(Inv{INV_BLOCK, blkHash})
 
-	return nil
-}
+	// Announce block to list of connected peers, now that we can send it
+	log.Printf("write to ch")
+	p.blkCh <- args
 
-// This RPC is used for peers to get latest information when they are newly
-// initalized. No useful argument.
-func (p *PeerRpc) GetBlockChain(args Empty, reply *[]blockchain.Block) error {
-	fmt.Println("GetBlockChain called")
+	// Check if the longest path changed
+	newlongest, newlength := GetLongestPath(p.miner.Settings.GenesisBlockHash)
+	newlastblock := newlongest[newlength-1]
 
-	chain := make([]blockchain.Block, 0)
-	for i, node := range BlockNodeArray {
-		if i != 0 {
-			chain = append(chain, node.Block)
-		}
+	// If the longest path changed we should build off of it so send it to problem solver.
+	// A heavier path can be shorter, so compare the tips rather than the lengths.
+	if GetBlockHash(newlastblock) != GetBlockHash(lastblock) {
+		fmt.Println("Propagation: new longest path at", GetBlockHash(newlastblock))
+		p.blkSCh <- newlastblock
 	}
-	*reply = chain
 
 	return nil
 }
 
-// This will initialize the miner peer listener.
-func listenPeerRpc(ln net.Listener, miner *Miner, opCh chan PropagateOpArgs,
+// This will initialize the miner peer listener. Every connection gets a
+// server of its own, so that who is on the other end is known to the RPCs.
+// Connections we dial are served the same RPCs. Connections are closed
+// right away while the inbound slots are taken.
+func ListenPeerRpc(ln net.Listener, miner *Miner, opCh chan PropagateOpArgs,
 	blkCh chan PropagateBlockArgs, opSCh chan blockchain.OperationInfo,
-	blkSCh chan blockchain.Block, reqCh chan net.Addr) {
-	pRpc := PeerRpc{miner, opCh, blkCh, opSCh, blkSCh, reqCh, make(map[string]Empty)}
-
-	fmt.Println("listenPeerRpc::listening on: ", ln.Addr().String())
+	blkSCh chan blockchain.Block) {
+	Peers.setHandler(PeerRpc{miner, opCh, blkCh, opSCh, blkSCh, nil, nil})
 
-	server := rpc.NewServer()
-	server.RegisterName("Peer", &pRpc)
+	fmt.Println("ListenPeerRpc::listening on: ", ln.Addr().String())
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	server.Accept(ln)
+	for {
+		conn, err := ln.Accept()
+		if CheckError(err, "ListenPeerRpc:Accept") {
+			return
+		}
+
+		if !Peers.CanAccept() {
+			fmt.Println("ListenPeerRpc::no inbound slot for", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		auth := &peerAuth{remote: conn.RemoteAddr().String()}
+		go func() {
+			cert, err := peerCertificateKey(conn)
+			if CheckError(err, "ListenPeerRpc:TLS") {
+				conn.Close()
+				return
+			}
+			auth.cert = cert
+
+			Peers.serve(NewPeerConn(conn), auth)
+		}()
+	}
 }
@@ -0,0 +1,226 @@
+/*
+
+This file contains how misbehaving peers are kept away. Every peer that sends
+us invalid data gets misbehaviour points, on both the address it listens at
+and its key:
+
+  - SCORE_INVALID_BLOCK for a block that doesn't validate
+  - SCORE_INVALID_OP for an op that is forged or malformed. Ops that clash
+    with ours (ink, overlaps) aren't counted: an honest peer can send those
+    when its view of the chain differs.
+  - SCORE_BAD_SYNC for headers or blocks that don't check out in a sync, or
+    asking for too many blocks at once
+  - SCORE_BAD_GOSSIP for announcing too many items at once
+
+Points wear off at SCORE_DECAY a minute. At BAN_THRESHOLD the address or key
+is banned for BAN_SECONDS: its connections are dropped and refused, and it
+isn't dialed. Bans are kept by address and key rather than by connection, so
+they hold when the peer reconnects, from the same address or as the same
+key. The ban list can be read and changed over the admin RPC (see
+admin-rpc.go).
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"../protocol"
+)
+
+const (
+	// Misbehaviour points for each kind of invalid data
+	SCORE_INVALID_BLOCK = 50
+	SCORE_INVALID_OP    = 10
+	SCORE_BAD_SYNC      = 25
+	SCORE_BAD_GOSSIP    = 25
+	// Points that wear off every minute
+	SCORE_DECAY = 1
+	// Points at which a peer is banned
+	BAN_THRESHOLD = 100
+	// Seconds a ban lasts
+	BAN_SECONDS = 60 * 60
+)
+
+// The misbehaviour of an address or key
+type PeerScore struct {
+	Target      string    // Address or key
+	Score       int       // Misbehaviour points
+	Updated     time.Time // When Score was last brought up to date
+	BannedUntil time.Time // Zero if not banned
+	Reason      string    // Last misbehaviour
+}
+
+type PeerScores struct {
+	mutex  *sync.Mutex
+	scores map[string]*PeerScore
+}
+
+func NewPeerScores() *PeerScores {
+	return &PeerScores{&sync.Mutex{}, make(map[string]*PeerScore)}
+}
+
+// Our singleton scores
+var Scores = NewPeerScores()
+
+// Adds points to the peer listening at addr with key for reason. Either may
+// be "". Returns true if the peer is banned now.
+func (s *PeerScores) Misbehaved(addr, key string, points int, reason string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	banned := false
+	for _, target := range []string{addr, key} {
+		if target == "" {
+			continue
+		}
+
+		score := s.get(target)
+		score.Score += points
+		score.Reason = reason
+		if score.Score >= BAN_THRESHOLD {
+			score.Score = 0
+			score.BannedUntil = time.Now().Add(BAN_SECONDS * time.Second)
+			fmt.Println("PeerScores:: banned", target, "until", score.BannedUntil, "for", reason)
+		}
+		banned = banned || time.Now().Before(score.BannedUntil)
+	}
+	return banned
+}
+
+// Whether the address or the key is banned. Either may be "".
+func (s *PeerScores) Banned(addr, key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, target := range []string{addr, key} {
+		if score, ok := s.scores[target]; ok && target != "" && time.Now().Before(score.BannedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the points of target, 0 if it has none
+func (s *PeerScores) Score(target string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.scores[target]; !ok {
+		return 0
+	}
+	return s.get(target).Score
+}
+
+// Bans target for seconds
+func (s *PeerScores) Ban(target string, seconds int, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	score := s.get(target)
+	score.BannedUntil = time.Now().Add(time.Duration(seconds) * time.Second)
+	score.Reason = reason
+}
+
+// Lifts the ban on target and clears its points. Returns false if it had
+// neither.
+func (s *PeerScores) Unban(target string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.scores[target]
+	delete(s.scores, target)
+	return ok
+}
+
+// Returns the scores of the targets that are banned now, soonest lifted first
+func (s *PeerScores) Bans() []PeerScore {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bans := make([]PeerScore, 0)
+	for target, score := range s.scores {
+		if time.Now().Before(score.BannedUntil) {
+			bans = append(bans, *s.get(target))
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].BannedUntil.Before(bans[j].BannedUntil) })
+	return bans
+}
+
+// Returns the score of target, brought up to date, making one if it has
+// none
+func (s *PeerScores) get(target string) *PeerScore {
+	score, ok := s.scores[target]
+	if !ok {
+		score = &PeerScore{Target: target, Updated: time.Now()}
+		s.scores[target] = score
+		return score
+	}
+
+	minutes := int(time.Since(score.Updated) / time.Minute)
+	if minutes > 0 {
+		score.Score -= minutes * SCORE_DECAY
+		if score.Score < 0 {
+			score.Score = 0
+		}
+		score.Updated = score.Updated.Add(time.Duration(minutes) * time.Minute)
+	}
+	return score
+}
+
+// Adds points to the peer on the other end of the connection for reason
+func (p *PeerRpc) misbehaved(points int, reason string) {
+	p.auth.Lock()
+	addr, key := p.auth.addr, p.auth.peer
+	p.auth.Unlock()
+
+	Scores.Misbehaved(addr, key, points, reason)
+}
+
+// Whether err from the mempool means the op was malformed, whatever the
+// chain it is checked against
+func opIsMalformed(err error) bool {
+	switch err.(type) {
+	case protocol.InvalidShapeSvgStringError, protocol.ShapeSvgStringTooLongError, protocol.OutOfBoundsError:
+		return true
+	}
+	return false
+}
+
+// Adds the points for err to the peer at addr with key, if err is the peer's
+// fault
+func misbehavedInSync(addr, key string, err error) {
+	if syncErr, ok := err.(ChainSyncError); ok {
+		Scores.Misbehaved(addr, key, SCORE_BAD_SYNC, syncErr.Reason)
+	}
+}
+
+// Returns addrs without the banned ones, least misbehaved first
+func PreferPeers(addrs []net.Addr) []net.Addr {
+	preferred := make([]net.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if !Scores.Banned(addr.String(), "") {
+			preferred = append(preferred, addr)
+		}
+	}
+	sort.SliceStable(preferred, func(i, j int) bool {
+		return Scores.Score(preferred[i].String()) < Scores.Score(preferred[j].String())
+	})
+	return preferred
+}
+
+// Drops the connections to peers that got banned
+func DropBannedPeers() {
+	for _, peer := range Peers.List() {
+		if Scores.Banned(peer.Addr, peer.Key) {
+			fmt.Println("Banned peer: ", peer.Addr, " deleting")
+			Peers.Remove(peer)
+		}
+	}
+}
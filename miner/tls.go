@@ -0,0 +1,99 @@
+/*
+
+This file contains the optional TLS on the links of the miner (see
+protocol/tls.go). With UseTLS set, every link runs over TLS, with a
+certificate for the miner's key:
+
+  - Art nodes dial us. They pin our key if they know it.
+  - Peers present certificates for their keys on both ends. The dialer pins
+    the key the server has registered at the address it dials, and the
+    listener checks that the dialer says hello with its certificate's key.
+  - We dial the server, pinning ServerKey if it is set.
+
+*/
+
+package miner
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"net"
+	"os"
+	"time"
+
+	"../protocol"
+	"../utils"
+)
+
+// Seconds a TLS handshake may take
+const TLS_HANDSHAKE_TIMEOUT = 10
+
+var (
+	// Whether the links run over TLS
+	UseTLS bool
+	// Hex of the x509 encoding of the server's public key. Empty takes any
+	// server.
+	ServerKey string
+)
+
+// Returns ln, serving TLS if UseTLS is set. Dialers must present a
+// certificate of their own if requireClientCert is set.
+func SecureListener(ln net.Listener, requireClientCert bool) net.Listener {
+	if !UseTLS {
+		return ln
+	}
+
+	config, err := protocol.ServerTLSConfig(MinerInstance.PrivKey, requireClientCert)
+	if CheckError(err, "SecureListener:ServerTLSConfig") {
+		os.Exit(1)
+	}
+	return tls.NewListener(ln, config)
+}
+
+// Returns conn, over TLS to the owner of pinned if UseTLS is set. nil pins
+// no key.
+func secureDial(conn net.Conn, pinned *ecdsa.PublicKey) (net.Conn, error) {
+	if !UseTLS {
+		return conn, nil
+	}
+
+	config, err := protocol.ClientTLSConfig(MinerInstance.PrivKey, pinned)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Returns the key of the certificate a peer dialing us over TLS presented,
+// or "" if conn isn't TLS
+func peerCertificateKey(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT * time.Second))
+	key, err := protocol.PeerKey(tlsConn)
+	if err != nil {
+		return "", err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return utils.GetPublicKeyString(*key), nil
+}
+
+// Returns the key ServerKey pins, or nil if it is empty
+func serverKey() (*ecdsa.PublicKey, error) {
+	if ServerKey == "" {
+		return nil, nil
+	}
+	return parsePubKey(ServerKey)
+}
@@ -1,7 +1,7 @@
 /*
 
 Purpose of this file is to contain the validation functions needed for the add
-and delete operations for shapes in the blockchain.
+and delete operations for shapes in the blockchain, and for ink transfers.
 
 */
 
@@ -11,7 +11,7 @@ import (
 	"fmt"
 
 	"../blockchain"
-	"../libminer"
+	"../protocol"
 	"../shapelib"
 )
 
@@ -28,6 +28,13 @@ func (m Miner) ValidateBlock(block blockchain.Block, chain []blockchain.Block) b
 	// check that the block hashes correctly
 	// this is checked a lot though, do we need this? TODO
 	if VerifyBlock(block) {
+		// Every op must be signed with the key it spends the ink of
+		for _, opInfo := range block.OpHistory {
+			if CheckOpSignature(opInfo, "block "+GetBlockHash(block)) != nil {
+				return false
+			}
+		}
+
 		validatedops := ValidateOps(block.OpHistory, chain)
 		if len(validatedops) == len(block.OpHistory) {
 			return true
@@ -40,40 +47,35 @@ func (m Miner) ValidateBlock(block blockchain.Block, chain []blockchain.Block) b
 // Validates a set of operations against the longest block chain
 func ValidateOps(ops []blockchain.OperationInfo, chain []blockchain.Block) []blockchain.OperationInfo {
 	fmt.Println("ValidateOps")
-	//chain, _ = GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-	testblock := new(blockchain.Block)
-	testblock.MinerPubKey = "TESTTESTTESTTESTTESTTESTTESTTESTTEST"
-	testblock.PrevHash = "TESTTESTTESTTESTTESTTESTTESTTESTTESTTEST"
+	validOps := make([]blockchain.OperationInfo, 0)
+
+	CanvasMutex.Lock()
+	defer CanvasMutex.Unlock()
+	canvas := canvasAt(chain)
+
+	// Every valid op is applied so the ops after it are validated as if they
+	// were in the same block. They are undone once we're done.
+	pending := make([]canvasUndo, 0, len(ops))
 	for _, opinfo := range ops {
-		oldchain := make([]blockchain.Block, 0)
-		oldchain = append(oldchain, chain...)
-		testchain := append(oldchain, *testblock)
-		op := opinfo.Op
-		shape, err := MinerInstance.getShapeFromOp(op)
-		if err != nil {
+		if err := MinerInstance.checkOp(opinfo, canvas); err != nil {
 			continue
 		}
 
-		subarr, inkRequired := shape.SubArrayAndCost()
-		if opinfo.Op.OpType == blockchain.ADD {
-			err = MinerInstance.checkInkAndConflicts(subarr, inkRequired, opinfo.PubKey, testchain, op.SVGString, opinfo.OpSig)
-		} else {
-			err = MinerInstance.checkDeletion(opinfo.AddSig, opinfo.PubKey, testchain)
-		}
-		if err != nil {
-			continue
-		}
+		pending = append(pending, canvas.applyPending(opinfo))
+		validOps = append(validOps, opinfo)
+	}
 
-		testblock.OpHistory = append(testblock.OpHistory, opinfo)
+	for i := len(pending) - 1; i >= 0; i-- {
+		canvas.undoOp(pending[i])
 	}
+
 	fmt.Println("ValidateOps done")
-	//chain, _ = GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-	return testblock.OpHistory
+	return validOps
 }
 
 // Checks if there are overlaps and enough ink
-func ValidateOperation(op blockchain.Operation, pubKey string, opSig string) error {
-	shape, err := MinerInstance.getShapeFromOp(op)
+func ValidateOperation(opInfo blockchain.OperationInfo) error {
+	shape, err := MinerInstance.getShapeFromOp(opInfo.Op)
 	if err != nil {
 		return err
 	}
@@ -84,141 +86,100 @@ func ValidateOperation(op blockchain.Operation, pubKey string, opSig string) err
 	defer validateLock.Unlock()
 
 	blocks, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
-	err = MinerInstance.checkInkAndConflicts(subarr, inkRequired, pubKey, blocks, op.SVGString, opSig)
 
+	CanvasMutex.Lock()
+	defer CanvasMutex.Unlock()
+	return MinerInstance.checkInkAndConflicts(subarr, inkRequired, opInfo, canvasAt(blocks))
+}
+
+// Checks that the sender of a transfer has the ink on the longest path
+func ValidateTransfer(opInfo blockchain.OperationInfo) error {
+	validateLock.Lock()
+	defer validateLock.Unlock()
+
+	blocks, _ := GetLongestPath(MinerInstance.Settings.GenesisBlockHash)
+
+	CanvasMutex.Lock()
+	defer CanvasMutex.Unlock()
+	return MinerInstance.checkTransfer(opInfo, canvasAt(blocks))
+}
+
+// Checks an add, delete or transfer operation against the canvas
+func (m Miner) checkOp(opinfo blockchain.OperationInfo, canvas *CanvasState) error {
+	op := opinfo.Op
+	if op.OpType == blockchain.TRANSFER {
+		return m.checkTransfer(opinfo, canvas)
+	}
+
+	shape, err := m.getShapeFromOp(op)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	subarr, inkRequired := shape.SubArrayAndCost()
+	if op.OpType == blockchain.ADD {
+		return m.checkInkAndConflicts(subarr, inkRequired, opinfo, canvas)
+	}
+	return m.checkDeletion(opinfo.AddSig, opinfo.PubKey, canvas)
 }
 
-// Function used to determine if an add operation is allowed on the blockchain.
+// Function used to determine if an add operation is allowed on the canvas.
+// Shapes may only overlap shapes of the same pubkey.
 func (m Miner) checkInkAndConflicts(subarr shapelib.PixelSubArray, inkRequired int,
-	pubkey string, blocks []blockchain.Block, svgString string, opSig string) error {
+	opinfo blockchain.OperationInfo, canvas *CanvasState) error {
 	if LOG_VALIDATION {
 		fmt.Println("checkInkAndConflicts called")
 	}
 
-	pubkeyInk := uint32(0)
-	shapesExisting := make(map[string]*blockchain.OperationInfo)
-
-	// Iterate over all blocks in this structure to form the pixel array
-	// formed by all shapes not from this pubkey, and the ink remaining
-	// of this pubkey.
-	for i := 0; i < len(blocks); i++ {
-		block := blocks[i]
-		//fmt.Println("comparing pub keys:")
-		//fmt.Println(block.MinerPubKey)
-		//fmt.Println("vs")
-		//fmt.Println(pubkey)
-		numOps := len(block.OpHistory)
-		if block.MinerPubKey == pubkey {
-			if numOps > 0 {
-				pubkeyInk += m.Settings.InkPerOpBlock
-			} else {
-				pubkeyInk += m.Settings.InkPerNoOpBlock
-			}
-		}
-
-		for j := 0; j < numOps; j++ {
-			opInfo := block.OpHistory[j]
-			op := opInfo.Op
-
-			if opInfo.PubKey == pubkey {
-				if opInfo.OpSig == opSig {
-					return DuplicateError("opSig")
-				}
-
-				shape, err := m.getShapeFromOp(op)
-				if err != nil {
-					fmt.Println("CRITICAL ERROR: BAD SHAPE IN BLOCKCHAIN")
-					continue
-				}
-
-				_, cost := shape.SubArrayAndCost()
-
-				// Don't fill in the pixels for the same pubkey,
-				// but compute the ink required in order to
-				// check if pubkey has sufficient ink.
-				// Don't bother validating that a DELETE has a
-				// corresponding ADD. Assume all are valid.
-				if op.OpType == blockchain.ADD {
-					pubkeyInk -= uint32(cost)
-				} else {
-					pubkeyInk += uint32(cost)
-				}
-			} else {
-				if op.OpType == blockchain.ADD {
-					shapesExisting[opInfo.OpSig] = &opInfo
-				} else {
-					delete(shapesExisting, opInfo.OpSig)
-				}
-			}
-		}
+	if canvas.HasOp(opinfo) {
+		return DuplicateError(opinfo.OpSig)
 	}
 
-	if inkRequired > int(pubkeyInk) {
-		fmt.Println("checkInkAndConflicts: insufficient ink:", inkRequired, " needed vs ", pubkeyInk)
-		return libminer.InsufficientInkError(uint32(inkRequired))
-	}
+	pubkey := opinfo.PubKey
 
-	pixelarr := shapelib.NewPixelArray(int(m.Settings.CanvasSettings.CanvasXMax),
-		int(m.Settings.CanvasSettings.CanvasYMax))
-
-	// Merge all shapes existing into the pixel array for validating conflicts
-	for _, v := range shapesExisting {
-		shape, err := m.getShapeFromOp(v.Op)
-		if err != nil {
-			fmt.Println("CRITICAL ERROR: BAD SHAPE IN BLOCKCHAIN")
-		}
-
-		subarr, _ := shape.SubArrayAndCost()
-		pixelarr.MergeSubArray(subarr)
+	if inkRequired > canvas.Ink(pubkey) {
+		fmt.Println("checkInkAndConflicts: insufficient ink:", inkRequired, " needed vs ", canvas.Ink(pubkey))
+		return protocol.InsufficientInkError(uint32(inkRequired))
 	}
 
-	if pixelarr.HasConflict(subarr) {
+	if !canvas.CanPaint(subarr, pubkey) {
 		fmt.Println("checkInkAndConflicts: conflict found")
-		return libminer.ShapeOverlapError(svgString)
+		return protocol.ShapeOverlapError(opinfo.Op.SVGString)
 	}
 
 	return nil
 }
 
-// Function used to determine if a delete operation is allowed on the blockchain.
-func (m Miner) checkDeletion(sHash string, pubkey string, blocks []blockchain.Block) error {
+// Function used to determine if a delete operation is allowed on the canvas.
+func (m Miner) checkDeletion(sHash string, pubkey string, canvas *CanvasState) error {
 	if LOG_VALIDATION {
 		fmt.Println("checkDeletion called")
 	}
 
-	delAllowed := false
+	// The shape must have been added by pubkey and not deleted since
+	if shape, ok := canvas.Shape(sHash); !ok || shape.OpInfo.PubKey != pubkey {
+		return protocol.ShapeOwnerError(sHash)
+	}
 
-	// Iterate over all blocks in this structure to check if the shape has
-	// actually been added. If shape is found to be added, cannot break out
-	// of loop immediately - need to check if delete was already done also.
-	// If a delete was done, can break out of loop and return an error.
-	for i := 0; i < len(blocks); i++ {
-		block := blocks[i]
+	return nil
+}
 
-		for j := 0; j < len(block.OpHistory); j++ {
-			opInfo := block.OpHistory[j]
+// Function used to determine if a transfer operation is allowed on the canvas.
+// The sender must have the ink, and the recipient must be a valid pubkey
+// other than the sender's.
+func (m Miner) checkTransfer(opinfo blockchain.OperationInfo, canvas *CanvasState) error {
+	op := opinfo.Op
+	if canvas.HasOp(opinfo) {
+		return DuplicateError(opinfo.OpSig)
+	}
 
-			if opInfo.PubKey == pubkey {
-				if opInfo.OpSig == sHash {
-					fmt.Println("Shape exists, cool")
-					delAllowed = true
-				} else if opInfo.AddSig == sHash {
-					fmt.Println("Deleted already?! Oh no!")
-					delAllowed = false
-					goto breakOuterLoop
-				}
-			}
-		}
+	if _, err := parsePubKey(op.To); err != nil || op.To == opinfo.PubKey || op.Amount == 0 {
+		return protocol.InvalidTransferError(op.To)
 	}
-breakOuterLoop:
 
-	if !delAllowed {
-		return libminer.ShapeOwnerError(sHash)
+	if int(op.Amount) > canvas.Ink(opinfo.PubKey) {
+		fmt.Println("checkTransfer: insufficient ink:", op.Amount, " needed vs ", canvas.Ink(opinfo.PubKey))
+		return protocol.InsufficientInkError(op.Amount)
 	}
 
 	return nil
@@ -1,49 +0,0 @@
-package minerserver
-
-import (
-	"crypto/ecdsa"
-	"net"
-)
-
-type RServer int
-
-////////////////////////Settings 
-
-// Settings for a canvas in BlockArt.
-type CanvasSettings struct {
-	// Canvas dimensions
-	CanvasXMax uint32
-	CanvasYMax uint32
-}
-
-// Settings for an instance of the BlockArt project/network.
-type MinerNetSettings struct {
-	// Hash of the very first (empty) block in the chain.
-	GenesisBlockHash string
-
-	// The minimum number of ink miners that an ink miner should be
-	// connected to. If the ink miner dips below this number, then
-	// they have to retrieve more nodes from the server using
-	// GetNodes().
-	MinNumMinerConnections uint8
-
-	// Mining ink reward per op and no-op blocks (>= 1)
-	InkPerOpBlock   uint32
-	InkPerNoOpBlock uint32
-
-	// Number of milliseconds between heartbeat messages to the server.
-	HeartBeat uint32
-
-	// Proof of work difficulty: number of zeroes in prefix (>=0)
-	PoWDifficultyOpBlock   uint8
-	PoWDifficultyNoOpBlock uint8
-
-	// Canvas settings
-	CanvasSettings CanvasSettings
-}
-
-type MinerInfo struct {
-	Address net.Addr
-	Key     ecdsa.PublicKey
-}
-
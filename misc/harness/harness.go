@@ -0,0 +1,95 @@
+/*
+
+This package holds what the harnesses in misc share: checks that print PASS
+or FAIL and fail the run, a miner set up on a fresh block chain, and a server
+that stands in for the BlockArt server.
+
+A harness checks as it goes and calls Done last:
+
+	harness.Check("name", ok, detail)
+	...
+	harness.Done()
+
+*/
+
+package harness
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"os"
+
+	"../../miner"
+	"../../protocol"
+)
+
+// Genesis block hash of the miners set up by NewMiner, unless their settings
+// name another
+const GENESIS = "genesis"
+
+var failed = false
+
+// Prints whether the check called name passed, with detail
+func Check(name string, ok bool, detail string) {
+	if !ok {
+		fmt.Println("FAIL", name, detail)
+		failed = true
+		return
+	}
+	fmt.Println("PASS", name, detail)
+}
+
+// Returns true if a check failed so far
+func Failed() bool {
+	return failed
+}
+
+// Exits with status 1 if a check failed
+func Done() {
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Returns a new key on the curve miners and art nodes use
+func NewKey() *ecdsa.PrivateKey {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	return key
+}
+
+// Makes the miner with privKey and settings our singleton miner, on a block
+// chain of just the genesis block. Settings without a genesis block get
+// GENESIS, and without a canvas a 1024x1024 one.
+func NewMiner(privKey *ecdsa.PrivateKey, settings protocol.MinerNetSettings) *miner.Miner {
+	if settings.GenesisBlockHash == "" {
+		settings.GenesisBlockHash = GENESIS
+	}
+	if settings.CanvasSettings == (protocol.CanvasSettings{}) {
+		settings.CanvasSettings = protocol.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
+	}
+
+	miner.MinerInstance = &miner.Miner{PrivKey: privKey, Settings: settings}
+	miner.InitBlockChain()
+	return miner.MinerInstance
+}
+
+// Stands in for the server. Keys are the miners registered at each address.
+type RServer struct {
+	Keys map[string]*ecdsa.PrivateKey
+}
+
+func NewRServer() *RServer {
+	return &RServer{make(map[string]*ecdsa.PrivateKey)}
+}
+
+func (s *RServer) GetMinerKey(addr string, key *ecdsa.PublicKey) error {
+	privKey, ok := s.Keys[addr]
+	if !ok {
+		return fmt.Errorf("BlockArt server: unknown address [%s]", addr)
+	}
+	// The server hands out keys the way it got them over gob
+	*key = ecdsa.PublicKey{Curve: elliptic.P384().Params(), X: privKey.X, Y: privKey.Y}
+	return nil
+}
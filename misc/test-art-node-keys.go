@@ -0,0 +1,160 @@
+/*
+
+Opens canvases with the keys of two art nodes and checks that the miner only
+takes requests signed with a key that opened a canvas, and by the key they
+claim. An art node opening its canvas again keeps its id, closing it gives
+the id back, and the number of art nodes is capped. Last, with both art nodes
+on one miner, only the one that added a shape may delete it.
+
+Usage:
+go run misc/test-art-node-keys.go
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"../blockchain"
+	"../libminer"
+	"../miner"
+	"../pow"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+// Returns a request signed by privKey, like blockartlib makes them
+func request(msg []byte, privKey *ecdsa.PrivateKey) *libminer.Request {
+	hashedMsg := utils.ComputeHash(msg)
+	r, s, _ := ecdsa.Sign(rand.Reader, privKey, hashedMsg)
+	return &libminer.Request{R: *r, S: *s, HashedMsg: hashedMsg, Msg: msg,
+		PubKey: utils.GetPublicKeyString(privKey.PublicKey)}
+}
+
+// Returns the OpSig of op signed by privKey, like blockartlib signs them
+func signOp(op blockchain.Operation, addSig string, privKey *ecdsa.PrivateKey) string {
+	opInfo := blockchain.OperationInfo{AddSig: addSig, PubKey: utils.GetPublicKeyString(privKey.PublicKey), Op: op}
+	sig, _ := privKey.Sign(rand.Reader, blockchain.OperationDigest(opInfo), nil)
+	return hex.EncodeToString(sig)
+}
+
+// Inserts a legacy block after the genesis block holding the ops
+func insert(ops ...blockchain.OperationInfo) {
+	block := blockchain.Block{PrevHash: miner.MinerInstance.Settings.GenesisBlockHash, MinerPubKey: ops[0].PubKey,
+		OpHistory: ops}
+	for !pow.Verify(miner.GetBlockHash(block), 0) {
+		block.Nonce++
+	}
+	if err := miner.InsertBlock(block); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	harness.NewMiner(nil, protocol.MinerNetSettings{})
+
+	alice := harness.NewKey()
+	bob := harness.NewKey()
+	mallory := harness.NewKey()
+	lmi := new(miner.LibMinerInterface)
+	hi, _ := json.Marshal(libminer.OpenCanvasRequest{ProtocolVersion: protocol.PROTOCOL_VERSION})
+
+	// 1. Registration
+	var aliceResp, bobResp libminer.RegisterResponse
+	harness.Check("alice opens", lmi.OpenCanvas(request(hi, alice), &aliceResp) == nil, "")
+	harness.Check("bob opens", lmi.OpenCanvas(request(hi, bob), &bobResp) == nil, "")
+	harness.Check("ids differ", aliceResp.Id != bobResp.Id, fmt.Sprint(aliceResp.Id, bobResp.Id))
+	harness.Check("canvas settings", aliceResp.CanvasXMax == 1024, fmt.Sprint(aliceResp.CanvasXMax))
+
+	forged := request(hi, mallory)
+	forged.PubKey = utils.GetPublicKeyString(bob.PublicKey)
+	harness.Check("open with another key", lmi.OpenCanvas(forged, &libminer.RegisterResponse{}) != nil, "")
+
+	garbage := request(hi, mallory)
+	garbage.PubKey = "not a key"
+	harness.Check("open with a garbage key", lmi.OpenCanvas(garbage, &libminer.RegisterResponse{}) != nil, "")
+
+	err := lmi.OpenCanvas(request([]byte("Hi"), mallory), &libminer.RegisterResponse{})
+	envelope, _ := protocol.UnwrapError(fmt.Sprint(err))
+	_, isVersion := envelope.Err().(protocol.ProtocolVersionError)
+	harness.Check("open from before versioning", isVersion, fmt.Sprint(envelope.Err()))
+
+	// 2. Requests are taken from registered keys only
+	artNode, ok := miner.ArtNodeKey(request([]byte("ink?"), alice))
+	harness.Check("alice's request", ok && artNode == utils.GetPublicKeyString(alice.PublicKey), "")
+
+	artNode, ok = miner.ArtNodeKey(request([]byte("ink?"), bob))
+	harness.Check("bob's request", ok && artNode == utils.GetPublicKeyString(bob.PublicKey), "")
+
+	_, ok = miner.ArtNodeKey(request([]byte("ink?"), mallory))
+	harness.Check("unregistered key", !ok, "")
+
+	impersonating := request([]byte("ink?"), mallory)
+	impersonating.PubKey = utils.GetPublicKeyString(alice.PublicKey)
+	_, ok = miner.ArtNodeKey(impersonating)
+	harness.Check("signed by another key", !ok, "")
+
+	tampered := request([]byte("ink?"), alice)
+	tampered.Msg = []byte("all the ink")
+	_, ok = miner.ArtNodeKey(tampered)
+	harness.Check("tampered message", !ok, "")
+
+	// 3. Opening again, closing and the cap
+	var again libminer.RegisterResponse
+	harness.Check("alice opens again", lmi.OpenCanvas(request(hi, alice), &again) == nil && again.Id == aliceResp.Id,
+		fmt.Sprint(again.Id))
+
+	bye, _ := json.Marshal(libminer.GenericRequest{Id: bobResp.Id})
+	harness.Check("bob closes", lmi.CloseCanvas(request(bye, bob), &libminer.InkResponse{}) == nil, "")
+	_, ok = miner.ArtNodeKey(request([]byte("ink?"), bob))
+	harness.Check("closed key", !ok, "")
+	harness.Check("closed key can't close", lmi.CloseCanvas(request(bye, bob), &libminer.InkResponse{}) != nil, "")
+
+	var malloryResp libminer.RegisterResponse
+	harness.Check("id given back", lmi.OpenCanvas(request(hi, mallory), &malloryResp) == nil && malloryResp.Id == bobResp.Id,
+		fmt.Sprint(malloryResp.Id))
+
+	miner.ArtNodes.MaxArtNodes = 2
+	err = lmi.OpenCanvas(request(hi, bob), &bobResp)
+	_, isFull := err.(miner.ArtNodeError)
+	harness.Check("too many art nodes", isFull, fmt.Sprint(err))
+
+	malloryBye, _ := json.Marshal(libminer.GenericRequest{Id: malloryResp.Id})
+	lmi.CloseCanvas(request(malloryBye, mallory), &libminer.InkResponse{})
+	harness.Check("bob opens once there is room", lmi.OpenCanvas(request(hi, bob), &bobResp) == nil, "")
+
+	// 4. Bob can't delete alice's shape
+	aliceKey := utils.GetPublicKeyString(alice.PublicKey)
+	square := blockchain.Operation{OpType: blockchain.ADD, SVGString: "M 0 0 l 10 0 l 0 10 l -10 0 z",
+		Fill: "transparent", Stroke: "red", OpNum: 1}
+	add := blockchain.OperationInfo{OpSig: signOp(square, "", alice), PubKey: aliceKey, Op: square}
+	insert(add)
+
+	lmi.SOpChan = make(chan blockchain.OperationInfo, 1)
+	lmi.POpChan = make(chan miner.PropagateOpArgs, 1)
+	deletion := square
+	deletion.OpType, deletion.OpNum = blockchain.DELETE, 2
+
+	bobDelete, _ := json.Marshal(libminer.DeleteRequest{Id: bobResp.Id, ShapeHash: add.OpSig, OpNum: 2,
+		OpSig: signOp(deletion, add.OpSig, bob)})
+	err = lmi.DeleteAsync(request(bobDelete, bob), &libminer.DrawResponse{})
+	envelope, _ = protocol.UnwrapError(fmt.Sprint(err))
+	_, isOwner := envelope.Err().(protocol.ShapeOwnerError)
+	harness.Check("bob deletes alice's shape", isOwner, fmt.Sprint(envelope.Err()))
+
+	aliceDelete, _ := json.Marshal(libminer.DeleteRequest{Id: aliceResp.Id, ShapeHash: add.OpSig, OpNum: 2,
+		OpSig: signOp(deletion, add.OpSig, alice)})
+	var deleted libminer.DrawResponse
+	err = lmi.DeleteAsync(request(aliceDelete, alice), &deleted)
+	harness.Check("alice deletes her shape", err == nil && len(miner.Pool.Ops()) == 1, fmt.Sprint(err))
+
+	harness.Done()
+}
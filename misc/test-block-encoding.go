@@ -0,0 +1,103 @@
+/*
+
+Golden vectors for the canonical block encoding. If any of these change,
+every miner's block hashes change with them, so a failure here means the
+encoding (or the hashing on top of it) is no longer backwards compatible.
+
+Usage:
+go run misc/test-block-encoding.go
+
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"../blockchain"
+	"./harness"
+)
+
+var op = blockchain.Operation{
+	OpType:    blockchain.ADD,
+	SVGString: "M 0 0 H 10 V 10 Z",
+	Fill:      "transparent",
+	Stroke:    "red",
+	OpNum:     7}
+
+var opInfo = blockchain.OperationInfo{
+	AddSig: "",
+	OpSig:  "3045",
+	PubKey: "3076",
+	Op:     op}
+
+var transfer = blockchain.Operation{
+	OpType: blockchain.TRANSFER,
+	OpNum:  7,
+	To:     "3076",
+	Amount: 50}
+
+var noOpBlock = blockchain.Block{
+	PrevHash:      "83218ac34c1834c26781fe4bde918ee4",
+	MinerPubKey:   "3076",
+	Nonce:         42,
+	HashAlgorithm: blockchain.SHA256}
+
+const (
+	GOLDEN_OPERATION = "0000000000000000000000114d2030203020482031302056203130205a" +
+		"0000000b7472616e73706172656e740000000372656400000000000000" +
+		"070000000000000000"
+	GOLDEN_TRANSFER = "00000000000000020000000000000000000000000000000000000007" +
+		"000000043330373600000032"
+	GOLDEN_NO_OP_BLOCK = "0500000006736861323536000000203833323138616333346331383334" +
+		"6332363738316665346264653931386565340000000433303736000000" +
+		"0000000000000000000000000000000000000000002a"
+)
+
+// Hashes of noOpBlock with opInfo added, under each algorithm
+var goldenHashes = map[blockchain.HashAlgorithm]string{
+	blockchain.MD5:     "642a147e9ac96e43925c5e1e3219b588",
+	blockchain.SHA256:  "856d84f03a31be0263e648cf39d247aa56e2875b278f8d232ff3cf07e52202fb",
+	blockchain.BLAKE2B: "958efc7b6817b8f054723df494b8444f7a0d0e020cfb77533be6cafc2a3dd77d",
+}
+
+func golden(name string, got string, expected string) {
+	detail := ""
+	if got != expected {
+		detail = fmt.Sprintf("\n  got:      %s\n  expected: %s", got, expected)
+	}
+	harness.Check(name, got == expected, detail)
+}
+
+func main() {
+	golden("EncodeOperation", hex.EncodeToString(blockchain.EncodeOperation(op)), GOLDEN_OPERATION)
+	golden("EncodeOperation transfer", hex.EncodeToString(blockchain.EncodeOperation(transfer)), GOLDEN_TRANSFER)
+	golden("EncodeBlock", hex.EncodeToString(blockchain.EncodeBlock(noOpBlock)), GOLDEN_NO_OP_BLOCK)
+
+	// The prefix plus the nonce must be the whole encoding
+	prefix := blockchain.EncodeBlockPrefix(noOpBlock)
+	golden("EncodeBlockPrefix", hex.EncodeToString(prefix)+"0000002a", GOLDEN_NO_OP_BLOCK)
+
+	// What the miner signs is the prefix without the signature and extra nonce
+	signed := blockchain.EncodeBlockForSigning(noOpBlock)
+	golden("EncodeBlockForSigning", hex.EncodeToString(signed)+"00000000"+"00000000", hex.EncodeToString(prefix))
+
+	for algorithm, expected := range goldenHashes {
+		block := noOpBlock
+		block.OpHistory = []blockchain.OperationInfo{opInfo}
+		block.HashAlgorithm = algorithm
+
+		hash, err := blockchain.HashBlock(block)
+		if err != nil {
+			hash = err.Error()
+		}
+		name := string(algorithm)
+		if algorithm == blockchain.MD5 {
+			name = "md5 (legacy json)"
+		}
+		golden("HashBlock "+name, hash, expected)
+	}
+
+	harness.Done()
+}
@@ -0,0 +1,83 @@
+/*
+
+Signs a block the way the miner does for a job and checks that it verifies
+with any nonces, and that unsigned blocks, blocks whose MinerPubKey was
+swapped to steal the reward, and blocks whose ops changed after signing are
+rejected. Legacy MD5 blocks predate signatures and pass unsigned.
+
+Usage:
+go run misc/test-block-signatures.go
+
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"../blockchain"
+	"../miner"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+func reason(err error) string {
+	if sigErr, ok := err.(miner.BlockSignatureError); ok {
+		return sigErr.Reason
+	}
+	return fmt.Sprint(err)
+}
+
+func main() {
+	alice := harness.NewKey()
+	mallory := harness.NewKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{})
+
+	block := blockchain.Block{
+		PrevHash:      "83218ac34c1834c26781fe4bde918ee4",
+		MinerPubKey:   utils.GetPublicKeyString(alice.PublicKey),
+		HashAlgorithm: blockchain.SHA256,
+		Timestamp:     1500000000000,
+		Difficulty:    5,
+		OpHistory:     []blockchain.OperationInfo{{OpSig: "3045", PubKey: "3076"}}}
+
+	unsigned := block
+	harness.Check("unsigned", reason(miner.VerifyBlockSignature(unsigned)) == miner.REJECT_UNSIGNED, "")
+
+	legacy := block
+	legacy.HashAlgorithm = blockchain.MD5
+	harness.Check("unsigned legacy", miner.VerifyBlockSignature(legacy) == nil, "")
+	miner.SignBlock(&legacy)
+	legacy.MinerPubKey = utils.GetPublicKeyString(mallory.PublicKey)
+	harness.Check("signed legacy still checked", reason(miner.VerifyBlockSignature(legacy)) == miner.REJECT_FORGED, "")
+
+	miner.SignBlock(&block)
+	harness.Check("signed", miner.VerifyBlockSignature(block) == nil, "")
+
+	// The solver rolls the nonces without signing again
+	solved := block
+	solved.Nonce, solved.ExtraNonce = 12345, 7
+	harness.Check("any nonces", miner.VerifyBlockSignature(solved) == nil, "")
+
+	stolen := block
+	stolen.MinerPubKey = utils.GetPublicKeyString(mallory.PublicKey)
+	harness.Check("stolen reward", reason(miner.VerifyBlockSignature(stolen)) == miner.REJECT_FORGED, "")
+
+	changed := block
+	changed.OpHistory = nil
+	harness.Check("ops changed", reason(miner.VerifyBlockSignature(changed)) == miner.REJECT_FORGED, "")
+
+	garbage := block
+	garbage.Signature = "not hex"
+	harness.Check("bad signature", reason(miner.VerifyBlockSignature(garbage)) == miner.REJECT_BAD_SIGNATURE, "")
+
+	// The signature is part of what is hashed
+	hash, _ := blockchain.HashBlock(block)
+	resigned := block
+	miner.SignBlock(&resigned)
+	rehash, _ := blockchain.HashBlock(resigned)
+	harness.Check("hash covers signature", hash != rehash, "")
+
+	harness.Done()
+}
@@ -0,0 +1,200 @@
+/*
+
+Checks that the block store survives a crash. Blocks are written through
+InsertBlock, then the log is cut off in the middle of the last record: the
+store reopens with the torn record dropped and the log truncated after the
+last whole one. With the index torn or gone it is rebuilt from the log, a
+record with a bad checksum ends the log, and blocks appended after recovery
+land after the last whole record. Last, the recovered chain is replayed on
+boot, and a store of another genesis block is moved aside.
+
+Usage:
+go run misc/test-block-store.go
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../pow"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+var clock = time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+
+// Mines and inserts a block after prevHash and returns it
+func mine(prevHash string) blockchain.Block {
+	clock += 1000
+	block := blockchain.Block{
+		PrevHash:      prevHash,
+		MinerPubKey:   utils.GetPublicKeyString(miner.MinerInstance.PrivKey.PublicKey),
+		HashAlgorithm: blockchain.SHA256,
+		Timestamp:     clock,
+		Difficulty:    miner.BaseDifficulty(false)}
+	miner.SignBlock(&block)
+	for !pow.Verify(miner.GetBlockHash(block), int(block.Difficulty)) {
+		block.Nonce++
+	}
+	if err := miner.InsertBlock(block); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return block
+}
+
+// Returns the length of block's record in the log
+func recordLen(block blockchain.Block) int64 {
+	payload, _ := json.Marshal(block)
+	return int64(miner.STORE_RECORD_HEADER + len(payload))
+}
+
+// Returns the length of the first n records in the log
+func logLen(blocks []blockchain.Block, n int) int64 {
+	var size int64
+	for _, block := range blocks[:n] {
+		size += recordLen(block)
+	}
+	return size
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// Returns true if the store holds exactly blocks, in order
+func holds(store *miner.BlockStore, blocks []blockchain.Block) bool {
+	stored, err := store.Blocks()
+	if err != nil || len(stored) != len(blocks) {
+		return false
+	}
+	for i, block := range blocks {
+		hash := miner.GetBlockHash(block)
+		got, err := store.Get(hash)
+		if !store.Has(hash) || err != nil || miner.GetBlockHash(got) != hash || miner.GetBlockHash(stored[i]) != hash {
+			return false
+		}
+	}
+	return true
+}
+
+func reopen(dir string) *miner.BlockStore {
+	store, err := miner.OpenBlockStore(dir, harness.GENESIS)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return store
+}
+
+// Drops the in-memory chain and loads it back from the store, like a miner
+// does on boot
+func boot(store *miner.BlockStore) {
+	miner.BlockNodeArray = nil
+	miner.BlockHashMap = make(map[string]int)
+	miner.PathMap = make(map[string]miner.LongestPathInfo)
+	miner.InitBlockChain()
+	miner.Store = store
+	miner.LoadBlockStore()
+}
+
+func main() {
+	alice := harness.NewKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{})
+
+	root, _ := ioutil.TempDir("", "blockstore")
+	dir := filepath.Join(root, "store")
+	logPath := filepath.Join(dir, miner.STORE_LOG_FILE)
+	indexPath := filepath.Join(dir, miner.STORE_INDEX_FILE)
+
+	// 1. Blocks inserted are written through to the store
+	miner.Store = reopen(dir)
+	var blocks []blockchain.Block
+	prevHash := harness.GENESIS
+	for i := 0; i < 5; i++ {
+		block := mine(prevHash)
+		blocks = append(blocks, block)
+		prevHash = miner.GetBlockHash(block)
+	}
+	harness.Check("blocks written", holds(miner.Store, blocks) && fileSize(logPath) == logLen(blocks, 5),
+		fmt.Sprint(fileSize(logPath)))
+	miner.Store.Close()
+
+	// 2. The log is cut off in the middle of the last record
+	os.Truncate(logPath, logLen(blocks, 4)+recordLen(blocks[4])/2)
+	store := reopen(dir)
+	harness.Check("torn record dropped", holds(store, blocks[:4]) && !store.Has(miner.GetBlockHash(blocks[4])), "")
+	harness.Check("torn tail truncated", fileSize(logPath) == logLen(blocks, 4), fmt.Sprint(fileSize(logPath)))
+	store.Close()
+
+	// 3. The index is cut off in the middle of a record, then lost altogether
+	indexSize := fileSize(indexPath)
+	os.Truncate(indexPath, indexSize/2+1)
+	store = reopen(dir)
+	harness.Check("torn index rebuilt", holds(store, blocks[:4]) && fileSize(indexPath) == indexSize,
+		fmt.Sprint(fileSize(indexPath), indexSize))
+	store.Close()
+
+	os.Truncate(indexPath, 0)
+	store = reopen(dir)
+	harness.Check("lost index rebuilt", holds(store, blocks[:4]) && fileSize(indexPath) == indexSize,
+		fmt.Sprint(fileSize(indexPath), indexSize))
+	store.Close()
+
+	// 4. A record with a bad checksum ends the log
+	logFile, _ := os.OpenFile(logPath, os.O_RDWR, 0644)
+	last := logLen(blocks, 3) + miner.STORE_RECORD_HEADER
+	b := make([]byte, 1)
+	logFile.ReadAt(b, last)
+	logFile.WriteAt([]byte{b[0] ^ 0xff}, last)
+	logFile.Close()
+	os.Truncate(indexPath, 0)
+	store = reopen(dir)
+	harness.Check("bad checksum dropped", holds(store, blocks[:3]) && fileSize(logPath) == logLen(blocks, 3),
+		fmt.Sprint(fileSize(logPath)))
+
+	// 5. The recovered chain is replayed on boot, and appended to after its
+	// last whole record
+	boot(store)
+	tip := miner.LocalTip()
+	harness.Check("replayed on boot", tip.Height == 3 && tip.Hash == miner.GetBlockHash(blocks[2]), fmt.Sprint(tip))
+	path, _ := miner.GetLongestPath(harness.GENESIS)
+	harness.Check("work replayed", miner.PathWork(path).Cmp(big.NewInt(3)) == 0, fmt.Sprint(miner.PathWork(path)))
+	harness.Check("replay not written again", fileSize(logPath) == logLen(blocks, 3), fmt.Sprint(fileSize(logPath)))
+
+	next := mine(miner.GetBlockHash(blocks[2]))
+	store.Close()
+	store = reopen(dir)
+	recovered := append(blocks[:3:3], next)
+	harness.Check("appended after recovery", holds(store, recovered) && fileSize(logPath) == logLen(recovered, 4),
+		fmt.Sprint(fileSize(logPath)))
+	boot(store)
+	harness.Check("appended block replayed", miner.LocalTip().Hash == miner.GetBlockHash(next), fmt.Sprint(miner.LocalTip()))
+	store.Close()
+	miner.Store = nil
+
+	// 6. A store of another genesis block is moved aside
+	other, err := miner.OpenBlockStore(dir, "other genesis")
+	stale, _ := filepath.Glob(dir + ".stale-*")
+	otherBlocks, _ := other.Blocks()
+	harness.Check("other genesis moved aside", err == nil && len(otherBlocks) == 0 && len(stale) == 1, fmt.Sprint(err, stale))
+	other.Close()
+
+	os.RemoveAll(root)
+	harness.Done()
+}
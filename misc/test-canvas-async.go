@@ -0,0 +1,150 @@
+/*
+
+Runs blockartlib against a fake miner that accepts shapes right away and
+then buries each one a block at a time. Checks that AddShapeAsync returns
+before any block, that many shapes can be in flight at once, that the depth
+channel sees every depth up to validateNum, and that a shape evicted for good
+reports OpEvictedError from its result.
+
+Usage:
+go run misc/test-canvas-async.go
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"../blockartlib"
+	"../libminer"
+	"../protocol"
+	"./harness"
+)
+
+const NUM_SHAPES = 30
+
+// Stands in for the miner's LibMinerInterface
+type LibMinerInterface struct {
+	mutex    sync.Mutex
+	ops      map[string]uint8 // ValidateNum of every accepted op
+	inFlight int              // Ops accepted but not done
+	maxIn    int              // Most ops in flight at once
+}
+
+func (lmi *LibMinerInterface) OpenCanvas(req *libminer.Request, resp *libminer.RegisterResponse) error {
+	resp.CanvasXMax = 1024
+	resp.CanvasYMax = 1024
+	resp.ProtocolVersion = protocol.PROTOCOL_VERSION
+	return nil
+}
+
+func (lmi *LibMinerInterface) DrawAsync(req *libminer.Request, resp *libminer.DrawResponse) error {
+	var drawReq libminer.DrawRequest
+	json.Unmarshal(req.Msg, &drawReq)
+
+	lmi.mutex.Lock()
+	defer lmi.mutex.Unlock()
+	resp.ShapeHash = fmt.Sprint("op", len(lmi.ops))
+	resp.OpHash = resp.ShapeHash
+	resp.InkRemaining = 1000
+	lmi.ops[resp.ShapeHash] = drawReq.ValidateNum
+	lmi.inFlight++
+	if lmi.inFlight > lmi.maxIn {
+		lmi.maxIn = lmi.inFlight
+	}
+	return nil
+}
+
+// Every op gets a block deeper on each call; ops with validateNum 0 never
+// make it
+func (lmi *LibMinerInterface) WaitOp(req *libminer.Request, resp *libminer.OpStatusResponse) error {
+	var statusReq libminer.OpStatusRequest
+	json.Unmarshal(req.Msg, &statusReq)
+	time.Sleep(10 * time.Millisecond)
+
+	lmi.mutex.Lock()
+	validateNum, ok := lmi.ops[statusReq.OpHash]
+	lmi.mutex.Unlock()
+	if !ok {
+		return protocol.WrapError(protocol.InvalidShapeHashError(statusReq.OpHash))
+	}
+	if validateNum == 0 {
+		return protocol.WrapError(protocol.OpEvictedError(statusReq.OpHash))
+	}
+
+	resp.Depth = statusReq.KnownDepth + 1
+	if resp.Depth >= int(validateNum) {
+		resp.Done = true
+		resp.BlockHash = "block-" + statusReq.OpHash
+		resp.InkRemaining = 900
+
+		lmi.mutex.Lock()
+		lmi.inFlight--
+		lmi.mutex.Unlock()
+	}
+	return nil
+}
+
+func main() {
+	lmi := &LibMinerInterface{ops: make(map[string]uint8)}
+	server := rpc.NewServer()
+	server.Register(lmi)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go server.Accept(ln)
+
+	privKey := harness.NewKey()
+	canvas, _, err := blockartlib.OpenCanvas(ln.Addr().String(), *privKey)
+	harness.Check("open", err == nil, fmt.Sprint(err))
+
+	// 1. Pipeline NUM_SHAPES shapes
+	var ops []*blockartlib.PendingOp
+	for i := 0; i < NUM_SHAPES; i++ {
+		op, err := canvas.AddShapeAsync(3, blockartlib.PATH, fmt.Sprintf("M %d 0 l 5 5", i*10), "transparent", "red")
+		if err != nil {
+			harness.Check("accepted", false, fmt.Sprint(err))
+			continue
+		}
+		ops = append(ops, op)
+	}
+	harness.Check("all accepted", len(ops) == NUM_SHAPES, fmt.Sprint(len(ops)))
+
+	wrong := ""
+	for _, op := range ops {
+		var depths []int
+		for depth := range op.Depths {
+			depths = append(depths, depth)
+		}
+		blockHash, ink, err := op.Result()
+		if (err != nil || blockHash != "block-"+op.OpSig || ink != 900 || fmt.Sprint(depths) != "[0 1 2 3]") && wrong == "" {
+			wrong = fmt.Sprint(op.OpSig, blockHash, ink, err, depths)
+		}
+	}
+	harness.Check("results", wrong == "", wrong)
+	harness.Check("shapes in flight together", lmi.maxIn > NUM_SHAPES/2, fmt.Sprint(lmi.maxIn))
+
+	// 2. An op evicted for good
+	op, err := canvas.AddShapeAsync(0, blockartlib.PATH, "M 0 0 l 5 5", "transparent", "red")
+	harness.Check("accepted", err == nil, fmt.Sprint(err))
+	select {
+	case <-op.Done():
+	case <-time.After(5 * time.Second):
+		harness.Check("done", false, "timed out")
+	}
+	_, _, err = op.Result()
+	_, isEvicted := err.(blockartlib.OpEvictedError)
+	harness.Check("evicted", isEvicted && strings.Contains(err.Error(), op.OpSig), fmt.Sprint(err))
+
+	harness.Done()
+}
@@ -0,0 +1,184 @@
+/*
+
+Checks the incremental canvas state against rebuilding it from scratch. A
+tree of random blocks (adds and deletes of random squares by a few keys) is
+built, and a single canvas state is moved between random paths of the tree,
+forwards, backwards and across forks. After every move it must agree with a
+fresh state built from the same path on ink, live shapes, the op index and
+pixel ownership.
+
+Usage:
+go run misc/test-canvas-state.go
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+const (
+	NUM_BLOCKS = 300
+	NUM_SEEKS  = 200
+	MAX_OPS    = 4
+)
+
+var keys = []string{"alice", "bob", "carol"}
+
+func randomSquare(r *rand.Rand) string {
+	w, h := 5+r.Intn(20), 5+r.Intn(20)
+	return fmt.Sprintf("M %d %d l %d 0 l 0 %d l -%d 0 z", r.Intn(1000), r.Intn(1000), w, h, w)
+}
+
+// Returns a tree of random blocks, as the path from the genesis block to
+// every block of the tree
+func buildTree(r *rand.Rand) [][]blockchain.Block {
+	genesis := blockchain.Block{}
+	paths := [][]blockchain.Block{{genesis}}
+	opNum := uint64(0)
+
+	for i := 0; i < NUM_BLOCKS; i++ {
+		// Mostly extend recent blocks so there are long paths and short forks
+		parentPath := paths[len(paths)-1-r.Intn(min(len(paths), 5))]
+		parent := parentPath[len(parentPath)-1]
+
+		block := blockchain.Block{
+			PrevHash:      miner.GetBlockHash(parent),
+			MinerPubKey:   keys[r.Intn(len(keys))],
+			Nonce:         r.Uint32(),
+			HashAlgorithm: blockchain.SHA256}
+
+		// Delete some of the shapes added on this path, add new ones
+		var added []blockchain.OperationInfo
+		for _, b := range parentPath {
+			for _, opInfo := range b.OpHistory {
+				if opInfo.Op.OpType == blockchain.ADD {
+					added = append(added, opInfo)
+				}
+			}
+		}
+
+		for j := r.Intn(MAX_OPS + 1); j > 0; j-- {
+			opNum++
+			opInfo := blockchain.OperationInfo{
+				OpSig:  fmt.Sprint("op", opNum),
+				PubKey: keys[r.Intn(len(keys))],
+				Op: blockchain.Operation{
+					OpType:    blockchain.ADD,
+					SVGString: randomSquare(r),
+					Fill:      "transparent",
+					Stroke:    "red",
+					OpNum:     opNum}}
+
+			if len(added) > 0 && r.Intn(3) == 0 {
+				add := added[r.Intn(len(added))]
+				opInfo.AddSig = add.OpSig
+				opInfo.PubKey = add.PubKey
+				opInfo.Op.OpType = blockchain.DELETE
+				opInfo.Op.SVGString = add.Op.SVGString
+			}
+
+			block.OpHistory = append(block.OpHistory, opInfo)
+		}
+
+		path := append(append([]blockchain.Block{}, parentPath...), block)
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+// Compares the two states on everything a validation can ask of them, and
+// returns the first thing they differ on, or "" if they agree
+func compare(paths [][]blockchain.Block, a, b *miner.CanvasState, r *rand.Rand) string {
+	for _, key := range keys {
+		if a.Ink(key) != b.Ink(key) {
+			return fmt.Sprint("ink ", key, " ", a.Ink(key), " ", b.Ink(key))
+		}
+	}
+
+	for _, path := range paths {
+		for _, opInfo := range path[len(path)-1].OpHistory {
+			if a.OpBlock(opInfo.OpSig) != b.OpBlock(opInfo.OpSig) {
+				return "op index " + opInfo.OpSig
+			}
+
+			_, liveA := a.Shape(opInfo.OpSig)
+			_, liveB := b.Shape(opInfo.OpSig)
+			if liveA != liveB {
+				return "live shape " + opInfo.OpSig
+			}
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		svg := randomSquare(r)
+		svgPath, _ := utils.GetParsedSVG(svg)
+		shape, _ := utils.SVGToPoints(svgPath, 1024, 1024, false, true)
+		subarr, _ := shape.SubArrayAndCost()
+		key := keys[r.Intn(len(keys))]
+		if a.CanPaint(subarr, key) != b.CanPaint(subarr, key) {
+			return "ownership " + svg
+		}
+	}
+	return ""
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func main() {
+	harness.NewMiner(nil, protocol.MinerNetSettings{
+		InkPerOpBlock:   1000,
+		InkPerNoOpBlock: 500})
+
+	r := rand.New(rand.NewSource(42))
+	paths := buildTree(r)
+
+	canvas := miner.NewCanvasState()
+	var incremental, rebuild time.Duration
+	mismatch := ""
+
+	for i := 0; i < NUM_SEEKS; i++ {
+		path := paths[r.Intn(len(paths))]
+
+		start := time.Now()
+		canvas.Seek(path)
+		incremental += time.Since(start)
+
+		start = time.Now()
+		fresh := miner.NewCanvasState()
+		fresh.Seek(path)
+		rebuild += time.Since(start)
+
+		diff := compare(paths, canvas, fresh, r)
+		if canvas.Tip() != fresh.Tip() {
+			diff = "tip"
+		}
+		if diff != "" && mismatch == "" {
+			mismatch = fmt.Sprint("seek ", i, " ", diff)
+		}
+	}
+	harness.Check("seeks match a rebuild", mismatch == "", mismatch)
+
+	// Back to the genesis block, everything is undone
+	canvas.Seek(paths[0])
+	diff := compare(paths, canvas, miner.NewCanvasState(), r)
+	harness.Check("genesis", diff == "", diff)
+
+	fmt.Println("seeks:", NUM_SEEKS, "incremental:", incremental, "rebuild:", rebuild)
+	harness.Done()
+}
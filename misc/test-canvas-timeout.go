@@ -0,0 +1,127 @@
+/*
+
+Runs blockartlib against a fake miner that never finishes validating a shape,
+and checks that the Ctx calls give up at their deadline with a TimeoutError,
+that the deadline reaches the miner, and that cancelling returns right away.
+Last, calls on a canvas without a miner name the canvas in their
+DisconnectedError.
+
+Usage:
+go run misc/test-canvas-timeout.go
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"time"
+
+	"../blockartlib"
+	"../libminer"
+	"../protocol"
+	"./harness"
+)
+
+// Stands in for the miner's LibMinerInterface
+type LibMinerInterface struct {
+	deadlines chan int64
+}
+
+func (lmi *LibMinerInterface) OpenCanvas(req *libminer.Request, resp *libminer.RegisterResponse) error {
+	resp.CanvasXMax = 1024
+	resp.CanvasYMax = 1024
+	resp.ProtocolVersion = protocol.PROTOCOL_VERSION
+	return nil
+}
+
+// Never gets enough blocks
+func (lmi *LibMinerInterface) Draw(req *libminer.Request, resp *libminer.DrawResponse) error {
+	var drawReq libminer.DrawRequest
+	json.Unmarshal(req.Msg, &drawReq)
+	lmi.deadlines <- drawReq.Deadline
+	select {}
+}
+
+func main() {
+	lmi := &LibMinerInterface{deadlines: make(chan int64, 2)}
+	server := rpc.NewServer()
+	server.Register(lmi)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go server.Accept(ln)
+
+	privKey := harness.NewKey()
+	canvas, _, err := blockartlib.OpenCanvas(ln.Addr().String(), *privKey)
+	harness.Check("open", err == nil, fmt.Sprint(err))
+
+	// 1. Deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	deadline, _ := ctx.Deadline()
+	start := time.Now()
+	_, _, _, err = canvas.AddShapeCtx(ctx, 2, blockartlib.PATH, "M 0 0 L 5 5", "transparent", "red")
+	elapsed := time.Since(start)
+	cancel()
+
+	_, isTimeout := err.(blockartlib.TimeoutError)
+	harness.Check("timeout error", isTimeout, fmt.Sprint(err))
+	harness.Check("returned at the deadline", elapsed < time.Second, fmt.Sprint(elapsed))
+	harness.Check("deadline sent to the miner", <-lmi.deadlines == deadline.UnixNano()/int64(time.Millisecond), "")
+
+	// 2. Cancel
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-lmi.deadlines
+		cancel()
+	}()
+	_, _, _, err = canvas.AddShapeCtx(ctx, 2, blockartlib.PATH, "M 0 0 L 5 5", "transparent", "red")
+	harness.Check("cancelled", err == context.Canceled, fmt.Sprint(err))
+
+	// 3. Already expired context never reaches the miner
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	_, _, err = blockartlib.OpenCanvasCtx(ctx, ln.Addr().String(), *privKey)
+	cancel()
+	_, isTimeout = err.(blockartlib.TimeoutError)
+	harness.Check("open with expired context", isTimeout, fmt.Sprint(err))
+
+	// 4. No miner
+	closed := blockartlib.CanvasT{Id: 42}
+	errs := make([]error, 0)
+	_, _, _, err = closed.AddShape(2, blockartlib.PATH, "M 0 0 L 5 5", "transparent", "red")
+	errs = append(errs, err)
+	_, err = closed.GetSvgString("shape")
+	errs = append(errs, err)
+	_, err = closed.GetInk()
+	errs = append(errs, err)
+	_, err = closed.DeleteShape(2, "shape")
+	errs = append(errs, err)
+	_, _, err = closed.TransferInk(2, "key", 1)
+	errs = append(errs, err)
+	_, err = closed.GetShapes("block")
+	errs = append(errs, err)
+	_, err = closed.GetGenesisBlock()
+	errs = append(errs, err)
+	_, err = closed.GetChildren("block")
+	errs = append(errs, err)
+	_, err = closed.CloseCanvas()
+	errs = append(errs, err)
+	_, err = closed.AddShapeAsync(2, blockartlib.PATH, "M 0 0 L 5 5", "transparent", "red")
+	errs = append(errs, err)
+	_, err = closed.DeleteShapeAsync(2, "shape")
+	errs = append(errs, err)
+	_, err = closed.GetPendingOps()
+	errs = append(errs, err)
+	for i, err := range errs {
+		harness.Check(fmt.Sprint("disconnected ", i), err == blockartlib.DisconnectedError("42"), fmt.Sprint(err))
+	}
+
+	harness.Done()
+}
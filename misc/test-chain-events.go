@@ -0,0 +1,173 @@
+/*
+
+Moves the chain event bus between forks and checks the events a watcher of
+one op receives: its confirmations as blocks pile on, its eviction when its
+block is reorged out, and its confirmation again once a fork holding it wins.
+A watcher that fell behind and missed its confirmation gets it on the next
+block, and a watcher is confirmed by a copy of its op signed again.
+
+Usage:
+go run misc/test-chain-events.go
+
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"../blockchain"
+	"../miner"
+	"./harness"
+)
+
+// Returns the op called name
+func op(name string) blockchain.OperationInfo {
+	return blockchain.OperationInfo{OpSig: "sig of " + name, Op: blockchain.Operation{SVGString: name}}
+}
+
+// Returns the hash the bus knows the op called name by
+func hash(name string) string {
+	return hex.EncodeToString(blockchain.OperationDigest(op(name)))
+}
+
+// Returns path extended by a block holding ops
+func extend(path []blockchain.Block, minerKey string, ops ...blockchain.OperationInfo) []blockchain.Block {
+	block := blockchain.Block{
+		PrevHash:      miner.GetBlockHash(path[len(path)-1]),
+		MinerPubKey:   minerKey,
+		HashAlgorithm: blockchain.SHA256,
+		OpHistory:     ops}
+
+	return append(append([]blockchain.Block{}, path...), block)
+}
+
+// Returns the events waiting on the subscription
+func drain(sub *miner.ChainSubscription) []miner.ChainEvent {
+	var events []miner.ChainEvent
+	for {
+		select {
+		case event := <-sub.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// Returns the op events only
+func opEvents(events []miner.ChainEvent) []miner.ChainEvent {
+	var ops []miner.ChainEvent
+	for _, event := range events {
+		if event.OpHash != "" {
+			ops = append(ops, event)
+		}
+	}
+	return ops
+}
+
+func main() {
+	bus := miner.NewChainEventBus()
+	genesis := []blockchain.Block{{}}
+	bus.Update(genesis)
+
+	watch := bus.WatchOp(hash("X"), 2)
+	all := bus.Subscribe()
+
+	// 1. X lands in a block, then gets buried
+	a1 := extend(genesis, "a")
+	a2 := extend(a1, "a", op("X"))
+	bus.Update(a2)
+	events := opEvents(drain(watch))
+	harness.Check("included", len(events) == 1 && events[0].Type == miner.OP_CONFIRMED && events[0].Depth == 0 &&
+		events[0].Height == 2, fmt.Sprint(events))
+
+	a3 := extend(a2, "a")
+	bus.Update(a3)
+	events = opEvents(drain(watch))
+	harness.Check("depth 1", len(events) == 1 && events[0].Depth == 1, fmt.Sprint(events))
+
+	// 2. A heavier fork without X replaces a2 and a3
+	drain(all)
+	b2 := extend(a1, "b")
+	b4 := extend(extend(b2, "b"), "b")
+	bus.Update(b4)
+	events = drain(all)
+	disconnects, connects, evicted := 0, 0, 0
+	for i, event := range events {
+		switch event.Type {
+		case miner.BLOCK_DISCONNECTED:
+			disconnects++
+			harness.Check("disconnects first", connects == 0, fmt.Sprint(i))
+		case miner.BLOCK_CONNECTED:
+			connects++
+		case miner.OP_EVICTED:
+			evicted++
+		}
+	}
+	harness.Check("reorg events", disconnects == 2 && connects == 3 && evicted == 1, fmt.Sprint(disconnects, connects, evicted))
+
+	events = opEvents(drain(watch))
+	harness.Check("evicted", len(events) == 1 && events[0].Type == miner.OP_EVICTED && events[0].Height == 2,
+		fmt.Sprint(events))
+
+	// 3. The fork picks X up again and buries it past the watched depth
+	b5 := extend(b4, "b", op("X"))
+	b7 := extend(extend(b5, "b"), "b")
+	bus.Update(b7)
+	events = opEvents(drain(watch))
+	harness.Check("confirmed again", len(events) == 1 && events[0].Depth == 2 && events[0].Height == 5,
+		fmt.Sprint(events))
+
+	bus.Update(extend(b7, "b"))
+	events = opEvents(drain(watch))
+	harness.Check("no events past the watched depth", len(events) == 0, fmt.Sprint(events))
+
+	// 4. A reorg that keeps X in a block on both sides evicts nothing
+	c6 := extend(b5, "c")
+	c9 := extend(extend(extend(c6, "c"), "c"), "c")
+	bus.Update(c9)
+	events = opEvents(drain(all))
+	harness.Check("op on both forks", len(events) == 0, fmt.Sprint(events))
+
+	// 5. Watching an op that is already deep enough confirms right away
+	late := bus.WatchOp(hash("X"), 1)
+	events = drain(late)
+	harness.Check("late watcher", len(events) == 1 && events[0].Type == miner.OP_CONFIRMED && events[0].Depth == 4,
+		fmt.Sprint(events))
+
+	// 6. Y is confirmed while its watcher is too far behind to hear it
+	behind := bus.WatchOp(hash("Y"), 1)
+	d := c9
+	for i := 0; i < miner.CHAIN_EVENT_BUFFER; i++ {
+		d = extend(d, "d")
+	}
+	d = extend(extend(d, "d", op("Y")), "d")
+	bus.Update(d)
+	events = opEvents(drain(behind))
+	harness.Check("confirmation dropped", len(events) == 0, fmt.Sprint(events))
+
+	d = extend(d, "d")
+	bus.Update(d)
+	events = opEvents(drain(behind))
+	harness.Check("confirmation sent again", len(events) == 1 && events[0].Type == miner.OP_CONFIRMED && events[0].Depth == 2,
+		fmt.Sprint(events))
+
+	// 7. Z makes it into a block under another signature
+	resigned := bus.WatchOp(hash("Z"), 0)
+	z := op("Z")
+	z.OpSig = "Z signed again"
+	bus.Update(extend(d, "d", z))
+	events = opEvents(drain(resigned))
+	harness.Check("confirmed by a copy signed again", len(events) == 1 && events[0].Type == miner.OP_CONFIRMED &&
+		events[0].OpHash == hash("Z"), fmt.Sprint(events))
+
+	bus.Unsubscribe(watch)
+	bus.Unsubscribe(all)
+	bus.Unsubscribe(late)
+	bus.Unsubscribe(behind)
+	bus.Unsubscribe(resigned)
+
+	harness.Done()
+}
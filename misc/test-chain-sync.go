@@ -0,0 +1,369 @@
+/*
+
+Syncs a miner with a fake peer and checks that only what is missing crosses
+the wire: the headers after the common ancestor found from the block locator,
+and the bodies of the blocks among them the miner doesn't have, in bounded
+batches. A peer that mined a block since it told its tip is asked for it
+again, and the bodies of each batch of headers are fetched before the next
+batch, so a peer making up headers is found out after one batch. Peers
+sending headers that don't link up, blocks that don't match their headers,
+invalid blocks or blocks holding forged ops are given up on. Then serves the
+miner's own chain to itself and checks what GetTip, GetHeaders and GetBlocks
+give out.
+
+Usage:
+go run misc/test-chain-sync.go
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../pow"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+// Stands in for a peer. Serves chain, counting what it sends. mode makes it
+// misbehave.
+type FakePeer struct {
+	chain   []blockchain.Block
+	mode    string
+	headers int
+	bodies  int
+	batches int
+	biggest int
+}
+
+func (p *FakePeer) GetTip(args miner.Empty, reply *miner.ChainTip) error {
+	*reply = p.tip()
+	switch p.mode {
+	case "short":
+		reply.Height = 2
+	case "endless":
+		reply.Height = 1 << 30
+	}
+	return nil
+}
+
+func (p *FakePeer) GetHeaders(args miner.GetHeadersArgs, reply *[]miner.BlockHeader) error {
+	if p.mode == "endless" {
+		// Made up headers after whatever we are asked for
+		headers := make([]miner.BlockHeader, miner.MAX_HEADERS)
+		prevHash := args.Locator[0]
+		for i := range headers {
+			headers[i] = miner.BlockHeader{Hash: fmt.Sprint("made up ", p.headers+i), PrevHash: prevHash}
+			prevHash = headers[i].Hash
+		}
+		p.headers += len(headers)
+		*reply = headers
+		return nil
+	}
+
+	hashes := chainHashes(p.chain)
+	start := 0
+	for _, hash := range args.Locator {
+		if i := indexOf(hashes, hash); i >= 0 {
+			start = i
+			break
+		}
+	}
+
+	headers := make([]miner.BlockHeader, 0)
+	for i := start + 1; i < len(hashes) && len(headers) < miner.MAX_HEADERS; i++ {
+		headers = append(headers, miner.NewBlockHeader(p.chain[i-1], hashes[i]))
+	}
+	if p.mode == "unlinked" && len(headers) > 1 {
+		headers[1].PrevHash = harness.GENESIS
+	}
+	p.headers += len(headers)
+	*reply = headers
+	return nil
+}
+
+func (p *FakePeer) GetBlocks(args miner.GetBlocksArgs, reply *[]blockchain.Block) error {
+	hashes := chainHashes(p.chain)
+	blocks := make([]blockchain.Block, 0)
+	for _, hash := range args.Hashes {
+		if i := indexOf(hashes, hash); i > 0 {
+			blocks = append(blocks, p.chain[i-1])
+		}
+	}
+
+	switch p.mode {
+	case "wrong":
+		blocks[0] = p.chain[0]
+	case "withhold":
+		blocks = blocks[:0]
+	}
+	p.bodies += len(blocks)
+	p.batches++
+	if len(args.Hashes) > p.biggest {
+		p.biggest = len(args.Hashes)
+	}
+	*reply = blocks
+	return nil
+}
+
+func (p *FakePeer) tip() miner.ChainTip {
+	hashes := chainHashes(p.chain)
+	return miner.ChainTip{Hash: hashes[len(hashes)-1], Height: len(p.chain)}
+}
+
+func (p *FakePeer) reset(mode string) {
+	p.mode = mode
+	p.headers, p.bodies, p.batches, p.biggest = 0, 0, 0, 0
+}
+
+// Returns the hashes of the genesis block and the blocks of chain
+func chainHashes(chain []blockchain.Block) []string {
+	hashes := []string{harness.GENESIS}
+	for _, block := range chain {
+		hashes = append(hashes, miner.GetBlockHash(block))
+	}
+	return hashes
+}
+
+func indexOf(hashes []string, hash string) int {
+	for i, h := range hashes {
+		if h == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// Whether err gave up on the sync for reason
+func gaveUp(err error, reason string) bool {
+	syncErr, ok := err.(miner.ChainSyncError)
+	return ok && syncErr.Reason == reason
+}
+
+var clock = time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+
+// Returns chain extended by n blocks holding ops, starting after prevHash,
+// signed by the miner unless unsigned is set
+func extend(chain []blockchain.Block, prevHash string, n int, unsigned bool, ops ...blockchain.OperationInfo) []blockchain.Block {
+	chain = append([]blockchain.Block{}, chain...)
+	for i := 0; i < n; i++ {
+		clock += 1000
+		block := blockchain.Block{
+			PrevHash:      prevHash,
+			MinerPubKey:   utils.GetPublicKeyString(miner.MinerInstance.PrivKey.PublicKey),
+			HashAlgorithm: blockchain.SHA256,
+			OpHistory:     ops,
+			Timestamp:     clock}
+		// Exactly no trailing zeroes at difficulty 0
+		for {
+			if !unsigned {
+				miner.SignBlock(&block)
+			}
+			if pow.Verify(miner.GetBlockHash(block), 0) {
+				break
+			}
+			block.Nonce++
+		}
+		chain = append(chain, block)
+		prevHash = miner.GetBlockHash(block)
+	}
+	return chain
+}
+
+// Returns an op spending the ink of the miner, signed by privKey
+func forgedOp(privKey *ecdsa.PrivateKey) blockchain.OperationInfo {
+	opInfo := blockchain.OperationInfo{
+		PubKey: utils.GetPublicKeyString(miner.MinerInstance.PrivKey.PublicKey),
+		Op: blockchain.Operation{OpType: blockchain.ADD, SVGString: "M 0 0 l 10 0 l 0 10 l -10 0 z",
+			Fill: "transparent", Stroke: "red", OpNum: 1}}
+	sig, _ := privKey.Sign(rand.Reader, blockchain.OperationDigest(opInfo), nil)
+	opInfo.OpSig = hex.EncodeToString(sig)
+	return opInfo
+}
+
+func insert(blocks []blockchain.Block) {
+	for _, block := range blocks {
+		if err := miner.InsertBlock(block); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+}
+
+func serve(name string, rcvr interface{}) *rpc.Client {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server := rpc.NewServer()
+	server.RegisterName(name, rcvr)
+	go server.Accept(ln)
+
+	client, err := rpc.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return client
+}
+
+func main() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+
+	alice := harness.NewKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{})
+
+	peer := &FakePeer{chain: extend(nil, harness.GENESIS, 40, false)}
+	client := serve("Peer", peer)
+	hashes := chainHashes(peer.chain)
+
+	// 1. From scratch, the bodies come in batches. The peer mined its last
+	// block after it told us its tip.
+	fetched, err := miner.SyncWithPeer(client, "peer", miner.ChainTip{Hash: hashes[39], Height: 39})
+	harness.Check("first sync", err == nil && fetched == 40, fmt.Sprint(fetched, err))
+	harness.Check("first sync wire", peer.headers == 40 && peer.bodies == 40, fmt.Sprint(peer.headers, peer.bodies))
+	harness.Check("batches", peer.batches == 3 && peer.biggest == miner.MAX_BLOCKS_PER_REQUEST, fmt.Sprint(peer.batches, peer.biggest))
+	harness.Check("tip", miner.LocalTip() == peer.tip(), fmt.Sprint(miner.LocalTip()))
+
+	// 2. Nothing is asked for when we have the tip
+	peer.reset("")
+	fetched, err = miner.SyncWithPeer(client, "peer", peer.tip())
+	harness.Check("in sync", err == nil && fetched == 0 && peer.headers == 0 && peer.batches == 0, fmt.Sprint(fetched, err))
+
+	// 3. Our own longer fork off block 20. The locator finds an older common
+	// ancestor, but only the blocks we miss are fetched.
+	fork := extend(nil, hashes[20], 25, false)
+	insert(fork)
+	forkTip := miner.LocalTip()
+	harness.Check("fork wins", forkTip.Height == 45 && forkTip.Hash == miner.GetBlockHash(fork[24]), fmt.Sprint(forkTip))
+
+	locator := miner.BlockLocator()
+	harness.Check("locator", len(locator) == 15 && locator[0] == forkTip.Hash && locator[len(locator)-1] == harness.GENESIS,
+		fmt.Sprint(len(locator)))
+
+	peer.chain = extend(peer.chain, hashes[40], 10, false)
+	hashes = chainHashes(peer.chain)
+	peer.reset("")
+	fetched, err = miner.SyncWithPeer(client, "peer", peer.tip())
+	harness.Check("catch up past our fork", err == nil && fetched == 10 && peer.bodies == 10, fmt.Sprint(fetched, peer.bodies, err))
+	harness.Check("headers from the common ancestor", peer.headers == 44, fmt.Sprint(peer.headers))
+	harness.Check("tip after catching up", miner.LocalTip() == peer.tip(), fmt.Sprint(miner.LocalTip()))
+
+	// 4. Bad peers are given up on
+	peer.chain = extend(peer.chain, hashes[50], 5, false)
+	hashes = chainHashes(peer.chain)
+
+	peer.reset("unlinked")
+	_, err = miner.SyncWithPeer(client, "peer", peer.tip())
+	harness.Check("unlinked headers", gaveUp(err, miner.SYNC_BAD_HEADERS), fmt.Sprint(err))
+
+	peer.reset("short")
+	_, err = miner.SyncWithPeer(client, "peer", miner.ChainTip{Hash: hashes[55], Height: 2})
+	harness.Check("more headers than the tip's height", gaveUp(err, miner.SYNC_TOO_MANY), fmt.Sprint(err))
+
+	peer.reset("wrong")
+	_, err = miner.SyncWithPeer(client, "peer", peer.tip())
+	harness.Check("block not matching its header", gaveUp(err, miner.SYNC_WRONG_BLOCK), fmt.Sprint(err))
+
+	peer.reset("withhold")
+	_, err = miner.SyncWithPeer(client, "peer", peer.tip())
+	harness.Check("withheld blocks", gaveUp(err, miner.SYNC_MISSING_BLOCKS), fmt.Sprint(err))
+
+	peer.reset("endless")
+	_, err = miner.SyncWithPeer(client, "peer", miner.ChainTip{Hash: "made up", Height: 1 << 30})
+	harness.Check("made up headers", gaveUp(err, miner.SYNC_MISSING_BLOCKS) && peer.headers == miner.MAX_HEADERS,
+		fmt.Sprint(peer.headers, err))
+	harness.Check("nothing taken from bad peers", miner.LocalTip().Height == 50, fmt.Sprint(miner.LocalTip()))
+
+	peer.chain = extend(peer.chain, hashes[55], 1, true)
+	hashes = chainHashes(peer.chain)
+	peer.reset("")
+	fetched, err = miner.SyncWithPeer(client, "peer", peer.tip())
+	harness.Check("invalid block", gaveUp(err, miner.SYNC_INVALID_BLOCK) && fetched == 6, fmt.Sprint(fetched, err))
+	harness.Check("valid blocks kept", miner.LocalTip().Height == 55, fmt.Sprint(miner.LocalTip()))
+
+	// A block signed by its miner, holding an op someone else signed
+	mallory := harness.NewKey()
+	peer.chain = extend(peer.chain[:55], hashes[55], 1, false, forgedOp(mallory))
+	peer.reset("")
+	fetched, err = miner.SyncWithPeer(client, "peer", peer.tip())
+	harness.Check("forged op", gaveUp(err, miner.SYNC_INVALID_BLOCK) && fetched == 1, fmt.Sprint(fetched, err))
+	harness.Check("forged op not taken", miner.LocalTip().Height == 55, fmt.Sprint(miner.LocalTip()))
+
+	peer.chain = peer.chain[:55]
+	hashes = chainHashes(peer.chain)
+
+	// 5. The miner serves its longest path to a peer, here itself
+	orphan := extend(nil, "nowhere", 1, false)
+	insert(orphan)
+
+	rserver := harness.NewRServer()
+	serverClient := serve("RServer", rserver)
+	miner.MinerInstance.MSI = &miner.MinerServerInterface{Client: serverClient}
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go miner.ListenPeerRpc(ln, miner.MinerInstance, nil, nil, nil, nil)
+	miner.MinerInstance.Addr = ln.Addr()
+	rserver.Keys[ln.Addr().String()] = alice
+
+	var empty miner.Empty
+	var tip miner.ChainTip
+	strangerConn, _ := net.Dial("tcp", ln.Addr().String())
+	stranger := rpc.NewClientWithCodec(miner.NewPeerConn(strangerConn).ClientCodec())
+	err = stranger.Call("Peer.GetTip", empty, &tip)
+	harness.Check("unauthenticated tip", err != nil && strings.Contains(err.Error(), miner.REJECT_UNAUTHENTICATED), fmt.Sprint(err))
+
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{ln.Addr()})
+	self, ok := miner.Peers.Get(ln.Addr().String())
+	harness.Check("connected to itself", ok, "")
+	if !ok {
+		os.Exit(1)
+	}
+
+	err = self.Client.Call("Peer.GetTip", empty, &tip)
+	harness.Check("served tip", err == nil && tip.Hash == hashes[55] && tip.Height == 55, fmt.Sprint(tip, err))
+
+	var headers []miner.BlockHeader
+	err = self.Client.Call("Peer.GetHeaders", miner.GetHeadersArgs{Locator: []string{forkTip.Hash, "unknown", hashes[30]}}, &headers)
+	harness.Check("headers after the common ancestor", err == nil && len(headers) == 25 && headers[0].PrevHash == hashes[30] &&
+		headers[24].Hash == hashes[55], fmt.Sprint(len(headers), err))
+
+	err = self.Client.Call("Peer.GetHeaders", miner.GetHeadersArgs{Locator: []string{"unknown"}}, &headers)
+	served := make(map[string]bool)
+	for _, header := range headers {
+		served[header.Hash] = true
+	}
+	harness.Check("headers from the genesis block", err == nil && len(headers) == 55 && headers[0].PrevHash == harness.GENESIS,
+		fmt.Sprint(len(headers), err))
+	harness.Check("no stale fork or orphans", !served[forkTip.Hash] && !served[miner.GetBlockHash(orphan[0])], "")
+
+	err = self.Client.Call("Peer.GetHeaders", miner.GetHeadersArgs{Locator: []string{hashes[55]}}, &headers)
+	harness.Check("no headers past the tip", err == nil && len(headers) == 0, fmt.Sprint(len(headers), err))
+
+	var blocks []blockchain.Block
+	err = self.Client.Call("Peer.GetBlocks", miner.GetBlocksArgs{Hashes: hashes[1:17]}, &blocks)
+	harness.Check("blocks", err == nil && len(blocks) == 16 && miner.GetBlockHash(blocks[15]) == hashes[16], fmt.Sprint(len(blocks), err))
+
+	err = self.Client.Call("Peer.GetBlocks", miner.GetBlocksArgs{Hashes: hashes[1:18]}, &blocks)
+	harness.Check("batch too big", err != nil && strings.Contains(err.Error(), miner.SYNC_BATCH_TOO_BIG), fmt.Sprint(err))
+
+	err = self.Client.Call("Peer.GetBlocks", miner.GetBlocksArgs{Hashes: []string{hashes[1], "unknown", hashes[2]}}, &blocks)
+	harness.Check("blocks up to an unknown one", err == nil && len(blocks) == 1, fmt.Sprint(len(blocks), err))
+
+	harness.Done()
+}
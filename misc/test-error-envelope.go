@@ -0,0 +1,161 @@
+/*
+
+Sends every protocol error type from a fake miner to blockartlib and checks
+that each comes out as the same type with the same payload: once straight
+through ErrorEnvelope, and once over net/rpc out of a blockartlib call. Errors
+that aren't protocol's keep their message, and errors net/rpc makes up itself
+aren't taken for miner errors. Last, a miner of another protocol version is
+turned away at OpenCanvas.
+
+Usage:
+go run misc/test-error-envelope.go
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"reflect"
+	"strings"
+
+	"../blockartlib"
+	"../libminer"
+	"../protocol"
+	"./harness"
+)
+
+// One of every error type, with a payload that would trip up a parser
+var minerErrors = []error{
+	protocol.ShapeSvgStringTooLongError("M 0 0 L 9 9 [too long]"),
+	protocol.InvalidShapeSvgStringError("M 0 0 X"),
+	protocol.InsufficientInkError(4242),
+	protocol.ShapeOverlapError("M 0 0 l 10 10 z"),
+	protocol.OutOfBoundsError{},
+	protocol.InvalidBlockHashError("9 not a block"),
+	protocol.ShapeOwnerError("3045abcd"),
+	protocol.InvalidShapeHashError(""),
+	protocol.OpEvictedError("op 1"),
+	protocol.OpExpiredError("op 2"),
+	protocol.TimeoutError("LibMinerInterface.Draw"),
+	protocol.MempoolFullError("op 3"),
+	protocol.InvalidTransferError("bob"),
+	protocol.ProtocolVersionError{Theirs: 0, Ours: 7},
+}
+
+// Stands in for the miner's LibMinerInterface. Draw fails with next, and
+// OpenCanvas answers with version and keeps the art node's in theirs.
+type LibMinerInterface struct {
+	next    error
+	version uint32
+	theirs  uint32
+}
+
+func (lmi *LibMinerInterface) OpenCanvas(req *libminer.Request, resp *libminer.RegisterResponse) error {
+	var openReq libminer.OpenCanvasRequest
+	json.Unmarshal(req.Msg, &openReq)
+	lmi.theirs = openReq.ProtocolVersion
+	resp.ProtocolVersion = lmi.version
+	return nil
+}
+
+func (lmi *LibMinerInterface) Draw(req *libminer.Request, resp *libminer.DrawResponse) error {
+	return lmi.next
+}
+
+// Returns the type name and payload of err, whatever package it is of
+func describe(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	v := reflect.ValueOf(err)
+	switch v.Kind() {
+	case reflect.String:
+		return fmt.Sprintf("%s(%q)", v.Type().Name(), v.String())
+	case reflect.Uint32:
+		return fmt.Sprintf("%s(%d)", v.Type().Name(), v.Uint())
+	default:
+		return fmt.Sprintf("%s(%s)", v.Type().Name(), err)
+	}
+}
+
+func main() {
+	lmi := &LibMinerInterface{version: protocol.PROTOCOL_VERSION}
+	server := rpc.NewServer()
+	server.Register(lmi)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go server.Accept(ln)
+
+	privKey := harness.NewKey()
+	canvas, _, err := blockartlib.OpenCanvas(ln.Addr().String(), *privKey)
+	harness.Check("open", err == nil && lmi.theirs == protocol.PROTOCOL_VERSION, fmt.Sprint(err))
+
+	for _, minerErr := range minerErrors {
+		// 1. Straight through the envelope
+		envelope := protocol.WrapError(minerErr)
+		wire := envelope.Error()
+		unwrapped, ok := protocol.UnwrapError(wire)
+		harness.Check("envelope "+describe(minerErr), ok && unwrapped.Err() == minerErr &&
+			unwrapped.Code == protocol.ErrorCode(minerErr) && unwrapped.Message == minerErr.Error(),
+			describe(unwrapped.Err()))
+
+		// 2. Over net/rpc into blockartlib
+		lmi.next = envelope
+		_, _, _, err := canvas.AddShape(1, blockartlib.PATH, "M 0 0 l 1 1", "transparent", "red")
+		harness.Check("rpc "+describe(minerErr), err == minerErr, describe(err))
+	}
+
+	// 3. Codes are distinct
+	codes := make(map[int]bool)
+	for _, minerErr := range minerErrors {
+		codes[protocol.ErrorCode(minerErr)] = true
+	}
+	harness.Check("distinct codes", len(codes) == len(minerErrors) && !codes[protocol.ERR_MINER], fmt.Sprint(codes))
+
+	// 4. Other errors of the miner keep their message
+	lmi.next = protocol.WrapError(errors.New("blockchain on fire"))
+	_, _, _, err = canvas.AddShape(1, blockartlib.PATH, "M 0 0 l 1 1", "transparent", "red")
+	harness.Check("miner error", err != nil && err.Error() == "blockchain on fire", fmt.Sprint(err))
+
+	wrapped := protocol.WrapError(protocol.WrapError(protocol.InsufficientInkError(7)))
+	harness.Check("wrapping twice", wrapped.Err() == protocol.InsufficientInkError(7), describe(wrapped.Err()))
+
+	// 5. Errors that aren't in an envelope
+	lmi.next = errors.New("invalid user")
+	_, _, _, err = canvas.AddShape(1, blockartlib.PATH, "M 0 0 l 1 1", "transparent", "red")
+	_, isDisconnected := err.(blockartlib.DisconnectedError)
+	harness.Check("plain server error", err != nil && err.Error() == "invalid user" && !isDisconnected, describe(err))
+
+	_, ok := protocol.UnwrapError(protocol.ERROR_ENVELOPE_PREFIX + "garbage")
+	harness.Check("garbage envelope", !ok, "")
+
+	_, ok = protocol.UnwrapError(strings.TrimPrefix(protocol.WrapError(protocol.TimeoutError("x")).Error(),
+		protocol.ERROR_ENVELOPE_PREFIX))
+	harness.Check("no prefix", !ok, "")
+
+	// 6. Miners of another protocol version
+	lmi.version = 0
+	_, _, err = blockartlib.OpenCanvas(ln.Addr().String(), *privKey)
+	harness.Check("old miner", err == protocol.ProtocolVersionError{Theirs: 0, Ours: protocol.PROTOCOL_VERSION}, describe(err))
+	lmi.version = protocol.PROTOCOL_VERSION + 1
+	_, _, err = blockartlib.OpenCanvas(ln.Addr().String(), *privKey)
+	_, isVersion := err.(blockartlib.ProtocolVersionError)
+	harness.Check("newer miner", isVersion, describe(err))
+
+	ln.Close()
+	canvas.(blockartlib.CanvasT).Miner.Close()
+	_, _, _, err = canvas.AddShape(1, blockartlib.PATH, "M 0 0 l 1 1", "transparent", "red")
+	_, isDisconnected = err.(blockartlib.DisconnectedError)
+	harness.Check("lost the miner", isDisconnected, describe(err))
+
+	harness.Done()
+}
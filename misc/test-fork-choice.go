@@ -0,0 +1,109 @@
+/*
+
+Checks that fork choice follows the most work, not the most blocks. Op blocks
+are mined at a higher difficulty than no-op blocks here, so a fork of one op
+block outweighs a longer fork of no-op blocks, until the longer fork makes up
+the work. The longest path from the genesis block and from a block inside
+the tree agree, on ties too.
+
+Usage:
+go run misc/test-fork-choice.go
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../pow"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+var clock = time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+
+// Mines and inserts n blocks after prevHash, holding ops, and returns the
+// hash of the last one
+func mine(prevHash string, n int, ops ...blockchain.OperationInfo) string {
+	for i := 0; i < n; i++ {
+		clock += 1000
+		block := blockchain.Block{
+			PrevHash:      prevHash,
+			MinerPubKey:   utils.GetPublicKeyString(miner.MinerInstance.PrivKey.PublicKey),
+			OpHistory:     ops,
+			HashAlgorithm: blockchain.SHA256,
+			Timestamp:     clock,
+			Difficulty:    miner.BaseDifficulty(len(ops) > 0)}
+		miner.SignBlock(&block)
+		for !pow.Verify(miner.GetBlockHash(block), int(block.Difficulty)) {
+			block.Nonce++
+		}
+		if err := miner.InsertBlock(block); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		prevHash = miner.GetBlockHash(block)
+	}
+	return prevHash
+}
+
+var opNum uint64 = 0
+
+func square(pubKey string) blockchain.OperationInfo {
+	opNum++
+	return blockchain.OperationInfo{
+		OpSig:  fmt.Sprint("op", opNum),
+		PubKey: pubKey,
+		Op: blockchain.Operation{OpType: blockchain.ADD, SVGString: "M 0 0 l 10 0 l 0 10 l -10 0 z",
+			Fill: "transparent", Stroke: "red", OpNum: opNum}}
+}
+
+// Returns the hash of the tip of the longest path from hash
+func tip(hash string) string {
+	path, length := miner.GetLongestPath(hash)
+	return miner.GetBlockHash(path[length-1])
+}
+
+func main() {
+	alice := harness.NewKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{
+		PoWDifficultyOpBlock:   2,
+		PoWDifficultyNoOpBlock: 0})
+	key := utils.GetPublicKeyString(alice.PublicKey)
+
+	fork := mine(harness.GENESIS, 1)
+
+	// 1. Four no-op blocks against one op block: 4 against 256
+	longer := mine(fork, 4)
+	harness.Check("longer fork first", tip(harness.GENESIS) == longer && tip(fork) == longer, "")
+
+	heavier := mine(fork, 1, square(key))
+	harness.Check("heavier fork wins", tip(harness.GENESIS) == heavier && miner.LocalTip().Height == 2,
+		fmt.Sprint(miner.LocalTip()))
+	harness.Check("heavier fork from inside the tree", tip(fork) == heavier, "")
+
+	path, _ := miner.GetLongestPath(harness.GENESIS)
+	harness.Check("work of the path", miner.PathWork(path).Int64() == 257, fmt.Sprint(miner.PathWork(path)))
+
+	// 2. The longer fork catches up: 256 no-op blocks tie, and the tie goes
+	// to the higher tip hash whichever block the path is looked up from
+	tied := mine(longer, 252)
+	winner := heavier
+	if tied > heavier {
+		winner = tied
+	}
+	harness.Check("tie", tip(harness.GENESIS) == winner && tip(fork) == winner, fmt.Sprint(miner.LocalTip()))
+
+	// 3. One more block and the longer fork is heavier too
+	overtaken := mine(tied, 1)
+	harness.Check("longer and heavier fork wins", tip(harness.GENESIS) == overtaken && tip(fork) == overtaken &&
+		miner.LocalTip().Height == 258, fmt.Sprint(miner.LocalTip()))
+
+	harness.Done()
+}
@@ -0,0 +1,334 @@
+/*
+
+Checks the announce/request gossip. First the seen cache forgets its oldest
+items once full, and an item asked for is asked for again if it doesn't
+arrive in time, but not once it did. Then 20 nodes on a ring with a few chords, each with a
+gossip of its own and a small seen cache, spread blocks and ops from several
+origins: every node gets every item, each exactly once, however many hops
+away it is. Last, a miner's Announce asks for what it lacks only, knowing ops
+by the hash of their content, and a block it is sent is taken in and
+announced onwards. What it asked for and never got is asked for again.
+
+Usage:
+go run misc/test-gossip.go
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../pow"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+const (
+	NUM_NODES = 20
+	NUM_ITEMS = 40
+	// Seen cache of a node, smaller than the number of items
+	NODE_SEEN_CACHE = 16
+)
+
+// A node of the simulated network. It announces every item new to it to its
+// peers, and sends them the ones they ask for.
+type Node struct {
+	gossip   *miner.Gossip
+	mutex    *sync.Mutex
+	items    map[miner.Inv]bool
+	received map[miner.Inv]int // Times the item was sent to the node
+	peers    []*rpc.Client
+	queue    chan miner.Inv
+}
+
+func NewNode() *Node {
+	node := &Node{mutex: &sync.Mutex{}, items: make(map[miner.Inv]bool), received: make(map[miner.Inv]int),
+		queue: make(chan miner.Inv, NUM_ITEMS*NUM_NODES)}
+	node.gossip = miner.NewGossip(NODE_SEEN_CACHE, node.has)
+	return node
+}
+
+func (n *Node) has(item miner.Inv) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.items[item]
+}
+
+// Takes item in, and announces it if it is new
+func (n *Node) add(item miner.Inv) {
+	n.mutex.Lock()
+	isNew := !n.items[item]
+	n.items[item] = true
+	n.mutex.Unlock()
+
+	if isNew {
+		n.queue <- item
+	}
+}
+
+func (n *Node) relay() {
+	for item := range n.queue {
+		for _, peer := range n.peers {
+			wanted, err := miner.Announce(peer, []miner.Inv{item})
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			for _, w := range wanted {
+				var empty miner.Empty
+				peer.Call("Peer.Send", w, &empty)
+			}
+		}
+	}
+}
+
+// The RPCs of a node
+type SimPeer struct {
+	node *Node
+}
+
+func (p *SimPeer) Announce(args miner.AnnounceArgs, reply *[]miner.Inv) error {
+	*reply = p.node.gossip.Want(args.Items)
+	return nil
+}
+
+func (p *SimPeer) Send(item miner.Inv, reply *miner.Empty) error {
+	p.node.mutex.Lock()
+	p.node.received[item]++
+	p.node.mutex.Unlock()
+	p.node.add(item)
+	p.node.gossip.Received(item)
+	return nil
+}
+
+func listen(name string, rcvr interface{}) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server := rpc.NewServer()
+	server.RegisterName(name, rcvr)
+	go server.Accept(ln)
+	return ln.Addr()
+}
+
+func dial(addr net.Addr) *rpc.Client {
+	client, err := rpc.Dial("tcp", addr.String())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// Returns a block following prevHash, signed by the miner
+func mine(prevHash string) blockchain.Block {
+	block := blockchain.Block{
+		PrevHash:      prevHash,
+		MinerPubKey:   utils.GetPublicKeyString(miner.MinerInstance.PrivKey.PublicKey),
+		HashAlgorithm: blockchain.SHA256,
+		Timestamp:     time.Now().UnixNano() / int64(time.Millisecond)}
+	// Exactly no trailing zeroes at difficulty 0
+	for {
+		miner.SignBlock(&block)
+		if pow.Verify(miner.GetBlockHash(block), 0) {
+			return block
+		}
+		block.Nonce++
+	}
+}
+
+// Returns a square of privKey's, signed like blockartlib signs ops
+func square(privKey *ecdsa.PrivateKey) blockchain.OperationInfo {
+	opInfo := blockchain.OperationInfo{
+		PubKey: utils.GetPublicKeyString(privKey.PublicKey),
+		Op: blockchain.Operation{OpType: blockchain.ADD, SVGString: "M 0 0 l 10 0 l 0 10 l -10 0 z",
+			Fill: "transparent", Stroke: "red", OpNum: 1}}
+	sig, _ := privKey.Sign(rand.Reader, blockchain.OperationDigest(opInfo), nil)
+	opInfo.OpSig = hex.EncodeToString(sig)
+	return opInfo
+}
+
+func simulate() {
+	nodes := make([]*Node, NUM_NODES)
+	addrs := make([]net.Addr, NUM_NODES)
+	for i := range nodes {
+		nodes[i] = NewNode()
+		addrs[i] = listen("Peer", &SimPeer{nodes[i]})
+	}
+
+	// A ring, with a chord from every fifth node to the node five ahead
+	for i, node := range nodes {
+		node.peers = append(node.peers, dial(addrs[(i+1)%NUM_NODES]), dial(addrs[(i+NUM_NODES-1)%NUM_NODES]))
+		if i%5 == 0 {
+			node.peers = append(node.peers, dial(addrs[(i+5)%NUM_NODES]))
+			nodes[(i+5)%NUM_NODES].peers = append(nodes[(i+5)%NUM_NODES].peers, dial(addrs[i]))
+		}
+		go node.relay()
+	}
+
+	// Items start at nodes all around the ring
+	origins := make(map[miner.Inv]int)
+	for i := 0; i < NUM_ITEMS; i++ {
+		item := miner.Inv{Type: miner.INV_BLOCK, Hash: fmt.Sprint("block", i)}
+		if i%2 == 1 {
+			item = miner.Inv{Type: miner.INV_OP, Hash: fmt.Sprint("op", i)}
+		}
+		origin := (i * 7) % NUM_NODES
+		origins[item] = origin
+		nodes[origin].add(item)
+	}
+
+	complete := func() bool {
+		for _, node := range nodes {
+			node.mutex.Lock()
+			n := len(node.items)
+			node.mutex.Unlock()
+			if n < NUM_ITEMS {
+				return false
+			}
+		}
+		return true
+	}
+	for deadline := time.Now().Add(30 * time.Second); !complete() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	harness.Check("every node has every item", complete(), "")
+
+	duplicates, sends, missing := 0, 0, 0
+	for i, node := range nodes {
+		node.mutex.Lock()
+		for item, origin := range origins {
+			times := node.received[item]
+			sends += times
+			if origin == i && times != 0 || origin != i && times == 0 {
+				missing++
+			}
+			if times > 1 {
+				duplicates++
+			}
+		}
+		node.mutex.Unlock()
+		harness.Check(fmt.Sprint("node ", i, " seen cache bounded"), node.gossip.Seen.Len() <= NODE_SEEN_CACHE,
+			fmt.Sprint(node.gossip.Seen.Len()))
+	}
+	harness.Check("items sent once per node", duplicates == 0 && missing == 0 && sends == NUM_ITEMS*(NUM_NODES-1),
+		fmt.Sprint(duplicates, missing, sends))
+}
+
+func main() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+
+	// 1. The seen cache forgets its oldest items
+	seen := miner.NewSeenCache(3)
+	for i := 0; i < 5; i++ {
+		seen.Add(miner.Inv{Type: miner.INV_OP, Hash: fmt.Sprint(i)})
+	}
+	harness.Check("seen cache size", seen.Len() == 3, fmt.Sprint(seen.Len()))
+	harness.Check("seen cache remembers", !seen.Add(miner.Inv{Type: miner.INV_OP, Hash: "4"}), "")
+	harness.Check("seen cache forgets", seen.Add(miner.Inv{Type: miner.INV_OP, Hash: "0"}), "")
+
+	// 2. Items asked for are waited on, up to a point
+	gossip := miner.NewGossip(2, func(miner.Inv) bool { return false })
+	gossip.RequestTimeout = 50 * time.Millisecond
+	x := miner.Inv{Type: miner.INV_BLOCK, Hash: "x"}
+	y := miner.Inv{Type: miner.INV_BLOCK, Hash: "y"}
+	z := miner.Inv{Type: miner.INV_BLOCK, Hash: "z"}
+	harness.Check("asked for", len(gossip.Want([]miner.Inv{x})) == 1, "")
+	harness.Check("waited on", len(gossip.Want([]miner.Inv{x})) == 0 && !gossip.Seen.Has(x), "")
+	wanted := gossip.Want([]miner.Inv{y, z})
+	harness.Check("waiting on a bounded number of items", len(wanted) == 1 && wanted[0] == y && gossip.Requested() == 2,
+		fmt.Sprint(wanted))
+
+	time.Sleep(2 * gossip.RequestTimeout)
+	harness.Check("asked for again", len(gossip.Want([]miner.Inv{x})) == 1, "")
+	gossip.Received(x)
+	time.Sleep(2 * gossip.RequestTimeout)
+	harness.Check("not asked for once received", len(gossip.Want([]miner.Inv{x})) == 0 && gossip.Seen.Has(x), "")
+	harness.Check("expired requests forgotten", len(gossip.Want([]miner.Inv{z})) == 1 && gossip.Requested() == 1,
+		fmt.Sprint(gossip.Requested()))
+
+	// 3. 20 nodes spread items between them
+	simulate()
+
+	// 4. A miner asks for what it lacks
+	alice := harness.NewKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{InkPerNoOpBlock: 1000})
+	known := mine("genesis")
+	miner.InsertBlock(known)
+
+	rserver := harness.NewRServer()
+	miner.MinerInstance.MSI = &miner.MinerServerInterface{Client: dial(listen("RServer", rserver))}
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	blkCh := make(chan miner.PropagateBlockArgs, 16)
+	go miner.ListenPeerRpc(ln, miner.MinerInstance, make(chan miner.PropagateOpArgs, 16), blkCh,
+		make(chan blockchain.OperationInfo, 16), make(chan blockchain.Block, 16))
+	miner.MinerInstance.Addr = ln.Addr()
+	rserver.Keys[ln.Addr().String()] = alice
+
+	strangerConn, _ := net.Dial("tcp", ln.Addr().String())
+	stranger := rpc.NewClientWithCodec(miner.NewPeerConn(strangerConn).ClientCodec())
+	_, err := miner.Announce(stranger, []miner.Inv{{Type: miner.INV_BLOCK, Hash: "new"}})
+	harness.Check("unauthenticated announcement", err != nil && strings.Contains(err.Error(), miner.REJECT_UNAUTHENTICATED), fmt.Sprint(err))
+
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{ln.Addr()})
+	self, ok := miner.Peers.Get(ln.Addr().String())
+	harness.Check("connected to itself", ok, "")
+	if !ok {
+		os.Exit(1)
+	}
+
+	fresh := mine(miner.GetBlockHash(known))
+	freshItem := miner.Inv{Type: miner.INV_BLOCK, Hash: miner.GetBlockHash(fresh)}
+	wanted, err = miner.Announce(self.Client, []miner.Inv{
+		{Type: miner.INV_BLOCK, Hash: miner.GetBlockHash(known)},
+		freshItem,
+		{Type: miner.INV_OP, Hash: "unknown op"},
+		{Type: "unknown", Hash: "thing"}})
+	harness.Check("asks for what it lacks", err == nil && len(wanted) == 2 && wanted[0] == freshItem && wanted[1].Type == miner.INV_OP,
+		fmt.Sprint(wanted, err))
+
+	wanted, err = miner.Announce(self.Client, []miner.Inv{freshItem})
+	harness.Check("asks once", err == nil && len(wanted) == 0, fmt.Sprint(wanted, err))
+
+	pooled := square(alice)
+	err = miner.Pool.Add(pooled)
+	wanted, _ = miner.Announce(self.Client, []miner.Inv{
+		{Type: miner.INV_OP, Hash: hex.EncodeToString(blockchain.OperationDigest(pooled))}})
+	harness.Check("pooled op known by its hash", err == nil && len(wanted) == 0, fmt.Sprint(wanted, err))
+
+	_, err = miner.Announce(self.Client, make([]miner.Inv, miner.MAX_INV+1))
+	harness.Check("too many items", err != nil && strings.Contains(err.Error(), miner.GOSSIP_TOO_MANY), fmt.Sprint(err))
+
+	var empty miner.Empty
+	err = self.Client.Call("Peer.PropagateBlock", miner.PropagateBlockArgs{Block: fresh}, &empty)
+	harness.Check("block taken in", err == nil && miner.LocalTip().Hash == freshItem.Hash, fmt.Sprint(err))
+	harness.Check("block announced onwards", len(blkCh) == 1, fmt.Sprint(len(blkCh)))
+
+	err = self.Client.Call("Peer.PropagateBlock", miner.PropagateBlockArgs{Block: fresh}, &empty)
+	harness.Check("block taken in once", err == nil && len(blkCh) == 1, fmt.Sprint(err))
+
+	miner.PeerGossip.RequestTimeout = 0
+	wanted, err = miner.Announce(self.Client, []miner.Inv{{Type: miner.INV_OP, Hash: "unknown op"}, freshItem})
+	harness.Check("asks again for what never came", err == nil && len(wanted) == 1 && wanted[0].Hash == "unknown op",
+		fmt.Sprint(wanted, err))
+
+	harness.Done()
+}
@@ -0,0 +1,155 @@
+/*
+
+Moves ink between pubkeys with TRANSFER ops: the sender must have the ink,
+with the ops ahead in the mempool counted, transfers of no ink or to bad keys
+are rejected, received ink can be spent, and the canvas state moves the ink
+both ways when the block holding a transfer is connected and disconnected.
+Last, a signed transfer no longer verifies once its recipient or amount is
+changed.
+
+Usage:
+go run misc/test-ink-transfer.go
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"../blockchain"
+	"../miner"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+// Returns path extended by a block of minerKey holding ops
+func extend(path []blockchain.Block, minerKey string, ops ...blockchain.OperationInfo) []blockchain.Block {
+	block := blockchain.Block{
+		PrevHash:      miner.GetBlockHash(path[len(path)-1]),
+		MinerPubKey:   minerKey,
+		OpHistory:     ops,
+		HashAlgorithm: blockchain.SHA256}
+	return append(append([]blockchain.Block{}, path...), block)
+}
+
+var opNum uint64 = 0
+
+func transfer(from string, to string, amount uint32) blockchain.OperationInfo {
+	opNum++
+	return blockchain.OperationInfo{
+		OpSig:  fmt.Sprint("transfer", opNum),
+		PubKey: from,
+		Op: blockchain.Operation{
+			OpType: blockchain.TRANSFER,
+			OpNum:  opNum,
+			To:     to,
+			Amount: amount}}
+}
+
+// Returns the transfer signed by privKey, like blockartlib signs them
+func signed(privKey *ecdsa.PrivateKey, opInfo blockchain.OperationInfo) blockchain.OperationInfo {
+	sig, _ := privKey.Sign(rand.Reader, blockchain.OperationDigest(opInfo), nil)
+	opInfo.OpSig = hex.EncodeToString(sig)
+	return opInfo
+}
+
+func square(pubKey string, x, y int) blockchain.OperationInfo {
+	opNum++
+	return blockchain.OperationInfo{
+		OpSig:  fmt.Sprint("op", opNum),
+		PubKey: pubKey,
+		Op: blockchain.Operation{
+			OpType:    blockchain.ADD,
+			SVGString: fmt.Sprintf("M %d %d l 10 0 l 0 10 l -10 0 z", x, y),
+			Fill:      "transparent",
+			Stroke:    "red",
+			OpNum:     opNum}}
+}
+
+func main() {
+	harness.NewMiner(nil, protocol.MinerNetSettings{
+		InkPerOpBlock:   100,
+		InkPerNoOpBlock: 100})
+
+	aliceKey := harness.NewKey()
+	bobKey := harness.NewKey()
+	alice := utils.GetPublicKeyString(aliceKey.PublicKey)
+	bob := utils.GetPublicKeyString(bobKey.PublicKey)
+
+	genesis := []blockchain.Block{{}}
+	tip := extend(extend(genesis, alice), alice)
+
+	pool := miner.NewMempool()
+	pool.Update(tip)
+
+	// 1. Balance, counting the transfers ahead in the pool
+	t := transfer(alice, bob, 150)
+	harness.Check("transfer", pool.Add(t) == nil, "")
+
+	_, isInk := pool.Add(transfer(alice, bob, 100)).(protocol.InsufficientInkError)
+	harness.Check("spent by a pending transfer", isInk, "")
+
+	// Ops go into blocks in pool order, so bob can pass on ink still pending
+	back := transfer(bob, alice, 10)
+	harness.Check("pending ink passed on", pool.Add(back) == nil, "")
+
+	// 2. Bad transfers
+	_, isInvalid := pool.Add(transfer(alice, bob, 0)).(protocol.InvalidTransferError)
+	harness.Check("no ink", isInvalid, "")
+
+	_, isInvalid = pool.Add(transfer(alice, alice, 10)).(protocol.InvalidTransferError)
+	harness.Check("to the sender", isInvalid, "")
+
+	_, isInvalid = pool.Add(transfer(alice, "bob", 10)).(protocol.InvalidTransferError)
+	harness.Check("to a bad key", isInvalid, "")
+
+	entries := pool.Entries()
+	harness.Check("costs its amount", len(entries) == 2 && entries[0].Cost == 150 && entries[1].Cost == 10, "")
+
+	// 3. The transfer in a block, mined by someone else
+	canvas := miner.NewCanvasState()
+	canvas.Seek(tip)
+	harness.Check("ink before", canvas.Ink(alice) == 200 && canvas.Ink(bob) == 0,
+		fmt.Sprint(canvas.Ink(alice), canvas.Ink(bob)))
+
+	withTransfer := extend(tip, "carol", t, back)
+	canvas.Seek(withTransfer)
+	harness.Check("ink after", canvas.Ink(alice) == 60 && canvas.Ink(bob) == 140,
+		fmt.Sprint(canvas.Ink(alice), canvas.Ink(bob)))
+
+	canvas.Seek(tip)
+	harness.Check("ink after disconnecting", canvas.Ink(alice) == 200 && canvas.Ink(bob) == 0,
+		fmt.Sprint(canvas.Ink(alice), canvas.Ink(bob)))
+
+	// 4. The recipient spends the ink
+	pool.Update(withTransfer)
+	harness.Check("taken into a block", len(pool.Ops()) == 0, fmt.Sprint(pool.Ops()))
+
+	_, isInk = pool.Add(transfer(alice, bob, 61)).(protocol.InsufficientInkError)
+	harness.Check("sender's remaining ink", isInk, "")
+
+	harness.Check("recipient draws", pool.Add(square(bob, 0, 0)) == nil, "")
+	harness.Check("recipient transfers", pool.Add(transfer(bob, alice, 100)) == nil, "")
+
+	// 5. A signed transfer can't be sent elsewhere or made bigger
+	malloryKey := harness.NewKey()
+	s := signed(aliceKey, transfer(alice, bob, 10))
+	harness.Check("signed transfer", miner.VerifyOpSignature(s) == nil, "")
+
+	redirected := s
+	redirected.Op.To = utils.GetPublicKeyString(malloryKey.PublicKey)
+	_, isForged := miner.VerifyOpSignature(redirected).(miner.OpSignatureError)
+	harness.Check("recipient changed", isForged, "")
+
+	raised := s
+	raised.Op.Amount = 60
+	_, isForged = miner.VerifyOpSignature(raised).(miner.OpSignatureError)
+	harness.Check("amount changed", isForged, "")
+
+	harness.Done()
+}
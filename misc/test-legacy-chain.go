@@ -0,0 +1,100 @@
+/*
+
+Builds a chain the way miners did before blocks named their hash algorithm:
+MD5 over the JSON of the block, no signature, timestamp or difficulty. Checks
+that it still verifies and validates, ops and all, and that it can move on to
+SHA-256 but not back. An algorithm named "md5" is not the legacy one and is
+rejected.
+
+Usage:
+go run misc/test-legacy-chain.go
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"../blockchain"
+	"../miner"
+	"../pow"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+// Returns a block of minerKey after prevHash holding ops, solved at
+// difficulty 0. Blocks that aren't legacy are signed.
+func solve(prevHash string, minerKey string, algorithm blockchain.HashAlgorithm, ops ...blockchain.OperationInfo) blockchain.Block {
+	block := blockchain.Block{PrevHash: prevHash, MinerPubKey: minerKey, OpHistory: ops, HashAlgorithm: algorithm}
+	if algorithm != blockchain.MD5 {
+		block.Timestamp = 1
+		miner.SignBlock(&block)
+	}
+	// Exactly no trailing zeroes at difficulty 0
+	for !pow.Verify(miner.GetBlockHash(block), 0) {
+		block.Nonce++
+	}
+	return block
+}
+
+// Returns a square of privKey's, signed like blockartlib signs ops
+func square(privKey *ecdsa.PrivateKey) blockchain.OperationInfo {
+	opInfo := blockchain.OperationInfo{
+		PubKey: utils.GetPublicKeyString(privKey.PublicKey),
+		Op: blockchain.Operation{OpType: blockchain.ADD, SVGString: "M 0 0 l 10 0 l 0 10 l -10 0 z",
+			Fill: "transparent", Stroke: "red", OpNum: 1}}
+	sig, _ := privKey.Sign(rand.Reader, blockchain.OperationDigest(opInfo), nil)
+	opInfo.OpSig = hex.EncodeToString(sig)
+	return opInfo
+}
+
+func main() {
+	alice := harness.NewKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{
+		InkPerOpBlock:   100,
+		InkPerNoOpBlock: 100})
+	key := utils.GetPublicKeyString(alice.PublicKey)
+
+	// 1. A legacy chain, hashed the old way
+	first := solve(harness.GENESIS, key, blockchain.MD5)
+	firstJson, _ := json.Marshal(first)
+	sum := md5.Sum(firstJson)
+	firstHash := miner.GetBlockHash(first)
+	harness.Check("hashed over json", firstHash == hex.EncodeToString(sum[:]) && first.Signature == "", firstHash)
+
+	prevHash := harness.GENESIS
+	for i, block := range []blockchain.Block{first, solve(firstHash, key, blockchain.MD5)} {
+		ok := miner.VerifyBlock(block) && miner.MinerInstance.ValidateBlock(block, miner.GetPath(prevHash))
+		harness.Check(fmt.Sprint("legacy block ", i), ok && miner.InsertBlock(block) == nil, "")
+		prevHash = miner.GetBlockHash(block)
+	}
+
+	withOp := solve(prevHash, key, blockchain.MD5, square(alice))
+	harness.Check("legacy block with an op", miner.MinerInstance.ValidateBlock(withOp, miner.GetPath(prevHash)) &&
+		miner.InsertBlock(withOp) == nil, "")
+	prevHash = miner.GetBlockHash(withOp)
+	harness.Check("legacy tip", miner.LocalTip().Height == 3 && miner.LocalTip().Hash == prevHash, fmt.Sprint(miner.LocalTip()))
+
+	// 2. Moving on to SHA-256, and not back
+	upgraded := solve(prevHash, key, blockchain.SHA256)
+	harness.Check("upgrade", miner.VerifyBlock(upgraded) && miner.InsertBlock(upgraded) == nil, "")
+	downgraded := solve(miner.GetBlockHash(upgraded), key, blockchain.MD5)
+	harness.Check("no downgrade", !miner.VerifyBlock(downgraded), "")
+
+	// 3. "md5" isn't the legacy algorithm
+	_, err := blockchain.HashAlgorithm("md5").New()
+	_, isUnknown := err.(blockchain.UnknownHashAlgorithmError)
+	harness.Check("md5 by name", isUnknown, fmt.Sprint(err))
+	named := first
+	named.HashAlgorithm = "md5"
+	harness.Check("block naming md5", !miner.VerifyBlock(named), "")
+
+	harness.Done()
+}
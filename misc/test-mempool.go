@@ -0,0 +1,145 @@
+/*
+
+Runs the mempool through the life of a few ops: validation against the tip
+and the ops ahead of them, dedup, being taken into a block, coming back when
+that block is reorged out, expiry, the caps, and a restart. Last, an op
+carrying another signature, as a malleated one, is still the same op.
+
+Usage:
+go run misc/test-mempool.go
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"../blockchain"
+	"../miner"
+	"../protocol"
+	"./harness"
+)
+
+// Returns path extended by a block of minerKey holding ops
+func extend(path []blockchain.Block, minerKey string, ops ...blockchain.OperationInfo) []blockchain.Block {
+	block := blockchain.Block{
+		PrevHash:      miner.GetBlockHash(path[len(path)-1]),
+		MinerPubKey:   minerKey,
+		OpHistory:     ops,
+		HashAlgorithm: blockchain.SHA256}
+	return append(append([]blockchain.Block{}, path...), block)
+}
+
+var opNum uint64 = 0
+
+func square(pubKey string, x, y int) blockchain.OperationInfo {
+	opNum++
+	return blockchain.OperationInfo{
+		OpSig:  fmt.Sprint("op", opNum),
+		PubKey: pubKey,
+		Op: blockchain.Operation{
+			OpType:    blockchain.ADD,
+			SVGString: fmt.Sprintf("M %d %d l 10 0 l 0 10 l -10 0 z", x, y),
+			Fill:      "transparent",
+			Stroke:    "red",
+			OpNum:     opNum}}
+}
+
+func opSigs(pool *miner.Mempool) string {
+	var sigs []string
+	for _, opInfo := range pool.Ops() {
+		sigs = append(sigs, opInfo.OpSig)
+	}
+	return fmt.Sprint(sigs)
+}
+
+func main() {
+	harness.NewMiner(nil, protocol.MinerNetSettings{
+		InkPerOpBlock:   100,
+		InkPerNoOpBlock: 100})
+
+	dir, _ := ioutil.TempDir("", "mempool")
+	defer os.RemoveAll(dir)
+
+	pool := miner.NewMempool()
+	pool.Open(dir)
+
+	genesis := []blockchain.Block{{}}
+	tip := extend(extend(genesis, "alice"), "bob")
+	pool.Update(tip)
+
+	// 1. Validation against the tip and the ops ahead
+	a := square("alice", 0, 0)
+	harness.Check("add", pool.Add(a) == nil, "")
+
+	_, isDup := pool.Add(a).(miner.DuplicateError)
+	harness.Check("dedup", isDup, "")
+
+	_, isOverlap := pool.Add(square("bob", 5, 5)).(protocol.ShapeOverlapError)
+	harness.Check("overlaps a pending op", isOverlap, "")
+
+	_, isInk := pool.Add(square("carol", 100, 100)).(protocol.InsufficientInkError)
+	harness.Check("no ink", isInk, "")
+
+	b := square("bob", 100, 100)
+	harness.Check("second op", pool.Add(b) == nil, opSigs(pool))
+
+	// 2. a goes into a block, then the block is reorged out
+	withA := extend(tip, "bob", a)
+	pool.Update(withA)
+	harness.Check("taken into a block", opSigs(pool) == fmt.Sprint([]string{b.OpSig}), opSigs(pool))
+
+	fork := extend(extend(tip, "carol"), "carol")
+	pool.Update(fork)
+	harness.Check("back after reorg", opSigs(pool) == fmt.Sprint([]string{a.OpSig, b.OpSig}), opSigs(pool))
+
+	// 3. Restart
+	restarted := miner.NewMempool()
+	harness.Check("open", restarted.Open(dir) == nil, "")
+	restarted.Update(fork)
+	harness.Check("survives restart", opSigs(restarted) == opSigs(pool), opSigs(restarted))
+
+	// 4. A block takes in an op that conflicts with a pending one
+	c := square("carol", 3, 3)
+	conflicting := extend(fork, "carol", c)
+	pool.Update(conflicting)
+	harness.Check("invalid after new tip", opSigs(pool) == fmt.Sprint([]string{b.OpSig}), opSigs(pool))
+
+	// 5. Expiry
+	stale := conflicting
+	for i := 0; i <= miner.OP_EXPIRY_BLOCKS; i++ {
+		stale = extend(stale, "alice")
+	}
+	pool.Update(stale)
+	harness.Check("expired", len(pool.Ops()) == 0, opSigs(pool))
+
+	// 6. Caps
+	pool.MaxInk = 10
+	_, isFull := pool.Add(square("alice", 500, 500)).(protocol.MempoolFullError)
+	harness.Check("ink cap", isFull, "")
+
+	pool.MaxInk = miner.MEMPOOL_MAX_INK
+	pool.MaxBytes = 10
+	_, isFull = pool.Add(square("alice", 500, 500)).(protocol.MempoolFullError)
+	harness.Check("byte cap", isFull, "")
+
+	// 7. The same op under another signature
+	pool.MaxBytes = miner.MEMPOOL_MAX_BYTES
+	d := square("alice", 600, 600)
+	resigned := d
+	resigned.OpSig = "d signed again"
+	harness.Check("add before resigning", pool.Add(d) == nil, "")
+
+	_, isDup = pool.Add(resigned).(miner.DuplicateError)
+	harness.Check("dedup under another signature", isDup, "")
+
+	pool.Update(extend(stale, "bob", resigned))
+	harness.Check("in a block under another signature", len(pool.Ops()) == 0, opSigs(pool))
+	_, isDup = pool.Add(d).(miner.DuplicateError)
+	harness.Check("on the path under another signature", isDup, "")
+
+	harness.Done()
+}
@@ -0,0 +1,96 @@
+/*
+
+Signs ops the way art nodes do and checks that VerifyOpSignature accepts
+them and rejects tampered ops, whichever field was changed, DELETEs moved to
+another shape, ops claiming another key, and garbage keys and signatures, and
+that CheckOpSignature counts the rejections by reason.
+
+Usage:
+go run misc/test-op-signatures.go
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"../blockchain"
+	"../miner"
+	"../utils"
+	"./harness"
+)
+
+// Returns an op signed by privKey, like blockartlib signs them
+func signedOp(privKey *ecdsa.PrivateKey, svg string) blockchain.OperationInfo {
+	op := blockchain.Operation{OpType: blockchain.ADD, SVGString: svg, Fill: "transparent", Stroke: "red", OpNum: 7}
+	return sign(privKey, blockchain.OperationInfo{PubKey: utils.GetPublicKeyString(privKey.PublicKey), Op: op})
+}
+
+func sign(privKey *ecdsa.PrivateKey, opInfo blockchain.OperationInfo) blockchain.OperationInfo {
+	opSig, _ := privKey.Sign(rand.Reader, blockchain.OperationDigest(opInfo), nil)
+	opInfo.OpSig = hex.EncodeToString(opSig)
+	return opInfo
+}
+
+func reason(err error) string {
+	if sigErr, ok := err.(miner.OpSignatureError); ok {
+		return sigErr.Reason
+	}
+	return fmt.Sprint(err)
+}
+
+func main() {
+	alice := harness.NewKey()
+	mallory := harness.NewKey()
+
+	op := signedOp(alice, "M 0 0 l 10 0 l 0 10 l -10 0 l 0 -10 l 10 0 l 0 10 l -10 0 z")
+	harness.Check("valid", miner.VerifyOpSignature(op) == nil, "")
+
+	tampered := op
+	tampered.Op.SVGString = "M 0 0 l 10 0 l 0 10 l -10 0 l 0 -10 l 10 0 l 0 10 l -10 0 l 500 500 z"
+	harness.Check("tampered op", reason(miner.VerifyOpSignature(tampered)) == miner.REJECT_FORGED, "")
+
+	stroke := op
+	stroke.Op.Stroke = "blue"
+	harness.Check("tampered stroke", reason(miner.VerifyOpSignature(stroke)) == miner.REJECT_FORGED, "")
+
+	opNum := op
+	opNum.Op.OpNum++
+	harness.Check("tampered op number", reason(miner.VerifyOpSignature(opNum)) == miner.REJECT_FORGED, "")
+
+	// A DELETE signed for one shape is moved to another
+	del := op
+	del.Op.OpType = blockchain.DELETE
+	del.AddSig = op.OpSig
+	del = sign(alice, del)
+	harness.Check("valid delete", miner.VerifyOpSignature(del) == nil, "")
+	retargeted := del
+	retargeted.AddSig = "another shape"
+	harness.Check("retargeted delete", reason(miner.VerifyOpSignature(retargeted)) == miner.REJECT_FORGED, "")
+
+	// Mallory signs an op with her key but claims Alice's ink
+	forged := signedOp(mallory, "M 0 0 l 10 10")
+	forged.PubKey = op.PubKey
+	harness.Check("forged key", reason(miner.VerifyOpSignature(forged)) == miner.REJECT_FORGED, "")
+
+	badKey := op
+	badKey.PubKey = "alice"
+	harness.Check("bad key", reason(miner.VerifyOpSignature(badKey)) == miner.REJECT_BAD_PUBKEY, "")
+
+	badSig := op
+	badSig.OpSig = "zz"
+	harness.Check("bad signature", reason(miner.VerifyOpSignature(badSig)) == miner.REJECT_BAD_SIGNATURE, "")
+
+	for _, opInfo := range []blockchain.OperationInfo{op, tampered, forged, badKey} {
+		miner.CheckOpSignature(opInfo, "test")
+	}
+	counts := miner.OpRejectionCounts()
+	harness.Check("counts", counts[miner.REJECT_FORGED] == 2 && counts[miner.REJECT_BAD_PUBKEY] == 1 &&
+		counts[miner.REJECT_BAD_SIGNATURE] == 0, fmt.Sprint(counts))
+
+	harness.Done()
+}
@@ -0,0 +1,282 @@
+/*
+
+Checks the orphan pool: its caps per peer, in number and in bytes, expiry and
+adoption. Then inserts a chain out of order and checks the orphans stay out of
+the block chain until their parent goes in. Then has the miner fetch the
+missing ancestors of orphans from the fake peer that sent them, on the peer's
+longest path and off it. Last, floods the miner with junk orphans over
+PropagateBlock and checks the pool holds only the sender's share of them.
+
+Usage:
+go run misc/test-orphan-pool.go
+
+*/
+
+package main
+
+import (
+	"crypto/elliptic"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../pow"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+// Stands in for a peer whose longest path is chain. It has the blocks of
+// others too.
+type FakePeer struct {
+	chain     []blockchain.Block
+	others    []blockchain.Block
+	getBlocks int
+}
+
+func (p *FakePeer) GetTip(args miner.Empty, reply *miner.ChainTip) error {
+	hashes := chainHashes(p.chain)
+	*reply = miner.ChainTip{Hash: hashes[len(hashes)-1], Height: len(p.chain)}
+	return nil
+}
+
+func (p *FakePeer) GetHeaders(args miner.GetHeadersArgs, reply *[]miner.BlockHeader) error {
+	hashes := chainHashes(p.chain)
+	start := 0
+	for _, hash := range args.Locator {
+		if i := indexOf(hashes, hash); i >= 0 {
+			start = i
+			break
+		}
+	}
+
+	headers := make([]miner.BlockHeader, 0)
+	for i := start + 1; i < len(hashes); i++ {
+		headers = append(headers, miner.NewBlockHeader(p.chain[i-1], hashes[i]))
+	}
+	*reply = headers
+	return nil
+}
+
+func (p *FakePeer) GetBlocks(args miner.GetBlocksArgs, reply *[]blockchain.Block) error {
+	p.getBlocks++
+	blocks := make([]blockchain.Block, 0)
+	for _, hash := range args.Hashes {
+		for _, block := range append(p.chain, p.others...) {
+			if miner.GetBlockHash(block) == hash {
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	*reply = blocks
+	return nil
+}
+
+// Returns the hashes of the genesis block and the blocks of chain
+func chainHashes(chain []blockchain.Block) []string {
+	hashes := []string{harness.GENESIS}
+	for _, block := range chain {
+		hashes = append(hashes, miner.GetBlockHash(block))
+	}
+	return hashes
+}
+
+func indexOf(hashes []string, hash string) int {
+	for i, h := range hashes {
+		if h == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+var clock = time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+
+// Returns chain extended by n blocks, starting after prevHash, signed by the
+// miner
+func extend(chain []blockchain.Block, prevHash string, n int) []blockchain.Block {
+	chain = append([]blockchain.Block{}, chain...)
+	for i := 0; i < n; i++ {
+		clock += 1000
+		block := blockchain.Block{
+			PrevHash:      prevHash,
+			MinerPubKey:   utils.GetPublicKeyString(miner.MinerInstance.PrivKey.PublicKey),
+			HashAlgorithm: blockchain.SHA256,
+			Timestamp:     clock}
+		// Exactly no trailing zeroes at difficulty 0
+		for {
+			miner.SignBlock(&block)
+			if pow.Verify(miner.GetBlockHash(block), 0) {
+				break
+			}
+			block.Nonce++
+		}
+		chain = append(chain, block)
+		prevHash = miner.GetBlockHash(block)
+	}
+	return chain
+}
+
+func has(block blockchain.Block) bool {
+	_, ok := miner.ReadBlockChainMap(miner.GetBlockHash(block))
+	return ok
+}
+
+func listen(name string, rcvr interface{}) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server := rpc.NewServer()
+	server.RegisterName(name, rcvr)
+	go server.Accept(ln)
+	return ln.Addr()
+}
+
+func dial(addr net.Addr) *rpc.Client {
+	client, err := rpc.Dial("tcp", addr.String())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// Returns a block the pool takes as it is, following parent
+func junk(parent string, nonce int) blockchain.Block {
+	return blockchain.Block{PrevHash: parent, Nonce: uint32(nonce)}
+}
+
+func testPool() {
+	pool := miner.NewOrphanPool()
+	pool.MaxOrphans = 5
+	pool.MaxPerPeer = 3
+
+	accepted := 0
+	for i := 0; i < 4; i++ {
+		if pool.Add(junk("p", i), "mallory") {
+			accepted++
+		}
+	}
+	harness.Check("share of one peer", accepted == 3 && pool.Len() == 3, fmt.Sprint(accepted))
+	harness.Check("pooled once", !pool.Add(junk("p", 0), "bob"), "")
+
+	for i := 0; i < 10; i++ {
+		pool.Add(junk("q", i), fmt.Sprint("peer", i))
+	}
+	harness.Check("capped", pool.Len() == 5, fmt.Sprint(pool.Len()))
+
+	pool = miner.NewOrphanPool()
+	pool.MaxBytes = 2 * len(blockchain.EncodeBlock(junk("p", 0)))
+	pool.Add(junk("p", 0), "")
+	pool.Add(junk("p", 1), "")
+	pool.Add(junk("p", 2), "")
+	harness.Check("capped in bytes", pool.Len() == 2, fmt.Sprint(pool.Len()))
+	big := junk("p", 3)
+	big.OpHistory = make([]blockchain.OperationInfo, 10)
+	harness.Check("too big", !pool.Add(big, ""), "")
+
+	pool = miner.NewOrphanPool()
+	a := junk("p", 0)
+	b := junk(miner.GetBlockHash(a), 0)
+	c := junk(miner.GetBlockHash(b), 0)
+	pool.Add(c, "")
+	pool.Add(b, "")
+	pool.Add(a, "")
+	pool.Add(junk("p", 1), "")
+	missing, ok := pool.MissingParent(miner.GetBlockHash(c))
+	harness.Check("missing parent", ok && missing == "p", missing)
+	adopted := pool.Adopt("p")
+	harness.Check("adopted", len(adopted) == 2 && pool.Len() == 2, fmt.Sprint(len(adopted)))
+	missing, _ = pool.MissingParent(miner.GetBlockHash(c))
+	harness.Check("missing parent after adoption", missing == miner.GetBlockHash(a), missing)
+
+	pool.Expiry = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	pool.Expire()
+	harness.Check("expired", pool.Len() == 0, fmt.Sprint(pool.Len()))
+}
+
+func main() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+
+	// 1. The pool on its own
+	testPool()
+
+	alice := harness.NewKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{})
+
+	// 2. Out of order, orphans wait for their parents outside the block chain
+	chain := extend(nil, harness.GENESIS, 5)
+	for i := 4; i >= 2; i-- {
+		miner.InsertBlock(chain[i])
+	}
+	harness.Check("orphans pooled", miner.Orphans.Len() == 3 && len(miner.BlockNodeArray) == 1,
+		fmt.Sprint(miner.Orphans.Len(), len(miner.BlockNodeArray)))
+	miner.InsertBlock(chain[0])
+	harness.Check("still orphans", miner.Orphans.Len() == 3 && miner.LocalTip().Height == 1, fmt.Sprint(miner.LocalTip()))
+	miner.InsertBlock(chain[1])
+	harness.Check("orphans adopted", miner.Orphans.Len() == 0 && miner.LocalTip().Height == 5, fmt.Sprint(miner.LocalTip()))
+
+	// 3. The peer that sent an orphan is asked for its ancestors
+	peer := &FakePeer{chain: extend(chain, miner.GetBlockHash(chain[4]), 10)}
+	miner.Peers.Add(&miner.Peer{Client: dial(listen("Peer", peer)), LastHeartBeat: time.Now(), Key: "fakekey", Addr: "fakepeer"})
+
+	tip := peer.chain[14]
+	miner.Orphans.Add(tip, "fakepeer")
+	miner.Orphans.RequestAncestors("fakepeer", miner.GetBlockHash(tip))
+	miner.FetchOrphanAncestors(<-miner.Orphans.Fetches)
+	harness.Check("ancestors on the peer's longest path", has(tip) && miner.LocalTip().Height == 15 && miner.Orphans.Len() == 0,
+		fmt.Sprint(miner.LocalTip()))
+
+	fork := extend(nil, miner.GetBlockHash(peer.chain[7]), 3)
+	peer.others = fork
+	peer.getBlocks = 0
+	miner.Orphans.Add(fork[2], "fakepeer")
+	miner.Orphans.RequestAncestors("fakepeer", miner.GetBlockHash(fork[2]))
+	miner.FetchOrphanAncestors(<-miner.Orphans.Fetches)
+	harness.Check("ancestors off the peer's longest path", has(fork[0]) && has(fork[1]) && has(fork[2]) && peer.getBlocks == 2,
+		fmt.Sprint(peer.getBlocks))
+	harness.Check("pool empty", miner.Orphans.Len() == 0, fmt.Sprint(miner.Orphans.Len()))
+
+	// 4. Junk orphans from a peer take up its share of the pool only
+	rserver := harness.NewRServer()
+	miner.MinerInstance.MSI = &miner.MinerServerInterface{Client: dial(listen("RServer", rserver))}
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go miner.ListenPeerRpc(ln, miner.MinerInstance, make(chan miner.PropagateOpArgs, 16),
+		make(chan miner.PropagateBlockArgs, 16), make(chan blockchain.OperationInfo, 16),
+		make(chan blockchain.Block, 16))
+	miner.MinerInstance.Addr = ln.Addr()
+	rserver.Keys[ln.Addr().String()] = alice
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{ln.Addr()})
+	self, ok := miner.Peers.Get(ln.Addr().String())
+	harness.Check("connected to itself", ok, "")
+	if !ok {
+		os.Exit(1)
+	}
+
+	var empty miner.Empty
+	blocks := len(miner.BlockNodeArray)
+	unsigned := junk("nowhere", 0)
+	unsigned.HashAlgorithm = blockchain.SHA256
+	self.Client.Call("Peer.PropagateBlock", miner.PropagateBlockArgs{Block: unsigned}, &empty)
+	harness.Check("unsigned orphan dropped", miner.Orphans.Len() == 0, "")
+
+	for i := 0; i < 2*miner.MAX_ORPHANS_PER_PEER; i++ {
+		orphan := extend(nil, fmt.Sprint("nowhere", i), 1)[0]
+		self.Client.Call("Peer.PropagateBlock", miner.PropagateBlockArgs{Block: orphan}, &empty)
+	}
+	harness.Check("junk capped", miner.Orphans.Len() == miner.MAX_ORPHANS_PER_PEER, fmt.Sprint(miner.Orphans.Len()))
+	harness.Check("junk kept out of the block chain", len(miner.BlockNodeArray) == blocks, fmt.Sprint(len(miner.BlockNodeArray)))
+	fetch := <-miner.Orphans.Fetches
+	harness.Check("sender asked for ancestors", fetch.Addr == ln.Addr().String(), fetch.Addr)
+
+	harness.Done()
+}
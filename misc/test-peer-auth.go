@@ -0,0 +1,207 @@
+/*
+
+Runs the peer listener of a miner against a fake server and checks the
+handshake: a peer that proves the key registered at its address gets in, and
+the miner proves its own key back. Connections that haven't authenticated,
+peers signing with another key, peers claiming another's address, replayed
+signatures and listeners at the address of someone else are all refused.
+
+Usage:
+go run misc/test-peer-auth.go
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+
+	"../miner"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+// Whether err is the rejection of a peer for reason
+func rejected(err error, reason string) bool {
+	return err != nil && strings.Contains(err.Error(), reason)
+}
+
+func listen(handler func(net.Listener)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go handler(ln)
+	return ln
+}
+
+func dial(addr net.Addr) *rpc.Client {
+	client, err := rpc.Dial("tcp", addr.String())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// Dials a miner, calling it over the connection the way peers do
+func dialPeer(addr net.Addr) *rpc.Client {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return rpc.NewClientWithCodec(miner.NewPeerConn(conn).ClientCodec())
+}
+
+// What a handshake signature is made over: the role, then the challenge of
+// the other side, then the signer's
+func digest(role string, theirs, ours []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(role))
+	h.Write(theirs)
+	h.Write(ours)
+	return h.Sum(nil)
+}
+
+func sign(privKey *ecdsa.PrivateKey, role string, theirs, ours []byte) []byte {
+	sig, _ := privKey.Sign(rand.Reader, digest(role, theirs, ours), nil)
+	return sig
+}
+
+func challenge() []byte {
+	c := make([]byte, miner.CHALLENGE_SIZE)
+	rand.Read(c)
+	return c
+}
+
+// Says hello to the miner as key, returning our challenge and the reply
+func hello(client *rpc.Client, key *ecdsa.PrivateKey) ([]byte, miner.HelloReply, error) {
+	ours := challenge()
+	var reply miner.HelloReply
+	err := client.Call("Peer.Hello", miner.HelloArgs{Key: utils.GetPublicKeyString(key.PublicKey), Challenge: ours}, &reply)
+	return ours, reply, err
+}
+
+func connect(client *rpc.Client, addr net.Addr, sig []byte) error {
+	var tip miner.ChainTip
+	return client.Call("Peer.Connect", miner.ConnectArgs{Addr: addr, Sig: sig}, &tip)
+}
+
+func main() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+
+	alice := harness.NewKey()
+	bob := harness.NewKey()
+	mallory := harness.NewKey()
+
+	// Bob and Mallory don't listen; the miner only has to know their addresses
+	bobAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1")
+	malloryAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:2")
+
+	rserver := harness.NewRServer()
+	rserver.Keys[bobAddr.String()] = bob
+	rserver.Keys[malloryAddr.String()] = mallory
+	serverLn := listen(func(ln net.Listener) {
+		server := rpc.NewServer()
+		server.Register(rserver)
+		server.Accept(ln)
+	})
+
+	// Alice is the miner under test
+	harness.NewMiner(alice, protocol.MinerNetSettings{})
+	miner.MinerInstance.MSI = &miner.MinerServerInterface{Client: dial(serverLn.Addr())}
+	aliceLn := listen(func(ln net.Listener) {
+		miner.ListenPeerRpc(ln, miner.MinerInstance, nil, nil, nil, nil)
+	})
+	aliceAddr := aliceLn.Addr()
+	miner.MinerInstance.Addr = aliceAddr
+	rserver.Keys[aliceAddr.String()] = alice
+
+	var empty miner.Empty
+
+	// 1. Nothing is taken before the handshake
+	stranger := dialPeer(aliceAddr)
+	err := stranger.Call("Peer.Hb", &empty, &empty)
+	harness.Check("unauthenticated heartbeat", rejected(err, miner.REJECT_UNAUTHENTICATED), fmt.Sprint(err))
+	var tip miner.ChainTip
+	err = stranger.Call("Peer.GetTip", empty, &tip)
+	harness.Check("unauthenticated tip", rejected(err, miner.REJECT_UNAUTHENTICATED), fmt.Sprint(err))
+	err = stranger.Call("Peer.PropagateBlock", miner.PropagateBlockArgs{}, &empty)
+	harness.Check("unauthenticated block", rejected(err, miner.REJECT_UNAUTHENTICATED), fmt.Sprint(err))
+	err = connect(stranger, bobAddr, nil)
+	harness.Check("connect before hello", rejected(err, miner.REJECT_NO_HELLO), fmt.Sprint(err))
+	var reply miner.HelloReply
+	err = stranger.Call("Peer.Hello", miner.HelloArgs{Key: utils.GetPublicKeyString(bob.PublicKey), Challenge: []byte("hi")}, &reply)
+	harness.Check("short challenge", rejected(err, miner.REJECT_BAD_CHALLENGE), fmt.Sprint(err))
+
+	// 2. Bob and the miner prove their keys to each other
+	bobConn := dialPeer(aliceAddr)
+	ours, reply, err := hello(bobConn, bob)
+	harness.Check("hello", err == nil, fmt.Sprint(err))
+	harness.Check("miner's key", reply.Key == utils.GetPublicKeyString(alice.PublicKey), "")
+	harness.Check("miner's proof", ecdsa.VerifyASN1(&alice.PublicKey, digest(miner.HANDSHAKE_ACCEPT, ours, reply.Challenge), reply.Sig), "")
+	bobSig := sign(bob, miner.HANDSHAKE_DIAL, reply.Challenge, ours)
+	err = connect(bobConn, bobAddr, bobSig)
+	harness.Check("bob connects", err == nil, fmt.Sprint(err))
+	peer, ok := miner.Peers.Get(bobAddr.String())
+	harness.Check("bob is an inbound peer", ok && peer.Inbound && peer.Key == utils.GetPublicKeyString(bob.PublicKey), "")
+	err = bobConn.Call("Peer.Hb", &empty, &empty)
+	harness.Check("bob's heartbeat", err == nil, fmt.Sprint(err))
+	err = bobConn.Call("Peer.GetTip", empty, &tip)
+	harness.Check("bob's tip", err == nil && tip.Hash == "genesis", fmt.Sprint(err))
+	_, _, err = hello(bobConn, mallory)
+	harness.Check("hello after connect", rejected(err, miner.REJECT_ALREADY_CONNECTED), fmt.Sprint(err))
+	harness.Check("stranger still refused", rejected(stranger.Call("Peer.Hb", &empty, &empty), miner.REJECT_UNAUTHENTICATED), "")
+
+	// 3. Mallory can't be Bob
+	malloryConn := dialPeer(aliceAddr)
+	ours, reply, _ = hello(malloryConn, bob)
+	err = connect(malloryConn, bobAddr, sign(mallory, miner.HANDSHAKE_DIAL, reply.Challenge, ours))
+	harness.Check("signed with another key", rejected(err, miner.REJECT_FORGED), fmt.Sprint(err))
+	err = connect(malloryConn, bobAddr, bobSig)
+	harness.Check("one try per challenge", rejected(err, miner.REJECT_NO_HELLO), fmt.Sprint(err))
+
+	ours, reply, _ = hello(malloryConn, mallory)
+	err = connect(malloryConn, bobAddr, sign(mallory, miner.HANDSHAKE_DIAL, reply.Challenge, ours))
+	harness.Check("another's address", rejected(err, miner.REJECT_UNREGISTERED), fmt.Sprint(err))
+
+	_, _, _ = hello(malloryConn, bob)
+	err = connect(malloryConn, bobAddr, bobSig)
+	harness.Check("replayed signature", rejected(err, miner.REJECT_FORGED), fmt.Sprint(err))
+
+	ours, reply, _ = hello(malloryConn, mallory)
+	err = connect(malloryConn, malloryAddr, sign(mallory, miner.HANDSHAKE_ACCEPT, reply.Challenge, ours))
+	harness.Check("reflected signature", rejected(err, miner.REJECT_FORGED), fmt.Sprint(err))
+	harness.Check("mallory refused", rejected(malloryConn.Call("Peer.Hb", &empty, &empty), miner.REJECT_UNAUTHENTICATED), "")
+	_, ok = miner.Peers.Get(malloryAddr.String())
+	harness.Check("mallory isn't a peer", !ok && miner.Peers.Len() == 1, fmt.Sprint(miner.Peers.Len()))
+
+	// 4. The miner's half: it gets in where it is registered...
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{aliceAddr})
+	peer, ok = miner.Peers.Get(aliceAddr.String())
+	harness.Check("dial", ok && !peer.Inbound && peer.Key == utils.GetPublicKeyString(alice.PublicKey), "")
+
+	// ...and drops listeners at the address of someone else
+	impostorLn := listen(func(ln net.Listener) {
+		miner.ListenPeerRpc(ln, miner.MinerInstance, nil, nil, nil, nil)
+	})
+	rserver.Keys[impostorLn.Addr().String()] = bob
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{impostorLn.Addr()})
+	_, ok = miner.Peers.Get(impostorLn.Addr().String())
+	harness.Check("impostor listener", !ok && miner.Peers.Len() == 2, fmt.Sprint(miner.Peers.Len()))
+
+	harness.Done()
+}
@@ -0,0 +1,265 @@
+/*
+
+Checks the peer manager. Fake miners dial a miner and are tracked as inbound
+peers, which the miner calls back over the same connection. A second
+connection from the same key is refused, and so are connections once the
+inbound slots are taken. When the miner dials a fake miner that dialed it
+already, both keep the connection dialed by the lower key. The miner doesn't
+dial once its outbound slots are taken, and stale peers are dropped. Last,
+art nodes get ids of their own.
+
+Usage:
+go run misc/test-peer-manager.go
+
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+// Stands in for a miner with key, listening at addr. It counts the calls the
+// miner under test makes to it.
+type FakeMiner struct {
+	key   *ecdsa.PrivateKey
+	addr  net.Addr
+	mutex *sync.Mutex
+	calls map[string]int
+}
+
+func NewFakeMiner(key *ecdsa.PrivateKey, addr net.Addr) *FakeMiner {
+	return &FakeMiner{key, addr, &sync.Mutex{}, make(map[string]int)}
+}
+
+func (m *FakeMiner) count(method string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.calls[method]
+}
+
+func (m *FakeMiner) called(method string) {
+	m.mutex.Lock()
+	m.calls[method]++
+	m.mutex.Unlock()
+}
+
+// The RPCs of a fake miner, on one connection
+type FakePeer struct {
+	miner *FakeMiner
+}
+
+func (p *FakePeer) Hb(args *miner.Empty, reply *miner.Empty) error {
+	p.miner.called("Hb")
+	return nil
+}
+
+func (p *FakePeer) Hello(args miner.HelloArgs, reply *miner.HelloReply) error {
+	p.miner.called("Hello")
+	ours := challenge()
+	*reply = miner.HelloReply{Key: utils.GetPublicKeyString(p.miner.key.PublicKey), Challenge: ours,
+		Sig: sign(p.miner.key, miner.HANDSHAKE_ACCEPT, args.Challenge, ours)}
+	return nil
+}
+
+func (p *FakePeer) Connect(args miner.ConnectArgs, reply *miner.ChainTip) error {
+	*reply = miner.ChainTip{Hash: "genesis", Height: 0}
+	return nil
+}
+
+// Serves the RPCs of the fake miner over conn, and returns a client to call
+// the other end with
+func (m *FakeMiner) serve(conn net.Conn) *rpc.Client {
+	peerConn := miner.NewPeerConn(conn)
+	server := rpc.NewServer()
+	server.RegisterName("Peer", &FakePeer{m})
+	go server.ServeCodec(peerConn.ServerCodec())
+	return rpc.NewClientWithCodec(peerConn.ClientCodec())
+}
+
+// Listens at a fresh address for the miner to dial
+func (m *FakeMiner) listen() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	m.addr = ln.Addr()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			m.serve(conn)
+		}
+	}()
+}
+
+// Dials the miner at addr and runs the handshake
+func (m *FakeMiner) dial(addr net.Addr) (*rpc.Client, error) {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	client := m.serve(conn)
+
+	ours := challenge()
+	var reply miner.HelloReply
+	err = client.Call("Peer.Hello", miner.HelloArgs{Key: utils.GetPublicKeyString(m.key.PublicKey), Challenge: ours}, &reply)
+	if err != nil {
+		return client, err
+	}
+	var tip miner.ChainTip
+	sig := sign(m.key, miner.HANDSHAKE_DIAL, reply.Challenge, ours)
+	return client, client.Call("Peer.Connect", miner.ConnectArgs{Addr: m.addr, Sig: sig}, &tip)
+}
+
+func sign(privKey *ecdsa.PrivateKey, role string, theirs, ours []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(role))
+	h.Write(theirs)
+	h.Write(ours)
+	sig, _ := privKey.Sign(rand.Reader, h.Sum(nil), nil)
+	return sig
+}
+
+func challenge() []byte {
+	c := make([]byte, miner.CHALLENGE_SIZE)
+	rand.Read(c)
+	return c
+}
+
+func newKey() *ecdsa.PrivateKey {
+	key := harness.NewKey()
+	return key
+}
+
+func main() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+
+	alice := newKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{HeartBeat: 1000})
+
+	rserver := harness.NewRServer()
+	serverLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := rpc.NewServer()
+	server.Register(rserver)
+	go server.Accept(serverLn)
+	serverClient, _ := rpc.Dial("tcp", serverLn.Addr().String())
+	miner.MinerInstance.MSI = &miner.MinerServerInterface{Client: serverClient}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go miner.ListenPeerRpc(ln, miner.MinerInstance, make(chan miner.PropagateOpArgs, 16),
+		make(chan miner.PropagateBlockArgs, 16), make(chan blockchain.OperationInfo, 16),
+		make(chan blockchain.Block, 16))
+	aliceAddr := ln.Addr()
+	miner.MinerInstance.Addr = aliceAddr
+	rserver.Keys[aliceAddr.String()] = alice
+
+	// 1. A miner that dials us is an inbound peer, called over its connection
+	bob := NewFakeMiner(newKey(), nil)
+	bob.listen()
+	rserver.Keys[bob.addr.String()] = bob.key
+	_, err := bob.dial(aliceAddr)
+	peer, ok := miner.Peers.Get(bob.addr.String())
+	harness.Check("inbound peer", err == nil && ok && peer.Inbound && peer.Key == utils.GetPublicKeyString(bob.key.PublicKey),
+		fmt.Sprint(err))
+	if !ok {
+		os.Exit(1)
+	}
+
+	var empty miner.Empty
+	err = peer.Client.Call("Peer.Hb", &empty, &empty)
+	harness.Check("called back over the same connection", err == nil && bob.count("Hb") == 1 && bob.count("Hello") == 0,
+		fmt.Sprint(err))
+	miner.PeerHeartBeats()
+	harness.Check("heartbeat to inbound peer", bob.count("Hb") == 2, fmt.Sprint(bob.count("Hb")))
+
+	// 2. One connection per key
+	_, err = bob.dial(aliceAddr)
+	harness.Check("second connection refused", err != nil && strings.Contains(err.Error(), miner.PEER_DUPLICATE), fmt.Sprint(err))
+	harness.Check("first connection kept", miner.Peers.Len() == 1 && peer.Client.Call("Peer.Hb", &empty, &empty) == nil,
+		fmt.Sprint(miner.Peers.Len()))
+
+	// 3. Inbound slots
+	miner.Peers.MaxInbound = 2
+	carol := NewFakeMiner(newKey(), nil)
+	carol.listen()
+	rserver.Keys[carol.addr.String()] = carol.key
+	_, err = carol.dial(aliceAddr)
+	harness.Check("inbound slot", err == nil && miner.Peers.Len() == 2, fmt.Sprint(err))
+
+	dave := NewFakeMiner(newKey(), nil)
+	dave.listen()
+	rserver.Keys[dave.addr.String()] = dave.key
+	_, err = dave.dial(aliceAddr)
+	_, ok = miner.Peers.Get(dave.addr.String())
+	harness.Check("inbound slots taken", err != nil && !ok && miner.Peers.Len() == 2, fmt.Sprint(err))
+
+	// 4. Dialing a miner that dialed us: the connection dialed by the lower
+	// key stays. Bob listens at a second address, as if its address had
+	// changed, so the miner doesn't know it is connected to bob already.
+	aliceKey := utils.GetPublicKeyString(alice.PublicKey)
+	bobKey := utils.GetPublicKeyString(bob.key.PublicKey)
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{bob.addr})
+	harness.Check("peer's address not dialed", bob.count("Hello") == 0, "")
+
+	bobPeer := peer
+	bob.listen()
+	rserver.Keys[bob.addr.String()] = bob.key
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{bob.addr})
+	harness.Check("dialed bob", bob.count("Hello") == 1, fmt.Sprint(bob.count("Hello")))
+	if aliceKey < bobKey {
+		peer, ok = miner.Peers.Get(bob.addr.String())
+		harness.Check("our connection kept", ok && !peer.Inbound && bobPeer.Client.Call("Peer.Hb", &empty, &empty) != nil,
+			fmt.Sprint(ok))
+	} else {
+		_, ok = miner.Peers.Get(bob.addr.String())
+		harness.Check("their connection kept", !ok && bobPeer.Client.Call("Peer.Hb", &empty, &empty) == nil, fmt.Sprint(ok))
+	}
+	harness.Check("one peer for bob", miner.Peers.Len() == 2, fmt.Sprint(miner.Peers.Len()))
+
+	// 5. Outbound slots
+	miner.Peers.MaxOutbound = 0
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{dave.addr})
+	harness.Check("outbound slots taken", dave.count("Hello") == 0 && miner.Peers.Len() == 2, fmt.Sprint(dave.count("Hello")))
+	miner.Peers.MaxOutbound = miner.MAX_OUTBOUND_PEERS
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{dave.addr})
+	peer, ok = miner.Peers.Get(dave.addr.String())
+	harness.Check("outbound peer", ok && !peer.Inbound && dave.count("Hello") == 1, fmt.Sprint(dave.count("Hello")))
+
+	// 6. Stale peers are dropped
+	peer.LastHeartBeat = time.Now().Add(-time.Minute)
+	miner.CheckLiveliness()
+	_, ok = miner.Peers.Get(dave.addr.String())
+	harness.Check("stale peer dropped", !ok && miner.Peers.Len() == 2 && peer.Client.Call("Peer.Hb", &empty, &empty) != nil,
+		fmt.Sprint(miner.Peers.Len()))
+
+	// 7. Art nodes
+	artNodes := miner.NewArtNodeRegistry()
+	first, _ := artNodes.Register("key 1")
+	second, _ := artNodes.Register("key 2")
+	harness.Check("art node ids", first == 0 && second == 1, fmt.Sprint(first, second))
+	harness.Check("art node registered", artNodes.Registered("key 2") && !artNodes.Registered("key 3"), "")
+
+	harness.Done()
+}
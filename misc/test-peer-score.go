@@ -0,0 +1,169 @@
+/*
+
+Checks peer scoring and bans. First the scores on their own: points add up to
+a ban, on the address and the key, and PreferPeers orders by them. Then a
+miner connected to itself is sent invalid blocks until it bans itself: the
+connection is refused and dropped, and neither the address nor the key gets
+back in. Last, the admin RPC lists, sets and lifts bans.
+
+Usage:
+go run misc/test-peer-score.go
+
+*/
+
+package main
+
+import (
+	"crypto/elliptic"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+func listen(name string, rcvr interface{}) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server := rpc.NewServer()
+	server.RegisterName(name, rcvr)
+	go server.Accept(ln)
+	return ln.Addr()
+}
+
+func dial(addr net.Addr) *rpc.Client {
+	client, err := rpc.Dial("tcp", addr.String())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return client
+}
+
+func testScores() {
+	scores := miner.NewPeerScores()
+	banned := scores.Misbehaved("1.1.1.1:1", "key", miner.SCORE_INVALID_BLOCK, "invalid block")
+	harness.Check("not banned yet", !banned && scores.Score("1.1.1.1:1") == miner.SCORE_INVALID_BLOCK &&
+		scores.Score("key") == miner.SCORE_INVALID_BLOCK, fmt.Sprint(scores.Score("key")))
+
+	banned = scores.Misbehaved("1.1.1.1:1", "key", miner.SCORE_INVALID_BLOCK, "invalid block")
+	harness.Check("banned at the threshold", banned && scores.Banned("1.1.1.1:1", "") && scores.Banned("", "key"), "")
+	harness.Check("banned from another address", scores.Banned("2.2.2.2:2", "key"), "")
+	harness.Check("ban listed", len(scores.Bans()) == 2 && scores.Bans()[0].Reason == "invalid block", fmt.Sprint(scores.Bans()))
+
+	harness.Check("unbanned", scores.Unban("key") && !scores.Banned("", "key") && scores.Banned("1.1.1.1:1", ""), "")
+	harness.Check("unban unknown", !scores.Unban("nobody"), "")
+
+	scores.Ban("3.3.3.3:3", 0, "expired")
+	harness.Check("ban expires", !scores.Banned("3.3.3.3:3", ""), "")
+
+	// PreferPeers works on the singleton scores
+	a, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:1")
+	b, _ := net.ResolveTCPAddr("tcp", "10.0.0.2:2")
+	c, _ := net.ResolveTCPAddr("tcp", "10.0.0.3:3")
+	miner.Scores.Misbehaved(a.String(), "", miner.SCORE_INVALID_OP, "malformed op")
+	miner.Scores.Ban(b.String(), miner.BAN_SECONDS, "test")
+	preferred := miner.PreferPeers([]net.Addr{a, b, c})
+	harness.Check("least misbehaved first, banned left out", len(preferred) == 2 && preferred[0] == c && preferred[1] == a,
+		fmt.Sprint(preferred))
+	miner.Scores.Unban(a.String())
+	miner.Scores.Unban(b.String())
+}
+
+func main() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+
+	// 1. The scores on their own
+	testScores()
+
+	alice := harness.NewKey()
+	harness.NewMiner(alice, protocol.MinerNetSettings{})
+	key := utils.GetPublicKeyString(alice.PublicKey)
+
+	// 2. A miner bans itself for sending invalid blocks
+	rserver := harness.NewRServer()
+	miner.MinerInstance.MSI = &miner.MinerServerInterface{Client: dial(listen("RServer", rserver))}
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go miner.ListenPeerRpc(ln, miner.MinerInstance, make(chan miner.PropagateOpArgs, 16),
+		make(chan miner.PropagateBlockArgs, 16), make(chan blockchain.OperationInfo, 16),
+		make(chan blockchain.Block, 16))
+	miner.MinerInstance.Addr = ln.Addr()
+	addr := ln.Addr().String()
+	rserver.Keys[addr] = alice
+
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{ln.Addr()})
+	self, ok := miner.Peers.Get(addr)
+	harness.Check("connected to itself", ok, "")
+	if !ok {
+		os.Exit(1)
+	}
+
+	var empty miner.Empty
+	unsigned := blockchain.Block{PrevHash: "genesis", HashAlgorithm: blockchain.SHA256}
+	err := self.Client.Call("Peer.PropagateBlock", miner.PropagateBlockArgs{Block: unsigned}, &empty)
+	harness.Check("invalid block counted", err == nil && miner.Scores.Score(addr) == miner.SCORE_INVALID_BLOCK &&
+		miner.Scores.Score(key) == miner.SCORE_INVALID_BLOCK, fmt.Sprint(miner.Scores.Score(addr), err))
+
+	orphan := blockchain.Block{PrevHash: "nowhere", HashAlgorithm: blockchain.SHA256}
+	self.Client.Call("Peer.PropagateBlock", miner.PropagateBlockArgs{Block: orphan}, &empty)
+	harness.Check("invalid orphan counted", miner.Scores.Banned(addr, "") && miner.Scores.Banned("", key) && miner.Orphans.Len() == 0, "")
+
+	err = self.Client.Call("Peer.Hb", &empty, &empty)
+	harness.Check("banned connection refused", err != nil && strings.Contains(err.Error(), miner.REJECT_BANNED), fmt.Sprint(err))
+
+	miner.DropBannedPeers()
+	_, ok = miner.Peers.Get(addr)
+	harness.Check("banned peer dropped", !ok, "")
+
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{ln.Addr()})
+	_, ok = miner.Peers.Get(addr)
+	harness.Check("banned address not dialed", !ok, "")
+
+	// The key stays banned once the address is unbanned
+	miner.Scores.Unban(addr)
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{ln.Addr()})
+	_, ok = miner.Peers.Get(addr)
+	harness.Check("banned key refused", !ok && miner.Peers.Len() == 0, fmt.Sprint(miner.Peers.Len()))
+
+	// 3. The admin RPC
+	admin := dial(listen("Admin", &miner.AdminRpc{}))
+	var bans []miner.PeerScore
+	err = admin.Call("Admin.GetBans", empty, &bans)
+	harness.Check("admin lists bans", err == nil && len(bans) == 1 && bans[0].Target == key, fmt.Sprint(bans, err))
+
+	err = admin.Call("Admin.Unban", key, &empty)
+	harness.Check("admin lifts ban", err == nil && !miner.Scores.Banned(addr, key), fmt.Sprint(err))
+	err = admin.Call("Admin.Unban", key, &empty)
+	harness.Check("admin lifts ban once", err != nil, fmt.Sprint(err))
+
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{ln.Addr()})
+	self, ok = miner.Peers.Get(addr)
+	harness.Check("reconnected once unbanned", ok, "")
+	if !ok {
+		os.Exit(1)
+	}
+
+	err = admin.Call("Admin.Ban", miner.BanArgs{Target: addr, Seconds: 60}, &empty)
+	bans = miner.Scores.Bans()
+	harness.Check("admin bans", err == nil && len(bans) == 1 && bans[0].Reason == "banned by admin" &&
+		bans[0].BannedUntil.Sub(time.Now()) <= 60*time.Second, fmt.Sprint(bans, err))
+	err = self.Client.Call("Peer.Hb", &empty, &empty)
+	harness.Check("admin ban refuses connection", err != nil && strings.Contains(err.Error(), miner.REJECT_BANNED), fmt.Sprint(err))
+
+	err = admin.Call("Admin.Ban", miner.BanArgs{}, &empty)
+	harness.Check("admin bans nothing", err != nil, fmt.Sprint(err))
+
+	harness.Done()
+}
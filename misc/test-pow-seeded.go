@@ -0,0 +1,106 @@
+/*
+
+Checks that the proof of work solver is deterministic for a seeded search,
+and that it rolls the extra nonce once a worker's nonce range runs out.
+
+The golden difficulty 8 solution below is ~4.2 billion hashes into the
+seeded search. By default the search is replayed from a window just before
+it; -full replays the whole seeded search from the seed, which takes over ten
+minutes on one core. Rolling the extra nonce is checked at a lower
+difficulty.
+
+Usage:
+go run misc/test-pow-seeded.go [-full]
+
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"time"
+
+	"../blockchain"
+	"../pow"
+	"./harness"
+)
+
+// The seed is the starting ExtraNonce of the block
+var seededBlock = blockchain.Block{
+	PrevHash:      "83218ac34c1834c26781fe4bde918ee4",
+	MinerPubKey:   "3076",
+	HashAlgorithm: blockchain.SHA256,
+	ExtraNonce:    416}
+
+// First difficulty 8 solution of seededBlock when searched by one worker
+const (
+	GOLDEN_EXTRA_NONCE = 416
+	GOLDEN_NONCE       = 4188212260
+	GOLDEN_HASH        = "36bf629ee7ff133a59f803225b858d7f81b92f7ac51ac42fd09b7d1700000000"
+	// Nonces searched before the golden one when not doing a -full search
+	REPLAY_WINDOW = 1 << 24
+)
+
+// Runs a single worker over [start, end] and waits for its solution
+func solve(block blockchain.Block, powDiff uint8, start uint32, end uint32) blockchain.Block {
+	solved := make(chan blockchain.Block)
+	done := make(chan bool)
+	go pow.Solve(block, powDiff, start, end, solved, done)
+	sol := <-solved
+	close(done)
+	return sol
+}
+
+func main() {
+	full := flag.Bool("full", false, "replay the whole seeded search from the seed")
+	flag.Parse()
+
+	// 1. A difficulty 8 block is found at the same place every time
+	block := seededBlock
+	start := uint32(0)
+	if !*full {
+		block.ExtraNonce = GOLDEN_EXTRA_NONCE
+		start = GOLDEN_NONCE - REPLAY_WINDOW
+	}
+
+	for run := 1; run <= 2; run++ {
+		startTime := time.Now()
+		sol := solve(block, 8, start, math.MaxUint32)
+		hash, _ := blockchain.HashBlock(sol)
+		harness.Check(fmt.Sprintf("seeded difficulty 8 search, run %d", run),
+			sol.ExtraNonce == GOLDEN_EXTRA_NONCE && sol.Nonce == GOLDEN_NONCE && hash == GOLDEN_HASH,
+			fmt.Sprintf("(extra nonce %d, nonce %d, %s, took %v)", sol.ExtraNonce, sol.Nonce, hash, time.Since(startTime)))
+		harness.Check("solution verifies", pow.Verify(hash, 8), "")
+
+		if *full {
+			// Once is plenty
+			break
+		}
+	}
+
+	// 2. A worker that exhausts its range rolls the extra nonce, deterministically
+	var first blockchain.Block
+	for run := 1; run <= 2; run++ {
+		sol := solve(seededBlock, 3, math.MaxUint32-15, math.MaxUint32)
+		hash, _ := blockchain.HashBlock(sol)
+		harness.Check(fmt.Sprintf("extra nonce roll, run %d", run),
+			sol.ExtraNonce > seededBlock.ExtraNonce && sol.Nonce >= math.MaxUint32-15 && pow.Verify(hash, 3),
+			fmt.Sprintf("(extra nonce %d, nonce %d)", sol.ExtraNonce, sol.Nonce))
+		if run == 1 {
+			first = sol
+		} else {
+			harness.Check("extra nonce roll is deterministic",
+				sol.ExtraNonce == first.ExtraNonce && sol.Nonce == first.Nonce, "")
+		}
+	}
+
+	// 3. Legacy MD5 blocks never carry an extra nonce
+	legacy := seededBlock
+	legacy.HashAlgorithm = blockchain.MD5
+	legacy.ExtraNonce = 0
+	harness.Check("legacy blocks cannot roll", !pow.CanRollExtraNonce(legacy), "")
+
+	harness.Done()
+}
@@ -0,0 +1,127 @@
+/*
+
+Checks how a proof of work job is split across workers and stopped. The
+nonce ranges of the workers cover the whole nonce space without overlapping,
+and every worker of a job searches its own range. Closing the done channel
+stops every worker within CHECK_INTERVAL hashes, and so does closing the
+solved channel under workers that found a solution at the same time, the
+way the miner kills a job. The hash rate counts the hashes of all workers,
+and stops once they do.
+
+Usage:
+go run misc/test-pow-workers.go
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"time"
+
+	"../blockchain"
+	"../miner"
+	"../pow"
+	"./harness"
+)
+
+const WORKERS = 4
+
+var block = blockchain.Block{
+	PrevHash:      "83218ac34c1834c26781fe4bde918ee4",
+	MinerPubKey:   "3076",
+	HashAlgorithm: blockchain.SHA256}
+
+// Returns the worker whose nonce range holds nonce
+func worker(nonce uint32, numWorkers int) int {
+	for i := 0; i < numWorkers; i++ {
+		start, end := pow.NonceRange(i, numWorkers)
+		if nonce >= start && nonce <= end {
+			return i
+		}
+	}
+	return -1
+}
+
+// Waits up to a second for the number of goroutines to drop back to n
+func settle(n int) bool {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func main() {
+	pow.NumWorkers = WORKERS
+	baseline := runtime.NumGoroutine()
+
+	// 1. The nonce ranges cover the nonce space, in order and without
+	// overlapping, and the last worker picks up the remainder
+	for _, numWorkers := range []int{1, 3, 4, 7, 64} {
+		next := uint64(0)
+		ok := true
+		for i := 0; i < numWorkers; i++ {
+			start, end := pow.NonceRange(i, numWorkers)
+			ok = ok && uint64(start) == next && end >= start
+			next = uint64(end) + 1
+		}
+		harness.Check(fmt.Sprint("nonce ranges of ", numWorkers, " workers"), ok && next == math.MaxUint32+1, "")
+	}
+
+	// 2. Every worker searches its own range. At difficulty 1 each worker
+	// soon finds a solution of its own, and stops once it has sent it.
+	solved := make(chan blockchain.Block)
+	done := miner.StartWorkers(block, 1, solved)
+	seen := make(map[int]bool)
+	extraNonce := uint32(0)
+	allVerify := true
+	for i := 0; i < WORKERS; i++ {
+		sol := <-solved
+		seen[worker(sol.Nonce, WORKERS)] = true
+		hash, _ := blockchain.HashBlock(sol)
+		allVerify = allVerify && pow.Verify(hash, 1)
+		if i == 0 {
+			extraNonce = sol.ExtraNonce
+		}
+		allVerify = allVerify && sol.ExtraNonce == extraNonce
+	}
+	close(done)
+	harness.Check("one solution from each worker", len(seen) == WORKERS && !seen[-1], fmt.Sprint(seen))
+	harness.Check("solutions verify, with the job's extra nonce", allVerify, "")
+	harness.Check("workers stop after a solution", settle(baseline), fmt.Sprint(runtime.NumGoroutine(), " goroutines"))
+
+	// 3. Closing done stops workers that are still searching
+	pow.HashRate()
+	solved = make(chan blockchain.Block)
+	done = miner.StartWorkers(block, 16, solved)
+	time.Sleep(200 * time.Millisecond)
+	harness.Check("workers running", runtime.NumGoroutine() == baseline+WORKERS, fmt.Sprint(runtime.NumGoroutine(), " goroutines"))
+	rate := pow.HashRate()
+	harness.Check("hash rate counts the workers", rate > 0, fmt.Sprintf("%.0f H/s", rate))
+
+	close(done)
+	harness.Check("workers stopped by done", settle(baseline), fmt.Sprint(runtime.NumGoroutine(), " goroutines"))
+	pow.HashRate()
+	time.Sleep(100 * time.Millisecond)
+	rate = pow.HashRate()
+	harness.Check("hash rate stops with the workers", rate == 0, fmt.Sprintf("%.0f H/s", rate))
+
+	// 4. The miner kills a job by closing both channels after the first
+	// solution. Workers blocked sending solutions of their own don't bring
+	// the miner down.
+	solved = make(chan blockchain.Block)
+	done = miner.StartWorkers(block, 1, solved)
+	<-solved
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	close(solved)
+	harness.Check("workers stopped by closing the job", settle(baseline), fmt.Sprint(runtime.NumGoroutine(), " goroutines"))
+
+	harness.Done()
+}
@@ -0,0 +1,90 @@
+/*
+
+Replays synthetic block timestamp sequences through the difficulty retarget
+rules and checks that the difficulty settles where the block rate is back
+within range of the target, without oscillating.
+
+Usage:
+go run misc/test-retarget.go
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"../pow"
+	"./harness"
+)
+
+const TARGET = 5000 // ms between blocks
+
+// Mines numBlocks blocks where a block at the configured difficulty takes
+// baseInterval ms, and every step of difficulty takes 16 times as long.
+// Returns the adjustment of every block.
+func replay(baseInterval float64, numBlocks int) []int {
+	timestamps := []int64{0} // genesis
+	adjustments := []int{0}
+	now := int64(1000000)
+
+	for height := 1; height <= numBlocks; height++ {
+		adjustment := pow.NextAdjustment(height, adjustments[height-1], timestamps, TARGET)
+		now += int64(baseInterval * math.Pow(16, float64(adjustment)))
+		timestamps = append(timestamps, now)
+		adjustments = append(adjustments, adjustment)
+	}
+
+	return adjustments
+}
+
+// Returns true if the adjustment never changes after block from
+func settled(adjustments []int, from int) bool {
+	for _, adjustment := range adjustments[from:] {
+		if adjustment != adjustments[from] {
+			return false
+		}
+	}
+	return true
+}
+
+func main() {
+	// 1. Blocks on target: the difficulty never moves
+	adjustments := replay(TARGET, 100)
+	harness.Check("on target", settled(adjustments, 0) && adjustments[100] == 0, fmt.Sprint(adjustments[100]))
+
+	// 2. Miners joined: blocks 50x too fast. One step up brings blocks to
+	// 0.32x target, which is in range, so it must stop there.
+	adjustments = replay(TARGET/50.0, 200)
+	harness.Check("too fast settles at +1", adjustments[200] == 1 && settled(adjustments, 100), fmt.Sprint(adjustments[200]))
+	harness.Check("adjusts only on the window", adjustments[pow.RETARGET_WINDOW*2-1] == 0, "")
+
+	// 3. Miners left: blocks 100x too slow. Goes -1 (6.25x) then -2 (0.39x).
+	adjustments = replay(TARGET*100.0, 200)
+	harness.Check("too slow settles at -2", adjustments[200] == -2 && settled(adjustments, 100), fmt.Sprint(adjustments[200]))
+
+	// 4. Absurd hash power is clamped
+	adjustments = replay(0.000001, 300)
+	harness.Check("clamped", adjustments[300] == pow.MAX_DIFFICULTY_ADJUSTMENT, fmt.Sprint(adjustments[300]))
+
+	// 5. Legacy blocks (no timestamps) in the window keep the adjustment
+	timestamps := make([]int64, 2*pow.RETARGET_WINDOW+1)
+	for i := pow.RETARGET_WINDOW + 1; i < len(timestamps); i++ {
+		timestamps[i] = int64(i)
+	}
+	timestamps[pow.RETARGET_WINDOW+3] = 0
+	adjustment := pow.NextAdjustment(2*pow.RETARGET_WINDOW, 2, timestamps, TARGET)
+	harness.Check("legacy window", adjustment == 2, fmt.Sprint(adjustment))
+
+	// 6. Retargeting disabled
+	adjustment = pow.NextAdjustment(pow.RETARGET_WINDOW, 3, []int64{1, 2, 3}, 0)
+	harness.Check("disabled", adjustment == 0, fmt.Sprint(adjustment))
+
+	// 7. Median time past ignores legacy blocks and only looks at recent blocks
+	median := pow.MedianTime([]int64{0, 100, 0, 5, 7, 6, 9, 8, 10, 11, 12, 13, 14, 15, 16})
+	harness.Check("median time", median == 11, fmt.Sprint(median))
+	harness.Check("median time, no timestamps", pow.MedianTime([]int64{0, 0}) == 0, "")
+
+	harness.Done()
+}
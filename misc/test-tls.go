@@ -0,0 +1,198 @@
+/*
+
+Runs every RPC link over TLS on localhost, with certificates made from the
+keys of the nodes: art node to a fake miner, miner to a fake server, and
+miner to miner. Checks that pinned keys are the ones the other end must have,
+that a peer can't hide behind the certificate of another key, and that
+plaintext dialers don't get through to TLS listeners.
+
+Usage:
+go run misc/test-tls.go
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+
+	"../blockartlib"
+	"../libminer"
+	"../miner"
+	"../protocol"
+	"../utils"
+	"./harness"
+)
+
+// Stands in for the miner's LibMinerInterface
+type LibMinerInterface struct{}
+
+func (lmi *LibMinerInterface) OpenCanvas(req *libminer.Request, resp *libminer.RegisterResponse) error {
+	resp.ProtocolVersion = protocol.PROTOCOL_VERSION
+	return nil
+}
+
+// Serves rcvr over TLS with a certificate for key
+func serveTLS(name string, rcvr interface{}, key *ecdsa.PrivateKey) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	config, err := protocol.ServerTLSConfig(key, false)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server := rpc.NewServer()
+	server.RegisterName(name, rcvr)
+	go server.Accept(tls.NewListener(ln, config))
+	return ln.Addr()
+}
+
+func openCanvas(addr net.Addr, key *ecdsa.PrivateKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	canvas, _, err := blockartlib.OpenCanvasCtx(ctx, addr.String(), *key)
+	if err == nil {
+		canvas.(blockartlib.CanvasT).Miner.Close()
+	}
+	return err
+}
+
+// Says hello to the miner at addr as key over TLS with a certificate for
+// certKey, then connects from the address of key
+func helloOverTLS(addr net.Addr, certKey, key *ecdsa.PrivateKey, keyAddr net.Addr) error {
+	config, _ := protocol.ClientTLSConfig(certKey, nil)
+	conn, err := tls.Dial("tcp", addr.String(), config)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClientWithCodec(miner.NewPeerConn(conn).ClientCodec())
+	defer client.Close()
+
+	ours := make([]byte, miner.CHALLENGE_SIZE)
+	rand.Read(ours)
+	var reply miner.HelloReply
+	err = client.Call("Peer.Hello", miner.HelloArgs{Key: utils.GetPublicKeyString(key.PublicKey), Challenge: ours}, &reply)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(miner.HANDSHAKE_DIAL))
+	h.Write(reply.Challenge)
+	h.Write(ours)
+	sig, _ := key.Sign(rand.Reader, h.Sum(nil), nil)
+	var tip miner.ChainTip
+	return client.Call("Peer.Connect", miner.ConnectArgs{Addr: keyAddr, Sig: sig}, &tip)
+}
+
+func main() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+
+	alice := harness.NewKey()
+	bob := harness.NewKey()
+	mallory := harness.NewKey()
+	serverKey := harness.NewKey()
+	artNode := harness.NewKey()
+
+	// 1. Certificates are for the key of the node
+	cert, err := protocol.NewCertificate(alice)
+	harness.Check("certificate", err == nil, fmt.Sprint(err))
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	harness.Check("certificate key", err == nil && protocol.SameKey(leaf.PublicKey.(*ecdsa.PublicKey), &alice.PublicKey), fmt.Sprint(err))
+
+	// 2. Art node to miner
+	minerAddr := serveTLS("LibMinerInterface", &LibMinerInterface{}, alice)
+	blockartlib.UseTLS = true
+	blockartlib.MinerKey = utils.GetPublicKeyString(alice.PublicKey)
+	err = openCanvas(minerAddr, artNode)
+	harness.Check("canvas pinned to the miner", err == nil, fmt.Sprint(err))
+
+	blockartlib.MinerKey = utils.GetPublicKeyString(mallory.PublicKey)
+	err = openCanvas(minerAddr, artNode)
+	_, isDisconnected := err.(blockartlib.DisconnectedError)
+	harness.Check("canvas pinned to another key", isDisconnected && strings.Contains(err.Error(), "pinned"), fmt.Sprint(err))
+
+	blockartlib.MinerKey = "not a key"
+	err = openCanvas(minerAddr, artNode)
+	harness.Check("canvas pinned to garbage", err != nil, fmt.Sprint(err))
+
+	blockartlib.MinerKey = ""
+	err = openCanvas(minerAddr, artNode)
+	harness.Check("canvas pinned to no key", err == nil, fmt.Sprint(err))
+
+	blockartlib.UseTLS = false
+	err = openCanvas(minerAddr, artNode)
+	harness.Check("plaintext canvas", err != nil, fmt.Sprint(err))
+
+	// 3. Miner to server
+	rserver := harness.NewRServer()
+	serverAddr := serveTLS("RServer", rserver, serverKey)
+	miner.UseTLS = true
+	miner.ServerKey = utils.GetPublicKeyString(serverKey.PublicKey)
+	harness.NewMiner(alice, protocol.MinerNetSettings{})
+	miner.MinerInstance.ConnectToServer(serverAddr.String())
+	_, err = miner.MinerInstance.MSI.GetMinerKey(serverAddr)
+	harness.Check("server over TLS", err != nil && strings.Contains(err.Error(), "unknown address"), fmt.Sprint(err))
+
+	// 4. Miner to miner
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go miner.ListenPeerRpc(miner.SecureListener(ln, true), miner.MinerInstance, nil, nil, nil, nil)
+	aliceAddr := ln.Addr()
+	miner.MinerInstance.Addr = aliceAddr
+	rserver.Keys[aliceAddr.String()] = alice
+
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{aliceAddr})
+	peer, ok := miner.Peers.Get(aliceAddr.String())
+	harness.Check("peer", ok && peer.Key == utils.GetPublicKeyString(alice.PublicKey), "")
+
+	// The miner only dials peers with the key registered at their address
+	impostorLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	go miner.ListenPeerRpc(miner.SecureListener(impostorLn, true), miner.MinerInstance, nil, nil, nil, nil)
+	rserver.Keys[impostorLn.Addr().String()] = bob
+	miner.MinerInstance.MSI.GetPeers([]net.Addr{impostorLn.Addr()})
+	_, ok = miner.Peers.Get(impostorLn.Addr().String())
+	harness.Check("impostor peer", !ok, "")
+
+	bobAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1")
+	malloryAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:2")
+	rserver.Keys[bobAddr.String()] = bob
+	rserver.Keys[malloryAddr.String()] = mallory
+
+	err = helloOverTLS(aliceAddr, bob, bob, bobAddr)
+	harness.Check("peer with its certificate", err == nil, fmt.Sprint(err))
+	peer, ok = miner.Peers.Get(bobAddr.String())
+	harness.Check("inbound peer", ok && peer.Inbound, "")
+
+	err = helloOverTLS(aliceAddr, bob, mallory, malloryAddr)
+	harness.Check("peer with another's certificate", err != nil && strings.Contains(err.Error(), miner.REJECT_TLS_MISMATCH), fmt.Sprint(err))
+
+	err = helloOverTLS(aliceAddr, nil, bob, bobAddr)
+	harness.Check("peer without a certificate", err != nil, fmt.Sprint(err))
+
+	plain, err := rpc.Dial("tcp", aliceAddr.String())
+	if err == nil {
+		var reply miner.HelloReply
+		err = plain.Call("Peer.Hello", miner.HelloArgs{}, &reply)
+	}
+	harness.Check("plaintext peer", err != nil, fmt.Sprint(err))
+	harness.Check("no other peers", miner.Peers.Len() == 2, fmt.Sprint(miner.Peers.Len()))
+
+	harness.Done()
+}
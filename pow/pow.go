@@ -1,47 +1,170 @@
 package pow
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"encoding/json"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"runtime"
 	"strings"
-	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"../blockchain"
 )
 
+// Number of workers a job's nonce space is split across. Defaults to one
+// worker per CPU; set it before starting any jobs to change it.
+var NumWorkers = runtime.NumCPU()
+
+// Total number of hashes computed by all workers, for the hash rate
+var hashCount uint64
+
+var (
+	rateMutex    sync.Mutex
+	rateLastTime = time.Now()
+	rateLastHash uint64
+)
+
+// How often a worker publishes its hash count and checks for cancellation
+const CHECK_INTERVAL = 1 << 12
+
 // Return true if hex representation of hash has exactly N trailing zeroes
 func Verify(hash string, N int) bool {
 	l := len(hash)
 	return strings.Count(hash[l-N:], "0") == N && strings.Count(hash[l-N-1:], "0") == N
 }
 
-func Solve(block blockchain.Block, powDiff uint8, start uint32, solved chan blockchain.Block, done chan bool) {
-	h := md5.New()
+// Same as Verify, but works on the raw hash so that workers don't have to hex
+// encode every attempt.
+func verifyBytes(sum []byte, N int) bool {
+	zeroes := 0
+	for i := len(sum) - 1; i >= 0; i-- {
+		if sum[i]&0x0f != 0 {
+			break
+		}
+		zeroes++
+		if sum[i]>>4 != 0 {
+			break
+		}
+		zeroes++
+	}
+	return zeroes == N
+}
+
+// Returns the [start, end] nonce range of worker i when the nonce space is
+// split across numWorkers workers. The last worker picks up the remainder.
+func NonceRange(i int, numWorkers int) (start uint32, end uint32) {
+	span := uint64(math.MaxUint32+1) / uint64(numWorkers)
+	start = uint32(span * uint64(i))
+	if i == numWorkers-1 {
+		return start, math.MaxUint32
+	}
+	return start, uint32(span*uint64(i+1) - 1)
+}
+
+// Searches the nonces in [start, end] for one that solves the block. The
+// block's canonical encoding minus the nonce is computed once, and each
+// attempt only rewrites the nonce at the end of it.
+//
+// When the range is exhausted the block's ExtraNonce is incremented and the
+// range is searched again, so a worker never runs out of work. Every worker
+// of a job owns a disjoint nonce range, so (ExtraNonce, Nonce) pairs are
+// never searched twice. With a single worker the search is deterministic:
+// the same block (including its starting ExtraNonce) always yields the same
+// solution.
+//
+// Legacy MD5 blocks are hashed over json and have to be fully re-hashed on
+// every attempt. They cannot carry an ExtraNonce (see CanRollExtraNonce), so
+// their search ends when the range is exhausted.
+func Solve(block blockchain.Block, powDiff uint8, start uint32, end uint32, solved chan blockchain.Block, done chan bool) {
 	N := int(powDiff)
-	//fmt.Println("starting operation with start point: ", start)
+
+	h, err := block.HashAlgorithm.New()
+	if err != nil {
+		fmt.Println("Solve:: cannot hash block:", err)
+		return
+	}
+	sum := make([]byte, 0, h.Size())
+
+	var counted uint64
 	for {
-		select {
-		case <-done:
-			//fmt.Println("job done, stopping")
-			return
-		default:
-			block.Nonce = rand.Uint32()
-			bytes, _ := json.Marshal(block)
-			h.Write(bytes)
-			hash := hex.EncodeToString(h.Sum(nil))
-			if Verify(hash, N) {
+		prefix := blockchain.EncodeBlockPrefix(block)
+		buf := make([]byte, len(prefix)+4)
+		copy(buf, prefix)
+		noncePos := len(prefix)
+
+		for nonce := uint64(start); nonce <= uint64(end); nonce++ {
+			if nonce%CHECK_INTERVAL == 0 {
+				atomic.AddUint64(&hashCount, counted)
+				counted = 0
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+			counted++
+
+			block.Nonce = uint32(nonce)
+			var found bool
+			if block.HashAlgorithm == blockchain.MD5 {
+				hash, _ := blockchain.HashBlock(block)
+				found = Verify(hash, N)
+			} else {
+				binary.BigEndian.PutUint32(buf[noncePos:], block.Nonce)
+				h.Reset()
+				h.Write(buf)
+				sum = h.Sum(sum[:0])
+				found = verifyBytes(sum, N)
+			}
+
+			if found {
+				atomic.AddUint64(&hashCount, counted)
 				defer Recover()
 				solved <- block
 				return
-			} else {
-				h.Reset()
 			}
 		}
+
+		if !CanRollExtraNonce(block) {
+			atomic.AddUint64(&hashCount, counted)
+			fmt.Println("Solve:: exhausted nonce range", start, "-", end)
+			return
+		}
+
+		// Our share of the 32 bit nonce space is used up; roll the extra nonce
+		block.ExtraNonce++
 	}
 }
 
+// Returns true if the block may carry a non-zero ExtraNonce. Legacy MD5
+// blocks are hashed over json by nodes that predate the field; they would
+// drop it and compute a different hash.
+func CanRollExtraNonce(block blockchain.Block) bool {
+	return block.HashAlgorithm != blockchain.MD5
+}
+
+// Returns the number of hashes per second computed by all workers since the
+// last call to HashRate.
+func HashRate() float64 {
+	rateMutex.Lock()
+	defer rateMutex.Unlock()
+
+	now := time.Now()
+	count := atomic.LoadUint64(&hashCount)
+	elapsed := now.Sub(rateLastTime).Seconds()
+
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(count-rateLastHash) / elapsed
+	}
+
+	rateLastTime = now
+	rateLastHash = count
+	return rate
+}
+
 func Recover() {
 	// recover from panic caused by writing to a closed channel
 	if r := recover(); r != nil {
@@ -0,0 +1,81 @@
+package pow
+
+import (
+	"sort"
+)
+
+const (
+	// Number of blocks between difficulty adjustments, and the number of
+	// block intervals that are averaged to decide each adjustment
+	RETARGET_WINDOW = 10
+	// Furthest the difficulty may move away from the configured difficulty
+	MAX_DIFFICULTY_ADJUSTMENT = 4
+	// Number of blocks whose median timestamp a new block has to beat
+	MEDIAN_TIME_BLOCKS = 11
+)
+
+// Returns the difficulty adjustment for the block at height, relative to the
+// difficulty configured by the server.
+//
+// The adjustment only changes every RETARGET_WINDOW blocks; in between, a
+// block inherits its parent's adjustment. At a retarget the average interval
+// over the last RETARGET_WINDOW blocks is compared to targetMillis. Each step
+// of difficulty is one more hex zero, i.e. 16 times the work, so the
+// difficulty only goes up when blocks come in more than 4 times too fast and
+// only goes down when they come in more than 4 times too slow. That way one
+// step can't overshoot into the opposite adjustment.
+//
+// timestamps are the timestamps (in ms) of the blocks up to and including the
+// parent, oldest first. A zero timestamp (a legacy block) inside the window
+// means there is nothing to measure and the adjustment is kept.
+func NextAdjustment(height int, parentAdjustment int, timestamps []int64, targetMillis int64) int {
+	if targetMillis <= 0 {
+		return 0
+	}
+
+	if height%RETARGET_WINDOW != 0 || len(timestamps) < RETARGET_WINDOW+1 {
+		return parentAdjustment
+	}
+
+	window := timestamps[len(timestamps)-RETARGET_WINDOW-1:]
+	for _, timestamp := range window {
+		if timestamp == 0 {
+			return parentAdjustment
+		}
+	}
+
+	average := (window[RETARGET_WINDOW] - window[0]) / RETARGET_WINDOW
+
+	adjustment := parentAdjustment
+	if average < targetMillis/4 {
+		adjustment++
+	} else if average > targetMillis*4 {
+		adjustment--
+	}
+
+	if adjustment > MAX_DIFFICULTY_ADJUSTMENT {
+		return MAX_DIFFICULTY_ADJUSTMENT
+	}
+	if adjustment < -MAX_DIFFICULTY_ADJUSTMENT {
+		return -MAX_DIFFICULTY_ADJUSTMENT
+	}
+	return adjustment
+}
+
+// Returns the median of the last MEDIAN_TIME_BLOCKS timestamps, ignoring
+// legacy blocks without one. A new block's timestamp must be after it.
+func MedianTime(timestamps []int64) int64 {
+	recent := make([]int64, 0, MEDIAN_TIME_BLOCKS)
+	for i := len(timestamps) - 1; i >= 0 && len(recent) < MEDIAN_TIME_BLOCKS; i-- {
+		if timestamps[i] != 0 {
+			recent = append(recent, timestamps[i])
+		}
+	}
+
+	if len(recent) == 0 {
+		return 0
+	}
+
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	return recent[len(recent)/2]
+}
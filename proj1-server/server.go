@@ -12,6 +12,10 @@ Usage:
 $ go run server.go
   -c string
     	Path to the JSON config
+  -key string
+    	Hex of the x509 EC private key to serve TLS with (generated if empty)
+  -tls
+    	Serve miners over TLS
 
 */
 
@@ -20,7 +24,11 @@ package main
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -34,6 +42,8 @@ import (
 	"sort"
 	"sync"
 	"time"
+
+	"../protocol"
 )
 
 // Errors that the server could return.
@@ -51,68 +61,24 @@ func (e AddressAlreadyRegisteredError) Error() string {
 	return fmt.Sprintf("BlockArt server: address already registered [%s]", string(e))
 }
 
-// Settings for a canvas in BlockArt.
-type CanvasSettings struct {
-	// Canvas dimensions
-	CanvasXMax uint32 `json:"canvas-x-max"`
-	CanvasYMax uint32 `json:"canvas-y-max"`
-}
-
-type MinerSettings struct {
-	// Hash of the very first (empty) block in the chain.
-	GenesisBlockHash string `json:"genesis-block-hash"`
-
-	// The minimum number of ink miners that an ink miner should be
-	// connected to.
-	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
-
-	// Mining ink reward per op and no-op blocks (>= 1)
-	InkPerOpBlock   uint32 `json:"ink-per-op-block"`
-	InkPerNoOpBlock uint32 `json:"ink-per-no-op-block"`
-
-	// Number of milliseconds between heartbeat messages to the server.
-	HeartBeat uint32 `json:"heartbeat"`
-
-	// Proof of work difficulty: number of zeroes in prefix (>=0)
-	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
-	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
-}
-
-// Settings for an instance of the BlockArt project/network.
-type MinerNetSettings struct {
-	// Hash of the very first (empty) block in the chain.
-	GenesisBlockHash string `json:"genesis-block-hash"`
-
-	// The minimum number of ink miners that an ink miner should be
-	// connected to.
-	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
-
-	// Mining ink reward per op and no-op blocks (>= 1)
-	InkPerOpBlock   uint32 `json:"ink-per-op-block"`
-	InkPerNoOpBlock uint32 `json:"ink-per-no-op-block"`
-
-	// Number of milliseconds between heartbeat messages to the server.
-	HeartBeat uint32 `json:"heartbeat"`
+type UnknownAddressError string
 
-	// Proof of work difficulty: number of zeroes in prefix (>=0)
-	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
-	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
-
-	// Canvas settings
-	CanvasSettings CanvasSettings `json:"canvas-settings"`
+func (e UnknownAddressError) Error() string {
+	return fmt.Sprintf("BlockArt server: unknown address [%s]", string(e))
 }
 
 type RServer int
 
 type Miner struct {
 	Address         net.Addr
+	Key             ecdsa.PublicKey
 	RecentHeartbeat int64
 }
 
 type Config struct {
-	MinerSettings    MinerNetSettings `json:"miner-settings"`
-	RpcIpPort        string           `json:"rpc-ip-port"`
-	NumMinerToReturn uint8            `json:"num-miner-to-return"`
+	MinerSettings    protocol.MinerNetSettings `json:"miner-settings"`
+	RpcIpPort        string                    `json:"rpc-ip-port"`
+	NumMinerToReturn uint8                     `json:"num-miner-to-return"`
 }
 
 type AllMiners struct {
@@ -146,6 +112,8 @@ func main() {
 	gob.Register(&elliptic.CurveParams{})
 
 	path := flag.String("c", "", "Path to the JSON config")
+	useTLS := flag.Bool("tls", false, "Serve miners over TLS")
+	keyHex := flag.String("key", "", "Hex of the x509 EC private key to serve TLS with (generated if empty)")
 	flag.Parse()
 
 	if *path == "" {
@@ -165,6 +133,9 @@ func main() {
 	l, e := net.Listen("tcp", config.RpcIpPort)
 
 	handleErrorFatal("listen error", e)
+	if *useTLS {
+		l = listenTLS(l, *keyHex)
+	}
 	outLog.Printf("Server started. Receiving on %s\n", config.RpcIpPort)
 
 	for {
@@ -173,9 +144,29 @@ func main() {
 	}
 }
 
-type MinerInfo struct {
-	Address net.Addr
-	Key     ecdsa.PublicKey
+// Serves l over TLS with a certificate for the key in keyHex, or a new key if
+// it is empty. Miners pin the public key logged.
+func listenTLS(l net.Listener, keyHex string) net.Listener {
+	var key *ecdsa.PrivateKey
+	if keyHex == "" {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P384(), crand.Reader)
+		handleErrorFatal("generate key", err)
+	} else {
+		keyBytes, err := hex.DecodeString(keyHex)
+		handleErrorFatal("decode key", err)
+		key, err = x509.ParseECPrivateKey(keyBytes)
+		handleErrorFatal("parse key", err)
+	}
+
+	tlsConfig, err := protocol.ServerTLSConfig(key, false)
+	handleErrorFatal("TLS config", err)
+
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	handleErrorFatal("marshal public key", err)
+	outLog.Printf("Serving TLS. Public key: %s\n", hex.EncodeToString(pubKeyBytes))
+
+	return tls.NewListener(l, tlsConfig)
 }
 
 // Function to delete dead miners (no recent heartbeat)
@@ -206,7 +197,12 @@ func pubKeyToString(key ecdsa.PublicKey) string {
 // Returns:
 // - AddressAlreadyRegisteredError if the server has already registered this address.
 // - KeyAlreadyRegisteredError if the server already has a registration record for publicKey.
-func (s *RServer) Register(m MinerInfo, r *MinerNetSettings) error {
+// - ProtocolVersionError if the miner speaks another protocol version.
+func (s *RServer) Register(m protocol.MinerInfo, r *protocol.MinerNetSettings) error {
+	if err := protocol.CheckVersion(m.ProtocolVersion); err != nil {
+		return protocol.WrapError(err)
+	}
+
 	allMiners.Lock()
 	defer allMiners.Unlock()
 
@@ -223,12 +219,14 @@ func (s *RServer) Register(m MinerInfo, r *MinerNetSettings) error {
 
 	allMiners.all[k] = &Miner{
 		m.Address,
+		m.Key,
 		time.Now().UnixNano(),
 	}
 
 	go monitor(k, time.Duration(config.MinerSettings.HeartBeat)*time.Millisecond)
 
 	*r = config.MinerSettings
+	r.ProtocolVersion = protocol.PROTOCOL_VERSION
 
 	outLog.Printf("Got Register from %s\n", m.Address.String())
 
@@ -308,6 +306,25 @@ func (s *RServer) HeartBeat(key ecdsa.PublicKey, _ignored *bool) error {
 	return nil
 }
 
+// Returns the public key of the miner registered at an address. Miners use it
+// to check that a peer owns the key it claims.
+//
+// Returns:
+// - UnknownAddressError if the server does not know a miner at this address.
+func (s *RServer) GetMinerKey(addr string, key *ecdsa.PublicKey) error {
+	allMiners.RLock()
+	defer allMiners.RUnlock()
+
+	for _, miner := range allMiners.all {
+		if miner.Address.String() == addr {
+			*key = miner.Key
+			return nil
+		}
+	}
+
+	return UnknownAddressError(addr)
+}
+
 func handleErrorFatal(msg string, e error) {
 	if e != nil {
 		errLog.Fatalf("%s, err = %s\n", msg, e.Error())
@@ -28,63 +28,9 @@ import (
 	"net/rpc"
 	"os"
 	"time"
-)
-
-type MinerInfo struct {
-	Address net.Addr
-	Key     ecdsa.PublicKey
-}
-
-// Settings for a canvas in BlockArt.
-type CanvasSettings struct {
-	// Canvas dimensions
-	CanvasXMax uint32 `json:"canvas-x-max"`
-	CanvasYMax uint32 `json:"canvas-y-max"`
-}
-
-type MinerSettings struct {
-	// Hash of the very first (empty) block in the chain.
-	GenesisBlockHash string `json:"genesis-block-hash"`
-
-	// The minimum number of ink miners that an ink miner should be
-	// connected to.
-	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
-
-	// Mining ink reward per op and no-op blocks (>= 1)
-	InkPerOpBlock   uint32 `json:"ink-per-op-block"`
-	InkPerNoOpBlock uint32 `json:"ink-per-no-op-block"`
-
-	// Number of milliseconds between heartbeat messages to the server.
-	HeartBeat uint32 `json:"heartbeat"`
-
-	// Proof of work difficulty: number of zeroes in prefix (>=0)
-	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
-	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
-}
-
-// Settings for an instance of the BlockArt project/network.
-type MinerNetSettings struct {
-	// Hash of the very first (empty) block in the chain.
-	GenesisBlockHash string `json:"genesis-block-hash"`
-
-	// The minimum number of ink miners that an ink miner should be
-	// connected to.
-	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
 
-	// Mining ink reward per op and no-op blocks (>= 1)
-	InkPerOpBlock   uint32 `json:"ink-per-op-block"`
-	InkPerNoOpBlock uint32 `json:"ink-per-no-op-block"`
-
-	// Number of milliseconds between heartbeat messages to the server.
-	HeartBeat uint32 `json:"heartbeat"`
-
-	// Proof of work difficulty: number of zeroes in prefix (>=0)
-	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
-	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
-
-	// Canvas settings
-	CanvasSettings CanvasSettings `json:"canvas-settings"`
-}
+	"../protocol"
+)
 
 func exitOnError(prefix string, err error) {
 	if err != nil {
@@ -129,18 +75,18 @@ func main() {
 	exitOnError("rpc dial", err)
 	defer c.Close()
 
-	var settings MinerNetSettings
+	var settings protocol.MinerNetSettings
 	var _ignored bool
 
 	// normal registration
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	err = c.Call("RServer.Register", protocol.MinerInfo{Address: addr1, Key: priv1.PublicKey, ProtocolVersion: protocol.PROTOCOL_VERSION}, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
-	err = c.Call("RServer.Register", MinerInfo{Address: addr2, Key: priv2.PublicKey}, &settings)
+	err = c.Call("RServer.Register", protocol.MinerInfo{Address: addr2, Key: priv2.PublicKey, ProtocolVersion: protocol.PROTOCOL_VERSION}, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr2.String()), err)
 	time.Sleep(twoHeartBeatIntervals)
 
 	// late heartbeat
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	err = c.Call("RServer.Register", protocol.MinerInfo{Address: addr1, Key: priv1.PublicKey, ProtocolVersion: protocol.PROTOCOL_VERSION}, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
 	time.Sleep(twoHeartBeatIntervals)
 	err = c.Call("RServer.HeartBeat", priv1.PublicKey, &_ignored)
@@ -149,19 +95,38 @@ func main() {
 	}
 
 	// register twice with same address
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	err = c.Call("RServer.Register", protocol.MinerInfo{Address: addr1, Key: priv1.PublicKey, ProtocolVersion: protocol.PROTOCOL_VERSION}, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv2.PublicKey}, &settings)
+	err = c.Call("RServer.Register", protocol.MinerInfo{Address: addr1, Key: priv2.PublicKey, ProtocolVersion: protocol.PROTOCOL_VERSION}, &settings)
 	if err == nil {
 		exitOnError("registering twice with the same address", ExpectedError)
 	}
 	time.Sleep(twoHeartBeatIntervals)
 
 	// register twice with same key
-	err = c.Call("RServer.Register", MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	err = c.Call("RServer.Register", protocol.MinerInfo{Address: addr1, Key: priv1.PublicKey, ProtocolVersion: protocol.PROTOCOL_VERSION}, &settings)
 	exitOnError(fmt.Sprintf("client registration for %s", addr1.String()), err)
-	err = c.Call("RServer.Register", MinerInfo{Address: addr2, Key: priv1.PublicKey}, &settings)
+	err = c.Call("RServer.Register", protocol.MinerInfo{Address: addr2, Key: priv1.PublicKey, ProtocolVersion: protocol.PROTOCOL_VERSION}, &settings)
 	if err == nil {
 		exitOnError("registering twice with the same key", ExpectedError)
 	}
+
+	// look up the key of a miner by its address
+	var key ecdsa.PublicKey
+	err = c.Call("RServer.GetMinerKey", addr1.String(), &key)
+	exitOnError(fmt.Sprintf("key lookup for %s", addr1.String()), err)
+	if key.X.Cmp(priv1.PublicKey.X) != 0 || key.Y.Cmp(priv1.PublicKey.Y) != 0 {
+		exitOnError("key lookup", errors.New("Wrong key returned"))
+	}
+	err = c.Call("RServer.GetMinerKey", addr2.String(), &key)
+	if err == nil {
+		exitOnError("key lookup for an unknown address", ExpectedError)
+	}
+	time.Sleep(twoHeartBeatIntervals)
+
+	// register with another protocol version
+	err = c.Call("RServer.Register", protocol.MinerInfo{Address: addr1, Key: priv1.PublicKey}, &settings)
+	if err == nil {
+		exitOnError("registering with another protocol version", ExpectedError)
+	}
 }
@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"strings"
+)
+
+// Errors cross net/rpc as strings, so the miner returns them wrapped in an
+// ErrorEnvelope, whose Error() is the envelope's gob encoding in base64 after
+// ERROR_ENVELOPE_PREFIX. Every error type of this package is registered with
+// gob, so the payload comes out as the type and value it went in as.
+
+const ERROR_ENVELOPE_PREFIX = "blockart-error:"
+
+// Codes of the error types
+const (
+	ERR_SVG_TOO_LONG       = 1
+	ERR_INVALID_SVG        = 2
+	ERR_INSUFFICIENT_INK   = 3
+	ERR_SHAPE_OVERLAP      = 4
+	ERR_OUT_OF_BOUNDS      = 5
+	ERR_INVALID_BLOCK_HASH = 6
+	ERR_SHAPE_OWNER        = 7
+	ERR_INVALID_SHAPE_HASH = 8
+	ERR_MINER              = 9 // Any error not of this package
+	ERR_OP_EVICTED         = 10
+	ERR_OP_EXPIRED         = 11
+	ERR_TIMEOUT            = 12
+	ERR_MEMPOOL_FULL       = 13
+	ERR_INVALID_TRANSFER   = 14
+	ERR_PROTOCOL_VERSION   = 15
+)
+
+type ErrorEnvelope struct {
+	Code    int
+	Payload error  // The error if it is of this package, nil for ERR_MINER
+	Message string // Error() of the error on the miner
+}
+
+func init() {
+	gob.Register(ShapeSvgStringTooLongError(""))
+	gob.Register(InvalidShapeSvgStringError(""))
+	gob.Register(InsufficientInkError(0))
+	gob.Register(ShapeOverlapError(""))
+	gob.Register(OutOfBoundsError{})
+	gob.Register(InvalidBlockHashError(""))
+	gob.Register(ShapeOwnerError(""))
+	gob.Register(InvalidShapeHashError(""))
+	gob.Register(OpEvictedError(""))
+	gob.Register(OpExpiredError(""))
+	gob.Register(TimeoutError(""))
+	gob.Register(MempoolFullError(""))
+	gob.Register(InvalidTransferError(""))
+	gob.Register(ProtocolVersionError{})
+}
+
+// Returns the envelope of err. An envelope is returned as is.
+func WrapError(err error) ErrorEnvelope {
+	if envelope, ok := err.(ErrorEnvelope); ok {
+		return envelope
+	}
+
+	envelope := ErrorEnvelope{Code: ErrorCode(err), Payload: err, Message: err.Error()}
+	if envelope.Code == ERR_MINER {
+		envelope.Payload = nil
+	}
+	return envelope
+}
+
+// Returns the code of err's type, ERR_MINER if it isn't of this package
+func ErrorCode(err error) int {
+	switch err.(type) {
+	case ShapeSvgStringTooLongError:
+		return ERR_SVG_TOO_LONG
+	case InvalidShapeSvgStringError:
+		return ERR_INVALID_SVG
+	case InsufficientInkError:
+		return ERR_INSUFFICIENT_INK
+	case ShapeOverlapError:
+		return ERR_SHAPE_OVERLAP
+	case OutOfBoundsError:
+		return ERR_OUT_OF_BOUNDS
+	case InvalidBlockHashError:
+		return ERR_INVALID_BLOCK_HASH
+	case ShapeOwnerError:
+		return ERR_SHAPE_OWNER
+	case InvalidShapeHashError:
+		return ERR_INVALID_SHAPE_HASH
+	case OpEvictedError:
+		return ERR_OP_EVICTED
+	case OpExpiredError:
+		return ERR_OP_EXPIRED
+	case TimeoutError:
+		return ERR_TIMEOUT
+	case MempoolFullError:
+		return ERR_MEMPOOL_FULL
+	case InvalidTransferError:
+		return ERR_INVALID_TRANSFER
+	case ProtocolVersionError:
+		return ERR_PROTOCOL_VERSION
+	default:
+		return ERR_MINER
+	}
+}
+
+// Returns the wire form of the envelope
+func (e ErrorEnvelope) Error() string {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		// Only an unregistered payload gets here; keep its message
+		return ErrorEnvelope{Code: ERR_MINER, Message: e.Message}.Error()
+	}
+	return ERROR_ENVELOPE_PREFIX + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// Returns the error the envelope carries: the payload, or an error with the
+// message if there is none
+func (e ErrorEnvelope) Err() error {
+	if e.Payload != nil {
+		return e.Payload
+	}
+	return errors.New(e.Message)
+}
+
+// Decodes the envelope from the wire form of one. Returns false if msg isn't
+// one, like the errors net/rpc makes up itself.
+func UnwrapError(msg string) (envelope ErrorEnvelope, ok bool) {
+	if !strings.HasPrefix(msg, ERROR_ENVELOPE_PREFIX) {
+		return envelope, false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(msg[len(ERROR_ENVELOPE_PREFIX):])
+	if err != nil {
+		return envelope, false
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&envelope); err != nil {
+		return envelope, false
+	}
+	return envelope, true
+}
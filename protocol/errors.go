@@ -0,0 +1,108 @@
+package protocol
+
+import "fmt"
+
+// The BlockArt errors that cross the wire. Miners send them to art nodes in an
+// ErrorEnvelope; blockartlib hands them to the application as is.
+
+// Contains amount of ink remaining.
+type InsufficientInkError uint32
+
+func (e InsufficientInkError) Error() string {
+	return fmt.Sprintf("BlockArt: Not enough ink to addShape [%d]", uint32(e))
+}
+
+// Contains the offending svg string.
+type InvalidShapeSvgStringError string
+
+func (e InvalidShapeSvgStringError) Error() string {
+	return fmt.Sprintf("BlockArt: Bad shape svg string [%s]", string(e))
+}
+
+// Contains the offending svg string.
+type ShapeSvgStringTooLongError string
+
+func (e ShapeSvgStringTooLongError) Error() string {
+	return fmt.Sprintf("BlockArt: Shape svg string too long [%s]", string(e))
+}
+
+// Contains the bad shape hash string.
+type InvalidShapeHashError string
+
+func (e InvalidShapeHashError) Error() string {
+	return fmt.Sprintf("BlockArt: Invalid shape hash [%s]", string(e))
+}
+
+// Contains the bad shape hash string.
+type ShapeOwnerError string
+
+func (e ShapeOwnerError) Error() string {
+	return fmt.Sprintf("BlockArt: Shape owned by someone else [%s]", string(e))
+}
+
+// Empty
+type OutOfBoundsError struct{}
+
+func (e OutOfBoundsError) Error() string {
+	return fmt.Sprintf("BlockArt: Shape is outside the bounds of the canvas")
+}
+
+// Contains the hash of the shape that this shape overlaps with.
+type ShapeOverlapError string
+
+func (e ShapeOverlapError) Error() string {
+	return fmt.Sprintf("BlockArt: Shape overlaps with a previously added shape [%s]", string(e))
+}
+
+// Contains the invalid block hash.
+type InvalidBlockHashError string
+
+func (e InvalidBlockHashError) Error() string {
+	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
+}
+
+// Contains the shape hash of the operation that kept being reorged out.
+type OpEvictedError string
+
+func (e OpEvictedError) Error() string {
+	return fmt.Sprintf("BlockArt: Operation was reorged out of the chain [%s]", string(e))
+}
+
+// Contains the shape hash of the operation that no block took in.
+type OpExpiredError string
+
+func (e OpExpiredError) Error() string {
+	return fmt.Sprintf("BlockArt: Operation expired before being added to a block [%s]", string(e))
+}
+
+// Contains what was being waited on when the deadline passed.
+type TimeoutError string
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("BlockArt: Deadline passed while waiting for the operation [%s]", string(e))
+}
+
+// Contains the shape hash of the operation the miner had no room for.
+type MempoolFullError string
+
+func (e MempoolFullError) Error() string {
+	return fmt.Sprintf("BlockArt: Miner has no room for more pending operations [%s]", string(e))
+}
+
+// Contains the recipient of a transfer of no ink, or to a bad or the sender's
+// own public key.
+type InvalidTransferError string
+
+func (e InvalidTransferError) Error() string {
+	return fmt.Sprintf("BlockArt: Invalid ink transfer to [%s]", string(e))
+}
+
+// Contains the protocol version that was rejected and the one required.
+type ProtocolVersionError struct {
+	Theirs uint32
+	Ours   uint32
+}
+
+func (e ProtocolVersionError) Error() string {
+	return fmt.Sprintf("BlockArt: Protocol version %d is not supported, version %d is required", e.Theirs, e.Ours)
+}
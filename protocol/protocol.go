@@ -0,0 +1,95 @@
+/*
+
+This package holds the types every BlockArt component sends over the wire:
+the settings the server hands to miners and miners to art nodes, the miner
+registration, and the errors. The server, the miners and blockartlib all
+import it, so there is a single definition of each.
+
+The wire types are versioned by PROTOCOL_VERSION. Bump it whenever one of
+them, or a message of libminer, changes in a way an older peer can't read.
+Miners register with the server, and art nodes open canvases with miners,
+only if both sides speak the same version.
+
+*/
+
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"net"
+)
+
+// 1: first versioned protocol
+// 2: miners authenticate each other, with RServer.GetMinerKey
+// 3: miners sync headers first, with Peer.GetTip, GetHeaders and GetBlocks
+// 4: miners announce blocks and ops with Peer.Announce, without a TTL
+// 5: miners call each other both ways over one connection, in frames
+// 6: art nodes sign the digest of the whole op, see blockchain.OperationDigest
+// 7: art nodes give their id back with LibMinerInterface.CloseCanvas
+// 8: art nodes and miners digest requests with SHA-256, see utils.ComputeHash
+// 9: art nodes follow async ops by the hash of the op, see DrawResponse.OpHash
+const PROTOCOL_VERSION = 9
+
+// Returns a ProtocolVersionError unless theirs is the version we speak
+func CheckVersion(theirs uint32) error {
+	if theirs != PROTOCOL_VERSION {
+		return ProtocolVersionError{Theirs: theirs, Ours: PROTOCOL_VERSION}
+	}
+	return nil
+}
+
+// Settings for a canvas in BlockArt.
+type CanvasSettings struct {
+	// Canvas dimensions
+	CanvasXMax uint32 `json:"canvas-x-max"`
+	CanvasYMax uint32 `json:"canvas-y-max"`
+}
+
+// Settings for an instance of the BlockArt project/network. The json names
+// are those of the server's config file.
+type MinerNetSettings struct {
+	// Hash of the very first (empty) block in the chain.
+	GenesisBlockHash string `json:"genesis-block-hash"`
+
+	// The minimum number of ink miners that an ink miner should be
+	// connected to. If the ink miner dips below this number, then
+	// they have to retrieve more nodes from the server using
+	// GetNodes().
+	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
+
+	// Mining ink reward per op and no-op blocks (>= 1)
+	InkPerOpBlock   uint32 `json:"ink-per-op-block"`
+	InkPerNoOpBlock uint32 `json:"ink-per-no-op-block"`
+
+	// Number of milliseconds between heartbeat messages to the server.
+	HeartBeat uint32 `json:"heartbeat"`
+
+	// Proof of work difficulty: number of zeroes in prefix (>=0)
+	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
+	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
+
+	// Hash function new blocks are mined with ("sha256", "blake2b").
+	// Empty means the legacy MD5 hash.
+	HashAlgorithm string `json:"hash-algorithm"`
+
+	// Target number of milliseconds between blocks. The PoW difficulty
+	// is retargeted around the values above to keep to it. 0 disables
+	// retargeting.
+	BlockInterval uint32 `json:"block-interval"`
+
+	// Canvas settings
+	CanvasSettings CanvasSettings `json:"canvas-settings"`
+
+	// Protocol version of the server, set by Register. Servers from before
+	// versioning leave it 0.
+	ProtocolVersion uint32 `json:"-"`
+}
+
+// What a miner registers with the server
+type MinerInfo struct {
+	Address net.Addr
+	Key     ecdsa.PublicKey
+
+	// Protocol version of the miner. Miners from before versioning leave it 0.
+	ProtocolVersion uint32
+}
@@ -0,0 +1,103 @@
+/*
+
+This file contains functions related to OwnerArray.
+
+*/
+package shapelib
+
+/************************
+* OWNER_ARRAY_FUNCTIONS *
+************************/
+
+// Returns a new owner array with no pixels owned. The array covers the same
+// pixels as a PixelArray of the same size.
+func NewOwnerArray(xMax int, yMax int) OwnerArray {
+	width := maxByte(xMax+1) * 8
+	height := yMax + 1
+
+	return OwnerArray{
+		owners: make([]uint32, width*height),
+		counts: make([]uint16, width*height),
+		width:  width,
+		height: height}
+}
+
+// Checks if any pixel of the sub array is out of bounds or belongs to a
+// shape of an owner other than the one given.
+func (a OwnerArray) HasConflict(sub PixelSubArray, owner uint32) bool {
+	conflict := false
+	sub.forEachPixel(func(x, y int) bool {
+		i, ok := a.index(x, y)
+		if !ok || (a.counts[i] > 0 && a.owners[i] != owner) {
+			conflict = true
+			return false
+		}
+		return true
+	})
+
+	return conflict
+}
+
+// Marks all of the filled pixels of the sub array as owned by owner. Pixels
+// can be covered by several shapes of the same owner; each one is counted.
+// Callers should check HasConflict first.
+func (a *OwnerArray) Add(sub PixelSubArray, owner uint32) {
+	sub.forEachPixel(func(x, y int) bool {
+		if i, ok := a.index(x, y); ok {
+			a.owners[i] = owner
+			a.counts[i]++
+		}
+		return true
+	})
+}
+
+// Undoes an Add of the same sub array. A pixel is free again once the last
+// shape covering it is removed.
+func (a *OwnerArray) Remove(sub PixelSubArray) {
+	sub.forEachPixel(func(x, y int) bool {
+		if i, ok := a.index(x, y); ok && a.counts[i] > 0 {
+			a.counts[i]--
+			if a.counts[i] == 0 {
+				a.owners[i] = 0
+			}
+		}
+		return true
+	})
+}
+
+// Returns the owner of a pixel, or 0 if no shape covers it.
+func (a OwnerArray) Owner(x, y int) uint32 {
+	if i, ok := a.index(x, y); ok && a.counts[i] > 0 {
+		return a.owners[i]
+	}
+	return 0
+}
+
+func (a OwnerArray) index(x, y int) (int, bool) {
+	if x < 0 || y < 0 || x >= a.width || y >= a.height {
+		return 0, false
+	}
+	return y*a.width + x, true
+}
+
+// Calls fn with the co-ordinates of every filled pixel of the sub array
+// until fn returns false.
+func (a PixelSubArray) forEachPixel(fn func(x, y int) bool) {
+	for yRow, row := range a.bytes {
+		for xByte, b := range row {
+			if b == 0 {
+				continue
+			}
+
+			for xBit := uint(0); xBit < 8; xBit++ {
+				if b&(1<<xBit) == 0 {
+					continue
+				}
+
+				if !fn((a.xStartByte+xByte)*8+int(xBit), a.yStart+yRow) {
+					return
+				}
+			}
+		}
+	}
+}
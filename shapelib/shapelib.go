@@ -14,6 +14,8 @@ Public functions:
 
 	NewPixelSubArray(xStart, xEnd, yStart, yEnd int) -> PixelSubArray
 
+	NewOwnerArray(xMax int, yMax int) -> OwnerArray
+
 
 Public types and methods:
 
@@ -26,6 +28,12 @@ Public types and methods:
 	  Print()
 	  PixelsFilled() -> int
 
+	OwnerArray
+	  HasConflict(sub PixelSubArray, owner uint32) -> bool
+	  Add(sub PixelSubArray, owner uint32)
+	  Remove(sub PixelSubArray)
+	  Owner(x, y int) -> uint32
+
 	Point
 
 	Shape
@@ -65,6 +73,16 @@ type PixelSubArray struct {
 	yStart     int
 }
 
+// Array of the owners of pixels, for validating conflicts between shapes of
+// different owners while shapes come and go. Each pixel holds the id of its
+// owner (0 for none) and the number of that owner's shapes covering it.
+type OwnerArray struct {
+	owners []uint32
+	counts []uint16
+	width  int
+	height int
+}
+
 // Interface for a shape that can return its subarray of pixel filled.
 type Shape interface {
 
@@ -17,8 +17,8 @@ echo "Testing libminer/"
 go test ./libminer/*.go
 echo "Testing miner/"
 go test ./miner/*.go
-echo "Testing minerserver/"
-go test ./minerserver/*.go
+echo "Testing protocol/"
+go test ./protocol/*.go
 echo "Testing shapelib/"
 go test ./shapelib/*.go
 echo "Testing utils/"
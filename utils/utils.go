@@ -2,7 +2,7 @@ package utils
 
 import (
 	"crypto/ecdsa"
-	"crypto/md5"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
@@ -12,7 +12,7 @@ import (
 	"strings"
 
 	"../blockchain"
-	"../libminer"
+	"../protocol"
 	"../shapelib"
 )
 
@@ -102,7 +102,7 @@ func GetHTMLSVGString(op blockchain.Operation) string {
 // - ShapeSvgStringTooLongError
 func GetParsedSVG(svgString string) (svgPath SVGPath, err error) {
 	if len(svgString) > MAX_SVG_LEN {
-		return svgPath, libminer.ShapeSvgStringTooLongError(svgString)
+		return svgPath, protocol.ShapeSvgStringTooLongError(svgString)
 	}
 
 	tokens := strings.Split(svgString, " ")
@@ -118,7 +118,7 @@ func GetParsedSVG(svgString string) (svgPath SVGPath, err error) {
 
 		// Must start with M command
 		if i == 0 && tokenUpper != "M" {
-			return svgPath, libminer.InvalidShapeSvgStringError(svgString)
+			return svgPath, protocol.InvalidShapeSvgStringError(svgString)
 		}
 
 		var param1, param2 int
@@ -126,11 +126,11 @@ func GetParsedSVG(svgString string) (svgPath SVGPath, err error) {
 			if i+2 < tokenLen {
 				param1, err = strconv.Atoi(tokens[i+1])
 				if err != nil {
-					return svgPath, libminer.InvalidShapeSvgStringError(svgString)
+					return svgPath, protocol.InvalidShapeSvgStringError(svgString)
 				}
 				param2, err = strconv.Atoi(tokens[i+2])
 				if err != nil {
-					return svgPath, libminer.InvalidShapeSvgStringError(svgString)
+					return svgPath, protocol.InvalidShapeSvgStringError(svgString)
 				}
 			}
 
@@ -149,7 +149,7 @@ func GetParsedSVG(svgString string) (svgPath SVGPath, err error) {
 			if i+1 < tokenLen {
 				param1, err = strconv.Atoi(tokens[i+1])
 				if err != nil {
-					return svgPath, libminer.InvalidShapeSvgStringError(svgString)
+					return svgPath, protocol.InvalidShapeSvgStringError(svgString)
 				}
 			}
 
@@ -220,7 +220,7 @@ func SVGToPoints(svgPath SVGPath, canvasX int, canvasY int, filled bool, strokeF
 			}
 		}
 		if point.X > canvasX || point.Y > canvasY || point.X < 0 || point.Y < 0 {
-			return path, libminer.OutOfBoundsError{}
+			return path, protocol.OutOfBoundsError{}
 		}
 
 		points = append(points, point)
@@ -243,7 +243,7 @@ func SVGToPoints(svgPath SVGPath, canvasX int, canvasY int, filled bool, strokeF
 			firstPoint := points[0]
 
 			if firstPoint.X != lastPoint.X || firstPoint.Y != lastPoint.Y {
-				return path, libminer.InvalidShapeSvgStringError("")
+				return path, protocol.InvalidShapeSvgStringError("")
 			}
 		} else {
 			// Weird stuff here. Need to check each individual shape
@@ -257,7 +257,7 @@ func SVGToPoints(svgPath SVGPath, canvasX int, canvasY int, filled bool, strokeF
 						startPoint.Y != prevPoint.Y {
 						fmt.Println("ERROR: sX pX sY pY", startPoint.X,
 							prevPoint.X, startPoint.Y, prevPoint.Y)
-						return path, libminer.InvalidShapeSvgStringError("")
+						return path, protocol.InvalidShapeSvgStringError("")
 					}
 
 					startPoint = points[i]
@@ -271,7 +271,7 @@ func SVGToPoints(svgPath SVGPath, canvasX int, canvasY int, filled bool, strokeF
 				startPoint.Y != prevPoint.Y {
 				fmt.Println("ERROR2: sX pX sY pY", startPoint.X,
 					prevPoint.X, startPoint.Y, prevPoint.Y)
-				return path, libminer.InvalidShapeSvgStringError("")
+				return path, protocol.InvalidShapeSvgStringError("")
 			}
 		}
 	}
@@ -286,39 +286,39 @@ func SVGToPoints(svgPath SVGPath, canvasX int, canvasY int, filled bool, strokeF
 
 // Return a shapelib.Circle struct from a blockchain operation struct.
 // Errors returned:
-//    libminer.InvalidShapeSvgStringError
-//    libminer.OutOfBoundsError
+//    protocol.InvalidShapeSvgStringError
+//    protocol.OutOfBoundsError
 func GetParsedCirc(op blockchain.Operation, canvasX int, canvasY int) (shapelib.Circle, error) {
 	var circ shapelib.Circle
 
 	if op.Fill == "transparent" && op.Stroke == "transparent" {
-		return circ, libminer.InvalidShapeSvgStringError(op.SVGString)
+		return circ, protocol.InvalidShapeSvgStringError(op.SVGString)
 	}
 
 	re := regexp.MustCompile(`circle x:(\d+) y:(\d+) r:(\d+)`)
 	match := re.FindStringSubmatch(op.SVGString)
 
 	if match == nil {
-		return circ, libminer.InvalidShapeSvgStringError(op.SVGString)
+		return circ, protocol.InvalidShapeSvgStringError(op.SVGString)
 	}
 
 	x, err := strconv.ParseUint(match[1], 10, 64)
 	if err != nil {
-		return circ, libminer.InvalidShapeSvgStringError(op.SVGString)
+		return circ, protocol.InvalidShapeSvgStringError(op.SVGString)
 	}
 
 	y, err := strconv.ParseUint(match[2], 10, 64)
 	if err != nil {
-		return circ, libminer.InvalidShapeSvgStringError(op.SVGString)
+		return circ, protocol.InvalidShapeSvgStringError(op.SVGString)
 	}
 
 	r, err := strconv.ParseUint(match[3], 10, 64)
 	if err != nil {
-		return circ, libminer.InvalidShapeSvgStringError(op.SVGString)
+		return circ, protocol.InvalidShapeSvgStringError(op.SVGString)
 	}
 
 	if x+r > uint64(canvasX) || y+r > uint64(canvasY) || x-r < 0 || y-r < 0{
-		return circ, libminer.OutOfBoundsError{}
+		return circ, protocol.OutOfBoundsError{}
 	}
 
 	circ = shapelib.NewCircle(
@@ -331,8 +331,11 @@ func GetParsedCirc(op blockchain.Operation, canvasX int, canvasY int) (shapelib.
 	return circ, nil
 }
 
+// Digest of a message signed between the art node and the miner. It is
+// SHA-256 whatever the network hashes blocks with, since an art node signs
+// its first request before it has the network's settings.
 func ComputeHash(data []byte) []byte {
-	h := md5.New()
+	h := sha256.New()
 	h.Write(data)
 	return h.Sum(nil)
 }